@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Accounts
+// An account may be registered with the currency it is held in:
+//
+//	PUT /accounts/{id}  {"currency": "USD"}   (admin only)
+//
+// A transfer from a registered account must be in its currency; a transfer to an
+// account in another currency is converted, see fx.go. Unregistered accounts
+// take any currency and are never converted, as before accounts existed.
+// The currency of an account cannot change once set: its history is in it.
+
+type account struct {
+	ID        string    `json:"id"`
+	Currency  string    `json:"currency"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type accountRequest struct {
+	Currency string `json:"currency"`
+}
+
+// accountCurrency is the currency of a registered account, "" if it is not.
+func (svc *service) accountCurrency(id string) (string, error) {
+	a, ok, err := svc.store.GetAccount(id)
+	if err != nil || !ok {
+		return "", err
+	}
+	return a.Currency, nil
+}
+
+// putAccount registers an account: 201 the first time, 200 when repeated with
+// the same currency.
+func putAccount(w http.ResponseWriter, r *http.Request, svc *service) {
+	if p, _ := principalFrom(r.Context()); !p.Admin {
+		writeError(w, codeForbidden, "admin scope required")
+		return
+	}
+	var in accountRequest
+	if err := bindJSON(r, &in); err != nil {
+		writeError(w, codeMalformedRequest, "bad request")
+		return
+	}
+	id := strings.TrimSpace(r.PathValue("id"))
+	currency, _, err := normalizeCurrency(in.Currency)
+	if err != nil {
+		writeInvalid(w, validationError{{"currency", "must be a supported ISO 4217 code"}})
+		return
+	}
+
+	// one registration at a time, so two different currencies cannot both win
+	unlock := svc.keyLocks.acquire(accountLockKey(id))
+	defer unlock()
+
+	a, ok, err := svc.store.GetAccount(id)
+	if err != nil {
+		writeError(w, codeInternal, "could not read account")
+		return
+	}
+	switch {
+	case ok && a.Currency == currency:
+		writeJSON(w, http.StatusOK, a)
+		return
+	case ok:
+		writeError(w, codeAccountCurrencyFixed, "account "+id+" is held in "+a.Currency)
+		return
+	}
+
+	a = account{ID: id, Currency: currency, CreatedAt: time.Now().UTC()}
+	if err := svc.store.PutAccount(a); err != nil {
+		writeError(w, codeInternal, "could not store account")
+		return
+	}
+	w.Header().Set("Location", "/accounts/"+id)
+	writeJSON(w, http.StatusCreated, a)
+}
+
+func getAccount(w http.ResponseWriter, r *http.Request, svc *service) {
+	id := r.PathValue("id")
+	a, ok, err := svc.store.GetAccount(id)
+	if err != nil {
+		writeError(w, codeInternal, "could not read account")
+		return
+	}
+	if p, _ := principalFrom(r.Context()); !ok || !p.owns(id) {
+		writeError(w, codeNotFound, "this account does not exist")
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAPI_Accounts(t *testing.T) {
+	ts, _ := newTestServer(t)
+	url := ts.URL + "/accounts/A1"
+
+	for _, test := range []struct {
+		Name     string
+		Currency string
+		Status   int
+	}{
+		{Name: "Create", Currency: "usd", Status: http.StatusCreated},
+		{Name: "Repeat", Currency: "USD", Status: http.StatusOK},
+		{Name: "OtherCurrency", Currency: "EUR", Status: http.StatusConflict},
+		{Name: "UnknownCurrency", Currency: "XXX", Status: http.StatusBadRequest},
+	} {
+		if res, body := putJSON(t, url, map[string]any{"currency": test.Currency}); res.StatusCode != test.Status {
+			t.Errorf("%s: expected %d, got %d body=%s", test.Name, test.Status, res.StatusCode, string(body))
+		}
+	}
+
+	b, _ := json.Marshal(map[string]any{"currency": "EUR"})
+	req, _ := http.NewRequest("PUT", ts.URL+"/accounts/A9", bytes.NewReader(b))
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", bearer("alice", "", "A9"))
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("owner without admin scope: expected 403, got %v %v", res, err)
+	} else {
+		res.Body.Close()
+	}
+
+	res, body := getWith(t, url, bearer("alice", "", "A1"))
+	var a account
+	_ = json.Unmarshal(body, &a)
+	if res.StatusCode != http.StatusOK || a.Currency != "USD" {
+		t.Errorf("owner: expected USD, got %d body=%s", res.StatusCode, string(body))
+	}
+	if res, _ := getWith(t, url, bearer("mallory", "", "Z1")); res.StatusCode != http.StatusNotFound {
+		t.Errorf("stranger: expected 404, got %d", res.StatusCode)
+	}
+}
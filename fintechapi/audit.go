@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Audit log
+// Every mutation (create, status change, reversal, edit) is appended to a hash chain:
+// an entry's hash covers its own fields and the hash of the entry before it, so
+// editing, reordering or deleting an entry breaks every hash after it. The
+// store chains the entries for the events of a write in that same write (and
+// log line), next to their outbox entries: a write either stores its change
+// and its entries or fails as a whole.
+//
+// GET /audit exports the log as NDJSON and GET /audit/head returns the newest
+// hash (both admin only). `fintechapi verify-audit [-head HASH] [FILE]` checks
+// an export offline; with -head, an export cut short at the end is caught too.
+//
+// A reversal is recorded as one entry for the new transaction: its reversal_of
+// and amount determine the change to the original.
+
+const (
+	auditCreate       = "create"
+	auditStatusChange = "status_change"
+	auditReversal     = "reversal"
+	auditUpdate       = "update"
+)
+
+// auditGenesis is the prev_hash of the first entry.
+var auditGenesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+const auditExportPage = 1000
+
+// auditEntry is one link of the chain. Data is the published event verbatim;
+// it is hashed as stored, so verifying never depends on re-encoding it.
+type auditEntry struct {
+	Seq           int64           `json:"seq"` // 1, 2, ...
+	At            time.Time       `json:"at"`
+	Action        string          `json:"action"`
+	TransactionID string          `json:"transaction_id"`
+	Data          json.RawMessage `json:"data"`
+	PrevHash      string          `json:"prev_hash"`
+	Hash          string          `json:"hash"`
+}
+
+// computeHash returns the hash e should carry.
+func (e auditEntry) computeHash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n%s\n%s\n%s\n", e.Seq, e.At.UTC().Format(time.RFC3339Nano), e.Action, e.TransactionID, e.PrevHash)
+	h.Write(e.Data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chainAudit makes the entries for events, in order, following head. The store
+// calls it inside the write that stores the events' changes, so a change is in
+// the store if and only if its entry is in the log.
+func chainAudit(head auditHead, events []Event) ([]auditEntry, error) {
+	var entries []auditEntry
+	for _, ev := range events {
+		action := auditCreate
+		switch {
+		case ev.Type == EventTransactionStatusChanged:
+			action = auditStatusChange
+		case ev.Type == EventTransactionUpdated:
+			action = auditUpdate
+		case ev.Transaction.ReversalOf != "":
+			action = auditReversal
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return nil, fmt.Errorf("audit %s %s: %w", ev.Type, ev.Transaction.ID, err)
+		}
+		e := auditEntry{Seq: head.Seq + 1, At: ev.At.UTC(), Action: action, TransactionID: ev.Transaction.ID, Data: data, PrevHash: head.Hash}
+		e.Hash = e.computeHash()
+		entries = append(entries, e)
+		head = auditHead{Seq: e.Seq, Hash: e.Hash}
+	}
+	return entries, nil
+}
+
+// exportAudit streams the log as NDJSON, from ?after=SEQ on (default: the start;
+// verify-audit needs an export from the start).
+func exportAudit(w http.ResponseWriter, r *http.Request, svc *service) {
+	if p, _ := principalFrom(r.Context()); !p.Admin {
+		writeError(w, codeForbidden, "admin scope required")
+		return
+	}
+	var after int64
+	if s := r.URL.Query().Get("after"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			writeInvalid(w, validationError{{Name: "after", Reason: "must be a sequence number"}})
+			return
+		}
+		after = n
+	}
+
+	page, err := svc.store.ListAudit(after, auditExportPage)
+	if err != nil {
+		writeError(w, codeInternal, "could not read audit log")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for len(page) > 0 {
+		for _, e := range page {
+			if err := enc.Encode(e); err != nil {
+				return // client went away
+			}
+		}
+		// entries appended meanwhile are exported too, the chain stays intact
+		if page, err = svc.store.ListAudit(page[len(page)-1].Seq, auditExportPage); err != nil {
+			log.Printf("audit export: %v", err)
+			return
+		}
+	}
+}
+
+type auditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// getAuditHead returns the newest entry's seq and hash, to anchor a later check
+// of an export.
+func getAuditHead(w http.ResponseWriter, r *http.Request, svc *service) {
+	if p, _ := principalFrom(r.Context()); !p.Admin {
+		writeError(w, codeForbidden, "admin scope required")
+		return
+	}
+	head := auditHead{Hash: auditGenesis}
+	last, ok, err := svc.store.LastAudit()
+	if err != nil {
+		writeError(w, codeInternal, "could not read audit log")
+		return
+	}
+	if ok {
+		head = auditHead{Seq: last.Seq, Hash: last.Hash}
+	}
+	writeJSON(w, http.StatusOK, head)
+}
+
+// verifyAudit checks an NDJSON export that starts at the first entry and
+// returns the last entry. The error names the first entry that does not fit.
+func verifyAudit(r io.Reader) (auditHead, error) {
+	head := auditHead{Hash: auditGenesis}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e auditEntry
+		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return head, fmt.Errorf("line %d: %v", line, err)
+		}
+		switch {
+		case e.Seq != head.Seq+1:
+			return head, fmt.Errorf("line %d: entry %d where %d was expected: entries were deleted or reordered", line, e.Seq, head.Seq+1)
+		case e.PrevHash != head.Hash:
+			return head, fmt.Errorf("line %d: entry %d does not follow entry %d", line, e.Seq, head.Seq)
+		case e.Hash != e.computeHash():
+			return head, fmt.Errorf("line %d: entry %d was modified", line, e.Seq)
+		}
+		head = auditHead{Seq: e.Seq, Hash: e.Hash}
+	}
+	return head, sc.Err()
+}
+
+// verifyAuditCommand runs `verify-audit` and returns the exit code: 0 when the
+// log is intact, 1 when it is not, 2 on usage or read errors.
+func verifyAuditCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: fintechapi verify-audit [-head HASH] [FILE]\n\nChecks an export of GET /audit; reads stdin without FILE.")
+		fs.PrintDefaults()
+	}
+	want := fs.String("head", "", "expected hash of the last entry, from GET /audit/head")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	in := stdin
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		defer f.Close()
+		in = f
+	}
+
+	head, err := verifyAudit(in)
+	if err == nil && *want != "" && head.Hash != *want {
+		err = fmt.Errorf("the log ends at entry %d, which is not the expected head: entries are missing at the end, or it is a different log", head.Seq)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "audit log invalid:", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "ok: %d entries, head %s\n", head.Seq, head.Hash)
+	return 0
+}
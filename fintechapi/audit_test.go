@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// auditExport runs create, status change and reversal and returns the export.
+func auditExport(t *testing.T) (lines []string, head auditHead) {
+	t.Helper()
+	ts, _ := newTestServer(t)
+	tr := createTx(t, ts, "A1", "A2")
+	_, _ = putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"})
+	reverseTx(t, ts, tr.ID, nil, nil)
+
+	res, body := get(t, ts.URL+"/audit")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected an NDJSON export, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	_, hb := get(t, ts.URL+"/audit/head")
+	_ = json.Unmarshal(hb, &head)
+	return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"), head
+}
+
+func TestAPI_Audit(t *testing.T) {
+	lines, head := auditExport(t)
+
+	var actions []string
+	for _, l := range lines {
+		var e auditEntry
+		_ = json.Unmarshal([]byte(l), &e)
+		actions = append(actions, e.Action)
+	}
+	if strings.Join(actions, ",") != "create,status_change,reversal" {
+		t.Errorf("unexpected actions %v", actions)
+	}
+	got, err := verifyAudit(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil || got != head || head.Seq != 3 {
+		t.Errorf("verify: err=%v, want head %+v, got %+v", err, head, got)
+	}
+
+	ts, _ := newTestServer(t)
+	for _, path := range []string{"/audit", "/audit/head"} {
+		if res, _ := getWith(t, ts.URL+path, bearer("alice", "", "A1")); res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", path, res.StatusCode)
+		}
+	}
+	if res, _ := get(t, ts.URL+"/audit?after=x"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad after: expected 400, got %d", res.StatusCode)
+	}
+}
+
+func TestVerifyAudit_DetectsTampering(t *testing.T) {
+	lines, head := auditExport(t)
+
+	for _, test := range []struct {
+		Name  string
+		Lines []string
+		Want  string
+	}{
+		{Name: "Edited", Lines: []string{lines[0], strings.Replace(lines[1], `"completed"`, `"failed"`, 1), lines[2]}, Want: "entry 2 was modified"},
+		{Name: "Reordered", Lines: []string{lines[0], lines[2], lines[1]}, Want: "entry 3 where 2 was expected"},
+		{Name: "Deleted", Lines: []string{lines[0], lines[2]}, Want: "entry 3 where 2 was expected"},
+		{Name: "DeletedFirst", Lines: lines[1:], Want: "entry 2 where 1 was expected"},
+		{Name: "Renumbered", Lines: []string{lines[0], strings.Replace(lines[2], `"seq":3`, `"seq":2`, 1)}, Want: "entry 2 does not follow entry 1"},
+	} {
+		if _, err := verifyAudit(strings.NewReader(strings.Join(test.Lines, "\n"))); err == nil || !strings.Contains(err.Error(), test.Want) {
+			t.Errorf("%s: want %q, got %v", test.Name, test.Want, err)
+		}
+	}
+
+	// the end of the log can only be checked against a known head
+	truncated := filepath.Join(t.TempDir(), "audit.ndjson")
+	_ = os.WriteFile(truncated, []byte(strings.Join(lines[:2], "\n")+"\n"), 0o644)
+	var stdout, stderr bytes.Buffer
+	if code := verifyAuditCommand([]string{truncated}, nil, &stdout, &stderr); code != 0 {
+		t.Errorf("without -head: want 0, got %d: %s", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := verifyAuditCommand([]string{"-head", head.Hash, truncated}, nil, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "missing at the end") {
+		t.Errorf("with -head: want 1, got %d: %s", code, stderr.String())
+	}
+
+	full := strings.NewReader(strings.Join(lines, "\n") + "\n")
+	stdout.Reset()
+	if code := verifyAuditCommand([]string{"-head", head.Hash}, full, &stdout, &stderr); code != 0 || !strings.HasPrefix(stdout.String(), "ok: 3 entries") {
+		t.Errorf("intact log from stdin: want 0, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+}
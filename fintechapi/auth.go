@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Authentication and authorization
+// Two credentials are checked on every route:
+//   - an API key in X-API-Key identifies the integrating client. The client and
+//     the token subject scope idempotency keys, and the client is recorded on the
+//     transactions it creates. Keys are kept as SHA-256 digests, never in clear.
+//   - a bearer token in Authorization carries the account IDs the caller may act
+//     on, or the admin scope. Tokens are HMAC-SHA256 signed by whoever shares
+//     the token secret; see signToken for the format.
+
+const (
+	apiKeyHeader = "X-API-Key"
+	scopeAdmin   = "admin"
+)
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token expired")
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	ClientID string          // from the API key
+	Subject  string          // from the bearer token
+	Accounts map[string]bool // accounts the caller owns
+	Admin    bool            // admin scope: sees and acts on every account
+}
+
+// owns reports whether the caller may act on account.
+func (p principal) owns(account string) bool {
+	return p.Admin || p.Accounts[account]
+}
+
+// canSee reports whether t touches one of the caller's accounts.
+func (p principal) canSee(t Transaction) bool {
+	return p.owns(t.FromAccountID) || p.owns(t.ToAccountID)
+}
+
+type ctxKey int
+
+const principalKey ctxKey = iota
+
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// principalFrom returns the caller stored by authenticate.
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey).(principal)
+	return p, ok
+}
+
+// apiKeys maps the SHA-256 digest of an API key to its client ID.
+type apiKeys map[[sha256.Size]byte]string
+
+// parseAPIKeys reads "key=client" pairs separated by commas, as in
+// FINTECH_API_KEYS="k1=acme,k2=globex".
+func parseAPIKeys(s string) (apiKeys, error) {
+	keys := make(apiKeys)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, client, ok := strings.Cut(pair, "=")
+		key, client = strings.TrimSpace(key), strings.TrimSpace(client)
+		if !ok || key == "" || client == "" {
+			return nil, fmt.Errorf("invalid api key entry %q, want key=client", pair)
+		}
+		keys.add(key, client)
+	}
+	return keys, nil
+}
+
+func (k apiKeys) add(key, clientID string) {
+	k[sha256.Sum256([]byte(key))] = clientID
+}
+
+// lookup resolves a presented key. Comparing digests through the map keeps the
+// lookup time independent of how much of a key an attacker got right.
+func (k apiKeys) lookup(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	client, ok := k[sha256.Sum256([]byte(key))]
+	return client, ok
+}
+
+// tokenClaims is the payload of a bearer token.
+type tokenClaims struct {
+	Subject  string   `json:"sub"`
+	Accounts []string `json:"accounts,omitempty"`
+	Scope    string   `json:"scope,omitempty"` // "admin" or empty
+	Expires  int64    `json:"exp"`             // unix seconds
+}
+
+// signToken issues a token: base64url(claims JSON) "." base64url(HMAC-SHA256(secret, first part)).
+func signToken(secret []byte, c tokenClaims) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(secret, payload)), nil
+}
+
+func tokenMAC(secret []byte, payload string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+// verifyToken checks signature and expiry and returns the claims.
+func verifyToken(secret []byte, token string, now time.Time) (tokenClaims, error) {
+	var c tokenClaims
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || len(secret) == 0 {
+		return c, errTokenMalformed
+	}
+	gotMAC, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return c, errTokenMalformed
+	}
+	if !hmac.Equal(gotMAC, tokenMAC(secret, payload)) {
+		return c, errTokenSignature
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return c, errTokenMalformed
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, errTokenMalformed
+	}
+	if c.Expires == 0 || now.Unix() >= c.Expires {
+		return c, errTokenExpired
+	}
+	return c, nil
+}
+
+// authenticator holds the credentials the service accepts.
+type authenticator struct {
+	apiKeys     apiKeys
+	tokenSecret []byte
+}
+
+// authenticate rejects requests without a valid API key and bearer token with 401
+// and stores the caller in the request context otherwise.
+func (svc *service) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, ok := svc.auth.apiKeys.lookup(r.Header.Get(apiKeyHeader))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `ApiKey header="`+apiKeyHeader+`"`)
+			writeError(w, codeUnauthenticated, "missing or invalid api key")
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			writeError(w, codeUnauthenticated, "missing bearer token")
+			return
+		}
+		claims, err := verifyToken(svc.auth.tokenSecret, strings.TrimSpace(token), time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, codeUnauthenticated, err.Error())
+			return
+		}
+
+		p := principal{
+			ClientID: client,
+			Subject:  claims.Subject,
+			Accounts: make(map[string]bool, len(claims.Accounts)),
+			Admin:    claims.Scope == scopeAdmin,
+		}
+		for _, a := range claims.Accounts {
+			p.Accounts[a] = true
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// scopedIdemKey namespaces an Idempotency-Key by client and token subject, so
+// two callers that pick the same key never see each other's records: a replay
+// skips the handler, and with it the check that the caller owns the account.
+func scopedIdemKey(ctx context.Context, key string) string {
+	p, _ := principalFrom(ctx)
+	return p.ClientID + "\x00" + p.Subject + "\x00" + key
+}
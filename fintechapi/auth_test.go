@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := parseAPIKeys(" k1=acme, k2 = globex ,")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if c, ok := keys.lookup("k1"); !ok || c != "acme" {
+		t.Errorf("k1: got %q %v", c, ok)
+	}
+	if c, ok := keys.lookup("k2"); !ok || c != "globex" {
+		t.Errorf("k2: got %q %v", c, ok)
+	}
+	if _, ok := keys.lookup(""); ok {
+		t.Errorf("empty key must not resolve")
+	}
+	for _, bad := range []string{"k1", "=acme", "k1="} {
+		if _, err := parseAPIKeys(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestAuth_RejectsMissingOrInvalidKey(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	for _, key := range []string{"", "wrong"} {
+		req, _ := http.NewRequest("GET", ts.URL+"/transactions", nil)
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("key %q: want 401 with WWW-Authenticate, got %d", key, res.StatusCode)
+		}
+	}
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1.00", "currency": "EUR"}
+	res, _ := postJSON(t, ts.URL+"/transactions", in, map[string]string{apiKeyHeader: "wrong"})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST with invalid key: want 401, got %d", res.StatusCode)
+	}
+}
+
+func TestAuth_IdempotencyKeysAreScopedByClient(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	inA := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1.00", "currency": "EUR"}
+	inB := map[string]any{"from_account_id": "B1", "to_account_id": "B2", "amount": "5.00", "currency": "EUR"}
+
+	resA, bodyA := postJSON(t, ts.URL+"/transactions", inA, map[string]string{"Idempotency-Key": "abc-123"})
+	resB, bodyB := postJSON(t, ts.URL+"/transactions", inB, map[string]string{"Idempotency-Key": "abc-123", apiKeyHeader: otherAPIKey})
+	if resA.StatusCode != http.StatusAccepted || resB.StatusCode != http.StatusAccepted {
+		t.Fatalf("same key from two clients: want 202 twice, got %d and %d", resA.StatusCode, resB.StatusCode)
+	}
+	if resA.Header.Get("Location") == resB.Header.Get("Location") {
+		t.Fatalf("clients must not share idempotency records")
+	}
+
+	var trA, trB Transaction
+	_ = json.Unmarshal(bodyA, &trA)
+	_ = json.Unmarshal(bodyB, &trB)
+	if trA.ClientID != "client-a" || trB.ClientID != "client-b" {
+		t.Errorf("creating client not recorded: %q, %q", trA.ClientID, trB.ClientID)
+	}
+
+	// each client still gets its own replay
+	res, body := postJSON(t, ts.URL+"/transactions", inB, map[string]string{"Idempotency-Key": "abc-123", apiKeyHeader: otherAPIKey})
+	if res.StatusCode != http.StatusAccepted || string(body) != string(bodyB) {
+		t.Errorf("client-b replay mismatch: %d %s", res.StatusCode, body)
+	}
+}
+
+func TestAuth_IdempotencyKeysAreScopedBySubject(t *testing.T) {
+	ts, _ := newTestServer(t)
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1.00", "currency": "EUR"}
+
+	res, body := postJSON(t, ts.URL+"/transactions", in, map[string]string{"Idempotency-Key": "abc-123", "Authorization": bearer("alice", "", "A1")})
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("alice: want 202, got %d %s", res.StatusCode, body)
+	}
+
+	// same API key, another subject: no replay of alice's response
+	res, body = postJSON(t, ts.URL+"/transactions", in, map[string]string{"Idempotency-Key": "abc-123", "Authorization": bearer("mallory", "", "Z9")})
+	if res.StatusCode != http.StatusForbidden || res.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("mallory with alice's key: want a fresh 403, got %d %v %s", res.StatusCode, res.Header, body)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	now := time.Now()
+	good, _ := signToken(testTokenSecret, tokenClaims{Subject: "u1", Accounts: []string{"A1"}, Expires: now.Add(time.Minute).Unix()})
+
+	c, err := verifyToken(testTokenSecret, good, now)
+	if err != nil || c.Subject != "u1" || len(c.Accounts) != 1 {
+		t.Fatalf("valid token: claims=%+v err=%v", c, err)
+	}
+
+	// swap in a payload granting more accounts, keep the old signature
+	payload, sig, _ := strings.Cut(good, ".")
+	forged, _ := signToken([]byte("attacker"), tokenClaims{Subject: "u1", Accounts: []string{"A1", "A2"}, Expires: now.Add(time.Minute).Unix()})
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	expired, _ := signToken(testTokenSecret, tokenClaims{Subject: "u1", Expires: now.Add(-time.Second).Unix()})
+	noExp, _ := signToken(testTokenSecret, tokenClaims{Subject: "u1"})
+
+	tests := []struct {
+		Name   string
+		Secret []byte
+		Token  string
+		Want   error
+	}{
+		{Name: "tampered payload", Secret: testTokenSecret, Token: forgedPayload + "." + sig, Want: errTokenSignature},
+		{Name: "wrong secret", Secret: []byte("other"), Token: good, Want: errTokenSignature},
+		{Name: "expired", Secret: testTokenSecret, Token: expired, Want: errTokenExpired},
+		{Name: "no expiry", Secret: testTokenSecret, Token: noExp, Want: errTokenExpired},
+		{Name: "no signature", Secret: testTokenSecret, Token: payload, Want: errTokenMalformed},
+		{Name: "empty secret", Secret: nil, Token: good, Want: errTokenMalformed},
+	}
+	for _, test := range tests {
+		if _, err := verifyToken(test.Secret, test.Token, now); !errors.Is(err, test.Want) {
+			t.Errorf("%s: want %v, got %v", test.Name, test.Want, err)
+		}
+	}
+}
+
+func TestAuth_RequiresBearerToken(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	for _, authz := range []string{"", "Bearer nonsense", bearer("u1", "")[:20]} {
+		res, _ := getWith(t, ts.URL+"/transactions", authz)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: want 401, got %d", authz, res.StatusCode)
+		}
+	}
+}
+
+func TestAuth_AccountOwnership(t *testing.T) {
+	ts, _ := newTestServer(t)
+	alice := bearer("alice", "", "ALICE-1", "ALICE-2")
+	bob := bearer("bob", "", "BOB-1")
+
+	create := func(authz, from, to string) (*http.Response, Transaction) {
+		in := map[string]any{"from_account_id": from, "to_account_id": to, "amount": "1.00", "currency": "EUR"}
+		res, body := postJSON(t, ts.URL+"/transactions", in, map[string]string{"Authorization": authz})
+		var tr Transaction
+		_ = json.Unmarshal(body, &tr)
+		return res, tr
+	}
+
+	if res, _ := create(alice, "BOB-1", "ALICE-1"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("transfer from someone else's account: want 403, got %d", res.StatusCode)
+	}
+	_, aliceToBob := create(alice, "ALICE-1", "BOB-1")
+	_, aliceInternal := create(alice, "ALICE-1", "ALICE-2")
+	_, bobOut := create(bob, "BOB-1", "CAROL-1")
+
+	// bob sees the transfer he received and his own, not alice's internal one
+	if res, _ := getWith(t, ts.URL+"/transactions/"+aliceToBob.ID, bob); res.StatusCode != http.StatusOK {
+		t.Errorf("receiver should see the transaction, got %d", res.StatusCode)
+	}
+	if res, _ := getWith(t, ts.URL+"/transactions/"+aliceInternal.ID, bob); res.StatusCode != http.StatusNotFound {
+		t.Errorf("unrelated transaction: want 404, got %d", res.StatusCode)
+	}
+
+	listIDs := func(authz string) string {
+		res, body := getWith(t, ts.URL+"/transactions", authz)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("list: %d %s", res.StatusCode, body)
+		}
+		var page struct {
+			Items []Transaction `json:"items"`
+		}
+		_ = json.Unmarshal(body, &page)
+		seen := make([]string, 0, len(page.Items))
+		for _, tr := range page.Items {
+			seen = append(seen, tr.ID)
+		}
+		sort.Strings(seen)
+		return strings.Join(seen, ",")
+	}
+	sorted := func(ids ...string) string {
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+
+	if got, want := listIDs(bob), sorted(aliceToBob.ID, bobOut.ID); got != want {
+		t.Errorf("bob's list: want %s, got %s", want, got)
+	}
+	if got, want := listIDs(alice), sorted(aliceToBob.ID, aliceInternal.ID); got != want {
+		t.Errorf("alice's list: want %s, got %s", want, got)
+	}
+	if got, want := listIDs(adminBearer), sorted(aliceToBob.ID, aliceInternal.ID, bobOut.ID); got != want {
+		t.Errorf("admin's list: want %s, got %s", want, got)
+	}
+}
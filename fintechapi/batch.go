@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Batches
+// POST /transactions/batch creates up to maxBatchItems transactions in one request:
+//
+//	{"atomic": true, "items": [{"from_account_id": ..., "amount": ...}, ...]}
+//
+// The response has one result per item, in request order. Without atomic every
+// item stands alone (207 Multi-Status). With atomic either every item is stored
+// (202) or none is: the batch is answered with the status of the first failing
+// item, and the items that were fine get 424 Failed Dependency. Rules see the
+// earlier items of a batch as history, so a batch cannot dodge a daily limit.
+// Items cannot be future-dated; use execute_at on POST /transactions for that.
+// Items are converted at the current rate; quotes are for single transfers.
+
+const maxBatchItems = 1000
+
+type batchRequest struct {
+	Atomic bool                 `json:"atomic"`
+	Items  []transactionRequest `json:"items"`
+}
+
+// batchResult is the outcome of one item.
+type batchResult struct {
+	Index       int          `json:"index"`
+	EndToEndID  string       `json:"end_to_end_id,omitempty"` // imported files only
+	Status      int          `json:"status"`                  // HTTP status the item would have had on its own
+	Transaction *Transaction `json:"transaction,omitempty"`
+	Error       *problem     `json:"error,omitempty"` // see problems.go
+}
+
+type batchResponse struct {
+	MsgID  string        `json:"msg_id,omitempty"` // imported files only
+	Atomic bool          `json:"atomic"`
+	Items  []batchResult `json:"items"`
+}
+
+func createBatch(w http.ResponseWriter, r *http.Request, svc *service) {
+	var in batchRequest
+	if err := bindJSON(r, &in); err != nil {
+		writeError(w, codeMalformedRequest, "bad request")
+		return
+	}
+	if len(in.Items) == 0 || len(in.Items) > maxBatchItems {
+		writeInvalid(w, validationError{{Name: "items", Reason: fmt.Sprintf("a batch has 1 to %d items", maxBatchItems)}})
+		return
+	}
+	p, _ := principalFrom(r.Context())
+
+	status, out, err := svc.runBatch(p, in.Atomic, in.Items, nil)
+	if err != nil {
+		writeError(w, codeInternal, "could not store transactions")
+		return
+	}
+	writeJSON(w, status, out)
+}
+
+// runBatch validates and books items for p and reports the response status and
+// the per-item results. invalid, when not nil, holds errors found by the caller
+// for some items (e.g. in an imported file); those items fail as invalid_document.
+func (svc *service) runBatch(p principal, atomic bool, items []transactionRequest, invalid []string) (int, batchResponse, error) {
+	// validate every item first
+	results := make([]batchResult, len(items))
+	var txs []Transaction
+	failed := -1 // first item that did not validate
+	for i, item := range items {
+		results[i].Index = i
+		prob := checkBatchItem(item, p)
+		if invalid != nil && invalid[i] != "" {
+			prob = newProblem(codeInvalidDocument, invalid[i])
+		}
+		if prob != nil {
+			results[i].Status, results[i].Error = prob.Status, prob
+			if failed < 0 {
+				failed = i
+			}
+			continue
+		}
+		amount, _ := ParseMoney(string(item.Amount), item.Currency) // already validated
+		t := newTransaction(item, amount)
+		t.ClientID = p.ClientID
+		if err := svc.convert(&t, nil); err != nil {
+			prob := fxProblem(err)
+			results[i].Status, results[i].Error = prob.Status, prob
+			if failed < 0 {
+				failed = i
+			}
+			continue
+		}
+		txs = append(txs, t)
+	}
+
+	if !atomic {
+		for i := range results {
+			if results[i].Status != 0 {
+				continue
+			}
+			t, v, err := svc.book(txs[0], true)
+			txs = txs[1:]
+			switch {
+			case err != nil:
+				results[i].Status, results[i].Error = http.StatusInternalServerError, newProblem(codeInternal, "could not store transaction")
+			case v != nil:
+				results[i].Status, results[i].Error = http.StatusUnprocessableEntity, v.problem()
+			default:
+				results[i].Status, results[i].Transaction = http.StatusAccepted, &t
+			}
+		}
+		return http.StatusMultiStatus, batchResponse{Items: results}, nil
+	}
+
+	if failed < 0 {
+		booked, violations, err := svc.bookAll(txs)
+		if err != nil {
+			return 0, batchResponse{}, err
+		}
+		for i, v := range violations {
+			if v == nil {
+				continue
+			}
+			results[i].Status, results[i].Error = http.StatusUnprocessableEntity, v.problem()
+			if failed < 0 {
+				failed = i
+			}
+		}
+		if failed < 0 {
+			for i := range booked {
+				results[i].Status, results[i].Transaction = http.StatusAccepted, &booked[i]
+			}
+			return http.StatusAccepted, batchResponse{Atomic: true, Items: results}, nil
+		}
+	}
+	for i := range results {
+		if results[i].Status == 0 {
+			results[i].Status, results[i].Error = http.StatusFailedDependency, newProblem(codeBatchItemNotStored, "not stored: another item of the batch failed")
+		}
+	}
+	return results[failed].Status, batchResponse{Atomic: true, Items: results}, nil
+}
+
+// checkBatchItem validates one item like POST /transactions would; nil means
+// it is fine.
+func checkBatchItem(item transactionRequest, p principal) *problem {
+	if item.ExecuteAt != nil {
+		return invalidProblem(validationError{{"execute_at", "not supported in batches"}})
+	}
+	if item.FXQuoteID != "" {
+		return invalidProblem(validationError{{"fx_quote_id", "not supported in batches"}})
+	}
+	if err := validateTransactionRequest(item); err != nil {
+		return invalidProblem(err)
+	}
+	if !p.owns(strings.TrimSpace(item.FromAccountID)) {
+		return newProblem(codeForbidden, "not allowed to transfer from this account")
+	}
+	return nil
+}
+
+// bookAll is book for a batch that is stored as a whole. It returns one entry per
+// transaction in violations when the rules reject any of them; nothing is
+// stored then. Otherwise every transaction is stored, failed ones included.
+func (svc *service) bookAll(ts []Transaction) (booked []Transaction, violations []*ruleViolation, err error) {
+	// lock every sending account, in order so that two batches cannot deadlock
+	accounts := make([]string, 0, len(ts))
+	for _, t := range ts {
+		accounts = append(accounts, t.FromAccountID)
+	}
+	slices.Sort(accounts)
+	for _, a := range slices.Compact(accounts) {
+		unlock := svc.keyLocks.acquire(accountLockKey(a))
+		defer unlock()
+	}
+
+	rules, fees := svc.rules.current(), svc.fees.current()
+	view := &batchView{Store: svc.store}
+	violations = make([]*ruleViolation, len(ts))
+	rejected := false
+	for i, t := range ts {
+		v, err := rules.check(view, t, t.At)
+		if err != nil {
+			return nil, nil, err
+		}
+		if v != nil && rules.action == ruleActionReject {
+			violations[i], rejected = v, true
+			continue
+		}
+		if v != nil {
+			t.Status, t.FailureReason = StatusFailed, v.Reason
+		} else if t.Fees, err = fees.charge(view, t); err != nil {
+			return nil, nil, err
+		}
+		view.pending = append(view.pending, t)
+	}
+	if rejected {
+		return nil, violations, nil
+	}
+
+	events := make([]Event, len(view.pending))
+	for i, t := range view.pending {
+		events[i] = newEvent(EventTransactionCreated, t)
+	}
+	if err := svc.store.PutTransactions(view.pending, events...); err != nil {
+		return nil, nil, err
+	}
+	svc.outbox.notify()
+	return view.pending, nil, nil
+}
+
+// batchView is the store as the rules see it while a batch is checked: the
+// earlier items of the batch are already there.
+type batchView struct {
+	Store
+	pending []Transaction
+}
+
+func (b *batchView) ListTransactions(q listQuery) ([]Transaction, error) {
+	items, err := b.Store.ListTransactions(q)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range b.pending {
+		if q.matches(t) {
+			items = append(items, t)
+		}
+	}
+	return q.page(items), nil
+}
+
+// canonicalBatchBody is the canonicalizer of POST /transactions/batch: the items
+// in their canonical form, in order.
+func canonicalBatchBody(body []byte) ([]byte, error) {
+	var in batchRequest
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	items := make([]json.RawMessage, len(in.Items))
+	for i, item := range in.Items {
+		c, err := canonicalTransaction(item)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = c
+	}
+	return json.Marshal(struct {
+		Atomic bool              `json:"atomic"`
+		Items  []json.RawMessage `json:"items"`
+	}{in.Atomic, items})
+}
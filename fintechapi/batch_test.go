@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func batchItem(from, to, amount string) map[string]any {
+	return map[string]any{"from_account_id": from, "to_account_id": to, "amount": amount, "currency": "EUR"}
+}
+
+func postBatch(t *testing.T, url string, atomic bool, items []map[string]any, headers map[string]string) (int, batchResponse) {
+	t.Helper()
+
+	res, body := postJSON(t, url+"/transactions/batch", map[string]any{"atomic": atomic, "items": items}, headers)
+	var out batchResponse
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatalf("batch response: %v body=%s", err, string(body))
+	}
+	return res.StatusCode, out
+}
+
+func statuses(out batchResponse) []int {
+	s := make([]int, len(out.Items))
+	for i, r := range out.Items {
+		s[i] = r.Status
+	}
+	return s
+}
+
+func TestAPI_Batch(t *testing.T) {
+	t.Run("AtomicAllStored", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		code, out := postBatch(t, ts.URL, true, []map[string]any{batchItem("A1", "A2", "1"), batchItem("A1", "A3", "2.50")}, nil)
+		if code != http.StatusAccepted || len(out.Items) != 2 || out.Items[1].Transaction == nil || out.Items[1].Transaction.Amount != 250 {
+			t.Fatalf("expected 202 with both transactions, got %d %+v", code, out)
+		}
+		if counts, _ := svc.store.CountTransactions(); counts[StatusPending] != 2 {
+			t.Errorf("want 2 stored, got %v", counts)
+		}
+	})
+
+	t.Run("AtomicNothingStoredOnInvalidItem", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		code, out := postBatch(t, ts.URL, true, []map[string]any{batchItem("A1", "A2", "1"), batchItem("A1", "A1", "1"), batchItem("A1", "A3", "1")}, nil)
+		if got := statuses(out); code != http.StatusBadRequest || got[0] != 424 || got[1] != 400 || got[2] != 424 {
+			t.Fatalf("expected 400 with [424 400 424], got %d %v", code, got)
+		}
+		if counts, _ := svc.store.CountTransactions(); len(counts) != 0 {
+			t.Errorf("nothing may be stored, got %v", counts)
+		}
+	})
+
+	t.Run("AtomicRulesSeeEarlierItems", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		path := filepath.Join(t.TempDir(), "rules.json")
+		writeRules(t, path, `{"max_daily_total":{"EUR":"100.00"}}`)
+		if err := svc.rules.loadFile(path); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+
+		code, out := postBatch(t, ts.URL, true, []map[string]any{batchItem("A1", "A2", "50"), batchItem("A1", "A2", "50"), batchItem("A1", "A2", "50")}, nil)
+		if got := statuses(out); code != http.StatusUnprocessableEntity || got[2] != 422 || out.Items[2].Error.Reason != reasonDailyLimit || got[0] != 424 {
+			t.Fatalf("expected 422 on the third item, got %d %+v", code, out)
+		}
+		if counts, _ := svc.store.CountTransactions(); len(counts) != 0 {
+			t.Errorf("nothing may be stored, got %v", counts)
+		}
+	})
+
+	t.Run("NonAtomicPerItem", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		payer := map[string]string{"Authorization": bearer("alice", "", "A1")}
+		code, out := postBatch(t, ts.URL, false, []map[string]any{
+			batchItem("A1", "A2", "1"),
+			batchItem("A1", "A2", "-1"),
+			batchItem("Z1", "A2", "1"),
+			batchItem("A1", "A3", "3"),
+		}, payer)
+		if got := statuses(out); code != http.StatusMultiStatus || got[0] != 202 || got[1] != 400 || got[2] != 403 || got[3] != 202 {
+			t.Fatalf("expected 207 with [202 400 403 202], got %d %v", code, got)
+		}
+		if out.Items[1].Error == nil || out.Items[1].Error.InvalidParams[0].Name != "amount" || out.Items[3].Index != 3 {
+			t.Errorf("unexpected results %+v", out.Items)
+		}
+		if counts, _ := svc.store.CountTransactions(); counts[StatusPending] != 2 {
+			t.Errorf("want the 2 valid items stored, got %v", counts)
+		}
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		items := make([]map[string]any, maxBatchItems+1)
+		for i := range items {
+			items[i] = batchItem("A1", "A2", "1")
+		}
+		for _, in := range [][]map[string]any{nil, items} {
+			if res, body := postJSON(t, ts.URL+"/transactions/batch", map[string]any{"items": in}, nil); res.StatusCode != http.StatusBadRequest {
+				t.Errorf("%d items: expected 400, got %d body=%s", len(in), res.StatusCode, string(body))
+			}
+		}
+	})
+
+	t.Run("Idempotent", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		key := map[string]string{"Idempotency-Key": "payroll-1"}
+		items := []map[string]any{batchItem("A1", "A2", "1"), batchItem("A1", "A3", "2")}
+
+		_, first := postBatch(t, ts.URL, true, items, key)
+		items[1]["amount"] = "2.00" // same amount, other spelling
+		code, again := postBatch(t, ts.URL, true, items, key)
+		if code != http.StatusAccepted || again.Items[0].Transaction.ID != first.Items[0].Transaction.ID {
+			t.Fatalf("expected a replay, got %d %+v", code, again)
+		}
+		if counts, _ := svc.store.CountTransactions(); counts[StatusPending] != 2 {
+			t.Errorf("a replay must not store again, got %v", counts)
+		}
+
+		items[1]["amount"] = "3"
+		if res, _ := postJSON(t, ts.URL+"/transactions/batch", map[string]any{"atomic": true, "items": items}, key); res.StatusCode != http.StatusConflict {
+			t.Errorf("changed item list: expected 409, got %d", res.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+// Package client is a Go client of the fintechapi HTTP API.
+//
+//	c := client.New("https://api.example.com", apiKey, token)
+//	t, err := c.CreateTransaction(ctx, client.CreateTransactionRequest{
+//		FromAccountID: "A1", ToAccountID: "B7", Amount: "10.50", Currency: "EUR",
+//	})
+//	var p *client.Error
+//	if errors.As(err, &p) && p.Code == client.CodeRuleViolation { ... }
+//
+//	for t, err := range c.Transactions(ctx, client.ListOptions{FromAccountID: "A1"}) { ... }
+//
+// Requests that fail on the network or with a 5xx are retried with exponential
+// backoff. That is safe for creates too: every create carries an Idempotency-Key,
+// generated unless the caller sets one, and the retry sends the same key, so the
+// server books the transaction once and replays its response.
+package client
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultBackoff    = 200 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+)
+
+// Client calls the API with an API key and a bearer token. Its fields may be
+// changed before the first request.
+type Client struct {
+	BaseURL string
+	APIKey  string // sent in X-API-Key
+	Token   string // the bearer token, without "Bearer "
+
+	HTTPClient *http.Client  // http.DefaultClient if nil
+	MaxRetries int           // retries after the first attempt; 0 disables them
+	Backoff    time.Duration // the first retry waits up to this, doubling each time
+	MaxBackoff time.Duration // the cap of a wait; 5s if 0
+}
+
+// New returns a client of the API at baseURL with the default retry policy.
+func New(baseURL, apiKey, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		Token:      token,
+		MaxRetries: defaultMaxRetries,
+		Backoff:    defaultBackoff,
+		MaxBackoff: defaultMaxBackoff,
+	}
+}
+
+// NewIdempotencyKey returns a random key for a request's Idempotency-Key.
+func NewIdempotencyKey() string {
+	var b [16]byte
+	_, _ = crand.Read(b[:]) // never fails
+	return hex.EncodeToString(b[:])
+}
+
+// do sends a request and decodes a 2xx response into out, retrying as the
+// package doc says. body is JSON-encoded; a nil body sends none.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, method, path, header, payload)
+		if err == nil && res.StatusCode < 300 {
+			defer res.Body.Close()
+			if out == nil {
+				return nil
+			}
+			if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+				return fmt.Errorf("decode response: %w", err)
+			}
+			return nil
+		}
+
+		var wait time.Duration
+		if err == nil {
+			err = readError(res)
+			wait = retryAfter(res)
+		}
+		if attempt >= c.MaxRetries || !retryable(ctx, err) {
+			return err
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, payload []byte) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-API-Key", c.APIKey)
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return hc.Do(req)
+}
+
+// retryable reports whether a request that failed with err may be sent again:
+// on network errors, 5xx, and while the same Idempotency-Key is still running.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var p *Error
+	if errors.As(err, &p) {
+		return p.Status >= 500 || p.Code == CodeIdempotencyInFlight
+	}
+	return true // the response never arrived
+}
+
+// backoff is the wait before retry attempt+1: a random duration between half
+// and all of Backoff·2^attempt, capped at MaxBackoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	ceiling := c.MaxBackoff
+	if ceiling <= 0 {
+		ceiling = defaultMaxBackoff
+	}
+	d := c.Backoff
+	for range attempt {
+		if d >= ceiling {
+			break
+		}
+		d *= 2
+	}
+	d = min(d, ceiling)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryAfter is the wait a response asks for in Retry-After (seconds), if any.
+func retryAfter(res *http.Response) time.Duration {
+	s, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || s < 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
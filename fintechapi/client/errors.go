@@ -0,0 +1,85 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Error codes of the API; switch on Error.Code, see GET /problems/{code}.
+const (
+	CodeMalformedRequest     = "malformed_request"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeInvalidTransition    = "invalid_status_transition"
+	CodeNotReversible        = "not_reversible"
+	CodeReversalExceeded     = "reversal_amount_exceeded"
+	CodeIdempotencyMismatch  = "idempotency_key_reused"
+	CodeIdempotencyInFlight  = "idempotency_key_in_flight"
+	CodePreconditionFailed   = "precondition_failed"
+	CodeRuleViolation        = "rule_violation"
+	CodeAccountCurrencyFixed = "account_currency_fixed"
+	CodeFXRateUnavailable    = "fx_rate_unavailable"
+	CodeFXQuoteExpired       = "fx_quote_expired"
+	CodeFXQuoteUsed          = "fx_quote_used"
+	CodeInternal             = "internal_error"
+)
+
+// Sentinels for errors.Is, which matches an *Error by its code.
+var (
+	ErrValidationFailed = &Error{Code: CodeValidationFailed}
+	ErrUnauthenticated  = &Error{Code: CodeUnauthenticated}
+	ErrForbidden        = &Error{Code: CodeForbidden}
+	ErrNotFound         = &Error{Code: CodeNotFound}
+	ErrRuleViolation    = &Error{Code: CodeRuleViolation}
+)
+
+// Error is an error answered by the API, decoded from its problem+json body.
+type Error struct {
+	Status        int            `json:"status"`
+	Code          string         `json:"code"` // empty if the body was no problem
+	Title         string         `json:"title"`
+	Detail        string         `json:"detail,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"` // validation_failed only
+	Reason        string         `json:"reason,omitempty"`         // rule_violation only: the rule
+}
+
+// InvalidParam names a field or query parameter and what is wrong with it.
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func (e *Error) Error() string {
+	msg := "fintechapi: " + http.StatusText(e.Status)
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// Is reports whether target is an *Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code != "" && t.Code == e.Code
+}
+
+// readError turns a non-2xx response into an *Error and closes its body.
+func readError(res *http.Response) error {
+	defer res.Body.Close()
+	e := &Error{}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/problem+json") {
+		_ = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(e)
+	}
+	e.Status = res.StatusCode // whatever the body says
+	if e.Title == "" {
+		e.Title = http.StatusText(res.StatusCode)
+	}
+	return e
+}
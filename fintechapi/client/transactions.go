@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Transaction is a transfer as the API returns it. Amounts are integer minor
+// units of their currency.
+type Transaction struct {
+	ID            string     `json:"id"`
+	FromAccountID string     `json:"from_account_id"`
+	ToAccountID   string     `json:"to_account_id"`
+	Amount        int64      `json:"amount_minor"`
+	Currency      string     `json:"currency"`
+	At            time.Time  `json:"at"`
+	Status        string     `json:"status"` // pending, completed or failed
+	SettledAt     *time.Time `json:"settled_at,omitempty"`
+	FailureReason string     `json:"failure_reason,omitempty"`
+
+	ToAmount   int64  `json:"to_amount_minor,omitempty"` // set when converted
+	ToCurrency string `json:"to_currency,omitempty"`
+	FXRate     string `json:"fx_rate,omitempty"`
+	FXQuoteID  string `json:"fx_quote_id,omitempty"`
+
+	Fees   []Fee  `json:"fees,omitempty"`
+	FeeFor string `json:"fee_for,omitempty"`
+
+	Description string            `json:"description,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	StandingOrderID string     `json:"standing_order_id,omitempty"`
+	ScheduledFor    *time.Time `json:"scheduled_for,omitempty"`
+
+	ReversalOf string `json:"reversal_of,omitempty"`
+	Reversed   int64  `json:"reversed_minor,omitempty"`
+}
+
+// Fee is a line item charged to the sender of a transaction.
+type Fee struct {
+	Schedule  string `json:"schedule"`
+	Type      string `json:"type"`
+	Amount    int64  `json:"amount_minor"`
+	Currency  string `json:"currency"`
+	Account   string `json:"account"`
+	Refunded  int64  `json:"refunded_minor,omitempty"`
+	PostingID string `json:"posting_id,omitempty"`
+}
+
+// CreateTransactionRequest is a transfer to book.
+type CreateTransactionRequest struct {
+	FromAccountID string            `json:"from_account_id"`
+	ToAccountID   string            `json:"to_account_id"`
+	Amount        string            `json:"amount"`   // major units, e.g. "10.50"
+	Currency      string            `json:"currency"` // ISO 4217 code
+	Description   string            `json:"description,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	FXQuoteID     string            `json:"fx_quote_id,omitempty"`
+
+	// IdempotencyKey is sent in Idempotency-Key; NewIdempotencyKey if empty.
+	// Set it to retry a create across processes or restarts.
+	IdempotencyKey string `json:"-"`
+}
+
+// CreateTransaction books a transfer. It comes back pending, or failed by the
+// risk rules (see FailureReason); rules that reject answer ErrRuleViolation.
+func (c *Client) CreateTransaction(ctx context.Context, in CreateTransactionRequest) (Transaction, error) {
+	key := in.IdempotencyKey
+	if key == "" {
+		key = NewIdempotencyKey()
+	}
+	var t Transaction
+	err := c.do(ctx, http.MethodPost, "/transactions", http.Header{"Idempotency-Key": {key}}, in, &t)
+	return t, err
+}
+
+// GetTransaction reads a transaction; ErrNotFound if the caller cannot see it.
+func (c *Client) GetTransaction(ctx context.Context, id string) (Transaction, error) {
+	var t Transaction
+	err := c.do(ctx, http.MethodGet, "/transactions/"+url.PathEscape(id), nil, nil, &t)
+	return t, err
+}
+
+// ListOptions filters Transactions.
+type ListOptions struct {
+	FromAccountID string
+	Metadata      map[string]string // all must match
+	PageSize      int               // the server's default if 0
+}
+
+// Transactions iterates over the transactions the caller can see, oldest
+// first, fetching pages as it goes. It stops after yielding an error.
+func (c *Client) Transactions(ctx context.Context, opts ListOptions) iter.Seq2[Transaction, error] {
+	return func(yield func(Transaction, error) bool) {
+		q := url.Values{}
+		if opts.FromAccountID != "" {
+			q.Set("from_account_id", opts.FromAccountID)
+		}
+		for k, v := range opts.Metadata {
+			q.Set("metadata["+k+"]", v)
+		}
+		if opts.PageSize > 0 {
+			q.Set("limit", strconv.Itoa(opts.PageSize))
+		}
+
+		for {
+			var page struct {
+				Items      []Transaction `json:"items"`
+				NextCursor string        `json:"next_cursor"`
+			}
+			if err := c.do(ctx, http.MethodGet, "/transactions?"+q.Encode(), nil, nil, &page); err != nil {
+				yield(Transaction{}, err)
+				return
+			}
+			for _, t := range page.Items {
+				if !yield(t, nil) {
+					return
+				}
+			}
+			if page.NextCursor == "" {
+				return
+			}
+			q.Set("cursor", page.NextCursor)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jerberlin/go-examples/fintechapi/client"
+)
+
+// newClientServer serves setupAndRouting, wrapped by wrap if not nil, and
+// returns an admin client of it that retries without waiting long.
+func newClientServer(t *testing.T, wrap func(http.Handler) http.Handler) (*client.Client, *service) {
+	t.Helper()
+
+	mux, svc, cancel := setupAndRouting(defaultConfig(), NewConStore(), testAuth())
+	t.Cleanup(cancel)
+	var h http.Handler = mux
+	if wrap != nil {
+		h = wrap(mux)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	c := client.New(ts.URL, testAPIKey, strings.TrimPrefix(adminBearer, "Bearer "))
+	c.Backoff, c.MaxBackoff = time.Millisecond, 5*time.Millisecond
+	return c, svc
+}
+
+func TestClient_CreateGetAndList(t *testing.T) {
+	c, _ := newClientServer(t, nil)
+	ctx := context.Background()
+
+	var ids []string
+	for i := range 7 {
+		in := client.CreateTransactionRequest{FromAccountID: "A1", ToAccountID: "A2", Amount: "1.50", Currency: "eur"}
+		if i%2 == 0 {
+			in.Metadata = map[string]string{"order": "even"}
+		}
+		tr, err := c.CreateTransaction(ctx, in)
+		if err != nil || tr.Amount != 150 || tr.Currency != "EUR" || tr.Status != "pending" {
+			t.Fatalf("create: %+v %v", tr, err)
+		}
+		ids = append(ids, tr.ID)
+	}
+	got, err := c.GetTransaction(ctx, ids[3])
+	if err != nil || got.ID != ids[3] || got.FromAccountID != "A1" {
+		t.Errorf("get: %+v %v", got, err)
+	}
+
+	var listed []string
+	for tr, err := range c.Transactions(ctx, client.ListOptions{FromAccountID: "A1", PageSize: 3}) {
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		listed = append(listed, tr.ID)
+	}
+	if strings.Join(listed, ",") != strings.Join(ids, ",") {
+		t.Errorf("want %v over three pages, got %v", ids, listed)
+	}
+
+	n := 0
+	for _, err := range c.Transactions(ctx, client.ListOptions{Metadata: map[string]string{"order": "even"}, PageSize: 2}) {
+		if err != nil {
+			t.Fatalf("list by metadata: %v", err)
+		}
+		if n++; n == 3 {
+			break // stopping early stops the paging
+		}
+	}
+	if n != 3 {
+		t.Errorf("want to stop at 3, got %d", n)
+	}
+}
+
+func TestClient_TypedErrors(t *testing.T) {
+	c, _ := newClientServer(t, nil)
+	ctx := context.Background()
+
+	_, err := c.CreateTransaction(ctx, client.CreateTransactionRequest{FromAccountID: "A1", ToAccountID: "A2", Amount: "ten", Currency: "EUR"})
+	var p *client.Error
+	if !errors.Is(err, client.ErrValidationFailed) || !errors.As(err, &p) || p.Status != http.StatusBadRequest ||
+		len(p.InvalidParams) != 1 || p.InvalidParams[0].Name != "amount" {
+		t.Errorf("invalid amount: got %#v", err)
+	}
+
+	if _, err := c.GetTransaction(ctx, "missing"); !errors.Is(err, client.ErrNotFound) || errors.Is(err, client.ErrForbidden) {
+		t.Errorf("missing: got %v", err)
+	}
+
+	stranger := *c
+	stranger.Token = strings.TrimPrefix(bearer("mallory", "", "Z1"), "Bearer ")
+	if _, err := stranger.CreateTransaction(ctx, client.CreateTransactionRequest{FromAccountID: "A1", ToAccountID: "Z1", Amount: "1", Currency: "EUR"}); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("foreign account: got %v", err)
+	}
+	stranger.APIKey = "wrong"
+	for _, err := range stranger.Transactions(ctx, client.ListOptions{}) {
+		if !errors.Is(err, client.ErrUnauthenticated) {
+			t.Errorf("bad API key: got %v", err)
+		}
+	}
+}
+
+func TestClient_RetriesServerErrors(t *testing.T) {
+	var calls, failures atomic.Int32 // failures: how many calls to answer 500
+	failures.Store(2)
+	var mu sync.Mutex
+	keys := make(map[string]bool)
+	c, _ := newClientServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			keys[r.Header.Get("Idempotency-Key")] = true
+			mu.Unlock()
+			calls.Add(1)
+			if failures.Add(-1) >= 0 {
+				writeError(w, codeInternal, "try again")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	tr, err := c.CreateTransaction(context.Background(), client.CreateTransactionRequest{FromAccountID: "A1", ToAccountID: "A2", Amount: "1", Currency: "EUR"})
+	if err != nil || tr.ID == "" || calls.Load() != 3 || len(keys) != 1 || keys[""] {
+		t.Errorf("want success on the third call with one key, got %+v %v after %d calls, keys %v", tr, err, calls.Load(), keys)
+	}
+
+	// a 4xx is not retried, and the retries run out
+	calls.Store(0)
+	if _, err := c.GetTransaction(context.Background(), "missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("missing: got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("a 404 was sent %d times", calls.Load())
+	}
+	c.MaxRetries = 1
+	calls.Store(0)
+	failures.Store(10)
+	var p *client.Error
+	if _, err := c.GetTransaction(context.Background(), tr.ID); !errors.As(err, &p) || p.Code != client.CodeInternal || calls.Load() != 2 {
+		t.Errorf("want the 500 after two calls, got %v after %d", err, calls.Load())
+	}
+}
+
+func TestClient_RetryAfterLostResponseBooksOnce(t *testing.T) {
+	var dropped atomic.Bool
+	c, svc := newClientServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || dropped.Swap(true) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// the transaction is booked, but the response never arrives
+			next.ServeHTTP(httptest.NewRecorder(), r)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack: %v", err)
+				return
+			}
+			conn.Close()
+		})
+	})
+
+	tr, err := c.CreateTransaction(context.Background(), client.CreateTransactionRequest{FromAccountID: "A1", ToAccountID: "A2", Amount: "1", Currency: "EUR"})
+	if err != nil || !dropped.Load() {
+		t.Fatalf("create: %v", err)
+	}
+	stored, _ := svc.store.ListTransactions(listQuery{})
+	if len(stored) != 1 || stored[0].ID != tr.ID {
+		t.Errorf("want the one transaction %s stored, got %+v", tr.ID, stored)
+	}
+}
+
+func TestClient_StopsRetryingWhenCancelled(t *testing.T) {
+	c, _ := newClientServer(t, func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, codeInternal, "down")
+		})
+	})
+	c.MaxRetries, c.Backoff, c.MaxBackoff = 100, time.Hour, time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.GetTransaction(ctx, "x"); !errors.Is(err, &client.Error{Code: client.CodeInternal}) {
+		t.Errorf("want the last 500, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("waited %v after cancellation", d)
+	}
+}
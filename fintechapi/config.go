@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// Configuration
+// Every setting has a default, can be set with an environment variable and
+// overridden with a flag: flag > environment > default. Credentials
+// (FINTECH_API_KEYS, FINTECH_TOKEN_SECRET) are read from the environment only,
+// so they don't show up in process listings.
+
+type config struct {
+	Addr      string
+	DataFile  string
+	RulesFile string
+
+	FeesFile    string
+	FXRatesFile string
+	FXQuoteTTL  time.Duration // how long POST /fx/quotes holds a rate
+
+	OutboxSinks string // comma-separated, see parseOutboxSinks
+
+	IdemTTL           time.Duration
+	SweepInterval     time.Duration
+	SchedulerInterval time.Duration // how often due standing orders are booked
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration // how long in-flight requests get to finish
+}
+
+func defaultConfig() config {
+	return config{
+		Addr:              port,
+		IdemTTL:           idemTTL,
+		SweepInterval:     sweepInterval,
+		SchedulerInterval: defaultSchedulerInterval,
+		FXQuoteTTL:        defaultFXQuoteTTL,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ShutdownTimeout:   20 * time.Second,
+	}
+}
+
+// loadConfig reads the settings from getenv and then from the command line args
+// (without the program name).
+func loadConfig(args []string, getenv func(string) string) (config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("fintechapi", flag.ContinueOnError)
+	str := func(p *string, name, env, usage string) {
+		if v := getenv(env); v != "" {
+			*p = v
+		}
+		fs.StringVar(p, name, *p, usage+" ($"+env+")")
+	}
+	var envErr error
+	dur := func(p *time.Duration, name, env, usage string) {
+		if v := getenv(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil && envErr == nil {
+				envErr = fmt.Errorf("%s: %w", env, err)
+			}
+			*p = d
+		}
+		fs.DurationVar(p, name, *p, usage+" ($"+env+")")
+	}
+
+	str(&cfg.Addr, "addr", "FINTECH_ADDR", "listen address")
+	str(&cfg.DataFile, "data-file", "FINTECH_DATA_FILE", "append-only data file; empty keeps everything in memory")
+	str(&cfg.RulesFile, "rules-file", "FINTECH_RULES_FILE", "JSON risk rules, reloaded when it changes; empty disables rules")
+	str(&cfg.FeesFile, "fees-file", "FINTECH_FEES_FILE", "JSON fee schedules, reloaded when it changes; empty charges no fees")
+	str(&cfg.FXRatesFile, "fx-rates-file", "FINTECH_FX_RATES_FILE", "JSON exchange rates, reloaded when it changes; empty disables conversion")
+	str(&cfg.OutboxSinks, "outbox-sinks", "FINTECH_OUTBOX_SINKS", "comma-separated event sinks besides webhooks and streams: log, file:PATH or an http(s) URL")
+	dur(&cfg.FXQuoteTTL, "fx-quote-ttl", "FINTECH_FX_QUOTE_TTL", "how long an FX quote holds its rate")
+	dur(&cfg.IdemTTL, "idem-ttl", "FINTECH_IDEM_TTL", "how long idempotency records are kept")
+	dur(&cfg.SweepInterval, "sweep-interval", "FINTECH_SWEEP_INTERVAL", "how often expired idempotency records are swept")
+	dur(&cfg.SchedulerInterval, "scheduler-interval", "FINTECH_SCHEDULER_INTERVAL", "how often due scheduled transfers are booked")
+	dur(&cfg.ReadHeaderTimeout, "read-header-timeout", "FINTECH_READ_HEADER_TIMEOUT", "server read header timeout")
+	dur(&cfg.ReadTimeout, "read-timeout", "FINTECH_READ_TIMEOUT", "server read timeout")
+	dur(&cfg.WriteTimeout, "write-timeout", "FINTECH_WRITE_TIMEOUT", "server write timeout (event streams are exempt)")
+	dur(&cfg.IdleTimeout, "idle-timeout", "FINTECH_IDLE_TIMEOUT", "keep-alive idle timeout")
+	dur(&cfg.ShutdownTimeout, "shutdown-timeout", "FINTECH_SHUTDOWN_TIMEOUT", "how long to drain requests on SIGINT/SIGTERM")
+	if envErr != nil {
+		return config{}, envErr
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+	if fs.NArg() > 0 {
+		return config{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if cfg.Addr == "" {
+		return config{}, fmt.Errorf("addr must not be empty")
+	}
+	if _, err := parseOutboxSinks(cfg.OutboxSinks); err != nil {
+		return config{}, err
+	}
+	for name, d := range map[string]time.Duration{
+		"idem-ttl": cfg.IdemTTL, "sweep-interval": cfg.SweepInterval, "scheduler-interval": cfg.SchedulerInterval,
+		"fx-quote-ttl": cfg.FXQuoteTTL,
+	} {
+		if d <= 0 {
+			return config{}, fmt.Errorf("%s must be positive, got %s", name, d)
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"read-header-timeout": cfg.ReadHeaderTimeout, "read-timeout": cfg.ReadTimeout,
+		"write-timeout": cfg.WriteTimeout, "idle-timeout": cfg.IdleTimeout, "shutdown-timeout": cfg.ShutdownTimeout,
+	} {
+		if d < 0 {
+			return config{}, fmt.Errorf("%s must not be negative, got %s", name, d)
+		}
+	}
+	return cfg, nil
+}
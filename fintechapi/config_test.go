@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	env := func(m map[string]string) func(string) string {
+		return func(k string) string { return m[k] }
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		cfg, err := loadConfig(nil, env(nil))
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		if cfg != defaultConfig() {
+			t.Errorf("want defaults %+v, got %+v", defaultConfig(), cfg)
+		}
+	})
+
+	t.Run("FlagOverridesEnv", func(t *testing.T) {
+		cfg, err := loadConfig(
+			[]string{"-addr", ":9090", "-write-timeout", "1m"},
+			env(map[string]string{"FINTECH_ADDR": ":7070", "FINTECH_IDEM_TTL": "2h", "FINTECH_WRITE_TIMEOUT": "5s"}),
+		)
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		if cfg.Addr != ":9090" || cfg.WriteTimeout != time.Minute {
+			t.Errorf("flags should win, got addr=%s write=%s", cfg.Addr, cfg.WriteTimeout)
+		}
+		if cfg.IdemTTL != 2*time.Hour {
+			t.Errorf("env should override the default, got ttl=%s", cfg.IdemTTL)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := []struct {
+			Name string
+			Args []string
+			Env  map[string]string
+		}{
+			{Name: "EnvDuration", Env: map[string]string{"FINTECH_SWEEP_INTERVAL": "often"}},
+			{Name: "FlagDuration", Args: []string{"-idem-ttl", "1 day"}},
+			{Name: "ZeroSweep", Args: []string{"-sweep-interval", "0s"}},
+			{Name: "NegativeTimeout", Args: []string{"-read-timeout", "-1s"}},
+			{Name: "UnknownFlag", Args: []string{"-port", "80"}},
+			{Name: "StrayArgument", Args: []string{"serve"}},
+			{Name: "UnknownOutboxSink", Args: []string{"-outbox-sinks", "log,kafka://events"}},
+		}
+		for _, test := range tests {
+			if _, err := loadConfig(test.Args, env(test.Env)); err == nil {
+				t.Errorf("%s: want error", test.Name)
+			}
+		}
+	})
+}
+
+func TestServe_DrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "done")
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	url := "http://" + ln.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, srv, ln, 5*time.Second) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		inFlight <- result{body: string(b), err: err}
+	}()
+	<-started
+
+	cancel()
+	// new connections are refused once shutdown has begun
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("listener still accepting after shutdown")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(release)
+	if r := <-inFlight; r.err != nil || r.body != "done" {
+		t.Errorf("in-flight request should complete, got %q %v", r.body, r.err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
+
+func TestServe_CutsOffAfterDrainDeadline(t *testing.T) {
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, srv, ln, 50*time.Millisecond) }()
+
+	go func() {
+		if res, err := http.Get("http://" + ln.Addr().String()); err == nil {
+			res.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Errorf("expected a drain error when requests outlive the deadline")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve did not return after the drain deadline")
+	}
+}
+
+func TestSetupAndRouting_CancelStopsStreamsAndClosesStore(t *testing.T) {
+	store, err := openFileStore(t.TempDir() + "/data.jsonl")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, svc, cancel := setupAndRouting(defaultConfig(), store, testAuth())
+
+	_, ch, _ := svc.stream.subscribe(0)
+	cancel()
+
+	if _, ok := <-ch; ok {
+		t.Errorf("event streams should be closed")
+	}
+	if err := store.PutTransaction(Transaction{ID: "late"}); err == nil {
+		t.Errorf("store should be closed")
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// Domain events
+// An Event is raised when a Transaction is stored, changes status or is edited.
+// It is written to the outbox together with the change, and the outbox delivers
+// it to webhooks, event streams and the configured sinks (see outbox.go).
+
+const (
+	EventTransactionCreated       = "transaction.created"
+	EventTransactionStatusChanged = "transaction.status_changed"
+	EventTransactionUpdated       = "transaction.updated" // description or metadata (see metadata.go), or reversal history
+)
+
+type Event struct {
+	ID             string             `json:"id"`
+	Type           string             `json:"type"`
+	At             time.Time          `json:"at"`
+	Transaction    Transaction        `json:"transaction"`
+	PreviousStatus *TransactionStatus `json:"previous_status,omitempty"` // status_changed only
+}
+
+func newEvent(typ string, t Transaction) Event {
+	return Event{ID: newID(), Type: typ, At: time.Now().UTC(), Transaction: t}
+}
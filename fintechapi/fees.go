@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fees
+// Transfers are charged by fee schedules from a JSON file, re-read when it
+// changes like the rules:
+//
+//	{
+//	  "revenue_account": "FEES",
+//	  "schedules": [
+//	    {"name": "transfer", "type": "flat", "currency": "EUR", "amount": "0.25"},
+//	    {"name": "service", "type": "percentage", "currency": "EUR", "percent": "0.5", "min": "1.00", "max": "20.00"},
+//	    {"name": "volume", "type": "tiered", "currency": "EUR", "tiers": [
+//	      {"up_to": "1000.00", "percent": "1"},
+//	      {"up_to": "10000.00", "percent": "0.5", "amount": "0.10"},
+//	      {"percent": "0.25"}
+//	    ]}
+//	  ]
+//	}
+//
+// Every schedule in the transfer's currency adds a line item to the transaction
+// when it is created. A tiered schedule picks the first tier whose up_to is
+// above what the sending account has sent in that currency this calendar month
+// (UTC); its fee is amount plus percent of the transfer. min and max bound the
+// fee of percentage and tiered schedules. Fees round half up to the minor unit.
+//
+// Fees are charged to the sender on top of the amount. When the transaction
+// completes, each fee is posted as a completed transaction "<id>-fee-<n>" from
+// the sender to the revenue account. A reversal refunds the fees pro rata to the
+// amount reversed, so a full reversal refunds them all; fees already posted are
+// refunded by a transaction "<reversal id>-refund-<n>" back to the sender, which
+// completes or fails with the reversal, the others are just charged less at
+// settlement. If the reversal fails after that, the difference is posted as
+// "<reversal id>-fee-<n>". Fee postings and refunds carry fee_for and are
+// neither charged nor counted by the rules.
+
+const (
+	feeFlat       = "flat"
+	feePercentage = "percentage"
+	feeTiered     = "tiered"
+)
+
+// feeItem is a line item of a transaction.
+type feeItem struct {
+	Schedule  string   `json:"schedule"`
+	Type      string   `json:"type"`
+	Amount    int64    `json:"amount_minor"`
+	Currency  string   `json:"currency"`
+	Account   string   `json:"account"`                  // the revenue account it goes to
+	Refunded  int64    `json:"refunded_minor,omitempty"` // by reversals so far
+	PostingID string   `json:"posting_id,omitempty"`     // set once posted on settlement
+	RefundIDs []string `json:"refund_ids,omitempty"`     // refunds of the posted fee
+}
+
+type feeFile struct {
+	RevenueAccount string `json:"revenue_account"`
+	Schedules      []struct {
+		Name     string        `json:"name"`
+		Type     string        `json:"type"`
+		Currency string        `json:"currency"`
+		Amount   decimalAmount `json:"amount,omitempty"`
+		Percent  string        `json:"percent,omitempty"`
+		Min      decimalAmount `json:"min,omitempty"`
+		Max      decimalAmount `json:"max,omitempty"`
+		Tiers    []struct {
+			UpTo    decimalAmount `json:"up_to,omitempty"`
+			Amount  decimalAmount `json:"amount,omitempty"`
+			Percent string        `json:"percent,omitempty"`
+		} `json:"tiers,omitempty"`
+	} `json:"schedules"`
+}
+
+// feeRate is amount plus percent of the transfer; zero values add nothing.
+type feeRate struct {
+	flat    int64
+	percent *big.Rat // a fraction, 0.5% is 1/200
+}
+
+type feeTier struct {
+	upTo int64 // minor units; 0 on the last tier
+	feeRate
+}
+
+type feeSchedule struct {
+	name     string
+	typ      string
+	currency string
+	min, max int64 // 0: no bound
+	feeRate        // flat and percentage
+	tiers    []feeTier
+}
+
+// feeTable is a parsed fee file.
+type feeTable struct {
+	revenue   string
+	schedules []feeSchedule
+}
+
+func parseFees(b []byte) (*feeTable, error) {
+	var f feeFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	ft := &feeTable{revenue: strings.TrimSpace(f.RevenueAccount)}
+	if ft.revenue == "" && len(f.Schedules) > 0 {
+		return nil, fmt.Errorf("revenue_account is required")
+	}
+	names := make(map[string]bool)
+	for i, s := range f.Schedules {
+		fs := feeSchedule{name: strings.TrimSpace(s.Name), typ: s.Type}
+		if fs.name == "" || names[fs.name] {
+			return nil, fmt.Errorf("schedules[%d]: name must be set and unique", i)
+		}
+		names[fs.name] = true
+		var err error
+		if fs.currency, _, err = normalizeCurrency(s.Currency); err != nil {
+			return nil, fmt.Errorf("schedule %s: currency %q: %w", fs.name, s.Currency, err)
+		}
+		amount := func(field string, a decimalAmount) (int64, error) {
+			if a == "" {
+				return 0, nil
+			}
+			m, err := ParseMoney(string(a), fs.currency)
+			if err != nil || m.Minor < 0 {
+				return 0, fmt.Errorf("schedule %s: %s must be a non-negative amount, got %q", fs.name, field, a)
+			}
+			return m.Minor, nil
+		}
+		rate := func(field string, a decimalAmount, percent string) (feeRate, error) {
+			var r feeRate
+			if r.flat, err = amount(field+"amount", a); err != nil {
+				return r, err
+			}
+			if percent != "" {
+				p, ok := new(big.Rat).SetString(strings.TrimSpace(percent))
+				if !ok || p.Sign() < 0 || p.Cmp(big.NewRat(100, 1)) > 0 {
+					return r, fmt.Errorf("schedule %s: %spercent must be 0 to 100, got %q", fs.name, field, percent)
+				}
+				r.percent = p.Quo(p, big.NewRat(100, 1))
+			}
+			return r, nil
+		}
+		if fs.min, err = amount("min", s.Min); err != nil {
+			return nil, err
+		}
+		if fs.max, err = amount("max", s.Max); err != nil {
+			return nil, err
+		}
+		if fs.max > 0 && fs.max < fs.min {
+			return nil, fmt.Errorf("schedule %s: max is below min", fs.name)
+		}
+
+		switch fs.typ {
+		case feeFlat:
+			if s.Amount == "" || s.Percent != "" || s.Min != "" || s.Max != "" || len(s.Tiers) > 0 {
+				return nil, fmt.Errorf("schedule %s: a flat fee has an amount only", fs.name)
+			}
+			fs.feeRate, err = rate("", s.Amount, "")
+		case feePercentage:
+			if s.Percent == "" || s.Amount != "" || len(s.Tiers) > 0 {
+				return nil, fmt.Errorf("schedule %s: a percentage fee has a percent and optionally min and max", fs.name)
+			}
+			fs.feeRate, err = rate("", "", s.Percent)
+		case feeTiered:
+			if len(s.Tiers) == 0 || s.Amount != "" || s.Percent != "" {
+				return nil, fmt.Errorf("schedule %s: a tiered fee has tiers and optionally min and max", fs.name)
+			}
+			for j, t := range s.Tiers {
+				field := "tiers[" + strconv.Itoa(j) + "]."
+				tier := feeTier{}
+				if tier.feeRate, err = rate(field, t.Amount, t.Percent); err != nil {
+					return nil, err
+				}
+				if tier.upTo, err = amount(field+"up_to", t.UpTo); err != nil {
+					return nil, err
+				}
+				last := j == len(s.Tiers)-1
+				switch {
+				case last && tier.upTo != 0:
+					return nil, fmt.Errorf("schedule %s: the last tier has no up_to", fs.name)
+				case !last && (tier.upTo == 0 || (j > 0 && tier.upTo <= fs.tiers[j-1].upTo)):
+					return nil, fmt.Errorf("schedule %s: up_to must rise from tier to tier", fs.name)
+				}
+				fs.tiers = append(fs.tiers, tier)
+			}
+		default:
+			return nil, fmt.Errorf("schedule %s: type must be %q, %q or %q, got %q", fs.name, feeFlat, feePercentage, feeTiered, s.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ft.schedules = append(ft.schedules, fs)
+	}
+	return ft, nil
+}
+
+// fee is what r charges on amount.
+func (r feeRate) fee(amount int64) int64 {
+	fee := r.flat
+	if r.percent != nil {
+		x := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), r.percent)
+		p, _ := roundRat(x, roundingHalfUp) // at most amount
+		fee += p
+	}
+	return fee
+}
+
+// charge returns the line items of t. History comes from store; the caller holds
+// the sending account's lock, as for the rules.
+func (ft *feeTable) charge(store Store, t Transaction) ([]feeItem, error) {
+	if t.FromAccountID == ft.revenue {
+		return nil, nil
+	}
+	var items []feeItem
+	volume := int64(-1) // read on first use
+	for _, s := range ft.schedules {
+		if s.currency != t.Currency {
+			continue
+		}
+		rate := s.feeRate
+		if s.typ == feeTiered {
+			if volume < 0 {
+				var err error
+				if volume, err = monthlyVolume(store, t); err != nil {
+					return nil, err
+				}
+			}
+			i := slices.IndexFunc(s.tiers, func(tier feeTier) bool { return tier.upTo == 0 || volume < tier.upTo })
+			rate = s.tiers[i].feeRate
+		}
+		fee := rate.fee(t.Amount)
+		if s.typ != feeFlat {
+			fee = max(fee, s.min)
+			if s.max > 0 {
+				fee = min(fee, s.max)
+			}
+		}
+		if fee > 0 {
+			items = append(items, feeItem{Schedule: s.name, Type: s.typ, Amount: fee, Currency: t.Currency, Account: ft.revenue})
+		}
+	}
+	return items, nil
+}
+
+// readsHistory reports whether charging t depends on its sender's monthly
+// volume, i.e. a tiered schedule applies to it.
+func (ft *feeTable) readsHistory(t Transaction) bool {
+	if t.FromAccountID == ft.revenue {
+		return false
+	}
+	return slices.ContainsFunc(ft.schedules, func(s feeSchedule) bool { return s.currency == t.Currency && s.typ == feeTiered })
+}
+
+// monthlyVolume is what t's sender has sent (see sent) in t's currency in t's
+// calendar month.
+func monthlyVolume(store Store, t Transaction) (int64, error) {
+	at := t.At.UTC()
+	month := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+	history, err := store.ListTransactions(listQuery{FromAccountID: t.FromAccountID, Since: month})
+	if err != nil {
+		return 0, err
+	}
+	var volume int64
+	for _, s := range history {
+		if sent(s) && s.Currency == t.Currency {
+			volume += s.Amount
+		}
+	}
+	return volume, nil
+}
+
+// feePostings marks the fees of t posted and returns the postings; t is
+// completing at now. The fee items are copied first: readers may still hold
+// the stored ones.
+func feePostings(t *Transaction, now time.Time) []Transaction {
+	var postings []Transaction
+	t.Fees = slices.Clone(t.Fees)
+	for i, f := range t.Fees {
+		if f.Amount-f.Refunded <= 0 || f.PostingID != "" {
+			continue
+		}
+		p := Transaction{
+			ID:            t.ID + "-fee-" + strconv.Itoa(i),
+			FromAccountID: t.FromAccountID,
+			ToAccountID:   f.Account,
+			Amount:        f.Amount - f.Refunded,
+			Currency:      f.Currency,
+			At:            now,
+			Status:        StatusCompleted,
+			SettledAt:     &now,
+			ClientID:      t.ClientID,
+			FeeFor:        t.ID,
+		}
+		t.Fees[i].PostingID = p.ID
+		postings = append(postings, p)
+	}
+	return postings
+}
+
+// feeRefunds refunds the fees of orig pro rata to what has been reversed of it
+// so far, and returns what each fee got back and the refunds of posted fees.
+// orig.Reversed must already include the new reversal rev. The refunds are
+// pending: they complete or fail with rev, see settleReversal.
+func feeRefunds(orig *Transaction, rev Transaction) (refunded []int64, refunds []Transaction) {
+	received, _ := orig.received()
+	orig.Fees = slices.Clone(orig.Fees)
+	for i := range orig.Fees {
+		f := &orig.Fees[i]
+		// rounded down until the last reversal refunds the rest
+		due := new(big.Int).Mul(big.NewInt(f.Amount), big.NewInt(orig.Reversed))
+		due.Quo(due, big.NewInt(received))
+		delta := due.Int64() - f.Refunded
+		if delta <= 0 {
+			continue
+		}
+		if refunded == nil {
+			refunded = make([]int64, len(orig.Fees))
+		}
+		refunded[i] = delta
+		f.Refunded += delta
+		if f.PostingID == "" {
+			continue // charged less at settlement
+		}
+		r := Transaction{
+			ID:            feeRefundID(rev.ID, i),
+			FromAccountID: f.Account,
+			ToAccountID:   orig.FromAccountID,
+			Amount:        delta,
+			Currency:      f.Currency,
+			At:            rev.At,
+			Status:        StatusPending,
+			ClientID:      orig.ClientID,
+			FeeFor:        orig.ID,
+		}
+		f.RefundIDs = append(slices.Clip(f.RefundIDs), r.ID)
+		refunds = append(refunds, r)
+	}
+	return refunded, refunds
+}
+
+// feeRefundID is the ID of the refund of fee i by the reversal revID.
+func feeRefundID(revID string, i int) string {
+	return revID + "-refund-" + strconv.Itoa(i)
+}
+
+// unrefundFees takes back what the failed reversal ref refunded of the fees of
+// orig. A fee posted since ref was booked was charged less by that much; the
+// difference is posted now and returned.
+func unrefundFees(orig *Transaction, ref reversalRef, now time.Time) []Transaction {
+	var postings []Transaction
+	orig.Fees = slices.Clone(orig.Fees)
+	for i, amount := range ref.FeesRefunded {
+		f := &orig.Fees[i]
+		if amount == 0 {
+			continue
+		}
+		f.Refunded -= amount
+		if f.PostingID == "" || slices.Contains(f.RefundIDs, feeRefundID(ref.ID, i)) {
+			continue // charged in full at settlement, or its refund fails with ref
+		}
+		postings = append(postings, Transaction{
+			ID:            ref.ID + "-fee-" + strconv.Itoa(i),
+			FromAccountID: orig.FromAccountID,
+			ToAccountID:   f.Account,
+			Amount:        amount,
+			Currency:      f.Currency,
+			At:            now,
+			Status:        StatusCompleted,
+			SettledAt:     &now,
+			ClientID:      orig.ClientID,
+			FeeFor:        orig.ID,
+		})
+	}
+	return postings
+}
+
+// feeEngine holds the active fee schedules and reloads them from their file.
+type feeEngine = reloadable[feeTable]
+
+func newFeeEngine() *feeEngine {
+	return newReloadable("fees", parseFees, &feeTable{})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseFees(t *testing.T) {
+	for name, in := range map[string]string{
+		"NoRevenueAccount": `{"schedules":[{"name":"f","type":"flat","currency":"EUR","amount":"1"}]}`,
+		"DuplicateName":    `{"revenue_account":"FEES","schedules":[{"name":"f","type":"flat","currency":"EUR","amount":"1"},{"name":"f","type":"flat","currency":"EUR","amount":"2"}]}`,
+		"UnknownType":      `{"revenue_account":"FEES","schedules":[{"name":"f","type":"free","currency":"EUR"}]}`,
+		"FlatWithPercent":  `{"revenue_account":"FEES","schedules":[{"name":"f","type":"flat","currency":"EUR","amount":"1","percent":"1"}]}`,
+		"Precision":        `{"revenue_account":"FEES","schedules":[{"name":"f","type":"flat","currency":"EUR","amount":"0.001"}]}`,
+		"PercentOver100":   `{"revenue_account":"FEES","schedules":[{"name":"f","type":"percentage","currency":"EUR","percent":"101"}]}`,
+		"MaxBelowMin":      `{"revenue_account":"FEES","schedules":[{"name":"f","type":"percentage","currency":"EUR","percent":"1","min":"5","max":"1"}]}`,
+		"TiersNotRising":   `{"revenue_account":"FEES","schedules":[{"name":"f","type":"tiered","currency":"EUR","tiers":[{"up_to":"10","percent":"1"},{"up_to":"5","percent":"1"},{"percent":"1"}]}]}`,
+		"LastTierBounded":  `{"revenue_account":"FEES","schedules":[{"name":"f","type":"tiered","currency":"EUR","tiers":[{"up_to":"10","percent":"1"}]}]}`,
+		"UnknownField":     `{"revenue_account":"FEES","schedules":[],"vat":"19"}`,
+	} {
+		if _, err := parseFees([]byte(in)); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestFeeTable_Charge(t *testing.T) {
+	ft, err := parseFees([]byte(`{"revenue_account":"FEES","schedules":[
+		{"name":"transfer","type":"flat","currency":"EUR","amount":"0.25"},
+		{"name":"service","type":"percentage","currency":"EUR","percent":"0.5","min":"1.00","max":"20.00"},
+		{"name":"volume","type":"tiered","currency":"EUR","tiers":[
+			{"up_to":"1000.00","percent":"1"},{"up_to":"10000.00","percent":"0.5","amount":"0.10"},{"percent":"0.25"}]},
+		{"name":"dollar","type":"flat","currency":"USD","amount":"1.00"}
+	]}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	at := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	store := NewConStore()
+	_ = store.PutTransactions([]Transaction{
+		{ID: "feb", FromAccountID: "A1", ToAccountID: "B", Amount: 900000, Currency: "EUR", At: at.AddDate(0, -1, 0)},
+		{ID: "mar", FromAccountID: "A1", ToAccountID: "B", Amount: 150000, Currency: "EUR", At: at.Add(-time.Hour)},
+		{ID: "failed", FromAccountID: "A1", ToAccountID: "B", Amount: 900000, Currency: "EUR", At: at.Add(-time.Hour), Status: StatusFailed},
+		{ID: "fee", FromAccountID: "A1", ToAccountID: "FEES", Amount: 900000, Currency: "EUR", At: at.Add(-time.Hour), FeeFor: "mar"},
+	})
+
+	fees := func(from string, amount int64, currency string) map[string]int64 {
+		items, err := ft.charge(store, Transaction{FromAccountID: from, ToAccountID: "B", Amount: amount, Currency: currency, At: at})
+		if err != nil {
+			t.Fatalf("charge: %v", err)
+		}
+		got := make(map[string]int64)
+		for _, it := range items {
+			if it.Account != "FEES" || it.Currency != currency {
+				t.Errorf("unexpected item %+v", it)
+			}
+			got[it.Schedule] = it.Amount
+		}
+		return got
+	}
+
+	// A1 sent 1500.00 EUR in March: the second tier
+	if got, want := fees("A1", 10000, "EUR"), map[string]int64{"transfer": 25, "service": 100, "volume": 60}; !reflect.DeepEqual(got, want) {
+		t.Errorf("100.00 EUR: want %v, got %v", want, got)
+	}
+	// new sender: the first tier, and the service fee is bounded
+	if got, want := fees("A2", 1000000, "EUR"), map[string]int64{"transfer": 25, "service": 2000, "volume": 10000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("10000.00 EUR: want %v, got %v", want, got)
+	}
+	if got, want := fees("A2", 100, "EUR"), map[string]int64{"transfer": 25, "service": 100, "volume": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("1.00 EUR: want %v, got %v", want, got)
+	}
+	if got, want := fees("A2", 100, "USD"), map[string]int64{"dollar": 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("USD: want %v, got %v", want, got)
+	}
+	if got := fees("FEES", 100, "EUR"); len(got) != 0 {
+		t.Errorf("the revenue account is not charged, got %v", got)
+	}
+}
+
+func newFeeServer(t *testing.T) (*httptest.Server, *service) {
+	t.Helper()
+
+	ts, svc := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "fees.json")
+	writeRules(t, path, `{"revenue_account":"FEES","schedules":[
+		{"name":"transfer","type":"flat","currency":"EUR","amount":"0.25"},
+		{"name":"service","type":"percentage","currency":"EUR","percent":"1","min":"0.50"}
+	]}`)
+	if err := svc.fees.loadFile(path); err != nil {
+		t.Fatalf("load fees: %v", err)
+	}
+	return ts, svc
+}
+
+func TestAPI_FeesPostedAndRefunded(t *testing.T) {
+	ts, svc := newFeeServer(t)
+	url := ts.URL
+
+	res, body := postJSON(t, url+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "100.00", "currency": "EUR"}, nil)
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusAccepted || len(tr.Fees) != 2 || tr.Fees[0].Amount != 25 || tr.Fees[1].Amount != 100 {
+		t.Fatalf("expected fees of 0.25 and 1.00, got %d body=%s", res.StatusCode, string(body))
+	}
+
+	res, body = putJSON(t, url+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"})
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusOK || tr.Fees[0].PostingID != tr.ID+"-fee-0" || tr.Fees[1].PostingID != tr.ID+"-fee-1" {
+		t.Fatalf("expected the fees posted, got %d body=%s", res.StatusCode, string(body))
+	}
+	posting, ok, _ := svc.store.GetTransaction(tr.ID + "-fee-1")
+	if !ok || posting.FromAccountID != "A1" || posting.ToAccountID != "FEES" || posting.Amount != 100 || posting.Status != StatusCompleted || posting.FeeFor != tr.ID {
+		t.Errorf("unexpected posting %+v", posting)
+	}
+	if res, _ := reverseTx(t, ts, posting.ID, nil, nil); res.StatusCode != http.StatusConflict {
+		t.Errorf("reversing a fee posting: expected 409, got %d", res.StatusCode)
+	}
+
+	refunded := func(want ...int64) Transaction {
+		t.Helper()
+		orig, _, _ := svc.store.GetTransaction(tr.ID)
+		for i, f := range orig.Fees {
+			if f.Refunded != want[i] {
+				t.Errorf("fee %d: want %d refunded, got %+v", i, want[i], f)
+			}
+		}
+		return orig
+	}
+	if res, _ := reverseTx(t, ts, tr.ID, map[string]any{"amount": "40.00"}, nil); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("partial reversal: %d", res.StatusCode)
+	}
+	refunded(10, 40)
+	if res, _ := reverseTx(t, ts, tr.ID, nil, nil); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("reversal of the rest: %d", res.StatusCode)
+	}
+	orig := refunded(25, 100)
+
+	var back int64
+	for _, f := range orig.Fees {
+		for _, id := range f.RefundIDs {
+			r, ok, _ := svc.store.GetTransaction(id)
+			if !ok || r.FromAccountID != "FEES" || r.ToAccountID != "A1" || r.FeeFor != tr.ID {
+				t.Errorf("unexpected refund %+v", r)
+			}
+			back += r.Amount
+		}
+	}
+	if back != 125 {
+		t.Errorf("want all 1.25 EUR of fees refunded, got %d", back)
+	}
+}
+
+func TestAPI_FeeRefundsSettleWithTheReversal(t *testing.T) {
+	ts, svc := newFeeServer(t)
+	url := ts.URL
+	tr := createTx(t, ts, "A1", "A2") // 1.00 EUR: fees of 0.25 and 0.01
+	if res, _ := putJSON(t, url+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("complete: %d", res.StatusCode)
+	}
+	refunds := func(revID string, want TransactionStatus) {
+		t.Helper()
+		r, ok, _ := svc.store.GetTransaction(feeRefundID(revID, 0))
+		if !ok || r.Status != want || (r.SettledAt != nil) != (want == StatusCompleted) {
+			t.Errorf("refund of %s: want %s, got %+v", revID, want, r)
+		}
+	}
+
+	_, rev := reverseTx(t, ts, tr.ID, map[string]any{"amount": "0.40"}, nil)
+	refunds(rev.ID, StatusPending)
+	if res, _ := putJSON(t, url+"/transactions/"+feeRefundID(rev.ID, 0)+"/status", map[string]any{"status": "completed"}); res.StatusCode != http.StatusConflict {
+		t.Errorf("settling a refund on its own: want 409, got %d", res.StatusCode)
+	}
+	_, _ = putJSON(t, url+"/transactions/"+rev.ID+"/status", map[string]any{"status": "completed"})
+	refunds(rev.ID, StatusCompleted)
+
+	_, rest := reverseTx(t, ts, tr.ID, nil, nil)
+	_, _ = putJSON(t, url+"/transactions/"+rest.ID+"/status", map[string]any{"status": "failed"})
+	refunds(rest.ID, StatusFailed)
+	orig, _, _ := svc.store.GetTransaction(tr.ID)
+	if orig.Reversed != 40 || orig.Fees[0].Refunded != 10 {
+		t.Errorf("want the failed reversal's amount and refund given back, got %d reversed and %+v", orig.Reversed, orig.Fees)
+	}
+
+	// the rest can be reversed again, refunding the rest of the fee
+	_, again := reverseTx(t, ts, tr.ID, nil, nil)
+	if r, _, _ := svc.store.GetTransaction(feeRefundID(again.ID, 0)); again.Amount != 60 || r.Amount != 15 {
+		t.Errorf("want 60 reversed and 15 refunded, got %d and %+v", again.Amount, r)
+	}
+}
+
+func TestAPI_FailedReversalBeforeSettlementChargesTheFeeInFull(t *testing.T) {
+	ts, svc := newFeeServer(t)
+	url := ts.URL
+	res, body := postJSON(t, url+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "100.00", "currency": "EUR"}, nil)
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("create: %d %s", res.StatusCode, string(body))
+	}
+
+	// posted at half while the reversal was pending, then the reversal fails
+	_, rev := reverseTx(t, ts, tr.ID, map[string]any{"amount": "50.00"}, nil)
+	_, _ = putJSON(t, url+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"})
+	if res, _ := putJSON(t, url+"/transactions/"+rev.ID+"/status", map[string]any{"status": "failed"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("fail the reversal: %d", res.StatusCode)
+	}
+	// by fee: the postings and top-ups end in the fee's index
+	var charged [2]int64
+	all, _ := svc.store.ListTransactions(listQuery{})
+	for _, p := range all {
+		if p.FeeFor == tr.ID && p.Status == StatusCompleted && p.FromAccountID == "A1" {
+			i, _ := strconv.Atoi(p.ID[len(p.ID)-1:])
+			charged[i] += p.Amount
+		}
+	}
+	if charged[0] != 25 || charged[1] != 100 {
+		t.Errorf("want the fees of 25 and 100 charged in full, got %v", charged)
+	}
+}
+
+func TestAPI_FeesReversedBeforeSettlement(t *testing.T) {
+	ts, svc := newFeeServer(t)
+	url := ts.URL
+	res, body := postJSON(t, url+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "100.00", "currency": "EUR"}, nil)
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("create: %d %s", res.StatusCode, string(body))
+	}
+
+	// half is reversed while pending: only the other half of the fees is posted
+	if res, _ := reverseTx(t, ts, tr.ID, map[string]any{"amount": "50.00"}, nil); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("reversal: %d", res.StatusCode)
+	}
+	if res, _ := putJSON(t, url+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("complete: %d", res.StatusCode)
+	}
+	for i, want := range []int64{13, 50} {
+		p, ok, _ := svc.store.GetTransaction(tr.ID + "-fee-" + strconv.Itoa(i))
+		if !ok || p.Amount != want {
+			t.Errorf("posting %d: want %d, got %+v", i, want, p)
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Durable storage
+// fileStore appends every mutation as one JSON line to a log file and fsyncs it
+// before the change becomes visible in memory. At startup the log is replayed into
+// a conStore. Compaction rewrites the log as a snapshot of the live state; it is
+// looked out for by the writes that run in the background, idempotency sweeps
+// and the outbox's offsets and pruning, so it never runs inside a request.
+// Outbox entries are written in the same line as the transactions that raised
+// them, so a crash keeps both or neither.
+
+const compactMinRecords = 1024 // don't bother compacting small logs
+
+var errStoreClosed = errors.New("store is closed")
+
+// logRecord is one line of the append-only log.
+type logRecord struct {
+	Op     string         `json:"op"`
+	Tx     *Transaction   `json:"tx,omitempty"`
+	Txs    []Transaction  `json:"txs,omitempty"`
+	Key    string         `json:"key,omitempty"`
+	Idem   *idemRecord    `json:"idem,omitempty"`
+	Cutoff *time.Time     `json:"cutoff,omitempty"`
+	Order  *standingOrder `json:"order,omitempty"`
+	Audit  *auditEntry    `json:"audit,omitempty"`
+	Acct   *account       `json:"account,omitempty"`
+	Events []outboxEntry  `json:"events,omitempty"` // put_tx, put_txs and outbox
+	Audits []auditEntry   `json:"audits,omitempty"` // put_tx and put_txs
+	Offset int64          `json:"offset,omitempty"` // outbox_offset, of sink Key; prune_outbox
+}
+
+const (
+	opPutTx     = "put_tx"
+	opPutTxs    = "put_txs" // a batch in one line: a torn write loses all of it
+	opPutIdem   = "put_idem"
+	opDelIdem   = "del_idem"
+	opSweepIdem = "sweep_idem"
+	opPutOrder  = "put_order"
+	opAudit     = "audit"
+	opPutAcct   = "put_account"
+	opOutbox    = "outbox" // entries alone, written by compaction
+	opOutboxOff = "outbox_offset"
+	opPruneOut  = "prune_outbox" // written by compaction: numbering goes on after Offset
+)
+
+// logFile is the open log; an *os.File outside of tests.
+type logFile interface {
+	io.WriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+type fileStore struct {
+	mem *conStore // in-memory index, rebuilt from the log
+
+	mu      sync.Mutex // serialises appends so log order equals apply order
+	path    string
+	f       logFile
+	records int // lines in the current log
+	closed  bool
+}
+
+// openFileStore opens (or creates) the log at path and recovers its state.
+// A torn last line, left by a crash in the middle of an append, is cut off.
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{mem: NewConStore(), path: path}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	good, err := s.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// drop whatever trails the last complete record
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.f = f
+
+	return s, nil
+}
+
+// replay applies every complete record of the log and returns the offset after the last one.
+func (s *fileStore) replay(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return offset, nil // a partial line without '\n' is a torn write
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		var rec logRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil {
+			// a bad line followed by more data is corruption, not a torn write
+			if _, perr := br.Peek(1); perr == nil {
+				return offset, fmt.Errorf("corrupt log record at offset %d: %w", offset, err)
+			}
+			return offset, nil
+		}
+		if err := s.mem.apply(rec); err != nil {
+			return offset, fmt.Errorf("log record at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+		s.records++
+	}
+}
+
+// apply performs a logged mutation on the in-memory state.
+func (s *conStore) apply(rec logRecord) error {
+	switch rec.Op {
+	case opPutTx:
+		if rec.Tx == nil {
+			return errors.New("put_tx without transaction")
+		}
+		return s.commit([]Transaction{*rec.Tx}, rec.Events, rec.Audits)
+	case opPutTxs:
+		return s.commit(rec.Txs, rec.Events, rec.Audits)
+	case opOutbox:
+		return s.commit(nil, rec.Events, nil)
+	case opOutboxOff:
+		return s.PutOutboxOffset(rec.Key, rec.Offset)
+	case opPruneOut:
+		return s.PruneOutbox(rec.Offset)
+	case opPutIdem:
+		if rec.Idem == nil {
+			return errors.New("put_idem without record")
+		}
+		return s.PutIdem(rec.Key, *rec.Idem)
+	case opDelIdem:
+		return s.DeleteIdem(rec.Key)
+	case opPutOrder:
+		if rec.Order == nil {
+			return errors.New("put_order without standing order")
+		}
+		return s.PutStandingOrder(*rec.Order)
+	case opPutAcct:
+		if rec.Acct == nil {
+			return errors.New("put_account without account")
+		}
+		return s.PutAccount(*rec.Acct)
+	case opAudit:
+		if rec.Audit == nil {
+			return errors.New("audit without entry")
+		}
+		return s.AppendAudit(*rec.Audit)
+	case opSweepIdem:
+		if rec.Cutoff == nil {
+			return errors.New("sweep_idem without cutoff")
+		}
+		_, err := s.SweepIdem(*rec.Cutoff)
+		return err
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+}
+
+// append writes rec durably and then applies it in memory.
+func (s *fileStore) append(rec logRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.appendLocked(rec); err != nil {
+		return err
+	}
+
+	return s.mem.apply(rec)
+}
+
+// appendLocked writes and fsyncs one record; s.mu must be held. A record that
+// fails half-way is cut off again, so the next one starts where it started.
+func (s *fileStore) appendLocked(rec logRecord) error {
+	if s.closed {
+		return errStoreClosed
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	end, err := s.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err = s.f.Write(b); err == nil {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		return errors.Join(err, s.truncate(end))
+	}
+	s.records++
+
+	return nil
+}
+
+// truncate drops whatever a failed append left after end.
+func (s *fileStore) truncate(end int64) error {
+	if err := s.f.Truncate(end); err != nil {
+		return fmt.Errorf("cutting off a failed append: %w", err)
+	}
+	if _, err := s.f.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("cutting off a failed append: %w", err)
+	}
+	return nil
+}
+
+func (s *fileStore) PutTransaction(t Transaction, events ...Event) error {
+	return s.appendWithEvents(logRecord{Op: opPutTx, Tx: &t}, events)
+}
+
+func (s *fileStore) PutTransactions(ts []Transaction, events ...Event) error {
+	return s.appendWithEvents(logRecord{Op: opPutTxs, Txs: ts}, events)
+}
+
+// appendWithEvents is append with events numbered into the outbox and chained
+// into the audit log, all in the one record.
+func (s *fileStore) appendWithEvents(rec logRecord, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// s.mu keeps other writers out between numbering and applying
+	if err := s.addEntries(&rec, events); err != nil {
+		return err
+	}
+	if err := s.appendLocked(rec); err != nil {
+		return err
+	}
+	return s.mem.apply(rec)
+}
+
+// addEntries puts the outbox and audit entries for events into rec; s.mu must be held.
+func (s *fileStore) addEntries(rec *logRecord, events []Event) error {
+	s.mem.MuTransactions.RLock()
+	defer s.mem.MuTransactions.RUnlock()
+	var err error
+	rec.Events, rec.Audits, err = s.mem.entriesLocked(events)
+	return err
+}
+
+func (s *fileStore) GetTransaction(id string) (Transaction, bool, error) {
+	return s.mem.GetTransaction(id)
+}
+
+func (s *fileStore) UpdateTransaction(id string, fn func(*Transaction) error) (Transaction, error) {
+	return s.ApplyTransaction(id, func(t *Transaction) (txWrite, error) { return txWrite{}, fn(t) })
+}
+
+func (s *fileStore) ApplyTransaction(id string, fn func(*Transaction) (txWrite, error)) (Transaction, error) {
+	ts, err := s.ApplyTransactions([]string{id}, func(ts []Transaction) (txWrite, error) { return fn(&ts[0]) })
+	if err != nil {
+		return Transaction{}, err
+	}
+	return ts[0], nil
+}
+
+func (s *fileStore) ApplyTransactions(ids []string, fn func([]Transaction) (txWrite, error)) ([]Transaction, error) {
+	// every write goes through s.mu, so the read-modify-write cannot interleave
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mem.MuTransactions.RLock()
+	ts, err := s.mem.getLocked(ids)
+	s.mem.MuTransactions.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	w, err := fn(ts)
+	if err != nil {
+		return nil, err
+	}
+	rec := logRecord{Op: opPutTx, Tx: &ts[0]}
+	if len(ts) > 1 || len(w.Put) > 0 {
+		rec = logRecord{Op: opPutTxs, Txs: append(slices.Clone(ts), w.Put...)}
+	}
+	if err := s.addEntries(&rec, w.Events); err != nil {
+		return nil, err
+	}
+	if err := s.appendLocked(rec); err != nil {
+		return nil, err
+	}
+	return ts, s.mem.apply(rec)
+}
+
+func (s *fileStore) CountTransactions() (map[TransactionStatus]int, error) {
+	return s.mem.CountTransactions()
+}
+
+func (s *fileStore) ListTransactions(q listQuery) ([]Transaction, error) {
+	return s.mem.ListTransactions(q)
+}
+
+func (s *fileStore) PutStandingOrder(o standingOrder) error {
+	return s.append(logRecord{Op: opPutOrder, Order: &o})
+}
+
+func (s *fileStore) GetStandingOrder(id string) (standingOrder, bool, error) {
+	return s.mem.GetStandingOrder(id)
+}
+
+func (s *fileStore) ListStandingOrders() ([]standingOrder, error) {
+	return s.mem.ListStandingOrders()
+}
+
+func (s *fileStore) PutAccount(a account) error {
+	return s.append(logRecord{Op: opPutAcct, Acct: &a})
+}
+
+func (s *fileStore) GetAccount(id string) (account, bool, error) {
+	return s.mem.GetAccount(id)
+}
+
+func (s *fileStore) AppendAudit(e auditEntry) error {
+	// check the sequence before writing: a gap in the log would fail the next replay
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mem.MuTransactions.RLock()
+	n := int64(len(s.mem.Audit))
+	s.mem.MuTransactions.RUnlock()
+	if e.Seq != n+1 {
+		return fmt.Errorf("audit entry %d out of sequence, log is at %d", e.Seq, n)
+	}
+	rec := logRecord{Op: opAudit, Audit: &e}
+	if err := s.appendLocked(rec); err != nil {
+		return err
+	}
+	return s.mem.apply(rec)
+}
+
+func (s *fileStore) ListAudit(after int64, limit int) ([]auditEntry, error) {
+	return s.mem.ListAudit(after, limit)
+}
+
+func (s *fileStore) LastAudit() (auditEntry, bool, error) {
+	return s.mem.LastAudit()
+}
+
+func (s *fileStore) ListOutbox(after int64, limit int) ([]outboxEntry, error) {
+	return s.mem.ListOutbox(after, limit)
+}
+
+func (s *fileStore) LastOutboxSeq() (int64, error) {
+	return s.mem.LastOutboxSeq()
+}
+
+func (s *fileStore) OutboxOffset(sink string) (int64, error) {
+	return s.mem.OutboxOffset(sink)
+}
+
+func (s *fileStore) PutOutboxOffset(sink string, seq int64) error {
+	if err := s.append(logRecord{Op: opOutboxOff, Key: sink, Offset: seq}); err != nil {
+		return err
+	}
+	s.compactIfDue()
+	return nil
+}
+
+// PruneOutbox drops the entries from memory; the log keeps them until the next
+// compaction, so a restart before it only lists them again.
+func (s *fileStore) PruneOutbox(through int64) error {
+	if err := s.mem.PruneOutbox(through); err != nil {
+		return err
+	}
+	s.compactIfDue()
+	return nil
+}
+
+func (s *fileStore) LookupIdem(key, hash string) (idemRecord, idemResult, error) {
+	return s.mem.LookupIdem(key, hash)
+}
+
+func (s *fileStore) PutIdem(key string, rec idemRecord) error {
+	return s.append(logRecord{Op: opPutIdem, Key: key, Idem: &rec})
+}
+
+func (s *fileStore) DeleteIdem(key string) error {
+	return s.append(logRecord{Op: opDelIdem, Key: key})
+}
+
+func (s *fileStore) SweepIdem(cutoff time.Time) (int, error) {
+	// the log only grows when there is something to sweep
+	if !s.mem.idemCache.expiresBefore(cutoff) {
+		return 0, nil
+	}
+	s.mu.Lock()
+	if err := s.appendLocked(logRecord{Op: opSweepIdem, Cutoff: &cutoff}); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	n, _ := s.mem.SweepIdem(cutoff)
+	s.mu.Unlock()
+
+	if err := s.maybeCompact(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (s *fileStore) IdemStats() idemStats {
+	return s.mem.IdemStats()
+}
+
+// maybeCompact compacts once the log holds well over twice the live records.
+func (s *fileStore) maybeCompact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.records < compactMinRecords {
+		return nil
+	}
+	s.mem.MuTransactions.RLock()
+	live := len(s.mem.Transactions) + len(s.mem.StandingOrders) + len(s.mem.Accounts) + len(s.mem.Audit) +
+		len(s.mem.Outbox) + len(s.mem.OutboxOffsets) + s.mem.idemCache.len()
+	s.mem.MuTransactions.RUnlock()
+
+	if s.records < 2*live {
+		return nil
+	}
+	return s.compactLocked()
+}
+
+// compactIfDue is maybeCompact after a write that has succeeded whether or not
+// the compaction does: a failure only leaves the log longer.
+func (s *fileStore) compactIfDue() {
+	if err := s.maybeCompact(); err != nil {
+		log.Printf("store: compacting %s: %v", s.path, err)
+	}
+}
+
+// Compact rewrites the log as one record per live transaction, standing order,
+// account, audit entry, outbox entry and offset, and idempotency record; pruned
+// outbox entries are left out. The snapshot goes to a temp file that replaces the log atomically.
+func (s *fileStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	return s.compactLocked()
+}
+
+func (s *fileStore) compactLocked() error {
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // no-op after a successful rename
+
+	// appends are blocked by s.mu, so the snapshot is consistent with the log
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	records := 0
+	s.mem.MuTransactions.RLock()
+	for _, t := range s.mem.Transactions {
+		t := t
+		if err = enc.Encode(logRecord{Op: opPutTx, Tx: &t}); err != nil {
+			break
+		}
+		records++
+	}
+	for _, o := range s.mem.StandingOrders {
+		if err != nil {
+			break
+		}
+		o := o
+		err = enc.Encode(logRecord{Op: opPutOrder, Order: &o})
+		records++
+	}
+	for _, a := range s.mem.Accounts {
+		if err != nil {
+			break
+		}
+		a := a
+		err = enc.Encode(logRecord{Op: opPutAcct, Acct: &a})
+		records++
+	}
+	for _, e := range s.mem.Audit { // in order: replay checks the sequence
+		if err != nil {
+			break
+		}
+		e := e
+		err = enc.Encode(logRecord{Op: opAudit, Audit: &e})
+		records++
+	}
+	if err == nil && s.mem.OutboxPruned > 0 {
+		err = enc.Encode(logRecord{Op: opPruneOut, Offset: s.mem.OutboxPruned})
+		records++
+	}
+	for _, e := range s.mem.Outbox { // in order, like the audit log
+		if err != nil {
+			break
+		}
+		err = enc.Encode(logRecord{Op: opOutbox, Events: []outboxEntry{e}})
+		records++
+	}
+	for sink, seq := range s.mem.OutboxOffsets {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(logRecord{Op: opOutboxOff, Key: sink, Offset: seq})
+		records++
+	}
+	if err == nil {
+		s.mem.idemCache.each(func(k string, rec idemRecord) {
+			if err == nil {
+				err = enc.Encode(logRecord{Op: opPutIdem, Key: k, Idem: &rec})
+				records++
+			}
+		})
+	}
+	s.mem.MuTransactions.RUnlock()
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = f
+	s.records = records
+
+	return nil
+}
+
+// syncDir makes a rename durable. Some platforms can't fsync directories; that is not fatal.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
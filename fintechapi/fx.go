@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Foreign exchange
+// A transfer to a registered account held in another currency than the
+// transfer's is converted (see accounts.go). The transaction keeps what was sent
+// (amount_minor, currency) and records what arrives (to_amount_minor,
+// to_currency) and the rate applied (fx_rate, to_currency per currency).
+//
+// Rates come from a local JSON file, re-read when it changes like the rules:
+//
+//	{
+//	  "rounding": "half_even",
+//	  "rates": [
+//	    {"base": "EUR", "quote": "USD", "rate": "1.0842", "effective_at": "2025-03-01T00:00:00Z"}
+//	  ]
+//	}
+//
+// A transfer uses the newest rate of its pair effective at its booking time. A
+// pair only listed the other way round uses the inverse. The converted amount is
+// rounded to the minor unit of the target currency: half_even (default),
+// half_up or down.
+//
+// POST /fx/quotes locks the current rate for an amount for the quote TTL; a
+// transfer created with its fx_quote_id before then gets exactly the quoted
+// amount. A quote is used once, by the client that asked for it. Scheduled and
+// batched transfers convert at the rate of their booking time.
+//
+// A reversal of a converted transfer is in the received currency and converts
+// back pro rata to the original amounts, so a full reversal returns exactly what
+// was sent.
+
+const defaultFXQuoteTTL = 30 * time.Second
+
+const (
+	roundingHalfEven = "half_even"
+	roundingHalfUp   = "half_up"
+	roundingDown     = "down"
+)
+
+// Failure reasons of scheduled transfers that could not be converted.
+const (
+	reasonCurrencyMismatch = "currency_mismatch"
+	reasonFXRateMissing    = "fx_rate_unavailable"
+)
+
+var (
+	errFXRateUnavailable = errors.New("no usable exchange rate")
+	errFXQuoteExpired    = errors.New("the quote has expired")
+	errFXQuoteUsed       = errors.New("the quote has already been used")
+)
+
+type fxRateFile struct {
+	Rounding string `json:"rounding,omitempty"`
+	Rates    []struct {
+		Base        string    `json:"base"`
+		Quote       string    `json:"quote"`
+		Rate        string    `json:"rate"`
+		EffectiveAt time.Time `json:"effective_at"`
+	} `json:"rates"`
+}
+
+type fxRate struct {
+	effectiveAt time.Time
+	rate        *big.Rat
+	text        string // as written in the file
+}
+
+// fxTable is a parsed rate file.
+type fxTable struct {
+	rounding string
+	rates    map[[2]string][]fxRate // [base, quote] -> oldest first
+}
+
+func parseFXRates(b []byte) (*fxTable, error) {
+	var f fxRateFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	tb := &fxTable{rounding: f.Rounding, rates: make(map[[2]string][]fxRate)}
+	switch tb.rounding {
+	case "":
+		tb.rounding = roundingHalfEven
+	case roundingHalfEven, roundingHalfUp, roundingDown:
+	default:
+		return nil, fmt.Errorf("rounding must be %q, %q or %q, got %q", roundingHalfEven, roundingHalfUp, roundingDown, f.Rounding)
+	}
+	for i, r := range f.Rates {
+		base, _, err := normalizeCurrency(r.Base)
+		if err != nil {
+			return nil, fmt.Errorf("rates[%d]: base %q: %w", i, r.Base, err)
+		}
+		quote, _, err := normalizeCurrency(r.Quote)
+		if err != nil {
+			return nil, fmt.Errorf("rates[%d]: quote %q: %w", i, r.Quote, err)
+		}
+		if base == quote {
+			return nil, fmt.Errorf("rates[%d]: base and quote are both %s", i, base)
+		}
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(r.Rate))
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("rates[%d]: rate must be a positive decimal, got %q", i, r.Rate)
+		}
+		if r.EffectiveAt.IsZero() {
+			return nil, fmt.Errorf("rates[%d]: effective_at is required", i)
+		}
+		pair := [2]string{base, quote}
+		tb.rates[pair] = append(tb.rates[pair], fxRate{effectiveAt: r.EffectiveAt.UTC(), rate: rate, text: strings.TrimSpace(r.Rate)})
+	}
+	for _, rates := range tb.rates {
+		slices.SortStableFunc(rates, func(a, b fxRate) int { return a.effectiveAt.Compare(b.effectiveAt) })
+	}
+	return tb, nil
+}
+
+// rate returns the rate from one currency to another effective at at, and how
+// it is recorded on a transaction.
+func (tb *fxTable) rate(from, to string, at time.Time) (*big.Rat, string, error) {
+	if r, ok := effective(tb.rates[[2]string{from, to}], at); ok {
+		return r.rate, r.text, nil
+	}
+	if r, ok := effective(tb.rates[[2]string{to, from}], at); ok {
+		inv := new(big.Rat).Inv(r.rate)
+		return inv, formatRate(inv), nil
+	}
+	return nil, "", fmt.Errorf("%w from %s to %s at %s", errFXRateUnavailable, from, to, at.UTC().Format(time.RFC3339))
+}
+
+// effective is the newest of rates (oldest first) that is in effect at at.
+func effective(rates []fxRate, at time.Time) (fxRate, bool) {
+	i, _ := slices.BinarySearchFunc(rates, at, func(r fxRate, at time.Time) int {
+		if r.effectiveAt.After(at) {
+			return 1
+		}
+		return -1
+	})
+	if i == 0 {
+		return fxRate{}, false
+	}
+	return rates[i-1], true
+}
+
+// convert converts amount minor units of from into minor units of to at the
+// rate effective at at.
+func (tb *fxTable) convert(amount int64, from, to string, at time.Time) (int64, string, error) {
+	rate, text, err := tb.rate(from, to, at)
+	if err != nil {
+		return 0, "", err
+	}
+	x := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), rate)
+	x.Mul(x, minorScale(from, to))
+	converted, ok := roundRat(x, tb.rounding)
+	if !ok {
+		return 0, "", fmt.Errorf("%w: %s is out of range in %s", errFXRateUnavailable, Money{amount, from}, to)
+	}
+	return converted, text, nil
+}
+
+// minorScale turns a rate between major units into one between minor units.
+func minorScale(from, to string) *big.Rat {
+	diff := currencyExponent[to] - currencyExponent[from]
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(max(diff, -diff))), nil)
+	if diff < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), pow)
+	}
+	return new(big.Rat).SetInt(pow)
+}
+
+// roundRat rounds a non-negative x to an integer; ok is false when it does not
+// fit an int64.
+func roundRat(x *big.Rat, mode string) (int64, bool) {
+	q, r := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+	if mode != roundingDown {
+		switch new(big.Int).Lsh(r, 1).Cmp(x.Denom()) {
+		case 1:
+			q.Add(q, big.NewInt(1))
+		case 0:
+			if mode == roundingHalfUp || q.Bit(0) == 1 {
+				q.Add(q, big.NewInt(1))
+			}
+		}
+	}
+	return q.Int64(), q.IsInt64()
+}
+
+// formatRate renders a computed rate with up to 10 decimals.
+func formatRate(r *big.Rat) string {
+	s := strings.TrimRight(r.FloatString(10), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// fxEngine holds the active rate table and reloads it from its file.
+type fxEngine = reloadable[fxTable]
+
+func newFXEngine() *fxEngine {
+	return newReloadable("fx rates", parseFXRates, &fxTable{rounding: roundingHalfEven})
+}
+
+// quotes
+
+type fxQuote struct {
+	ID           string    `json:"id"`
+	ClientID     string    `json:"-"`
+	FromCurrency string    `json:"from_currency"`
+	ToCurrency   string    `json:"to_currency"`
+	Amount       int64     `json:"amount_minor"`
+	ToAmount     int64     `json:"to_amount_minor"`
+	Rate         string    `json:"rate"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	used         bool
+}
+
+// fxQuotes holds the quotes handed out; they live in memory only, a restart
+// expires them all.
+type fxQuotes struct {
+	mu  sync.Mutex
+	m   map[string]*fxQuote
+	ttl time.Duration
+	now func() time.Time // injectable clock
+}
+
+func newFXQuotes(ttl time.Duration) *fxQuotes {
+	return &fxQuotes{m: make(map[string]*fxQuote), ttl: ttl, now: time.Now}
+}
+
+// add stores q with its expiry and drops the quotes that expired a TTL ago: until
+// then, using one still tells the client it expired.
+func (qs *fxQuotes) add(q fxQuote) fxQuote {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	now := qs.now().UTC()
+	for id, old := range qs.m {
+		if now.Sub(old.ExpiresAt) > qs.ttl {
+			delete(qs.m, id)
+		}
+	}
+	q.ID, q.CreatedAt, q.ExpiresAt = newID(), now, now.Add(qs.ttl)
+	qs.m[q.ID] = &q
+	return q
+}
+
+// take marks quote id of client as used and returns it.
+func (qs *fxQuotes) take(id, clientID string) (*fxQuote, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q, ok := qs.m[id]
+	switch {
+	case !ok || q.ClientID != clientID:
+		return nil, validationError{{"fx_quote_id", "unknown quote"}}
+	case q.used:
+		return nil, errFXQuoteUsed
+	case !qs.now().Before(q.ExpiresAt):
+		return nil, errFXQuoteExpired
+	}
+	q.used = true
+	taken := *q
+	return &taken, nil
+}
+
+// release makes a taken quote usable again after the transfer was not stored.
+func (qs *fxQuotes) release(q *fxQuote) {
+	if q == nil {
+		return
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if stored, ok := qs.m[q.ID]; ok {
+		stored.used = false
+	}
+}
+
+// convert sets the received side of t when its receiving account is held in
+// another currency, at the rate of q if given, else at the rate of t.At.
+func (svc *service) convert(t *Transaction, q *fxQuote) error {
+	from, err := svc.accountCurrency(t.FromAccountID)
+	if err != nil {
+		return err
+	}
+	if from != "" && from != t.Currency {
+		return validationError{{"currency", "must be " + from + ", the currency of account " + t.FromAccountID}}
+	}
+	to, err := svc.accountCurrency(t.ToAccountID)
+	if err != nil {
+		return err
+	}
+	if to == "" || to == t.Currency {
+		if q != nil {
+			return validationError{{"fx_quote_id", "the transfer needs no conversion"}}
+		}
+		return nil
+	}
+
+	if q != nil {
+		if q.FromCurrency != t.Currency || q.ToCurrency != to || q.Amount != t.Amount {
+			return validationError{{"fx_quote_id", fmt.Sprintf("the quote is for %s to %s", Money{q.Amount, q.FromCurrency}, q.ToCurrency)}}
+		}
+		t.ToAmount, t.ToCurrency, t.FXRate, t.FXQuoteID = q.ToAmount, to, q.Rate, q.ID
+		return nil
+	}
+	amount, rate, err := svc.fx.current().convert(t.Amount, t.Currency, to, t.At)
+	if err != nil {
+		return err
+	}
+	t.ToAmount, t.ToCurrency, t.FXRate = amount, to, rate
+	return nil
+}
+
+// fxProblem is the problem for an error of convert or take.
+func fxProblem(err error) *problem {
+	var invalid validationError
+	switch {
+	case errors.As(err, &invalid):
+		return invalidProblem(err)
+	case errors.Is(err, errFXRateUnavailable):
+		return newProblem(codeFXRateUnavailable, err.Error())
+	case errors.Is(err, errFXQuoteExpired):
+		return newProblem(codeFXQuoteExpired, err.Error())
+	case errors.Is(err, errFXQuoteUsed):
+		return newProblem(codeFXQuoteUsed, err.Error())
+	default:
+		return newProblem(codeInternal, "could not convert transaction")
+	}
+}
+
+// fxFailureReason is the failure reason of a scheduled transfer that convert
+// refused; ok is false for errors that are not the transfer's fault.
+func fxFailureReason(err error) (reason string, ok bool) {
+	var invalid validationError
+	switch {
+	case errors.As(err, &invalid):
+		return reasonCurrencyMismatch, true
+	case errors.Is(err, errFXRateUnavailable):
+		return reasonFXRateMissing, true
+	}
+	return "", false
+}
+
+// received is what arrives on the receiving account of t.
+func (t Transaction) received() (int64, string) {
+	if t.ToCurrency != "" {
+		return t.ToAmount, t.ToCurrency
+	}
+	return t.Amount, t.Currency
+}
+
+// convertBack is the amount in orig's sent currency that a reversal of amount
+// (received currency) returns: pro rata to the original amounts.
+func (svc *service) convertBack(orig Transaction, amount int64) int64 {
+	x := new(big.Rat).SetFrac(new(big.Int).Mul(big.NewInt(orig.Amount), big.NewInt(amount)), big.NewInt(orig.ToAmount))
+	back, _ := roundRat(x, svc.fx.current().rounding) // at most orig.Amount
+	return back
+}
+
+type fxQuoteRequest struct {
+	FromCurrency string        `json:"from_currency"`
+	ToCurrency   string        `json:"to_currency"`
+	Amount       decimalAmount `json:"amount"` // major units of from_currency
+}
+
+func createFXQuote(w http.ResponseWriter, r *http.Request, svc *service) {
+	var in fxQuoteRequest
+	if err := bindJSON(r, &in); err != nil {
+		writeError(w, codeMalformedRequest, "bad request")
+		return
+	}
+	var invalids validationError
+	from, _, err := normalizeCurrency(in.FromCurrency)
+	if err != nil {
+		invalids = append(invalids, invalidParam{"from_currency", "must be a supported ISO 4217 code"})
+	} else if m, err := ParseMoney(string(in.Amount), from); err != nil || m.Minor <= 0 {
+		invalids = append(invalids, invalidParam{"amount", "must be a positive amount in the currency's minor unit"})
+	}
+	to, _, err := normalizeCurrency(in.ToCurrency)
+	switch {
+	case err != nil:
+		invalids = append(invalids, invalidParam{"to_currency", "must be a supported ISO 4217 code"})
+	case to == from:
+		invalids = append(invalids, invalidParam{"to_currency", "must differ from from_currency"})
+	}
+	if len(invalids) > 0 {
+		writeInvalid(w, invalids)
+		return
+	}
+
+	amount, _ := ParseMoney(string(in.Amount), from) // already validated
+	converted, rate, err := svc.fx.current().convert(amount.Minor, from, to, svc.quotes.now().UTC())
+	if err != nil {
+		writeProblem(w, fxProblem(err))
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	q := svc.quotes.add(fxQuote{ClientID: p.ClientID, FromCurrency: from, ToCurrency: to, Amount: amount.Minor, ToAmount: converted, Rate: rate})
+	writeJSON(w, http.StatusCreated, q)
+}
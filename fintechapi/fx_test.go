@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseFXRates(t *testing.T) {
+	for name, in := range map[string]string{
+		"Rounding":     `{"rounding":"up","rates":[]}`,
+		"Currency":     `{"rates":[{"base":"EUR","quote":"XXX","rate":"1","effective_at":"2025-01-01T00:00:00Z"}]}`,
+		"SamePair":     `{"rates":[{"base":"EUR","quote":"eur","rate":"1","effective_at":"2025-01-01T00:00:00Z"}]}`,
+		"ZeroRate":     `{"rates":[{"base":"EUR","quote":"USD","rate":"0","effective_at":"2025-01-01T00:00:00Z"}]}`,
+		"NotANumber":   `{"rates":[{"base":"EUR","quote":"USD","rate":"1,08","effective_at":"2025-01-01T00:00:00Z"}]}`,
+		"NoEffective":  `{"rates":[{"base":"EUR","quote":"USD","rate":"1.08"}]}`,
+		"UnknownField": `{"rates":[],"spread":"0.01"}`,
+	} {
+		if _, err := parseFXRates([]byte(in)); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestFXTable_Convert(t *testing.T) {
+	tb, err := parseFXRates([]byte(`{"rates":[
+		{"base":"EUR","quote":"USD","rate":"1.1000","effective_at":"2025-06-01T00:00:00Z"},
+		{"base":"EUR","quote":"USD","rate":"1.0842","effective_at":"2025-01-01T00:00:00Z"},
+		{"base":"USD","quote":"JPY","rate":"150","effective_at":"2025-01-01T00:00:00Z"}
+	]}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	march := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		Name     string
+		Amount   int64
+		From, To string
+		At       time.Time
+		Want     int64
+		Rate     string
+	}{
+		{Name: "Direct", Amount: 10000, From: "EUR", To: "USD", At: march, Want: 10842, Rate: "1.0842"},
+		{Name: "NewerRate", Amount: 10000, From: "EUR", To: "USD", At: march.AddDate(0, 4, 0), Want: 11000, Rate: "1.1000"},
+		{Name: "AtEffectiveTime", Amount: 10000, From: "EUR", To: "USD", At: time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), Want: 11000, Rate: "1.1000"},
+		{Name: "Inverse", Amount: 10842, From: "USD", To: "EUR", At: march, Want: 10000, Rate: "0.9223390518"},
+		{Name: "MinorUnits", Amount: 100, From: "USD", To: "JPY", At: march, Want: 150, Rate: "150"},
+		{Name: "RoundsToCent", Amount: 1, From: "JPY", To: "USD", At: march, Want: 1, Rate: "0.0066666667"},
+	} {
+		got, rate, err := tb.convert(test.Amount, test.From, test.To, test.At)
+		if err != nil || got != test.Want || rate != test.Rate {
+			t.Errorf("%s: want %d at %s, got %d at %s (%v)", test.Name, test.Want, test.Rate, got, rate, err)
+		}
+	}
+	if _, _, err := tb.convert(100, "EUR", "USD", march.AddDate(-1, 0, 0)); err == nil {
+		t.Errorf("before the first rate: want error")
+	}
+	if _, _, err := tb.convert(100, "EUR", "JPY", march); err == nil {
+		t.Errorf("unknown pair: want error")
+	}
+}
+
+func TestFXTable_Rounding(t *testing.T) {
+	for mode, want := range map[string][2]int64{
+		roundingHalfEven: {2, 4},
+		roundingHalfUp:   {2, 5},
+		roundingDown:     {1, 4},
+	} {
+		tb, err := parseFXRates([]byte(`{"rounding":"` + mode + `","rates":[{"base":"EUR","quote":"USD","rate":"1.5","effective_at":"2025-01-01T00:00:00Z"}]}`))
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		for i, amount := range []int64{1, 3} { // 1.5 and 4.5 cents
+			if got, _, _ := tb.convert(amount, "EUR", "USD", time.Now()); got != want[i] {
+				t.Errorf("%s: %d cents: want %d, got %d", mode, amount, want[i], got)
+			}
+		}
+	}
+}
+
+// newFXServer is a test server with A1 in EUR, A2 in USD, A3 in JPY and EUR/USD
+// at rate.
+func newFXServer(t *testing.T, rate string) (*httptest.Server, *service, string) {
+	t.Helper()
+
+	ts, svc := newTestServer(t)
+	for id, currency := range map[string]string{"A1": "EUR", "A2": "USD", "A3": "JPY"} {
+		if res, body := putJSON(t, ts.URL+"/accounts/"+id, map[string]any{"currency": currency}); res.StatusCode != http.StatusCreated {
+			t.Fatalf("account %s: %d %s", id, res.StatusCode, string(body))
+		}
+	}
+	path := filepath.Join(t.TempDir(), "rates.json")
+	writeFXRates(t, svc, path, rate)
+	return ts, svc, path
+}
+
+func writeFXRates(t *testing.T, svc *service, path, rate string) {
+	t.Helper()
+	writeRules(t, path, `{"rates":[{"base":"EUR","quote":"USD","rate":"`+rate+`","effective_at":"2000-01-01T00:00:00Z"}]}`)
+	if err := svc.fx.loadFile(path); err != nil {
+		t.Fatalf("load rates: %v", err)
+	}
+}
+
+func TestAPI_FXTransfer(t *testing.T) {
+	ts, _, _ := newFXServer(t, "1.25")
+	tx := func(from, to, amount, currency string) map[string]any {
+		return map[string]any{"from_account_id": from, "to_account_id": to, "amount": amount, "currency": currency}
+	}
+
+	res, body := postJSON(t, ts.URL+"/transactions", tx("A1", "A2", "10.00", "EUR"), nil)
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusAccepted || tr.Amount != 1000 || tr.Currency != "EUR" || tr.ToAmount != 1250 || tr.ToCurrency != "USD" || tr.FXRate != "1.25" {
+		t.Fatalf("expected 10.00 EUR -> 12.50 USD, got %d body=%s", res.StatusCode, string(body))
+	}
+
+	for _, test := range []struct {
+		Name string
+		In   map[string]any
+		Code string
+	}{
+		{Name: "WrongSourceCurrency", In: tx("A1", "A2", "10.00", "USD"), Code: codeValidationFailed},
+		{Name: "NoRate", In: tx("A1", "A3", "10.00", "EUR"), Code: codeFXRateUnavailable},
+	} {
+		res, body := postJSON(t, ts.URL+"/transactions", test.In, nil)
+		if p := decodeProblem(t, res, body); p.Code != test.Code {
+			t.Errorf("%s: want %s, got %+v", test.Name, test.Code, p)
+		}
+	}
+
+	// unregistered accounts are never converted
+	res, body = postJSON(t, ts.URL+"/transactions", tx("Z1", "A2", "10.00", "EUR"), nil)
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusAccepted || tr.ToCurrency != "USD" {
+		t.Errorf("to a USD account: expected a conversion, got %d body=%s", res.StatusCode, string(body))
+	}
+	res, body = postJSON(t, ts.URL+"/transactions", tx("Z1", "Z2", "10.00", "EUR"), nil)
+	var plain Transaction
+	if _ = json.Unmarshal(body, &plain); res.StatusCode != http.StatusAccepted || plain.ToCurrency != "" || plain.FXRate != "" {
+		t.Errorf("between unregistered accounts: expected no conversion, got %d body=%s", res.StatusCode, string(body))
+	}
+
+	status, out := postBatch(t, ts.URL, false, []map[string]any{tx("A1", "A2", "2.00", "EUR"), tx("A1", "A3", "2.00", "EUR")}, nil)
+	if status != http.StatusMultiStatus || out.Items[0].Transaction == nil || out.Items[0].Transaction.ToAmount != 250 || out.Items[1].Status != http.StatusUnprocessableEntity {
+		t.Errorf("batch: expected the first item converted and the second without rate, got %d %+v", status, out.Items)
+	}
+}
+
+func TestAPI_FXReversal(t *testing.T) {
+	ts, _, _ := newFXServer(t, "1.25")
+	res, body := postJSON(t, ts.URL+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "10.00", "currency": "EUR"}, nil)
+	var orig Transaction
+	_ = json.Unmarshal(body, &orig)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("create: %d %s", res.StatusCode, string(body))
+	}
+
+	// the reversal is in the received currency
+	res, rev := reverseTx(t, ts, orig.ID, map[string]any{"amount": "5.00"}, nil)
+	if res.StatusCode != http.StatusAccepted || rev.Amount != 500 || rev.Currency != "USD" || rev.ToAmount != 400 || rev.ToCurrency != "EUR" || rev.FXRate != "0.8" {
+		t.Fatalf("partial: expected 5.00 USD -> 4.00 EUR, got %d %+v", res.StatusCode, rev)
+	}
+	res, rev = reverseTx(t, ts, orig.ID, nil, nil)
+	if res.StatusCode != http.StatusAccepted || rev.Amount != 750 || rev.ToAmount != 600 {
+		t.Errorf("rest: expected 7.50 USD -> 6.00 EUR, got %d %+v", res.StatusCode, rev)
+	}
+	if res, _ := reverseTx(t, ts, orig.ID, map[string]any{"amount": "0.01"}, nil); res.StatusCode != http.StatusConflict {
+		t.Errorf("nothing left: expected 409, got %d", res.StatusCode)
+	}
+}
+
+func TestAPI_FXQuotes(t *testing.T) {
+	ts, svc, path := newFXServer(t, "1.25")
+	clock := &fakeClock{now: time.Now().UTC()}
+	svc.quotes.now = clock.Now
+
+	quote := func(amount string) fxQuote {
+		t.Helper()
+		res, body := postJSON(t, ts.URL+"/fx/quotes", map[string]any{"from_currency": "EUR", "to_currency": "USD", "amount": amount}, nil)
+		var q fxQuote
+		_ = json.Unmarshal(body, &q)
+		if res.StatusCode != http.StatusCreated || q.ID == "" {
+			t.Fatalf("quote: expected 201, got %d body=%s", res.StatusCode, string(body))
+		}
+		return q
+	}
+	create := func(q fxQuote, amount string, headers map[string]string) (*http.Response, []byte) {
+		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": amount, "currency": "EUR", "fx_quote_id": q.ID}
+		return postJSON(t, ts.URL+"/transactions", in, headers)
+	}
+
+	q := quote("10.00")
+	if q.ToAmount != 1250 || q.Rate != "1.25" || !q.ExpiresAt.Equal(q.CreatedAt.Add(defaultFXQuoteTTL)) {
+		t.Errorf("unexpected quote %+v", q)
+	}
+
+	// the quote holds while the rates move
+	writeFXRates(t, svc, path, "1.50")
+	res, body := create(q, "20.00", nil)
+	if p := decodeProblem(t, res, body); p.Code != codeValidationFailed {
+		t.Errorf("other amount: want validation_failed, got %+v", p)
+	}
+	res, body = create(q, "10.00", map[string]string{apiKeyHeader: otherAPIKey})
+	if p := decodeProblem(t, res, body); p.Code != codeValidationFailed {
+		t.Errorf("other client: want validation_failed, got %+v", p)
+	}
+	res, body = create(q, "10.00", nil)
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusAccepted || tr.ToAmount != 1250 || tr.FXRate != "1.25" || tr.FXQuoteID != q.ID {
+		t.Fatalf("with quote: expected 12.50 USD at 1.25, got %d body=%s", res.StatusCode, string(body))
+	}
+	res, body = create(q, "10.00", nil)
+	if p := decodeProblem(t, res, body); p.Code != codeFXQuoteUsed {
+		t.Errorf("second use: want fx_quote_used, got %+v", p)
+	}
+
+	q = quote("10.00")
+	clock.now = clock.now.Add(defaultFXQuoteTTL)
+	res, body = create(q, "10.00", nil)
+	if p := decodeProblem(t, res, body); p.Code != codeFXQuoteExpired {
+		t.Errorf("expired: want fx_quote_expired, got %+v", p)
+	}
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "10.00", "currency": "EUR", "fx_quote_id": quote("10.00").ID,
+		"execute_at": clock.now.Add(time.Hour)}
+	if res, _ := postJSON(t, ts.URL+"/transactions", in, nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("quote with execute_at: expected 400, got %d", res.StatusCode)
+	}
+	res, body = postJSON(t, ts.URL+"/fx/quotes", map[string]any{"from_currency": "EUR", "to_currency": "JPY", "amount": "1"}, nil)
+	if p := decodeProblem(t, res, body); p.Code != codeFXRateUnavailable {
+		t.Errorf("quote without rate: want fx_rate_unavailable, got %+v", p)
+	}
+	res, body = postJSON(t, ts.URL+"/fx/quotes", map[string]any{"from_currency": "EUR", "to_currency": "EUR", "amount": "1"}, nil)
+	if p := decodeProblem(t, res, body); p.Code != codeValidationFailed {
+		t.Errorf("same currency: want validation_failed, got %+v", p)
+	}
+}
+
+func TestScheduler_FailsWithoutRate(t *testing.T) {
+	svc := newService(NewConStore(), testAuth())
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	svc.schedule.now = clock.Now
+	_ = svc.store.PutAccount(account{ID: "A1", Currency: "EUR"})
+	_ = svc.store.PutAccount(account{ID: "A3", Currency: "JPY"})
+
+	o := standingOrder{ID: "o1", FromAccountID: "A1", ToAccountID: "A3", Amount: 500, Currency: "EUR",
+		Frequency: FrequencyOnce, StartAt: clock.now, CreatedAt: clock.now}
+	o.advance()
+	_ = svc.store.PutStandingOrder(o)
+	if err := svc.schedule.runDue(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	tr, ok, _ := svc.store.GetTransaction("o1-0")
+	if !ok || tr.Status != StatusFailed || tr.FailureReason != reasonFXRateMissing {
+		t.Errorf("expected a failed transaction with %s, got %+v", reasonFXRateMissing, tr)
+	}
+}
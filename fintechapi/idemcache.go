@@ -0,0 +1,242 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Idempotency cache
+// A bounded map of idempotency records. Entries are capped by count and by an
+// approximate byte budget; when either is exceeded the least recently used entry
+// goes. A min-heap on CreatedAt (expiry order, as every record shares one TTL)
+// lets a sweep stop at the first record that is still fresh.
+
+const (
+	defaultIdemMaxEntries = 100_000
+	defaultIdemMaxBytes   = 64 << 20
+	idemEntryOverhead     = 256 // rough per-entry cost of the map, list and heap nodes
+)
+
+// idemResult is the outcome of looking up an idempotency key with a fingerprint.
+type idemResult int
+
+const (
+	idemMiss     idemResult = iota // key unknown: first request
+	idemHit                        // same key, same payload: replay
+	idemConflict                   // same key, different payload
+	idemInFlight                   // same key, first request still running (middleware only)
+)
+
+// idemStats are the cache counters; they only ever grow, except Entries and Bytes.
+type idemStats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Conflicts uint64 `json:"conflicts"`
+	Evictions uint64 `json:"evictions"` // dropped by the LRU to respect the caps
+	Expired   uint64 `json:"expired"`   // dropped by a sweep
+}
+
+type idemEntry struct {
+	key       string
+	rec       idemRecord
+	size      int64
+	heapIndex int
+}
+
+type idemCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu     sync.Mutex
+	items  map[string]*list.Element // values are *idemEntry
+	lru    *list.List               // front is most recently used
+	expiry expiryHeap
+	bytes  int64
+
+	hits, misses, conflicts, evictions, expired atomic.Uint64
+}
+
+func newIdemCache(maxEntries int, maxBytes int64) *idemCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultIdemMaxEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultIdemMaxBytes
+	}
+	return &idemCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func entrySize(key string, rec idemRecord) int64 {
+	n := len(key) + len(rec.Hash) + len(rec.Body)
+	for k, vs := range rec.Header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+	return int64(n) + idemEntryOverhead
+}
+
+// lookup finds key and compares its fingerprint with hash, counting the outcome.
+func (c *idemCache) lookup(key, hash string) (idemRecord, idemResult) {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	var rec idemRecord
+	if ok {
+		c.lru.MoveToFront(el)
+		rec = el.Value.(*idemEntry).rec
+	}
+	c.mu.Unlock()
+
+	switch {
+	case !ok:
+		c.misses.Add(1)
+		return idemRecord{}, idemMiss
+	case rec.Hash != hash:
+		c.conflicts.Add(1)
+		return rec, idemConflict
+	default:
+		c.hits.Add(1)
+		return rec, idemHit
+	}
+}
+
+// get returns the record for key without touching the counters or the LRU order.
+func (c *idemCache) get(key string) (idemRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		return el.Value.(*idemEntry).rec, true
+	}
+	return idemRecord{}, false
+}
+
+func (c *idemCache) put(key string, rec idemRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := entrySize(key, rec)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*idemEntry)
+		c.bytes += size - e.size
+		e.rec, e.size = rec, size
+		heap.Fix(&c.expiry, e.heapIndex)
+		c.lru.MoveToFront(el)
+	} else {
+		e := &idemEntry{key: key, rec: rec, size: size}
+		c.items[key] = c.lru.PushFront(e)
+		heap.Push(&c.expiry, e)
+		c.bytes += size
+	}
+
+	// evict from the cold end; the entry just written is kept even if it alone
+	// exceeds the byte budget, so the current request can still be replayed
+	for (len(c.items) > c.maxEntries || c.bytes > c.maxBytes) && c.lru.Len() > 1 {
+		c.removeLocked(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *idemCache) delete(key string) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.removeLocked(el)
+	}
+	c.mu.Unlock()
+}
+
+// sweep drops records created before cutoff. It pops the expiry heap and stops at
+// the first fresh record, so its cost follows the number of expired records.
+func (c *idemCache) sweep(cutoff time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for len(c.expiry) > 0 && c.expiry[0].rec.CreatedAt.Before(cutoff) {
+		c.removeLocked(c.items[c.expiry[0].key])
+		n++
+	}
+	c.expired.Add(uint64(n))
+	return n
+}
+
+// expiresBefore reports whether a sweep with cutoff would remove anything.
+func (c *idemCache) expiresBefore(cutoff time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.expiry) > 0 && c.expiry[0].rec.CreatedAt.Before(cutoff)
+}
+
+func (c *idemCache) removeLocked(el *list.Element) {
+	e := el.Value.(*idemEntry)
+	c.lru.Remove(el)
+	heap.Remove(&c.expiry, e.heapIndex)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
+
+// each calls fn for every record; fn must not call back into the cache.
+func (c *idemCache) each(fn func(key string, rec idemRecord)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Back(); el != nil; el = el.Prev() { // oldest first, so a replay keeps the LRU order
+		e := el.Value.(*idemEntry)
+		fn(e.key, e.rec)
+	}
+}
+
+func (c *idemCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+func (c *idemCache) stats() idemStats {
+	c.mu.Lock()
+	entries, bytes := len(c.items), c.bytes
+	c.mu.Unlock()
+	return idemStats{
+		Entries:   entries,
+		Bytes:     bytes,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Conflicts: c.conflicts.Load(),
+		Evictions: c.evictions.Load(),
+		Expired:   c.expired.Load(),
+	}
+}
+
+// expiryHeap orders entries by CreatedAt, oldest on top.
+type expiryHeap []*idemEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].rec.CreatedAt.Before(h[j].rec.CreatedAt) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	e := x.(*idemEntry)
+	e.heapIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdemCache_EvictsLeastRecentlyUsedByCount(t *testing.T) {
+	c := newIdemCache(3, 1<<20)
+	t0 := time.Now()
+	for i := 0; i < 3; i++ {
+		c.put("k"+strconv.Itoa(i), idemRecord{Hash: "h", CreatedAt: t0})
+	}
+
+	// touch k0 so k1 becomes the coldest entry
+	if _, res := c.lookup("k0", "h"); res != idemHit {
+		t.Fatalf("k0: want hit, got %v", res)
+	}
+	c.put("k3", idemRecord{Hash: "h", CreatedAt: t0})
+
+	if _, ok := c.get("k1"); ok {
+		t.Errorf("k1 should have been evicted")
+	}
+	for _, k := range []string{"k0", "k2", "k3"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("%s should still be cached", k)
+		}
+	}
+	if st := c.stats(); st.Entries != 3 || st.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestIdemCache_EvictsUnderMemoryPressure(t *testing.T) {
+	body := []byte(strings.Repeat("x", 1000))
+	budget := int64(5 * (len(body) + idemEntryOverhead + 16))
+	c := newIdemCache(1000, budget)
+
+	for i := 0; i < 50; i++ {
+		c.put("key-"+strconv.Itoa(i), idemRecord{Hash: "h", Body: body, CreatedAt: time.Now()})
+		if st := c.stats(); st.Bytes > budget {
+			t.Fatalf("after %d puts: %d bytes exceed budget %d", i+1, st.Bytes, budget)
+		}
+	}
+
+	st := c.stats()
+	if st.Entries == 0 || st.Entries > 5 {
+		t.Errorf("expected at most 5 entries within the byte budget, got %d", st.Entries)
+	}
+	if st.Evictions != uint64(50-st.Entries) {
+		t.Errorf("expected %d evictions, got %d", 50-st.Entries, st.Evictions)
+	}
+	if _, ok := c.get("key-49"); !ok {
+		t.Errorf("newest entry should survive")
+	}
+
+	// a single record larger than the budget is kept so its request can replay
+	huge := []byte(strings.Repeat("y", int(budget)))
+	c.put("huge", idemRecord{Hash: "h", Body: huge, CreatedAt: time.Now()})
+	if _, ok := c.get("huge"); !ok || c.len() != 1 {
+		t.Errorf("oversized record should replace everything else, have %d entries", c.len())
+	}
+}
+
+func TestIdemCache_SweepTouchesOnlyExpired(t *testing.T) {
+	c := newIdemCache(100, 1<<20)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	// insert out of order: the expiry index, not insertion order, drives the sweep
+	for _, m := range []int{30, 10, 50, 20, 40} {
+		c.put("k"+strconv.Itoa(m), idemRecord{Hash: "h", CreatedAt: t0.Add(time.Duration(m) * time.Minute)})
+	}
+
+	if c.expiresBefore(t0) {
+		t.Errorf("nothing is older than t0")
+	}
+	if n := c.sweep(t0.Add(25 * time.Minute)); n != 2 {
+		t.Fatalf("want 2 expired, got %d", n)
+	}
+	for _, k := range []string{"k10", "k20"} {
+		if _, ok := c.get(k); ok {
+			t.Errorf("%s should have expired", k)
+		}
+	}
+	for _, k := range []string{"k30", "k40", "k50"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("%s should still be cached", k)
+		}
+	}
+	if st := c.stats(); st.Expired != 2 || st.Evictions != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	// overwriting a record moves it in the expiry index
+	c.put("k30", idemRecord{Hash: "h", CreatedAt: t0.Add(time.Hour)})
+	if n := c.sweep(t0.Add(45 * time.Minute)); n != 1 {
+		t.Errorf("want only k40 to expire, got %d", n)
+	}
+	if _, ok := c.get("k30"); !ok {
+		t.Errorf("refreshed k30 should survive")
+	}
+}
+
+func TestIdemCache_LookupCounters(t *testing.T) {
+	c := newIdemCache(10, 1<<20)
+	c.put("k", idemRecord{Hash: "h1", CreatedAt: time.Now()})
+
+	c.lookup("k", "h1")
+	c.lookup("k", "h1")
+	c.lookup("k", "h2")
+	c.lookup("missing", "h1")
+
+	st := c.stats()
+	if st.Hits != 2 || st.Conflicts != 1 || st.Misses != 1 {
+		t.Errorf("unexpected counters %+v", st)
+	}
+}
+
+func TestIdempotency_ConflictCountedThroughAPI(t *testing.T) {
+	ts, svc := newTestServer(t)
+	headers := map[string]string{"Idempotency-Key": "stats-key"}
+
+	postJSON(t, ts.URL+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1.00", "currency": "EUR"}, headers)
+	postJSON(t, ts.URL+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1.00", "currency": "EUR"}, headers)
+	postJSON(t, ts.URL+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "2.00", "currency": "EUR"}, headers)
+
+	st := svc.store.IdemStats()
+	if st.Misses != 1 || st.Hits != 1 || st.Conflicts != 1 || st.Entries != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Idempotency middleware
+// Any mutating route opts in with one line:
+//
+//	mux.Handle("POST /things", svc.idempotent(http.HandlerFunc(h), nil))
+//
+// The first request with an Idempotency-Key runs the handler and its full response
+// (status, selected headers, body) is recorded. Later requests with the same key
+// and payload get that response replayed; a different payload gets 409. While the
+// first request is still running, a retry gets 409 with Retry-After instead of
+// waiting or running twice. 5xx responses are not recorded, so they can be retried.
+
+const (
+	maxBodyBytes       = 1 << 20 // request bodies are buffered to fingerprint them
+	inFlightRetryAfter = 1       // seconds
+)
+
+// idemReplayHeaders are the response headers recorded and replayed with the body.
+var idemReplayHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// canonicalizer maps a request body to the form it is fingerprinted in, so that
+// equivalent payloads ("10.5" and "10.50") share a key. An error falls back to
+// the raw body; the handler then rejects it and that rejection is recorded.
+type canonicalizer func(body []byte) ([]byte, error)
+
+// inFlight tracks keys whose first request has not produced a response yet.
+type inFlight struct {
+	mu sync.Mutex
+	m  map[string]string // key -> fingerprint
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{m: make(map[string]string)}
+}
+
+func (f *inFlight) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fp, ok := f.m[key]
+	return fp, ok
+}
+
+func (f *inFlight) set(key, fp string) {
+	f.mu.Lock()
+	f.m[key] = fp
+	f.mu.Unlock()
+}
+
+func (f *inFlight) clear(key string) {
+	f.mu.Lock()
+	delete(f.m, key)
+	f.mu.Unlock()
+}
+
+// fingerprint hashes method, path and (canonical) body of a request.
+func fingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(path))
+	h.Write([]byte{'\n'})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent wraps next with Idempotency-Key handling; requests without the header
+// pass straight through. canon may be nil to fingerprint the raw body.
+func (svc *service) idempotent(next http.Handler, canon canonicalizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key") // idempotency-key is optional
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// records, locks and in-flight markers are per caller
+		key = scopedIdemKey(r.Context(), key)
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+		if err != nil {
+			writeError(w, codeMalformedRequest, "could not read request body")
+			return
+		}
+		if len(body) > maxBodyBytes {
+			writeError(w, codeBodyTooLarge, "request body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fpBody := body
+		if canon != nil {
+			if c, err := canon(body); err == nil {
+				fpBody = c
+			}
+		}
+		fp := fingerprint(r.Method, r.URL.Path, fpBody)
+
+		rec, res, err := svc.reserveKey(key, fp)
+		if err != nil {
+			writeError(w, codeInternal, "could not read idempotency record")
+			return
+		}
+		switch res {
+		case idemHit:
+			svc.metrics.idemReplays.inc()
+			replay(w, rec)
+			return
+		case idemConflict:
+			svc.metrics.idemConflicts.inc("payload_mismatch")
+			writeError(w, codeIdempotencyMismatch, "idempotency key reuse with different payload")
+			return
+		case idemInFlight:
+			svc.metrics.idemConflicts.inc("in_flight")
+			w.Header().Set("Retry-After", strconv.Itoa(inFlightRetryAfter))
+			writeError(w, codeIdempotencyInFlight, "a request with this idempotency key is still in progress")
+			return
+		}
+		defer svc.inFlight.clear(key)
+
+		rw := &recordingWriter{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		if rw.status < http.StatusInternalServerError {
+			rec := idemRecord{
+				Hash:       fp,
+				StatusCode: rw.status,
+				Header:     make(http.Header),
+				Body:       rw.body.Bytes(),
+				CreatedAt:  time.Now(),
+			}
+			for _, h := range idemReplayHeaders {
+				if v := rw.header.Values(h); len(v) > 0 {
+					rec.Header[h] = v
+				}
+			}
+			if err := svc.store.PutIdem(key, rec); err != nil {
+				writeError(w, codeInternal, "could not store idempotency record")
+				return
+			}
+		}
+
+		// the response is written after every lock has been released
+		for k, v := range rw.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rw.status)
+		_, _ = w.Write(rw.body.Bytes())
+	})
+}
+
+// reserveKey decides what to do with a keyed request. On a miss the key is marked
+// in flight; the caller clears it once the response is recorded. Only requests
+// with the same key wait for each other, and only for the lookup.
+func (svc *service) reserveKey(key, fp string) (idemRecord, idemResult, error) {
+	unlockKey := svc.keyLocks.acquire(key)
+	defer unlockKey()
+
+	rec, res, err := svc.store.LookupIdem(key, fp)
+	if err != nil || res != idemMiss {
+		return rec, res, err
+	}
+	if running, ok := svc.inFlight.get(key); ok {
+		if running != fp {
+			return idemRecord{}, idemConflict, nil
+		}
+		return idemRecord{}, idemInFlight, nil
+	}
+	svc.inFlight.set(key, fp)
+
+	return idemRecord{}, idemMiss, nil
+}
+
+func replay(w http.ResponseWriter, rec idemRecord) {
+	for k, v := range rec.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(rec.StatusCode)
+	_, _ = w.Write(rec.Body)
+}
+
+// recordingWriter buffers a response so it can be stored before it is sent.
+type recordingWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *recordingWriter) Header() http.Header { return rw.header }
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.status = status
+	rw.wroteHeader = true
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.body.Write(b)
+}
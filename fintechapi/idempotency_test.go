@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newIdempotentServer wraps h in the middleware on POST /things and /other.
+func newIdempotentServer(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	svc := newService(NewConStore(), nil)
+	mux := http.NewServeMux()
+	mux.Handle("POST /things", svc.idempotent(h, nil))
+	mux.Handle("POST /other", svc.idempotent(h, nil))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func postRaw(t *testing.T, url, body, key string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res, string(b)
+}
+
+func TestIdempotent_ReplaysFullResponse(t *testing.T) {
+	calls := 0
+	ts := newIdempotentServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", "/things/1")
+		w.Header().Set("X-Not-Recorded", "x")
+		writeJSON(w, http.StatusCreated, map[string]int{"call": calls})
+	})
+
+	res1, body1 := postRaw(t, ts.URL+"/things", `{"a":1}`, "k")
+	res2, body2 := postRaw(t, ts.URL+"/things", `{"a":1}`, "k")
+
+	if calls != 1 {
+		t.Fatalf("handler ran %d times", calls)
+	}
+	if res2.StatusCode != http.StatusCreated || body2 != body1 {
+		t.Errorf("replay mismatch: %d %q vs %d %q", res2.StatusCode, body2, res1.StatusCode, body1)
+	}
+	if res2.Header.Get("Location") != "/things/1" || res2.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("selected headers not replayed: %v", res2.Header)
+	}
+	if res2.Header.Get("X-Not-Recorded") != "" {
+		t.Errorf("unselected header replayed")
+	}
+	if res2.Header.Get("Idempotent-Replayed") != "true" || res1.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("only the replay should be marked")
+	}
+}
+
+func TestIdempotent_RecordsClientErrorsButNotServerErrors(t *testing.T) {
+	code := codeRuleViolation // 422
+	calls := 0
+	ts := newIdempotentServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeError(w, code, "nope")
+	})
+
+	postRaw(t, ts.URL+"/things", `{}`, "k4")
+	res, _ := postRaw(t, ts.URL+"/things", `{}`, "k4")
+	if calls != 1 || res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("4xx should be recorded and replayed: calls=%d status=%d", calls, res.StatusCode)
+	}
+
+	code = codeInternal // 500
+	postRaw(t, ts.URL+"/things", `{}`, "k5")
+	postRaw(t, ts.URL+"/things", `{}`, "k5")
+	if calls != 3 {
+		t.Errorf("5xx should not be recorded, handler ran %d times", calls)
+	}
+}
+
+func TestIdempotent_FingerprintCoversMethodPathAndBody(t *testing.T) {
+	ts := newIdempotentServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, nil)
+	})
+
+	postRaw(t, ts.URL+"/things", `{"a":1}`, "k")
+	if res, _ := postRaw(t, ts.URL+"/things", `{"a":2}`, "k"); res.StatusCode != http.StatusConflict {
+		t.Errorf("different body: want 409, got %d", res.StatusCode)
+	}
+	if res, _ := postRaw(t, ts.URL+"/other", `{"a":1}`, "k"); res.StatusCode != http.StatusConflict {
+		t.Errorf("different path: want 409, got %d", res.StatusCode)
+	}
+}
+
+func TestIdempotent_InFlightGets409WithRetryAfter(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := newIdempotentServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		writeJSON(w, http.StatusCreated, map[string]string{"ok": "yes"})
+	})
+
+	first := make(chan int)
+	go func() {
+		res, _ := postRaw(t, ts.URL+"/things", `{"a":1}`, "slow")
+		first <- res.StatusCode
+	}()
+	<-started
+
+	res, _ := postRaw(t, ts.URL+"/things", `{"a":1}`, "slow")
+	if res.StatusCode != http.StatusConflict || res.Header.Get("Retry-After") == "" {
+		t.Errorf("in-flight retry: want 409 with Retry-After, got %d %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	res, _ = postRaw(t, ts.URL+"/things", `{"a":2}`, "slow")
+	if res.StatusCode != http.StatusConflict || res.Header.Get("Retry-After") != "" {
+		t.Errorf("in-flight mismatch: want plain 409, got %d", res.StatusCode)
+	}
+
+	close(release)
+	select {
+	case code := <-first:
+		if code != http.StatusCreated {
+			t.Fatalf("first request: want 201, got %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("first request did not finish")
+	}
+
+	res, _ = postRaw(t, ts.URL+"/things", `{"a":1}`, "slow")
+	if res.StatusCode != http.StatusCreated || res.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("after completion: want replayed 201, got %d", res.StatusCode)
+	}
+}
+
+func TestIdempotent_NoKeyPassesThrough(t *testing.T) {
+	calls := 0
+	ts := newIdempotentServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNoContent)
+	})
+	postRaw(t, ts.URL+"/things", `{}`, "")
+	postRaw(t, ts.URL+"/things", `{}`, "")
+	if calls != 2 {
+		t.Errorf("requests without a key must not be deduplicated, handler ran %d times", calls)
+	}
+}
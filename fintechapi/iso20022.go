@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ISO 20022 payment files
+// GET /transactions/export/pain.001?id=..&id=.. renders the selected transactions
+// as a pain.001.001.09 customer credit transfer initiation, one payment
+// information block per sending account and day. Account IDs go to Othr/Id.
+// POST /transactions/import/pain.001 takes such a file (versions .03 to .09) and
+// books its instructions as one atomic batch, see batch.go. The file's MsgId is
+// its idempotency key: sending a file again replays the first response, another
+// file with the same MsgId is a 409. Errors in a single instruction are reported
+// per instruction and nothing is booked; errors in the group header fail the file.
+// Requested execution dates in the future are not supported.
+
+const (
+	pain001Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.001.001.09"
+	pain001Prefix    = "urn:iso:std:iso:20022:tech:xsd:pain.001."
+	maxISOTextLen    = 35 // Max35Text: MsgId, PmtInfId, EndToEndId
+)
+
+type pain001Document struct {
+	XMLName xml.Name          `xml:"Document"`
+	Xmlns   string            `xml:"xmlns,attr,omitempty"`
+	Initn   pain001Initiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001Initiation struct {
+	GrpHdr pain001GroupHeader `xml:"GrpHdr"`
+	PmtInf []pain001PmtInf    `xml:"PmtInf"`
+}
+
+type pain001GroupHeader struct {
+	MsgID    string   `xml:"MsgId"`
+	CreDtTm  string   `xml:"CreDtTm"`
+	NbOfTxs  string   `xml:"NbOfTxs"`
+	CtrlSum  string   `xml:"CtrlSum,omitempty"`
+	InitgPty isoParty `xml:"InitgPty"`
+}
+
+type pain001PmtInf struct {
+	PmtInfID    string         `xml:"PmtInfId"`
+	PmtMtd      string         `xml:"PmtMtd"`
+	NbOfTxs     string         `xml:"NbOfTxs,omitempty"`
+	CtrlSum     string         `xml:"CtrlSum,omitempty"`
+	ReqdExctnDt isoDate        `xml:"ReqdExctnDt"`
+	Dbtr        isoParty       `xml:"Dbtr"`
+	DbtrAcct    isoAccount     `xml:"DbtrAcct"`
+	DbtrAgt     isoAgent       `xml:"DbtrAgt"`
+	CdtTrfTxInf []pain001CdtTx `xml:"CdtTrfTxInf"`
+}
+
+type pain001CdtTx struct {
+	PmtID    isoPaymentID `xml:"PmtId"`
+	Amt      isoAmount    `xml:"Amt"`
+	Cdtr     isoParty     `xml:"Cdtr"`
+	CdtrAcct isoAccount   `xml:"CdtrAcct"`
+}
+
+type isoParty struct {
+	Nm string `xml:"Nm,omitempty"`
+}
+
+type isoAgent struct {
+	FinInstnID struct {
+		BICFI string `xml:"BICFI,omitempty"`
+		Othr  *struct {
+			ID string `xml:"Id"`
+		} `xml:"Othr,omitempty"`
+	} `xml:"FinInstnId"`
+}
+
+type isoAccount struct {
+	ID struct {
+		IBAN string `xml:"IBAN,omitempty"`
+		Othr *struct {
+			ID string `xml:"Id"`
+		} `xml:"Othr,omitempty"`
+	} `xml:"Id"`
+}
+
+func newISOAccount(id string) isoAccount {
+	var a isoAccount
+	a.ID.Othr = &struct {
+		ID string `xml:"Id"`
+	}{id}
+	return a
+}
+
+// account is the IBAN or the other identification, whichever is there.
+func (a isoAccount) account() string {
+	if iban := strings.TrimSpace(a.ID.IBAN); iban != "" {
+		return iban
+	}
+	if a.ID.Othr != nil {
+		return strings.TrimSpace(a.ID.Othr.ID)
+	}
+	return ""
+}
+
+// isoDate is a date (version .03) or a choice of Dt and DtTm (version .08 on).
+type isoDate struct {
+	Text string `xml:",chardata"`
+	Dt   string `xml:"Dt,omitempty"`
+	DtTm string `xml:"DtTm,omitempty"`
+}
+
+// date is the day requested, or the zero time when none is given.
+func (d isoDate) date() (time.Time, error) {
+	switch {
+	case d.Dt != "":
+		return time.Parse(time.DateOnly, strings.TrimSpace(d.Dt))
+	case d.DtTm != "":
+		return time.Parse(time.RFC3339, strings.TrimSpace(d.DtTm))
+	case strings.TrimSpace(d.Text) != "":
+		return time.Parse(time.DateOnly, strings.TrimSpace(d.Text))
+	}
+	return time.Time{}, nil
+}
+
+type isoPaymentID struct {
+	InstrID    string `xml:"InstrId,omitempty"`
+	EndToEndID string `xml:"EndToEndId"`
+}
+
+type isoAmount struct {
+	InstdAmt struct {
+		Ccy   string `xml:"Ccy,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"InstdAmt"`
+}
+
+// instruction is one credit transfer of an imported file.
+type instruction struct {
+	endToEndID string
+	item       transactionRequest
+	err        string // schema error, empty when fine
+}
+
+func parsePain001(body []byte) (pain001Document, error) {
+	var doc pain001Document
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return doc, fmt.Errorf("malformed pain.001: %w", err)
+	}
+	if !strings.HasPrefix(doc.XMLName.Space, pain001Prefix) {
+		return doc, fmt.Errorf("not a pain.001 document: namespace %q", doc.XMLName.Space)
+	}
+	return doc, nil
+}
+
+// instructions checks the group header and flattens the payment information
+// blocks. An error means the file as a whole is unusable.
+func (doc pain001Document) instructions(now time.Time) ([]instruction, error) {
+	hdr := doc.Initn.GrpHdr
+	if id := strings.TrimSpace(hdr.MsgID); id == "" || len(id) > maxISOTextLen {
+		return nil, fmt.Errorf("GrpHdr/MsgId: must be 1 to %d characters", maxISOTextLen)
+	}
+
+	var out []instruction
+	sum := new(big.Rat)
+	today := now.UTC().Format(time.DateOnly)
+	for _, pi := range doc.Initn.PmtInf {
+		// errors of the block apply to each of its instructions
+		var blockErr string
+		switch date, err := pi.ReqdExctnDt.date(); {
+		case strings.TrimSpace(pi.PmtMtd) != "TRF":
+			blockErr = "PmtInf/PmtMtd: must be TRF"
+		case pi.DbtrAcct.account() == "":
+			blockErr = "PmtInf/DbtrAcct: missing account identification"
+		case err != nil:
+			blockErr = "PmtInf/ReqdExctnDt: invalid date"
+		case date.UTC().Format(time.DateOnly) > today:
+			blockErr = "PmtInf/ReqdExctnDt: execution in the future is not supported"
+		}
+		if pi.NbOfTxs != "" && pi.NbOfTxs != strconv.Itoa(len(pi.CdtTrfTxInf)) && blockErr == "" {
+			blockErr = "PmtInf/NbOfTxs: does not match the number of CdtTrfTxInf"
+		}
+
+		for _, tx := range pi.CdtTrfTxInf {
+			in := instruction{
+				endToEndID: strings.TrimSpace(tx.PmtID.EndToEndID),
+				item: transactionRequest{
+					FromAccountID: pi.DbtrAcct.account(),
+					ToAccountID:   tx.CdtrAcct.account(),
+					Amount:        decimalAmount(strings.TrimSpace(tx.Amt.InstdAmt.Value)),
+					Currency:      strings.TrimSpace(tx.Amt.InstdAmt.Ccy),
+				},
+				err: blockErr,
+			}
+			if amount, ok := new(big.Rat).SetString(string(in.item.Amount)); ok {
+				sum.Add(sum, amount)
+			}
+			if in.err == "" {
+				in.err = in.check()
+			}
+			out = append(out, in)
+		}
+	}
+
+	switch {
+	case len(out) == 0:
+		return nil, fmt.Errorf("no CdtTrfTxInf")
+	case len(out) > maxBatchItems:
+		return nil, fmt.Errorf("a file has 1 to %d instructions", maxBatchItems)
+	case strings.TrimSpace(hdr.NbOfTxs) != strconv.Itoa(len(out)):
+		return nil, fmt.Errorf("GrpHdr/NbOfTxs: %q does not match %d instructions", hdr.NbOfTxs, len(out))
+	}
+	if hdr.CtrlSum != "" {
+		ctrl, ok := new(big.Rat).SetString(strings.TrimSpace(hdr.CtrlSum))
+		if !ok || ctrl.Cmp(sum) != 0 {
+			return nil, fmt.Errorf("GrpHdr/CtrlSum: %q does not match the sum of the instructions", hdr.CtrlSum)
+		}
+	}
+	return out, nil
+}
+
+// check reports schema errors of one instruction; business validation is left
+// to the batch.
+func (in instruction) check() string {
+	switch {
+	case in.endToEndID == "" || len(in.endToEndID) > maxISOTextLen:
+		return fmt.Sprintf("PmtId/EndToEndId: must be 1 to %d characters", maxISOTextLen)
+	case in.item.ToAccountID == "":
+		return "CdtrAcct: missing account identification"
+	case in.item.Currency == "":
+		return "InstdAmt: missing Ccy"
+	case in.item.Amount == "":
+		return "InstdAmt: missing amount"
+	}
+	return ""
+}
+
+// pain001Key makes the MsgId of an imported file its idempotency key, for the
+// idempotent handler next.
+func pain001Key(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+		if err != nil {
+			writeError(w, codeMalformedRequest, "could not read request body")
+			return
+		}
+		if len(body) > maxBodyBytes {
+			writeError(w, codeBodyTooLarge, "request body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		doc, err := parsePain001(body)
+		if err != nil {
+			writeError(w, codeInvalidDocument, err.Error())
+			return
+		}
+		if id := strings.TrimSpace(doc.Initn.GrpHdr.MsgID); id != "" {
+			r.Header.Set("Idempotency-Key", "pain.001:"+id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canonicalPain001Body is the canonicalizer of pain.001 imports: the
+// instructions as a batch, so formatting and header details don't matter.
+func canonicalPain001Body(body []byte) ([]byte, error) {
+	doc, err := parsePain001(body)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, pi := range doc.Initn.PmtInf {
+		for _, tx := range pi.CdtTrfTxInf {
+			c, err := canonicalTransaction(transactionRequest{
+				FromAccountID: pi.DbtrAcct.account(),
+				ToAccountID:   tx.CdtrAcct.account(),
+				Amount:        decimalAmount(strings.TrimSpace(tx.Amt.InstdAmt.Value)),
+				Currency:      tx.Amt.InstdAmt.Ccy,
+			})
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, "%s %s\n", strings.TrimSpace(tx.PmtID.EndToEndID), c)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func importPain001(w http.ResponseWriter, r *http.Request, svc *service) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, codeMalformedRequest, "could not read request body")
+		return
+	}
+	doc, err := parsePain001(body)
+	if err != nil {
+		writeError(w, codeInvalidDocument, err.Error())
+		return
+	}
+	ins, err := doc.instructions(time.Now())
+	if err != nil {
+		writeError(w, codeInvalidDocument, err.Error())
+		return
+	}
+
+	items := make([]transactionRequest, len(ins))
+	invalid := make([]string, len(ins))
+	for i, in := range ins {
+		items[i], invalid[i] = in.item, in.err
+	}
+	p, _ := principalFrom(r.Context())
+	status, out, err := svc.runBatch(p, true, items, invalid)
+	if err != nil {
+		writeError(w, codeInternal, "could not store transactions")
+		return
+	}
+	out.MsgID = strings.TrimSpace(doc.Initn.GrpHdr.MsgID)
+	for i := range out.Items {
+		out.Items[i].EndToEndID = ins[i].endToEndID
+	}
+	writeJSON(w, status, out)
+}
+
+func exportPain001(w http.ResponseWriter, r *http.Request, svc *service) {
+	ids := r.URL.Query()["id"]
+	if len(ids) == 0 || len(ids) > maxBatchItems {
+		writeInvalid(w, validationError{{Name: "id", Reason: fmt.Sprintf("select 1 to %d transactions", maxBatchItems)}})
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	txs := make([]Transaction, 0, len(ids))
+	for _, id := range ids {
+		t, ok, err := svc.store.GetTransaction(id)
+		if err != nil {
+			writeError(w, codeInternal, "could not read transaction")
+			return
+		}
+		if !ok || !p.canSee(t) {
+			writeError(w, codeNotFound, "transaction "+id+" does not exist")
+			return
+		}
+		if t.Status == StatusFailed {
+			writeError(w, codeTransactionFailed, "transaction "+id+" has failed")
+			return
+		}
+		txs = append(txs, t)
+	}
+
+	doc := newPain001(txs, p.ClientID, time.Now().UTC())
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+doc.Initn.GrpHdr.MsgID+`.xml"`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	_ = enc.Encode(doc)
+}
+
+// newPain001 builds the document for txs, grouped by sending account and day in
+// the order they first appear.
+func newPain001(txs []Transaction, initiator string, now time.Time) pain001Document {
+	doc := pain001Document{Xmlns: pain001Namespace}
+	doc.XMLName.Local = "Document"
+	hdr := &doc.Initn.GrpHdr
+	hdr.MsgID = newID()
+	hdr.CreDtTm = now.Format(time.RFC3339)
+	hdr.NbOfTxs = strconv.Itoa(len(txs))
+	hdr.InitgPty.Nm = initiator
+
+	total := new(big.Rat)
+	block := map[string]int{} // account and day -> index in PmtInf
+	for _, t := range txs {
+		day := t.At.UTC().Format(time.DateOnly)
+		key := t.FromAccountID + "\x00" + day
+		i, ok := block[key]
+		if !ok {
+			i = len(doc.Initn.PmtInf)
+			block[key] = i
+			pi := pain001PmtInf{
+				PmtInfID: fmt.Sprintf("%s-%d", hdr.MsgID[:24], i+1),
+				PmtMtd:   "TRF",
+				DbtrAcct: newISOAccount(t.FromAccountID),
+			}
+			pi.ReqdExctnDt.Dt = day
+			pi.DbtrAgt.FinInstnID.Othr = &struct {
+				ID string `xml:"Id"`
+			}{"NOTPROVIDED"}
+			doc.Initn.PmtInf = append(doc.Initn.PmtInf, pi)
+		}
+		pi := &doc.Initn.PmtInf[i]
+
+		amount := Money{Minor: t.Amount, Currency: t.Currency}.Decimal()
+		var tx pain001CdtTx
+		tx.PmtID.EndToEndID = t.ID
+		tx.Amt.InstdAmt.Ccy = t.Currency
+		tx.Amt.InstdAmt.Value = amount
+		tx.CdtrAcct = newISOAccount(t.ToAccountID)
+		pi.CdtTrfTxInf = append(pi.CdtTrfTxInf, tx)
+
+		r, _ := new(big.Rat).SetString(amount)
+		total.Add(total, r)
+	}
+	for i := range doc.Initn.PmtInf {
+		pi := &doc.Initn.PmtInf[i]
+		pi.NbOfTxs = strconv.Itoa(len(pi.CdtTrfTxInf))
+		sum := new(big.Rat)
+		for _, tx := range pi.CdtTrfTxInf {
+			r, _ := new(big.Rat).SetString(tx.Amt.InstdAmt.Value)
+			sum.Add(sum, r)
+		}
+		pi.CtrlSum = formatRat(sum)
+	}
+	hdr.CtrlSum = formatRat(total)
+	return doc
+}
+
+// formatRat renders a sum of decimal amounts without trailing zeros.
+func formatRat(r *big.Rat) string {
+	s := r.FloatString(4) // no currency has more than 4 decimals
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readSample(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	return b
+}
+
+func postXML(t *testing.T, url string, body []byte, authorization string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", authorization)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", url, err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+
+	return res, data
+}
+
+func TestPain001_Instructions(t *testing.T) {
+	doc, err := parsePain001(readSample(t, "pain001_v03.xml"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	ins, err := doc.instructions(time.Now())
+	if err != nil || len(ins) != 1 {
+		t.Fatalf("instructions: %v %+v", err, ins)
+	}
+	want := transactionRequest{FromAccountID: "DE89370400440532013000", ToAccountID: "GB29NWBK60161331926819", Amount: "1200", Currency: "JPY"}
+	if !reflect.DeepEqual(ins[0].item, want) || ins[0].endToEndID != "INV-7" || ins[0].err != "" {
+		t.Errorf("unexpected instruction %+v", ins[0])
+	}
+
+	// a future execution date is reported per instruction
+	future := strings.Replace(string(readSample(t, "pain001_v03.xml")), "2024-06-03</ReqdExctnDt>", "2999-01-01</ReqdExctnDt>", 1)
+	doc, _ = parsePain001([]byte(future))
+	if ins, err = doc.instructions(time.Now()); err != nil || !strings.Contains(ins[0].err, "ReqdExctnDt") {
+		t.Errorf("want a ReqdExctnDt error, got %v %+v", err, ins)
+	}
+
+	for _, bad := range []string{
+		`<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.08"/>`,
+		`<Document`,
+	} {
+		if _, err := parsePain001([]byte(bad)); err == nil {
+			t.Errorf("%s: want error", bad)
+		}
+	}
+}
+
+func TestAPI_ImportPain001(t *testing.T) {
+	t.Run("BookedAsOneBatch", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		file := readSample(t, "pain001_v09.xml")
+
+		res, body := postXML(t, ts.URL+"/transactions/import/pain.001", file, adminBearer)
+		var out batchResponse
+		_ = json.Unmarshal(body, &out)
+		if res.StatusCode != http.StatusAccepted || out.MsgID != "PAYROLL-2025-01" || len(out.Items) != 3 {
+			t.Fatalf("expected 202 with 3 items, got %d body=%s", res.StatusCode, string(body))
+		}
+		last := out.Items[2]
+		if last.EndToEndID != "EXPENSES-001" || last.Transaction == nil || last.Transaction.FromAccountID != "A4" || last.Transaction.Amount != 25025 {
+			t.Errorf("unexpected last item %+v", last)
+		}
+
+		// the same file again is a replay, keyed by MsgId
+		res, again := postXML(t, ts.URL+"/transactions/import/pain.001", file, adminBearer)
+		if res.StatusCode != http.StatusAccepted || !bytes.Equal(again, body) {
+			t.Errorf("expected a replay, got %d body=%s", res.StatusCode, string(again))
+		}
+		if counts, _ := svc.store.CountTransactions(); counts[StatusPending] != 3 {
+			t.Errorf("want 3 transactions, got %v", counts)
+		}
+
+		// another file under the same MsgId
+		changed := bytes.Replace(file, []byte("250.25"), []byte("250.26"), 1)
+		changed = bytes.Replace(changed, []byte("3250.75"), []byte("3250.76"), 1)
+		if res, body := postXML(t, ts.URL+"/transactions/import/pain.001", changed, adminBearer); res.StatusCode != http.StatusConflict {
+			t.Errorf("expected 409, got %d body=%s", res.StatusCode, string(body))
+		}
+	})
+
+	t.Run("ErrorsPerInstruction", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		res, body := postXML(t, ts.URL+"/transactions/import/pain.001", readSample(t, "pain001_invalid_instructions.xml"), adminBearer)
+		var out batchResponse
+		_ = json.Unmarshal(body, &out)
+		if got := statuses(out); res.StatusCode != http.StatusBadRequest || len(got) != 4 || got[0] != 424 || got[1] != 400 || got[2] != 400 || got[3] != 400 {
+			t.Fatalf("expected 400 with [424 400 400 400], got %d body=%s", res.StatusCode, string(body))
+		}
+		for i, want := range []string{"", "EndToEndId", "Ccy", "PmtMtd"} {
+			if e := out.Items[i].Error; e == nil || !strings.Contains(e.Detail, want) {
+				t.Errorf("item %d: want an error about %s, got %+v", i, want, e)
+			}
+		}
+		if out.Items[2].EndToEndID != "NO-CCY" {
+			t.Errorf("items should carry their EndToEndId, got %+v", out.Items[2])
+		}
+		if counts, _ := svc.store.CountTransactions(); len(counts) != 0 {
+			t.Errorf("nothing may be stored, got %v", counts)
+		}
+	})
+
+	t.Run("BadHeader", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		res, body := postXML(t, ts.URL+"/transactions/import/pain.001", readSample(t, "pain001_bad_header.xml"), adminBearer)
+		if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "NbOfTxs") {
+			t.Errorf("expected 400 about NbOfTxs, got %d body=%s", res.StatusCode, string(body))
+		}
+	})
+
+	t.Run("OnlyOwnAccounts", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		res, body := postXML(t, ts.URL+"/transactions/import/pain.001", readSample(t, "pain001_v09.xml"), bearer("alice", "", "A1"))
+		var out batchResponse
+		_ = json.Unmarshal(body, &out)
+		if got := statuses(out); res.StatusCode != http.StatusForbidden || len(got) != 3 || got[0] != 424 || got[2] != 403 {
+			t.Errorf("A4 is not alice's: expected 403 with [424 424 403], got %d body=%s", res.StatusCode, string(body))
+		}
+	})
+}
+
+func TestAPI_ExportPain001(t *testing.T) {
+	ts, _ := newTestServer(t)
+	a := createTx(t, ts, "A1", "A2")
+	b := createTx(t, ts, "A1", "A3")
+	c := createTx(t, ts, "A4", "A2")
+
+	url := ts.URL + "/transactions/export/pain.001?id=" + a.ID + "&id=" + b.ID + "&id=" + c.ID
+	res, body := get(t, url)
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "application/xml") {
+		t.Fatalf("expected 200 xml, got %d %s body=%s", res.StatusCode, res.Header.Get("Content-Type"), string(body))
+	}
+	if !bytes.Contains(body, []byte(`<Document xmlns="`+pain001Namespace+`">`)) {
+		t.Errorf("missing namespace in\n%s", string(body))
+	}
+
+	doc, err := parsePain001(body)
+	if err != nil {
+		t.Fatalf("parse export: %v", err)
+	}
+	if len(doc.Initn.PmtInf) != 2 || doc.Initn.PmtInf[0].NbOfTxs != "2" {
+		t.Errorf("want one block per sending account, got %+v", doc.Initn.PmtInf)
+	}
+	ins, err := doc.instructions(time.Now())
+	if err != nil || len(ins) != 3 {
+		t.Fatalf("the export should pass its own checks: %v", err)
+	}
+	for i, tr := range []Transaction{a, b, c} {
+		m, _ := ParseMoney(string(ins[i].item.Amount), ins[i].item.Currency)
+		if ins[i].endToEndID != tr.ID || ins[i].item.FromAccountID != tr.FromAccountID || ins[i].item.ToAccountID != tr.ToAccountID || m.Minor != tr.Amount {
+			t.Errorf("instruction %d does not match %+v: %+v", i, tr, ins[i])
+		}
+	}
+
+	if res, _ := getWith(t, url, bearer("alice", "", "A1")); res.StatusCode != http.StatusNotFound {
+		t.Errorf("c is not alice's: expected 404, got %d", res.StatusCode)
+	}
+	if res, _ := get(t, ts.URL+"/transactions/export/pain.001"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("no ids: expected 400, got %d", res.StatusCode)
+	}
+}
@@ -3,18 +3,21 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math"
+	"net"
 	"net/http"
-	"sort"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -25,50 +28,56 @@ const (
 )
 
 var (
-	idemTTL       = 24 * time.Hour
-	sweepInterval = 5 * time.Minute
+	idemTTL        = 24 * time.Hour
+	sweepInterval  = 5 * time.Minute
+	idemMaxEntries = defaultIdemMaxEntries
+	idemMaxBytes   = int64(defaultIdemMaxBytes)
 )
 
 // persistency and exchange types
-
-// conStore is an in-memory concurrency-safe store guarded by an RWmutex
-type conStore struct {
-	MuTransactions sync.RWMutex
-	Transactions   map[string]Transaction
-}
-
-func NewConStore() *conStore {
-	store := &conStore{
-		MuTransactions: sync.RWMutex{},
-		Transactions:   make(map[string]Transaction),
-	}
-
-	return store
-}
-
-type idemRecord struct {
-	Hash       string
-	Tr         Transaction
-	StatusCode int
-	CreatedAt  time.Time
-	Body       []byte
-	Location   string
-}
-
-// conStoreWithCache is an in-memory concurrency-safe store guarded by an RWmutex
-// with a mechanism to use idempotency keys
-type conStoreWithIdempotency struct {
-	*conStore
-	idemCache map[string]idemRecord
-	keyLocks  *lockRegistry
-}
-
-func NewConStoreWithIdempotency() *conStoreWithIdempotency {
-	return &conStoreWithIdempotency{
-		conStore:  &conStore{Transactions: make(map[string]Transaction)},
-		idemCache: make(map[string]idemRecord),
-		keyLocks:  newLockRegistry(),
-	}
+// Store, conStore and idemRecord live in storage.go, fileStore in filestore.go.
+
+// service bundles the storage backend with the per-key locks and in-flight
+// markers used for idempotency. It is injected into the handlers that need it.
+type service struct {
+	store    Store
+	auth     *authenticator
+	keyLocks *lockRegistry
+	inFlight *inFlight
+	webhooks *webhooks
+	stream   *eventStream
+	metrics  *metrics
+	rules    *rulesEngine
+	schedule *scheduler
+	recons   *reconciliations
+	fx       *fxEngine
+	quotes   *fxQuotes
+	fees     *feeEngine
+	outbox   *outboxDispatcher
+}
+
+func newService(store Store, auth *authenticator) *service {
+	svc := &service{
+		store:    store,
+		auth:     auth,
+		keyLocks: newLockRegistry(),
+		inFlight: newInFlight(),
+		webhooks: newWebhooks(),
+		rules:    newRulesEngine(),
+		recons:   newReconciliations(),
+		fx:       newFXEngine(),
+		quotes:   newFXQuotes(defaultFXQuoteTTL),
+		fees:     newFeeEngine(),
+	}
+	// webhooks and streams take the events written from now on; a store that
+	// can't tell starts them at the beginning of the outbox
+	last, _ := store.LastOutboxSeq()
+	svc.stream = newEventStream(sseReplaySize, uint64(last))
+	svc.outbox = newOutboxDispatcher(store, nil)
+	svc.outbox.addLive(last, svc.webhooks, svc.stream)
+	svc.metrics = newMetrics(svc)
+	svc.schedule = &scheduler{svc: svc, now: time.Now}
+	return svc
 }
 
 type keyLock struct {
@@ -107,7 +116,16 @@ func (r *lockRegistry) acquire(key string) (unlock func()) {
 	}
 }
 
-func startCacheSweeperWith(ctx context.Context, s *conStoreWithIdempotency, ttl, interval time.Duration) {
+// len reports how many keys are locked or waited for.
+func (r *lockRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.m)
+}
+
+// startCacheSweeperWith sweeps expired idempotency records every interval until
+// ctx is done. onSweep, if set, gets the duration and yield of every run.
+func startCacheSweeperWith(ctx context.Context, s Store, ttl, interval time.Duration, onSweep func(took time.Duration, swept int)) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
@@ -115,14 +133,14 @@ func startCacheSweeperWith(ctx context.Context, s *conStoreWithIdempotency, ttl,
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			now := time.Now()
-			s.MuTransactions.Lock()
-			for k, rec := range s.idemCache {
-				if now.Sub(rec.CreatedAt) > ttl {
-					delete(s.idemCache, k)
-				}
+			start := time.Now()
+			n, err := s.SweepIdem(start.Add(-ttl))
+			if err != nil {
+				log.Printf("idempotency sweep: %v", err)
+			}
+			if onSweep != nil {
+				onSweep(time.Since(start), n)
 			}
-			s.MuTransactions.Unlock()
 		}
 	}
 }
@@ -130,14 +148,97 @@ func startCacheSweeperWith(ctx context.Context, s *conStoreWithIdempotency, ttl,
 // Main program
 
 func main() {
-	mux, cancel := setupAndRouting()
-	defer cancel()
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAuditCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Println("listening on " + port)
-	if err := http.ListenAndServe(port, mux); err != nil {
+	if err := run(ctx, cfg); err != nil {
 		log.Fatal(err)
 	}
+}
+
+// run serves until ctx is cancelled, then drains and shuts everything down.
+func run(ctx context.Context, cfg config) error {
+	store, err := openStore(cfg.DataFile)
+	if err != nil {
+		return err
+	}
+	keys, err := parseAPIKeys(os.Getenv("FINTECH_API_KEYS"))
+	if err != nil {
+		return err
+	}
+	auth := &authenticator{apiKeys: keys, tokenSecret: []byte(os.Getenv("FINTECH_TOKEN_SECRET"))}
+	if len(keys) == 0 || len(auth.tokenSecret) == 0 {
+		log.Println("warning: FINTECH_API_KEYS or FINTECH_TOKEN_SECRET is empty, every request will get 401")
+	}
+	mux, svc, cancel := setupAndRouting(cfg, store, auth)
+	defer cancel() // after the drain: stops the workers and flushes the store
+
+	for _, f := range []struct {
+		path string
+		w    fileWatcher
+	}{{cfg.RulesFile, svc.rules}, {cfg.FXRatesFile, svc.fx}, {cfg.FeesFile, svc.fees}} {
+		if f.path == "" {
+			continue
+		}
+		if err := f.w.loadFile(f.path); err != nil {
+			return err
+		}
+		go f.w.watch(ctx, fileReloadInterval)
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	// event streams never finish on their own
+	srv.RegisterOnShutdown(svc.stream.close)
+
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	log.Println("listening on " + ln.Addr().String())
+	return serve(ctx, srv, ln, cfg.ShutdownTimeout)
+}
+
+// serve runs srv on ln until ctx is cancelled. It then stops accepting
+// connections and gives in-flight requests up to drain to finish; whatever is
+// still running after that is cut off.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, drain time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
 
+	log.Printf("shutting down, draining requests for up to %s", drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		_ = srv.Close()
+		return fmt.Errorf("drain: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 // Models
@@ -192,9 +293,31 @@ type Transaction struct {
 	ID            string            `json:"id"`
 	FromAccountID string            `json:"from_account_id"`
 	ToAccountID   string            `json:"to_account_id"`
-	Amount        float64           `json:"amount"`
-	At            time.Time         `json:"at"` // RFC3339 by default
+	Amount        int64             `json:"amount_minor"` // integer minor units of Currency
+	Currency      string            `json:"currency"`     // ISO 4217 code
+	At            time.Time         `json:"at"`           // RFC3339 by default
 	Status        TransactionStatus `json:"status"`
+	SettledAt     *time.Time        `json:"settled_at,omitempty"`     // set when completed, see statements.go
+	ClientID      string            `json:"client_id,omitempty"`      // API client that created it
+	FailureReason string            `json:"failure_reason,omitempty"` // rule that failed it, see rules.go and fx.go
+
+	ToAmount   int64  `json:"to_amount_minor,omitempty"` // set when converted: what arrives, see fx.go
+	ToCurrency string `json:"to_currency,omitempty"`
+	FXRate     string `json:"fx_rate,omitempty"` // to_currency per currency
+	FXQuoteID  string `json:"fx_quote_id,omitempty"`
+
+	Fees   []feeItem `json:"fees,omitempty"`    // charged to the sender on top of the amount, see fees.go
+	FeeFor string    `json:"fee_for,omitempty"` // set on a fee posting or refund: the transaction charged
+
+	Description string            `json:"description,omitempty"` // the client's, see metadata.go
+	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	StandingOrderID string     `json:"standing_order_id,omitempty"` // set when booked by the scheduler
+	ScheduledFor    *time.Time `json:"scheduled_for,omitempty"`     // the due time it was booked for
+
+	ReversalOf string        `json:"reversal_of,omitempty"`    // set on a reversal: the original's ID
+	Reversed   int64         `json:"reversed_minor,omitempty"` // set on an original: total reversed so far, in the received currency
+	Reversals  []reversalRef `json:"reversals,omitempty"`      // set on an original: its reversals, oldest first
 }
 
 // helper functions
@@ -223,218 +346,466 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-func writeError(w http.ResponseWriter, status int, msg string) {
-	writeJSON(w, status, map[string]string{"error": msg})
+// openStore opens the durable log at path, or an in-memory store when path is empty.
+func openStore(path string) (Store, error) {
+	if path == "" {
+		return NewConStore(), nil
+	}
+	return openFileStore(path)
 }
 
 // Routing and Handlers
-// setupAndRouting sets up the in-memory store and the server, and register the routes.
-func setupAndRouting() (*http.ServeMux, context.CancelFunc) {
-	// setup in-memory, concurrency safe store
-	store := NewConStoreWithIdempotency()
+// setupAndRouting sets up the service around store and the server, and register the routes.
+// The returned cancel stops the background work and closes the store.
+func setupAndRouting(cfg config, store Store, auth *authenticator) (*http.ServeMux, *service, context.CancelFunc) {
+	svc := newService(store, auth)
+	svc.quotes.ttl = cfg.FXQuoteTTL
 	// setup server
 	mux := http.NewServeMux()
 	// setup cache sweeper
 	ctx, cancel := context.WithCancel(context.Background())
-	go startCacheSweeperWith(ctx, store, idemTTL, sweepInterval)
+	sweeperDone := make(chan struct{})
+	go func() {
+		defer close(sweeperDone)
+		startCacheSweeperWith(ctx, store, cfg.IdemTTL, cfg.SweepInterval, svc.metrics.observeSweep)
+	}()
+	// setup scheduler of standing orders
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		svc.schedule.run(ctx, cfg.SchedulerInterval)
+	}()
+	// setup dispatcher of the outbox
+	outboxDone := make(chan struct{})
+	sinks, err := parseOutboxSinks(cfg.OutboxSinks)
+	if err != nil {
+		log.Printf("outbox: %v", err) // loadConfig has checked them
+	}
+	svc.outbox.add(sinks...)
+	go func() {
+		defer close(outboxDone)
+		svc.outbox.run(ctx)
+	}()
+
+	registerRoutes(mux, svc)
+
+	return mux, svc, func() {
+		cancel()
+		<-sweeperDone // no sweep may run into a closed store
+		<-schedulerDone
+		<-outboxDone // offsets are saved in the store
+		svc.stream.close()
+		svc.webhooks.close()
+		if err := store.Close(); err != nil {
+			log.Printf("closing store: %v", err)
+		}
+	}
+}
 
-	// Handlers
-	// The store is injected into the handlers that need it.
+// registerRoutes registers the handlers, with the service injected into them.
+// Every route but /metrics and /problems is behind API-key and bearer-token authentication;
+// every route is counted and timed under its pattern.
+func registerRoutes(mux *http.ServeMux, svc *service) {
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, svc.metrics.instrument(pattern, svc.authenticate(h)))
+	}
 
-	// transactions
-	mux.HandleFunc("POST /transactions", func(w http.ResponseWriter, r *http.Request) {
-		createTransaction(w, r, store)
-	})
-	mux.HandleFunc("GET /transactions/{id}", func(w http.ResponseWriter, r *http.Request) {
-		getTransaction(w, r, store)
-	})
+	mux.Handle("GET /metrics", svc.metrics.instrument("GET /metrics", svc.metrics))
+	// documentation of the error codes, see problems.go
+	mux.Handle("GET /problems/{code}", svc.metrics.instrument("GET /problems/{code}", http.HandlerFunc(getProblemType)))
 
-	return mux, cancel
+	// transactions
+	handle("POST /transactions", svc.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		createTransaction(w, r, svc)
+	}), canonicalTransactionBody))
+	handle("POST /transactions/batch", svc.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		createBatch(w, r, svc)
+	}), canonicalBatchBody))
+	handle("POST /transactions/import/pain.001", pain001Key(svc.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		importPain001(w, r, svc)
+	}), canonicalPain001Body)))
+	handle("GET /transactions/export/pain.001", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exportPain001(w, r, svc)
+	}))
+	handle("GET /transactions", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listTransactions(w, r, svc)
+	}))
+	handle("GET /transactions/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamEvents(w, r, svc)
+	}))
+	handle("GET /transactions/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getTransaction(w, r, svc)
+	}))
+	handle("POST /transactions/{id}/reverse", svc.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reverseTransaction(w, r, svc)
+	}), canonicalReverseBody))
+	handle("PATCH /transactions/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		patchTransaction(w, r, svc)
+	}))
+	handle("PUT /transactions/{id}/status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updateTransactionStatus(w, r, svc)
+	}))
+
+	// standing orders
+	handle("POST /standing-orders", svc.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		createStandingOrder(w, r, svc)
+	}), canonicalStandingOrderBody))
+	handle("GET /standing-orders", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listStandingOrders(w, r, svc)
+	}))
+	handle("GET /standing-orders/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getStandingOrder(w, r, svc)
+	}))
+	handle("DELETE /standing-orders/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancelStandingOrder(w, r, svc)
+	}))
+
+	// accounts and foreign exchange
+	handle("PUT /accounts/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		putAccount(w, r, svc)
+	}))
+	handle("GET /accounts/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getAccount(w, r, svc)
+	}))
+	handle("GET /accounts/{id}/balance", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getBalance(w, r, svc)
+	}))
+	handle("GET /accounts/{id}/statements", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getStatement(w, r, svc)
+	}))
+	handle("POST /fx/quotes", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		createFXQuote(w, r, svc)
+	}))
+
+	// reconciliations
+	handle("POST /reconciliations", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		createReconciliation(w, r, svc)
+	}))
+	handle("GET /reconciliations/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getReconciliation(w, r, svc)
+	}))
+
+	// audit log
+	handle("GET /audit", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exportAudit(w, r, svc)
+	}))
+	handle("GET /audit/head", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getAuditHead(w, r, svc)
+	}))
+
+	// webhooks
+	handle("POST /webhooks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		createWebhook(w, r, svc)
+	}))
+	handle("GET /webhooks/{id}/deliveries", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listWebhookDeliveries(w, r, svc)
+	}))
 }
 
 // transactions
 
 type transactionRequest struct {
-	FromAccountID string  `json:"from_account_id"`
-	ToAccountID   string  `json:"to_account_id"`
-	Amount        float64 `json:"amount"`
+	FromAccountID string            `json:"from_account_id"`
+	ToAccountID   string            `json:"to_account_id"`
+	Amount        decimalAmount     `json:"amount"`               // major units, e.g. "10.50"
+	Currency      string            `json:"currency"`             // ISO 4217 code
+	ExecuteAt     *time.Time        `json:"execute_at,omitempty"` // future-dated: booked by the scheduler
+	Description   string            `json:"description,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	FXQuoteID     string            `json:"fx_quote_id,omitempty"` // see fx.go
 }
 
-func createTransaction(w http.ResponseWriter, r *http.Request, store *conStoreWithIdempotency) {
-	key := r.Header.Get("Idempotency-Key") // idempotency-key is optional
+func createTransaction(w http.ResponseWriter, r *http.Request, svc *service) {
 	var in transactionRequest
 
 	if err := bindJSON(r, &in); err != nil {
-		writeError(w, http.StatusBadRequest, "bad request")
+		writeError(w, codeMalformedRequest, "bad request")
 		return
 	}
 
 	err := validateTransactionRequest(in)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, err.Error())
+		writeInvalid(w, err)
 		return
 	}
 
-	fp, err := fingerprint(in)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "could not calculate fingerprint of transaction request")
+	p, _ := principalFrom(r.Context())
+	if !p.owns(strings.TrimSpace(in.FromAccountID)) {
+		writeError(w, codeForbidden, "not allowed to transfer from this account")
 		return
 	}
 
-	// lookup in cache when idempotency key is present
-	status := http.StatusAccepted
-
-	if key != "" {
-		// Serialize only same-key requests
-		unlockKey := store.keyLocks.acquire(key)
-		defer unlockKey()
+	amount, _ := ParseMoney(string(in.Amount), in.Currency) // already validated
+	t := newTransaction(in, amount)
+	t.ClientID = p.ClientID
 
-		// locked idempotency check/insert:
-		store.MuTransactions.Lock()
-		defer store.MuTransactions.Unlock()
-
-		if rec, ok := store.idemCache[key]; ok {
-			if rec.Hash != fp {
-				writeError(w, http.StatusConflict, "idempotency key reuse with different payload")
-				return
-			}
-			w.Header().Set("Location", rec.Location)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(rec.StatusCode)
-			_, _ = w.Write(rec.Body)
+	if in.ExecuteAt != nil && in.ExecuteAt.After(svc.schedule.now()) {
+		if in.FXQuoteID != "" {
+			writeInvalid(w, validationError{{"fx_quote_id", "a quote cannot be held until execute_at"}})
 			return
 		}
+		scheduleTransaction(w, svc, t, *in.ExecuteAt)
+		return
+	}
 
-		t := Transaction{
-			ID:            newID(),
-			FromAccountID: in.FromAccountID,
-			ToAccountID:   in.ToAccountID,
-			Amount:        in.Amount,
-			At:            time.Now().UTC(),
-			Status:        StatusPending,
-		}
-		store.Transactions[t.ID] = t
-		body, _ := json.Marshal(t)
-		loc := "/transactions/" + t.ID
-		store.idemCache[key] = idemRecord{
-			Hash:       fp,
-			Tr:         t,
-			StatusCode: status,
-			CreatedAt:  time.Now(),
-			Body:       body,
-			Location:   loc,
+	var quote *fxQuote
+	if in.FXQuoteID != "" {
+		if quote, err = svc.quotes.take(in.FXQuoteID, p.ClientID); err != nil {
+			writeProblem(w, fxProblem(err))
+			return
 		}
+	}
+	if err := svc.convert(&t, quote); err != nil {
+		svc.quotes.release(quote)
+		writeProblem(w, fxProblem(err))
+		return
+	}
 
-		w.Header().Set("Location", loc)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(status)
-		_, _ = w.Write(body)
+	t, v, err := svc.book(t, true)
+	if err != nil || v != nil {
+		svc.quotes.release(quote)
+	}
+	if err != nil {
+		writeError(w, codeInternal, "could not store transaction")
 		return
 	}
+	if v != nil {
+		writeViolation(w, v)
+		return
+	}
+
+	w.Header().Set("Location", "/transactions/"+t.ID)
+	w.Header().Set("ETag", transactionETag(t))
+	writeJSON(w, http.StatusAccepted, t)
+}
+
+// book checks t against the rules, charges its fees, stores it and publishes it. A violation fails
+// the transaction, unless the rules say reject and the caller can take a
+// rejection (mayReject): then nothing is stored and the violation is returned.
+// A transaction that has already failed is stored as it is.
+func (svc *service) book(t Transaction, mayReject bool) (Transaction, *ruleViolation, error) {
+	rules, fees := svc.rules.current(), svc.fees.current()
+	// Only a velocity or daily limit, or a tiered fee, reads the account's
+	// history; then it must not change between the check and the put. Every
+	// other booking is decided by t alone and stored in one store write.
+	if rules.readsHistory(t) || fees.readsHistory(t) {
+		unlock := svc.keyLocks.acquire(accountLockKey(t.FromAccountID))
+		defer unlock()
+	}
+
+	if t.Status != StatusFailed {
+		v, err := rules.check(svc.store, t, t.At)
+		if err != nil {
+			return Transaction{}, nil, err
+		}
+		if v != nil && mayReject && rules.action == ruleActionReject {
+			return Transaction{}, v, nil
+		}
+		if v != nil {
+			t.Status, t.FailureReason = StatusFailed, v.Reason
+		}
+	}
+	if t.Status != StatusFailed {
+		items, err := fees.charge(svc.store, t)
+		if err != nil {
+			return Transaction{}, nil, err
+		}
+		t.Fees = items
+	}
+	ev := newEvent(EventTransactionCreated, t)
+	if err := svc.store.PutTransaction(t, ev); err != nil {
+		return Transaction{}, nil, err
+	}
+	svc.outbox.notify()
+
+	return t, nil, nil
+}
 
-	// No key: normal path (no per-key lock)
-	t := Transaction{
+// newTransaction builds a pending transaction from a validated request.
+func newTransaction(in transactionRequest, amount Money) Transaction {
+	return Transaction{
 		ID:            newID(),
-		FromAccountID: in.FromAccountID,
-		ToAccountID:   in.ToAccountID,
-		Amount:        in.Amount,
+		FromAccountID: strings.TrimSpace(in.FromAccountID),
+		ToAccountID:   strings.TrimSpace(in.ToAccountID),
+		Amount:        amount.Minor,
+		Currency:      amount.Currency,
 		At:            time.Now().UTC(),
 		Status:        StatusPending,
+		Description:   in.Description,
+		Metadata:      in.Metadata,
 	}
-
-	store.MuTransactions.Lock()
-	store.Transactions[t.ID] = t
-	store.MuTransactions.Unlock()
-	w.Header().Set("Location", "/transactions/"+t.ID)
-	writeJSON(w, status, t)
 }
 
-func getTransaction(w http.ResponseWriter, r *http.Request, store *conStoreWithIdempotency) {
+func getTransaction(w http.ResponseWriter, r *http.Request, svc *service) {
 	id := r.PathValue("id")
 	if strings.TrimSpace(id) == "" {
-		writeError(w, http.StatusBadRequest, "missing id")
+		writeInvalid(w, validationError{{Name: "id", Reason: "required"}})
 		return
 	}
 
-	store.MuTransactions.RLock()
-	t, ok := store.Transactions[id]
-	store.MuTransactions.RUnlock()
+	t, ok, err := svc.store.GetTransaction(id)
+	if err != nil {
+		writeError(w, codeInternal, "could not read transaction")
+		return
+	}
+	// transactions of other accounts are reported as missing, not as forbidden,
+	// so their IDs can't be probed
+	if p, _ := principalFrom(r.Context()); !ok || !p.canSee(t) {
+		writeError(w, codeNotFound, "this payment does not exist")
+		return
+	}
 
+	etag := transactionETag(t)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+var (
+	errInvalidTransition = errors.New("only pending transactions can change status")
+	errRefundSettles     = errors.New("fee refunds complete or fail with their reversal")
+)
+
+// setStatus moves a pending transaction to a final status and publishes the
+// change. Completing it posts its fees in the same write; a reversal takes its
+// fee refunds and original along, see settleReversal.
+func (svc *service) setStatus(id string, to TransactionStatus) (Transaction, error) {
+	cur, ok, err := svc.store.GetTransaction(id)
+	if err != nil {
+		return Transaction{}, err
+	}
 	if !ok {
-		writeError(w, http.StatusNotFound, "this payment does not exist")
+		return Transaction{}, errTransactionNotFound
+	}
+	if cur.FeeFor != "" {
+		return Transaction{}, errRefundSettles
+	}
+	ids := []string{id}
+	if cur.ReversalOf != "" {
+		if ids, err = svc.reversalIDs(cur); err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	var w txWrite
+	ts, err := svc.store.ApplyTransactions(ids, func(ts []Transaction) (txWrite, error) {
+		t := &ts[0]
+		if t.Status != StatusPending || to == StatusPending {
+			return txWrite{}, errInvalidTransition
+		}
+		from := t.Status
+		t.Status = to
+		// taken under the store's lock: statements rely on it
+		now := time.Now().UTC()
+		if to == StatusCompleted {
+			t.SettledAt = &now
+			w.Put = feePostings(t, now)
+		}
+		changed := []Transaction{*t}
+		if t.ReversalOf != "" {
+			w.Put = append(w.Put, settleReversal(*t, &ts[1], ts[2:], now)...)
+			changed = append(changed, ts[2:]...)
+		}
+		for _, c := range changed {
+			ev := newEvent(EventTransactionStatusChanged, c)
+			ev.PreviousStatus = &from
+			w.Events = append(w.Events, ev)
+		}
+		if t.ReversalOf != "" {
+			// its history (and, on failure, what is left to reverse) changed
+			w.Events = append(w.Events, newEvent(EventTransactionUpdated, ts[1]))
+		}
+		for _, p := range w.Put {
+			w.Events = append(w.Events, newEvent(EventTransactionCreated, p))
+		}
+		return w, nil
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	svc.outbox.notify()
+	return ts[0], nil
+}
+
+type statusRequest struct {
+	Status TransactionStatus `json:"status"`
+}
+
+// updateTransactionStatus is the settlement callback: admin only.
+func updateTransactionStatus(w http.ResponseWriter, r *http.Request, svc *service) {
+	if p, _ := principalFrom(r.Context()); !p.Admin {
+		writeError(w, codeForbidden, "admin scope required")
+		return
+	}
+	var in statusRequest
+	if err := bindJSON(r, &in); err != nil {
+		writeError(w, codeMalformedRequest, "bad request")
+		return
+	}
+
+	t, err := svc.setStatus(r.PathValue("id"), in.Status)
+	switch {
+	case errors.Is(err, errTransactionNotFound):
+		writeError(w, codeNotFound, "this payment does not exist")
+		return
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errRefundSettles):
+		writeError(w, codeInvalidTransition, err.Error())
+		return
+	case err != nil:
+		writeError(w, codeInternal, "could not update transaction")
 		return
 	}
 
 	writeJSON(w, http.StatusOK, t)
-	return
 }
 
-func listTransactions(w http.ResponseWriter, r *http.Request, store *conStoreWithIdempotency) {
+func listTransactions(w http.ResponseWriter, r *http.Request, svc *service) {
 	from := strings.TrimSpace(r.URL.Query().Get("from_account_id"))
 	limit, err := parseLimit(r.URL.Query().Get("limit"))
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "invalid limit")
+		writeInvalid(w, err)
 		return
 	}
 
 	curStr := r.URL.Query().Get("cursor")
 	cur, err := decodeCursor(curStr)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, err.Error())
+		writeInvalid(w, validationError{{Name: "cursor", Reason: err.Error()}})
 		return
 	}
 	// cursor/query mismatch check
 	if cur.FA != "" && cur.FA != from {
-		writeError(w, http.StatusBadRequest, "cursor does not match query")
+		writeInvalid(w, validationError{{Name: "cursor", Reason: "does not match the query"}})
 		return
 	}
 
-	// Snapshot under rread lock
-	store.MuTransactions.RLock()
-	items := make([]Transaction, 0, len(store.Transactions))
-	for _, t := range store.Transactions {
-		if from != "" && t.FromAccountID != from {
-			continue
-		}
-		items = append(items, t)
+	// fetch one extra item to know whether there is a next page
+	md, err := parseMetadataFilter(r.URL.Query())
+	if err != nil {
+		writeInvalid(w, err)
+		return
 	}
-	store.MusTransactions.RUnlock()
-
-	// Stort by (At ASC, ID ASC)
-	sort.Slice(items, func(i, j int) bool {
-		if items[i].At.Before(items[j].At) {
-			return true
-		}
-		if items[i].At.After(items[j].At) {
-			return false
-		}
-		return items[i].ID < items[j].ID
-	})
 
-	// Apply keyset window
-	start := 0
-	if cur.At != (time.Time{}) {
-		// find first strictly after cursor
-		// linear scan is fine for in-mem; swap to binary search if needed
-		for idx := range items {
-			if afterCursor(items[idx], cur) {
-				start = idx
-				break
-			}
-			start = len(items) // if none is after, empty page
-		}
+	q := listQuery{FromAccountID: from, Metadata: md, After: cur, Limit: limit + 1}
+	if p, _ := principalFrom(r.Context()); !p.Admin {
+		q.Accounts = p.Accounts
 	}
-
-	// Page slice
-	end := start + limit
-	if end > len(items) {
-		end = len(items)
+	items, err := svc.store.ListTransactions(q)
+	if err != nil {
+		writeError(w, codeInternal, "could not list transactions")
+		return
+	}
+	page := items
+	if len(page) > limit {
+		page = page[:limit]
 	}
-	page := items[start:end]
 
 	// Build next cursor (only if more items remain)
 	next := ""
-	if end < len(items) && len(page) > 0 {
+	if len(items) > limit {
 		last := page[len(page)-1]
 		nc := trCursor{At: last.At.UTC(), ID: last.ID, FA: from}
 		if s, err := encodeCursor(nc); err == nil {
@@ -454,7 +825,7 @@ type trCursor struct {
 	FA string    `json:"fa"` // from account
 }
 
-func encodeCursor(c txCursor) (string, error) {
+func encodeCursor(c trCursor) (string, error) {
 	b, err := json.Marshal(c)
 	if err != nil {
 		return "", err
@@ -462,8 +833,8 @@ func encodeCursor(c txCursor) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func decodeCursor(s string) (txCursor, error) {
-	var c txCursor
+func decodeCursor(s string) (trCursor, error) {
+	var c trCursor
 	if strings.TrimSpace(s) == "" {
 		return c, nil
 	}
@@ -482,15 +853,15 @@ func decodeCursor(s string) (txCursor, error) {
 
 func parseLimit(q string) (int, error) {
 	if strings.TrimSpace(q) == "" {
-		return defaultLimit, nil
+		return defaultEntriesLimit, nil
 	}
 
 	n, err := strconv.Atoi(q)
 	if err != nil || n <= 0 {
-		return 0, fmt.Errorf("invalid limit")
+		return 0, validationError{{Name: "limit", Reason: "must be a positive integer"}}
 	}
-	if n > maxLimit {
-		n = maxLimit
+	if n > maxEntriesLimit {
+		n = maxEntriesLimit
 	}
 	return n, nil
 }
@@ -509,20 +880,26 @@ func afterCursor(a Transaction, cur trCursor) bool {
 // Logic
 
 func validateTransactionRequest(req transactionRequest) error {
-	var invalids []string
+	var invalids validationError
 
 	if strings.TrimSpace(req.FromAccountID) == "" {
-		invalids = append(invalids, "from_account_id")
+		invalids = append(invalids, invalidParam{"from_account_id", "required"})
 	}
-	if strings.TrimSpace(req.ToAccountID) == "" || strings.TrimSpace(req.FromAccountID) == strings.TrimSpace(req.ToAccountID) {
-		invalids = append(invalids, "to_account_id")
+	switch to := strings.TrimSpace(req.ToAccountID); {
+	case to == "":
+		invalids = append(invalids, invalidParam{"to_account_id", "required"})
+	case to == strings.TrimSpace(req.FromAccountID):
+		invalids = append(invalids, invalidParam{"to_account_id", "must differ from from_account_id"})
 	}
-	if req.Amount <= 0 || math.IsNaN(req.Amount) || math.IsInf(req.Amount, 0) {
-		invalids = append(invalids, "amount")
+	if _, _, err := normalizeCurrency(req.Currency); err != nil {
+		invalids = append(invalids, invalidParam{"currency", "must be a supported ISO 4217 code"})
+	} else if m, err := ParseMoney(string(req.Amount), req.Currency); err != nil || m.Minor <= 0 {
+		invalids = append(invalids, invalidParam{"amount", "must be a positive amount in the currency's minor unit"})
 	}
+	invalids = append(invalids, validateAnnotations(req.Description, req.Metadata)...)
 
 	if len(invalids) > 0 {
-		return fmt.Errorf("invalid or missing: %s", strings.Join(invalids, ", "))
+		return invalids
 	}
 
 	return nil
@@ -530,27 +907,45 @@ func validateTransactionRequest(req transactionRequest) error {
 
 // helper functions
 
-// loadByKey returns a previously stored transaction by idempotency key
-func loadByKey(key string, store *conStoreWithIdempotency) (idemRecord, bool) {
-	store.MuTransactions.RLock()
-	rec, ok := store.idemCache[key]
-	store.MuTransactions.RUnlock()
-	return rec, ok
-}
-
-// storeByKey stores a transaction in the cache by idempotency key
-func storeByKey(key string, rec idemRecord, store *conStoreWithIdempotency) {
-	store.MuTransactions.Lock()
-	store.idemCache[key] = rec
-	store.MuTransactions.Unlock()
-}
-
-func fingerprint(req transactionRequest) (string, error) {
-	b, err := json.Marshal(req) // field order must be stable (this is assured in Go)
+// canonicalTransaction is the canonical form of a request: trimmed account IDs,
+// the amount in minor units and the upper-cased currency. "10.5" and "10.50" EUR
+// therefore share an idempotency fingerprint.
+func canonicalTransaction(req transactionRequest) ([]byte, error) {
+	m, err := ParseMoney(string(req.Amount), req.Currency)
 	if err != nil {
-		return "", err
-	}
-	sum := sha256.Sum256(b)
-
-	return hex.EncodeToString(sum[:]), nil
+		return nil, err
+	}
+	canonical := struct {
+		FromAccountID string            `json:"from_account_id"`
+		ToAccountID   string            `json:"to_account_id"`
+		Amount        int64             `json:"amount_minor"`
+		Currency      string            `json:"currency"`
+		ExecuteAt     *time.Time        `json:"execute_at,omitempty"`
+		Description   string            `json:"description,omitempty"`
+		Metadata      map[string]string `json:"metadata,omitempty"` // keys are sorted
+		FXQuoteID     string            `json:"fx_quote_id,omitempty"`
+	}{
+		FromAccountID: strings.TrimSpace(req.FromAccountID),
+		ToAccountID:   strings.TrimSpace(req.ToAccountID),
+		Amount:        m.Minor,
+		Currency:      m.Currency,
+		Description:   req.Description,
+		Metadata:      req.Metadata,
+		FXQuoteID:     strings.TrimSpace(req.FXQuoteID),
+	}
+	if req.ExecuteAt != nil {
+		at := req.ExecuteAt.UTC()
+		canonical.ExecuteAt = &at
+	}
+
+	return json.Marshal(canonical) // field order must be stable (this is assured in Go)
+}
+
+// canonicalTransactionBody is the canonicalizer of POST /transactions.
+func canonicalTransactionBody(body []byte) ([]byte, error) {
+	var req transactionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	return canonicalTransaction(req)
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,26 +15,80 @@ import (
 	"time"
 )
 
-func newTestServer(t *testing.T) (*httptest.Server, *conStoreWithIdempotency) {
-	t.Helper()
+// Credentials known to test servers. Helpers send testAPIKey and an admin token
+// unless the headers they get say otherwise.
+const (
+	testAPIKey  = "test-key"
+	otherAPIKey = "other-key"
+)
 
-	store := NewConStoreWithIdempotency()
+var testTokenSecret = []byte("test-token-secret")
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("POST /transactions", func(w http.ResponseWriter, r *http.Request) {
-		createTransaction(w, r, store)
+func testAuth() *authenticator {
+	keys := make(apiKeys)
+	keys.add(testAPIKey, "client-a")
+	keys.add(otherAPIKey, "client-b")
+	return &authenticator{apiKeys: keys, tokenSecret: testTokenSecret}
+}
+
+// bearer returns an Authorization header value for a token valid for an hour.
+func bearer(sub, scope string, accounts ...string) string {
+	tok, err := signToken(testTokenSecret, tokenClaims{
+		Subject:  sub,
+		Accounts: accounts,
+		Scope:    scope,
+		Expires:  time.Now().Add(time.Hour).Unix(),
 	})
-	mux.HandleFunc("GET /transactions/{id}", func(w http.ResponseWriter, r *http.Request) {
-		getTransaction(w, r, store)
+	if err != nil {
+		panic(err)
+	}
+	return "Bearer " + tok
+}
+
+var adminBearer = bearer("test-admin", scopeAdmin)
+
+func newTestServer(t *testing.T) (*httptest.Server, *service) {
+	t.Helper()
+	return newTestServerWithStore(t, NewConStore())
+}
+
+// newTestServerWithStore is newTestServer on store, as after a restart.
+func newTestServerWithStore(t *testing.T, store Store) (*httptest.Server, *service) {
+	t.Helper()
+
+	svc := newService(store, testAuth())
+	svc.webhooks.allowed = func(netip.Addr) bool { return true } // receivers are httptest servers
+	t.Cleanup(svc.webhooks.close)
+	t.Cleanup(svc.stream.close)
+	// webhooks and streams get their events from the outbox
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.outbox.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
 	})
 
+	mux := http.NewServeMux()
+	registerRoutes(mux, svc)
+
 	ts := httptest.NewServer(mux)
 	t.Cleanup(ts.Close)
 
-	return ts, store
+	return ts, svc
 
 }
 
+// waitDelivered waits until every outbox sink of svc has taken what was written so far.
+func waitDelivered(t *testing.T, svc *service) {
+	t.Helper()
+	last, _ := svc.store.LastOutboxSeq()
+	waitFor(t, "outbox delivery", func() bool { return svc.outbox.delivered() >= last })
+}
+
 func postJSON(t *testing.T, url string, body any, headers map[string]string) (*http.Response, []byte) {
 	t.Helper()
 
@@ -41,6 +96,8 @@ func postJSON(t *testing.T, url string, body any, headers map[string]string) (*h
 	req, _ := http.NewRequest("POST", url, bytes.NewReader(b))
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", adminBearer)
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
@@ -60,7 +117,17 @@ func postJSON(t *testing.T, url string, body any, headers map[string]string) (*h
 func get(t *testing.T, url string) (*http.Response, []byte) {
 	t.Helper()
 
-	res, err := http.Get(url)
+	return getWith(t, url, adminBearer)
+}
+
+// getWith sends a GET with the test API key and the given Authorization header.
+func getWith(t *testing.T, url, authorization string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", authorization)
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatalf("GET %s failed: %v", url, err)
 	}
@@ -78,28 +145,72 @@ func TestValidateTransactionRequest(t *testing.T) {
 		WantError     bool
 		FromAccountID string
 		ToAccountID   string
-		Amount        float64
+		Amount        string
+		Currency      string
 	}{
 		{
 			Name:          "correct transaction request",
 			WantError:     false,
 			FromAccountID: "ac123",
 			ToAccountID:   "ac125",
-			Amount:        100.00,
+			Amount:        "100.00",
+			Currency:      "EUR",
 		},
 		{
 			Name:          "negative amount",
 			WantError:     true,
 			FromAccountID: "ac234",
 			ToAccountID:   "ac134",
-			Amount:        -100.00,
+			Amount:        "-100.00",
+			Currency:      "EUR",
 		},
 		{
 			Name:          "same account in to and from",
 			WantError:     true,
 			FromAccountID: "ac123",
 			ToAccountID:   "ac123",
-			Amount:        100.00,
+			Amount:        "100.00",
+			Currency:      "EUR",
+		},
+		{
+			Name:          "more decimals than the currency allows",
+			WantError:     true,
+			FromAccountID: "ac123",
+			ToAccountID:   "ac125",
+			Amount:        "10.001",
+			Currency:      "EUR",
+		},
+		{
+			Name:          "fraction on zero-exponent currency",
+			WantError:     true,
+			FromAccountID: "ac123",
+			ToAccountID:   "ac125",
+			Amount:        "100.5",
+			Currency:      "JPY",
+		},
+		{
+			Name:          "three decimals on KWD",
+			WantError:     false,
+			FromAccountID: "ac123",
+			ToAccountID:   "ac125",
+			Amount:        "10.001",
+			Currency:      "KWD",
+		},
+		{
+			Name:          "unknown currency",
+			WantError:     true,
+			FromAccountID: "ac123",
+			ToAccountID:   "ac125",
+			Amount:        "10.00",
+			Currency:      "XXX",
+		},
+		{
+			Name:          "zero amount",
+			WantError:     true,
+			FromAccountID: "ac123",
+			ToAccountID:   "ac125",
+			Amount:        "0.00",
+			Currency:      "EUR",
 		},
 	}
 
@@ -108,7 +219,8 @@ func TestValidateTransactionRequest(t *testing.T) {
 		req := transactionRequest{
 			FromAccountID: test.FromAccountID,
 			ToAccountID:   test.ToAccountID,
-			Amount:        test.Amount,
+			Amount:        decimalAmount(test.Amount),
+			Currency:      test.Currency,
 		}
 
 		err := validateTransactionRequest(req)
@@ -136,6 +248,7 @@ func TestAPI(t *testing.T) {
 			"from_account_id": "ac123",
 			"to_account_id":   "ac125",
 			"amount":          100.00,
+			"currency":        "EUR",
 		}
 
 		// POST
@@ -166,7 +279,7 @@ func TestAPI(t *testing.T) {
 
 		key := "k123"
 		headers := map[string]string{"Idempotency-Key": key}
-		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
+		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
 
 		res1, body1 := postJSON(t, ts.URL+"/transactions", in, headers)
 		loc1 := res1.Header.Get("Location")
@@ -190,8 +303,8 @@ func TestAPI(t *testing.T) {
 		key := "k123"
 		headers := map[string]string{"Idempotency-Key": key}
 
-		in1 := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
-		in2 := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 20.0}
+		in1 := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
+		in2 := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 20.0, "currency": "EUR"}
 
 		res1, _ := postJSON(t, ts.URL+"/transactions", in1, headers)
 		if res1.StatusCode != http.StatusAccepted {
@@ -208,7 +321,7 @@ func TestAPI(t *testing.T) {
 		ts, _ := newTestServer(t)
 		defer ts.Close()
 
-		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
+		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
 		res1, _ := postJSON(t, ts.URL+"/transactions", in, nil)
 		res2, _ := postJSON(t, ts.URL+"/transactions", in, nil)
 		if res1.Header.Get("Location") == "" || res2.Header.Get("Location") == "" {
@@ -220,12 +333,12 @@ func TestAPI(t *testing.T) {
 	})
 
 	t.Run("ConcurrentSameKey_SerializesToSingleTransaction", func(t *testing.T) {
-		ts, store := newTestServer(t)
+		ts, svc := newTestServer(t)
 		defer ts.Close()
 
 		key := "concurrent-key"
 		headers := map[string]string{"Idempotency-Key": key}
-		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
+		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
 
 		const N = 20
 		var wg sync.WaitGroup
@@ -233,6 +346,7 @@ func TestAPI(t *testing.T) {
 
 		statuses := make([]int, N)
 		locations := make([]string, N)
+		retryAfter := make([]string, N)
 
 		for i := 0; i < N; i++ {
 			go func(i int) {
@@ -240,26 +354,35 @@ func TestAPI(t *testing.T) {
 				res, _ := postJSON(t, ts.URL+"/transactions", in, headers)
 				statuses[i] = res.StatusCode
 				locations[i] = res.Header.Get("Location")
+				retryAfter[i] = res.Header.Get("Retry-After")
 			}(i)
 		}
 		wg.Wait()
 
-		// All should agree on location
-		loc0 := locations[0]
-		for i, loc := range locations {
-			if loc != loc0 {
-				t.Errorf("location mismatch at request %d: %q vs %q", i, loc, loc0)
+		// Every request either got the one transaction or was told to retry
+		loc0 := ""
+		for i := range statuses {
+			switch statuses[i] {
+			case http.StatusAccepted:
+				if loc0 == "" {
+					loc0 = locations[i]
+				}
+				if locations[i] != loc0 {
+					t.Errorf("location mismatch at request %d: %q vs %q", i, locations[i], loc0)
+				}
+			case http.StatusConflict:
+				if retryAfter[i] == "" {
+					t.Errorf("request %d: in-flight 409 without Retry-After", i)
+				}
+			default:
+				t.Errorf("request %d: unexpected status %d", i, statuses[i])
 			}
 		}
 
-		// Exactly one transaction record created for that ID
-		id := strings.TrimPrefix(loc0, "/transactions/")
-		time.Sleep(50 * time.Millisecond) // tinyh delay to let writes finish
-		store.MuTransactions.RLock()
-		_, ok := store.Transactions[id]
-		store.MuTransactions.RUnlock()
-		if !ok {
-			t.Fatalf("expected transaction %s to exist", id)
+		// Exactly one transaction record created
+		all, _ := svc.store.ListTransactions(listQuery{})
+		if len(all) != 1 || "/transactions/"+all[0].ID != loc0 {
+			t.Fatalf("expected exactly the transaction at %q, got %d transactions", loc0, len(all))
 		}
 	})
 	t.Run("StrictJSONUnknownField_400", func(t *testing.T) {
@@ -271,6 +394,7 @@ func TestAPI(t *testing.T) {
 			"from_account_id": "A1",
 			"to_account_id":   "A2",
 			"amount":          1.0,
+			"currency":        "EUR",
 			"extra":           "nope", // unknown
 		}
 		res, body := postJSON(t, ts.URL+"/transactions", in, nil)
@@ -279,6 +403,47 @@ func TestAPI(t *testing.T) {
 		}
 	})
 
+	t.Run("List_PaginatesWithCursor", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+
+		for i := 0; i < 5; i++ {
+			in := map[string]any{"from_account_id": "L1", "to_account_id": "L2", "amount": "1.00", "currency": "EUR"}
+			postJSON(t, ts.URL+"/transactions", in, nil)
+		}
+		postJSON(t, ts.URL+"/transactions", map[string]any{"from_account_id": "other", "to_account_id": "L2", "amount": "1.00", "currency": "EUR"}, nil)
+
+		seen := map[string]bool{}
+		url := ts.URL + "/transactions?from_account_id=L1&limit=2"
+		for pages := 0; url != ""; pages++ {
+			if pages > 3 {
+				t.Fatalf("too many pages")
+			}
+			res, body := get(t, url)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d body=%s", res.StatusCode, string(body))
+			}
+			var page struct {
+				Items      []Transaction `json:"items"`
+				NextCursor string        `json:"next_cursor"`
+			}
+			_ = json.Unmarshal(body, &page)
+			for _, tr := range page.Items {
+				if tr.FromAccountID != "L1" || seen[tr.ID] {
+					t.Errorf("unexpected item %+v", tr)
+				}
+				seen[tr.ID] = true
+			}
+			url = ""
+			if page.NextCursor != "" {
+				url = ts.URL + "/transactions?from_account_id=L1&limit=2&cursor=" + page.NextCursor
+			}
+		}
+		if len(seen) != 5 {
+			t.Errorf("expected 5 items across pages, got %d", len(seen))
+		}
+	})
+
 	t.Run("ResponseHeaders_ContentTypeAndLocation", func(t *testing.T) {
 		t.Parallel()
 		ts, _ := newTestServer(t)
@@ -288,6 +453,7 @@ func TestAPI(t *testing.T) {
 			"from_account_id": "A1",
 			"to_account_id":   "A2",
 			"amount":          10.0,
+			"currency":        "EUR",
 		}
 		res, body := postJSON(t, ts.URL+"/transactions", in, nil)
 		if res.StatusCode != http.StatusAccepted {
@@ -309,7 +475,7 @@ func BenchmarkCreate_NoKey(b *testing.B) {
 	ts, _ := newTestServer(t)
 	defer ts.Close()
 
-	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -328,7 +494,7 @@ func BenchmarkCreate_Idempotent_SameKey(b *testing.B) {
 
 	key := "bench-samekey"
 	h := map[string]string{"Idempotency-Key": key}
-	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
 
 	// Warm-up first call to populate cache
 	res, _ := postJSON(t, ts.URL+"/transactions", in, h)
@@ -348,7 +514,7 @@ func BenchmarkCreate_Idempotent_DifferentKeys_Parallel(b *testing.B) {
 	defer ts.Close()
 
 	var ctr uint64
-	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -368,7 +534,7 @@ func BenchmarkCreate_NoKey_Parallel(b *testing.B) {
 	ts, _ := newTestServer(&testing.T{})
 	defer ts.Close()
 
-	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -383,14 +549,9 @@ func BenchmarkCreate_NoKey_Parallel(b *testing.B) {
 
 func TestIdempotency_TTLEviction(t *testing.T) {
 	// Build a custom server: same handlers, but our own sweeper with tiny TTL.
-	store := NewConStoreWithIdempotency()
+	store := NewConStore()
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /transactions", func(w http.ResponseWriter, r *http.Request) {
-		createTransaction(w, r, store)
-	})
-	mux.HandleFunc("GET /transactions/{id}", func(w http.ResponseWriter, r *http.Request) {
-		getTransaction(w, r, store)
-	})
+	registerRoutes(mux, newService(store, testAuth()))
 	ts := httptest.NewServer(mux)
 	defer ts.Close()
 
@@ -399,12 +560,12 @@ func TestIdempotency_TTLEviction(t *testing.T) {
 	defer cancel()
 	ttl := 50 * time.Millisecond
 	interval := 20 * time.Millisecond
-	go startCacheSweeperWith(ctx, store, ttl, interval)
+	go startCacheSweeperWith(ctx, store, ttl, interval, nil)
 
 	// Create via idempotency key
 	key := "ttl-key"
 	headers := map[string]string{"Idempotency-Key": key}
-	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0}
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
 	res, _ := postJSON(t, ts.URL+"/transactions", in, headers)
 	if res.StatusCode != http.StatusAccepted {
 		t.Fatalf("expected 202, got %d", res.StatusCode)
@@ -423,3 +584,103 @@ func TestIdempotency_TTLEviction(t *testing.T) {
 		t.Fatalf("expected eviction to force a new transaction (different Location)")
 	}
 }
+
+func TestIdempotency_SameKeyWaitDoesNotBlockOthers(t *testing.T) {
+	ts, svc := newTestServer(t)
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.0, "currency": "EUR"}
+	res, _ := postJSON(t, ts.URL+"/transactions", in, nil)
+	loc := res.Header.Get("Location")
+
+	// hold the lock of "busy" as if a same-key request were in progress
+	unlock := svc.keyLocks.acquire(scopedIdemKey(withPrincipal(context.Background(), principal{ClientID: "client-a", Subject: "test-admin"}), "busy"))
+	blocked := make(chan int)
+	go func() {
+		res, _ := postJSON(t, ts.URL+"/transactions", in, map[string]string{"Idempotency-Key": "busy"})
+		blocked <- res.StatusCode
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if res, _ := get(t, ts.URL+loc); res.StatusCode != http.StatusOK {
+			t.Errorf("GET expected 200, got %d", res.StatusCode)
+		}
+		res, _ := postJSON(t, ts.URL+"/transactions", in, map[string]string{"Idempotency-Key": "other"})
+		if res.StatusCode != http.StatusAccepted {
+			t.Errorf("other key expected 202, got %d", res.StatusCode)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("GET and other-key POST waited on an unrelated idempotency key")
+	}
+
+	select {
+	case code := <-blocked:
+		t.Fatalf("same-key request should still wait, got %d", code)
+	default:
+	}
+	unlock()
+	if code := <-blocked; code != http.StatusAccepted {
+		t.Errorf("same-key request expected 202 after release, got %d", code)
+	}
+}
+
+// latencyStore simulates a store whose writes take time (disk, network), which
+// makes lock contention visible even on a single CPU.
+type latencyStore struct {
+	Store
+	delay time.Duration
+}
+
+func (s latencyStore) PutTransaction(t Transaction, events ...Event) error {
+	time.Sleep(s.delay)
+	return s.Store.PutTransaction(t, events...)
+}
+
+// BenchmarkCreate_Idempotent_DistinctKeys drives the handlers in-process against a
+// store with write latency, while a quarter of the requests are GETs. With one key
+// per request ns/op drops as parallelism grows, because only same-key requests
+// wait for each other and the store's lock is not held across the slow write.
+// No rule reads A1's history, so its bookings don't take the account lock either.
+func BenchmarkCreate_Idempotent_DistinctKeys(b *testing.B) {
+	for _, par := range []int{1, 4, 16} {
+		b.Run("parallelism="+strconv.Itoa(par), func(b *testing.B) {
+			svc := newService(latencyStore{Store: NewConStore(), delay: 200 * time.Microsecond}, testAuth())
+			mux := http.NewServeMux()
+			registerRoutes(mux, svc)
+
+			const body = `{"from_account_id":"A1","to_account_id":"A2","amount":"10.00","currency":"EUR"}`
+			seed := httptest.NewRecorder()
+			seedReq := httptest.NewRequest("POST", "/transactions", strings.NewReader(body))
+			seedReq.Header.Set(apiKeyHeader, testAPIKey)
+			seedReq.Header.Set("Authorization", adminBearer)
+			mux.ServeHTTP(seed, seedReq)
+			getURL := seed.Header().Get("Location")
+
+			var ctr uint64
+			b.SetParallelism(par)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := atomic.AddUint64(&ctr, 1)
+					var req *http.Request
+					if n%4 == 0 {
+						req = httptest.NewRequest("GET", getURL, nil)
+					} else {
+						req = httptest.NewRequest("POST", "/transactions", strings.NewReader(body))
+						req.Header.Set("Idempotency-Key", "bench-"+strconv.FormatUint(n, 10))
+					}
+					req.Header.Set(apiKeyHeader, testAPIKey)
+					req.Header.Set("Authorization", adminBearer)
+					mux.ServeHTTP(httptest.NewRecorder(), req)
+				}
+			})
+		})
+	}
+}
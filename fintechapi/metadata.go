@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Metadata
+// A transaction carries the client's own references: a description and a small
+// string map, set on create and edited with
+//
+//	PATCH /transactions/{id}  {"description": "...", "metadata": {"order": "42", "old": null}}
+//
+// The patch merges like RFC 7396: a null value deletes a key, "" clears the
+// description, absent fields stay as they are. Nothing else can be patched.
+//
+// GET returns a strong ETag and PATCH requires If-Match with it: an edit based on
+// a stale read gets 412 instead of overwriting someone else's. "If-Match: *"
+// would skip that check, so it gets 428 like a missing header. The ETag covers
+// the whole representation, so a status change or a reversal makes it stale too.
+//
+// GET /transactions?metadata[order]=42 lists the transactions with that pair;
+// several pairs must all match.
+
+const (
+	maxMetadataKeys     = 20
+	maxMetadataKeyLen   = 40
+	maxMetadataValueLen = 500
+	maxDescriptionLen   = 500
+)
+
+var errPreconditionFailed = errors.New("the transaction has changed since it was read")
+
+// validateAnnotations checks the bounds of a description and metadata map.
+func validateAnnotations(description string, md map[string]string) validationError {
+	var invalids validationError
+	if utf8.RuneCountInString(description) > maxDescriptionLen {
+		invalids = append(invalids, invalidParam{"description", fmt.Sprintf("must be at most %d characters", maxDescriptionLen)})
+	}
+	if len(md) > maxMetadataKeys {
+		invalids = append(invalids, invalidParam{"metadata", fmt.Sprintf("must have at most %d keys", maxMetadataKeys)})
+	}
+	for _, k := range slices.Sorted(maps.Keys(md)) {
+		switch {
+		case !validMetadataKey(k):
+			invalids = append(invalids, invalidParam{"metadata[" + k + "]", fmt.Sprintf("keys are 1 to %d letters, digits, '_', '-' or '.'", maxMetadataKeyLen)})
+		case utf8.RuneCountInString(md[k]) > maxMetadataValueLen:
+			invalids = append(invalids, invalidParam{"metadata[" + k + "]", fmt.Sprintf("must be at most %d characters", maxMetadataValueLen)})
+		}
+	}
+	return invalids
+}
+
+// validMetadataKey keeps keys usable in the metadata[key] query syntax.
+func validMetadataKey(k string) bool {
+	if k == "" || len(k) > maxMetadataKeyLen {
+		return false
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMetadataFilter reads the metadata[key]=value parameters of a list query.
+func parseMetadataFilter(q url.Values) (map[string]string, error) {
+	var filter map[string]string
+	for name, values := range q {
+		k, ok := strings.CutPrefix(name, "metadata[")
+		if !ok {
+			continue
+		}
+		k, ok = strings.CutSuffix(k, "]")
+		if !ok || !validMetadataKey(k) || len(values) != 1 {
+			return nil, validationError{{name, "use metadata[key]=value once per key"}}
+		}
+		if filter == nil {
+			filter = make(map[string]string)
+		}
+		filter[k] = values[0]
+	}
+	return filter, nil
+}
+
+// transactionETag is a strong validator of t's JSON representation.
+func transactionETag(t Transaction) string {
+	b, _ := json.Marshal(t) // a Transaction always marshals; map keys are sorted
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-Match header lists etag, comparing strongly.
+// "*" matches nothing: PATCH wants to know which version is being edited.
+func etagMatches(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		if v = strings.TrimSpace(v); v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+type transactionPatch struct {
+	Description *string            `json:"description"`
+	Metadata    map[string]*string `json:"metadata"`
+}
+
+// apply merges p into t. The metadata map is copied first: readers may still
+// hold the stored one.
+func (p transactionPatch) apply(t *Transaction) {
+	if p.Description != nil {
+		t.Description = *p.Description
+	}
+	if len(p.Metadata) == 0 {
+		return
+	}
+	md := maps.Clone(t.Metadata)
+	if md == nil {
+		md = make(map[string]string, len(p.Metadata))
+	}
+	for k, v := range p.Metadata {
+		if v == nil {
+			delete(md, k)
+		} else {
+			md[k] = *v
+		}
+	}
+	if len(md) == 0 {
+		md = nil
+	}
+	t.Metadata = md
+}
+
+// updateTransaction edits the description and metadata of transaction id if its
+// ETag still matches ifMatch, and publishes the change.
+func (svc *service) updateTransaction(id, ifMatch string, patch transactionPatch) (Transaction, error) {
+	var w txWrite
+	t, err := svc.store.ApplyTransaction(id, func(t *Transaction) (txWrite, error) {
+		before := transactionETag(*t)
+		if !etagMatches(ifMatch, before) {
+			return txWrite{}, errPreconditionFailed
+		}
+		patch.apply(t)
+		if invalid := validateAnnotations(t.Description, t.Metadata); len(invalid) > 0 {
+			return txWrite{}, invalid
+		}
+		if transactionETag(*t) != before {
+			w.Events = []Event{newEvent(EventTransactionUpdated, *t)}
+		}
+		return w, nil
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	svc.outbox.notify()
+	return t, nil
+}
+
+func patchTransaction(w http.ResponseWriter, r *http.Request, svc *service) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || strings.TrimSpace(ifMatch) == "*" {
+		writeError(w, codePreconditionRequired, "send If-Match with the ETag of the transaction")
+		return
+	}
+	var in transactionPatch
+	if err := bindJSON(r, &in); err != nil {
+		writeError(w, codeMalformedRequest, "only description and metadata can be changed")
+		return
+	}
+
+	id := r.PathValue("id")
+	orig, ok, err := svc.store.GetTransaction(id)
+	if err != nil {
+		writeError(w, codeInternal, "could not read transaction")
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	if !ok || !p.canSee(orig) {
+		writeError(w, codeNotFound, "this payment does not exist")
+		return
+	}
+	if !p.owns(orig.FromAccountID) {
+		writeError(w, codeForbidden, "not allowed to edit transfers from this account")
+		return
+	}
+
+	t, err := svc.updateTransaction(id, ifMatch, in)
+	var invalid validationError
+	switch {
+	case errors.Is(err, errTransactionNotFound):
+		writeError(w, codeNotFound, "this payment does not exist")
+		return
+	case errors.Is(err, errPreconditionFailed):
+		writeError(w, codePreconditionFailed, err.Error())
+		return
+	case errors.As(err, &invalid):
+		writeInvalid(w, err)
+		return
+	case err != nil:
+		writeError(w, codeInternal, "could not update transaction")
+		return
+	}
+
+	w.Header().Set("ETag", transactionETag(t))
+	writeJSON(w, http.StatusOK, t)
+}
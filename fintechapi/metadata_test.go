@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func patchJSON(t *testing.T, url string, body any, ifMatch, authorization string) (*http.Response, []byte) {
+	t.Helper()
+
+	b, _ := json.Marshal(body)
+	req, _ := http.NewRequest("PATCH", url, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", authorization)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PATCH %s failed: %v", url, err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+
+	return res, data
+}
+
+func createAnnotated(t *testing.T, ts *httptest.Server, from string, md map[string]string) (Transaction, string) {
+	t.Helper()
+
+	in := map[string]any{"from_account_id": from, "to_account_id": "A2", "amount": "1", "currency": "EUR", "description": "rent", "metadata": md}
+	res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+	if res.StatusCode != http.StatusAccepted || res.Header.Get("ETag") == "" {
+		t.Fatalf("expected 202 with an ETag, got %d body=%s", res.StatusCode, string(body))
+	}
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	return tr, res.Header.Get("ETag")
+}
+
+func TestValidateAnnotations(t *testing.T) {
+	many := map[string]string{}
+	for i := 0; i <= maxMetadataKeys; i++ {
+		many[strings.Repeat("k", i+1)] = "v"
+	}
+	for _, test := range []struct {
+		Name        string
+		Description string
+		Metadata    map[string]string
+		Want        []string // names in invalid-params
+	}{
+		{Name: "Fine", Description: "rent", Metadata: map[string]string{"order_id": "42", "a.b-c": ""}},
+		{Name: "LongDescription", Description: strings.Repeat("é", maxDescriptionLen+1), Want: []string{"description"}},
+		{Name: "TooManyKeys", Metadata: many, Want: []string{"metadata"}},
+		{Name: "LongKey", Metadata: map[string]string{strings.Repeat("k", maxMetadataKeyLen+1): "v"}, Want: []string{"metadata[" + strings.Repeat("k", maxMetadataKeyLen+1) + "]"}},
+		{Name: "BadKeys", Metadata: map[string]string{"": "x", "a]b": "y"}, Want: []string{"metadata[]", "metadata[a]b]"}},
+		{Name: "LongValue", Metadata: map[string]string{"k": strings.Repeat("v", maxMetadataValueLen+1)}, Want: []string{"metadata[k]"}},
+	} {
+		var got []string
+		for _, p := range validateAnnotations(test.Description, test.Metadata) {
+			got = append(got, p.Name)
+		}
+		if !reflect.DeepEqual(got, test.Want) {
+			t.Errorf("%s: want %v, got %v", test.Name, test.Want, got)
+		}
+	}
+}
+
+func TestAPI_PatchTransaction(t *testing.T) {
+	ts, _ := newTestServer(t)
+	tr, etag := createAnnotated(t, ts, "A1", map[string]string{"order": "42", "old": "x"})
+	url := ts.URL + "/transactions/" + tr.ID
+
+	res, _ := get(t, url)
+	if res.Header.Get("ETag") != etag {
+		t.Fatalf("GET and POST disagree on the ETag: %q vs %q", res.Header.Get("ETag"), etag)
+	}
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", adminBearer)
+	req.Header.Set("If-None-Match", etag)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: expected 304, got %v %v", res, err)
+	} else {
+		res.Body.Close()
+	}
+
+	patch := map[string]any{"description": "rent march", "metadata": map[string]any{"old": nil, "invoice": "INV-7"}}
+	for _, ifMatch := range []string{"", "*"} {
+		if res, body := patchJSON(t, url, patch, ifMatch, adminBearer); res.StatusCode != http.StatusPreconditionRequired {
+			t.Errorf("If-Match %q: expected 428, got %d body=%s", ifMatch, res.StatusCode, string(body))
+		}
+	}
+	if res, body := patchJSON(t, url, patch, `"other", *`, adminBearer); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("If-Match with * in a list: expected 412, got %d body=%s", res.StatusCode, string(body))
+	}
+	res, body := patchJSON(t, url, patch, etag, adminBearer)
+	var got Transaction
+	_ = json.Unmarshal(body, &got)
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") == etag {
+		t.Fatalf("expected 200 with a new ETag, got %d body=%s", res.StatusCode, string(body))
+	}
+	want := map[string]string{"order": "42", "invoice": "INV-7"}
+	if got.Description != "rent march" || !reflect.DeepEqual(got.Metadata, want) || got.Amount != tr.Amount {
+		t.Errorf("unexpected result %+v", got)
+	}
+	fresh := res.Header.Get("ETag")
+
+	// the first ETag is stale now
+	if res, body := patchJSON(t, url, map[string]any{"description": "lost"}, etag, adminBearer); res.StatusCode != http.StatusPreconditionFailed || !strings.Contains(string(body), codePreconditionFailed) {
+		t.Errorf("stale If-Match: expected 412, got %d body=%s", res.StatusCode, string(body))
+	}
+	// so is the fresh one after a status change
+	_, _ = putJSON(t, url+"/status", map[string]any{"status": "completed"})
+	if res, _ := patchJSON(t, url, map[string]any{"description": "lost"}, fresh, adminBearer); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("ETag after a status change: expected 412, got %d", res.StatusCode)
+	}
+
+	res, _ = get(t, url)
+	current := res.Header.Get("ETag")
+	for _, test := range []struct {
+		Name   string
+		Patch  any
+		Auth   string
+		Status int
+	}{
+		{Name: "OtherFields", Patch: map[string]any{"amount": "100"}, Auth: adminBearer, Status: http.StatusBadRequest},
+		{Name: "BadKey", Patch: map[string]any{"metadata": map[string]any{"a b": "x"}}, Auth: adminBearer, Status: http.StatusBadRequest},
+		{Name: "Receiver", Patch: map[string]any{"description": "mine"}, Auth: bearer("bob", "", "A2"), Status: http.StatusForbidden},
+		{Name: "Stranger", Patch: map[string]any{"description": "mine"}, Auth: bearer("mallory", "", "Z1"), Status: http.StatusNotFound},
+	} {
+		if res, body := patchJSON(t, url, test.Patch, current, test.Auth); res.StatusCode != test.Status {
+			t.Errorf("%s: expected %d, got %d body=%s", test.Name, test.Status, res.StatusCode, string(body))
+		}
+	}
+}
+
+func TestAPI_PatchTransactionConcurrent(t *testing.T) {
+	ts, _ := newTestServer(t)
+	tr, etag := createAnnotated(t, ts, "A1", nil)
+
+	const n = 8
+	codes := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, _ := patchJSON(t, ts.URL+"/transactions/"+tr.ID, map[string]any{"metadata": map[string]any{"writer": strings.Repeat("w", i+1)}}, etag, adminBearer)
+			codes <- res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	won := 0
+	for c := range codes {
+		switch c {
+		case http.StatusOK:
+			won++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("unexpected status %d", c)
+		}
+	}
+	if won != 1 {
+		t.Errorf("exactly one edit may win, got %d", won)
+	}
+}
+
+func TestAPI_ListByMetadata(t *testing.T) {
+	ts, _ := newTestServer(t)
+	a, _ := createAnnotated(t, ts, "A1", map[string]string{"order": "42", "shop": "north"})
+	createAnnotated(t, ts, "A1", map[string]string{"order": "43", "shop": "north"})
+	createAnnotated(t, ts, "A1", nil)
+
+	for query, want := range map[string][]string{
+		"?metadata[order]=42":                      {a.ID},
+		"?metadata[shop]=north&metadata[order]=42": {a.ID},
+		"?metadata[shop]=south":                    {},
+	} {
+		res, body := get(t, ts.URL+"/transactions"+query)
+		var page struct{ Items []Transaction }
+		_ = json.Unmarshal(body, &page)
+		got := []string{}
+		for _, tr := range page.Items {
+			got = append(got, tr.ID)
+		}
+		if res.StatusCode != http.StatusOK || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want %v, got %d %v", query, want, res.StatusCode, got)
+		}
+	}
+	if res, _ := get(t, ts.URL+"/transactions?metadata[a%20b]=1"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad key: expected 400, got %d", res.StatusCode)
+	}
+}
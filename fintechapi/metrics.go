@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics
+// GET /metrics serves the Prometheus text exposition format (version 0.0.4).
+// Counters and histograms are updated as requests run; gauges and the idempotency
+// cache counters are read from their owners at scrape time. /metrics is not
+// behind authentication, like most scrape targets; keep it on an internal network.
+
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricFamily is one metric name with all its series.
+type metricFamily interface {
+	write(w io.Writer) error
+}
+
+// sample is one series of a gauge or counter read at scrape time.
+type sample struct {
+	labels []string // values, in the order of the family's label names
+	value  float64
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*sample
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: make(map[string]*sample)}
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &sample{labels: values}
+		c.series[key] = s
+	}
+	s.value += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(values ...string) { c.add(1, values...) }
+
+func (c *counterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	samples := make([]sample, 0, len(c.series))
+	for _, s := range c.series {
+		samples = append(samples, *s)
+	}
+	c.mu.Unlock()
+	return writeSamples(w, c.name, c.help, "counter", c.labels, samples)
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending; +Inf is implied
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	i := sort.SearchFloat64s(h.buckets, v) // first bucket with v <= bound
+
+	h.mu.Lock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: values, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[i]++
+	s.sum += v
+	s.count++
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) write(w io.Writer) error {
+	h.mu.Lock()
+	series := make([]histogramSeries, 0, len(h.series))
+	for _, s := range h.series {
+		c := *s
+		c.counts = append([]uint64(nil), s.counts...)
+		series = append(series, c)
+	}
+	h.mu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].labels, "\xff") < strings.Join(series[j].labels, "\xff")
+	})
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	withLe := append(append([]string(nil), h.labels...), "le")
+	for _, s := range series {
+		var cum uint64
+		for i, bound := range append(slices.Clip(h.buckets), math.Inf(1)) {
+			cum += s.counts[i]
+			le := append(append([]string(nil), s.labels...), formatFloat(bound))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(withLe, le), cum); err != nil {
+				return err
+			}
+		}
+		lbl := formatLabels(h.labels, s.labels)
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, lbl, formatFloat(s.sum), h.name, lbl, s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// funcFamily is a gauge or counter whose series are read from fn at scrape time.
+type funcFamily struct {
+	name, help, typ string
+	labels          []string
+	fn              func() []sample
+}
+
+func (f funcFamily) write(w io.Writer) error {
+	return writeSamples(w, f.name, f.help, f.typ, f.labels, f.fn())
+}
+
+func writeSamples(w io.Writer, name, help, typ string, labels []string, samples []sample) error {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ); err != nil {
+		return err
+	}
+	for _, s := range samples {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, s.labels), formatFloat(s.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metrics are the instruments of a service.
+type metrics struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+	idemReplays     *counterVec
+	idemConflicts   *counterVec
+	sweepDuration   *histogramVec
+	swept           *counterVec
+
+	families []metricFamily // in exposition order
+}
+
+func newMetrics(svc *service) *metrics {
+	m := &metrics{
+		requests: newCounterVec("fintech_http_requests_total",
+			"HTTP requests by route and status code.", "route", "code"),
+		requestDuration: newHistogramVec("fintech_http_request_duration_seconds",
+			"HTTP request latency by route and status code.", defaultLatencyBuckets, "route", "code"),
+		idemReplays: newCounterVec("fintech_idempotency_replays_total",
+			"Responses replayed for a repeated Idempotency-Key."),
+		idemConflicts: newCounterVec("fintech_idempotency_conflicts_total",
+			"409 responses for an Idempotency-Key, by reason (payload_mismatch, in_flight).", "reason"),
+		sweepDuration: newHistogramVec("fintech_idem_sweep_duration_seconds",
+			"Duration of idempotency sweeper runs.", defaultLatencyBuckets),
+		swept: newCounterVec("fintech_idem_swept_total",
+			"Idempotency records removed by the sweeper."),
+	}
+
+	idem := func(get func(idemStats) float64) func() []sample {
+		return func() []sample { return []sample{{value: get(svc.store.IdemStats())}} }
+	}
+	m.families = []metricFamily{
+		m.requests,
+		m.requestDuration,
+		funcFamily{name: "fintech_transactions", help: "Stored transactions by status.", typ: "gauge",
+			labels: []string{"status"}, fn: func() []sample {
+				counts, err := svc.store.CountTransactions()
+				if err != nil {
+					return nil
+				}
+				out := make([]sample, 0, len(statusName))
+				for st, name := range statusName {
+					out = append(out, sample{labels: []string{name}, value: float64(counts[st])})
+				}
+				return out
+			}},
+		m.idemReplays,
+		m.idemConflicts,
+		funcFamily{name: "fintech_idem_cache_hits_total", help: "Idempotency cache lookups that found a matching record.",
+			typ: "counter", fn: idem(func(s idemStats) float64 { return float64(s.Hits) })},
+		funcFamily{name: "fintech_idem_cache_misses_total", help: "Idempotency cache lookups that found no record.",
+			typ: "counter", fn: idem(func(s idemStats) float64 { return float64(s.Misses) })},
+		funcFamily{name: "fintech_idem_cache_entries", help: "Records in the idempotency cache.",
+			typ: "gauge", fn: idem(func(s idemStats) float64 { return float64(s.Entries) })},
+		funcFamily{name: "fintech_idem_cache_bytes", help: "Approximate size of the idempotency cache.",
+			typ: "gauge", fn: idem(func(s idemStats) float64 { return float64(s.Bytes) })},
+		funcFamily{name: "fintech_idem_cache_evictions_total", help: "Idempotency records dropped, by reason (lru, expired).",
+			typ: "counter", labels: []string{"reason"}, fn: func() []sample {
+				s := svc.store.IdemStats()
+				return []sample{{labels: []string{"lru"}, value: float64(s.Evictions)}, {labels: []string{"expired"}, value: float64(s.Expired)}}
+			}},
+		m.sweepDuration,
+		m.swept,
+		funcFamily{name: "fintech_request_lock_entries", help: "Idempotency keys, accounts and standing orders with a request holding or waiting for their lock.",
+			typ: "gauge", fn: func() []sample { return []sample{{value: float64(svc.keyLocks.len())}} }},
+	}
+	return m
+}
+
+// observeSweep is the sweeper callback.
+func (m *metrics) observeSweep(took time.Duration, swept int) {
+	m.sweepDuration.observe(took.Seconds())
+	m.swept.add(float64(swept))
+}
+
+// instrument counts and times the requests of one route.
+func (m *metrics) instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		code := strconv.Itoa(sw.status)
+		m.requests.inc(route, code)
+		m.requestDuration.observe(time.Since(start).Seconds(), route, code)
+	})
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, f := range m.families {
+		if err := f.write(w); err != nil {
+			return
+		}
+	}
+}
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status, sw.wroteHeader = status, true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and deadlines (event streams).
+func (sw *statusWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
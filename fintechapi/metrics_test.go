@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape fetches /metrics and parses the text format into "name{labels}" -> value,
+// checking that every sample belongs to a family announced with # TYPE.
+func scrape(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+
+	res, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("expected 200 text/plain 0.0.4, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	types := map[string]string{}
+	out := map[string]float64{}
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, typ, _ := strings.Cut(rest, " ")
+			types[name] = typ
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("malformed sample %q", line)
+		}
+		series, raw := line[:i], line[i+1:]
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			t.Fatalf("malformed value in %q: %v", line, err)
+		}
+		name, _, _ := strings.Cut(series, "{")
+		family := name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base, ok := strings.CutSuffix(name, suffix); ok && types[base] == "histogram" {
+				family = base
+			}
+		}
+		if types[family] == "" {
+			t.Errorf("sample %q without a # TYPE line", line)
+		}
+		out[series] = v
+	}
+	return out
+}
+
+func TestMetrics_Scrape(t *testing.T) {
+	ts, svc := newTestServer(t)
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1", "currency": "EUR"}
+	key := map[string]string{"Idempotency-Key": "m-1"}
+	_, _ = postJSON(t, ts.URL+"/transactions", in, key)
+	_, _ = postJSON(t, ts.URL+"/transactions", in, key) // replay
+	in["amount"] = "2"
+	_, _ = postJSON(t, ts.URL+"/transactions", in, key) // payload mismatch
+	_, _ = postJSON(t, ts.URL+"/transactions", map[string]any{}, nil)
+
+	unlock := svc.keyLocks.acquire("held")
+	m := scrape(t, ts.URL)
+	unlock()
+
+	want := map[string]float64{
+		`fintech_http_requests_total{route="POST /transactions",code="202"}`:                            2,
+		`fintech_http_requests_total{route="POST /transactions",code="409"}`:                            1,
+		`fintech_http_requests_total{route="POST /transactions",code="400"}`:                            1,
+		`fintech_http_request_duration_seconds_count{route="POST /transactions",code="202"}`:            2,
+		`fintech_http_request_duration_seconds_bucket{route="POST /transactions",code="202",le="+Inf"}`: 2,
+		`fintech_transactions{status="pending"}`:                                                        1,
+		`fintech_transactions{status="completed"}`:                                                      0,
+		`fintech_idempotency_replays_total`:                                                             1,
+		`fintech_idempotency_conflicts_total{reason="payload_mismatch"}`:                                1,
+		`fintech_idem_cache_entries`:                                                                    1,
+		`fintech_idem_cache_evictions_total{reason="lru"}`:                                              0,
+		`fintech_request_lock_entries`:                                                                  1,
+	}
+	for series, v := range want {
+		got, ok := m[series]
+		if !ok {
+			t.Errorf("missing %s", series)
+		} else if got != v {
+			t.Errorf("%s: want %g, got %g", series, v, got)
+		}
+	}
+	if m["fintech_idem_cache_hits_total"] < 1 {
+		t.Errorf("the replay should count as a cache hit")
+	}
+
+	// buckets are cumulative and end at the count
+	prev := -1.0
+	for _, le := range []string{"0.005", "0.01", "0.1", "1", "10", "+Inf"} {
+		v := m[`fintech_http_request_duration_seconds_bucket{route="POST /transactions",code="202",le="`+le+`"}`]
+		if v < prev {
+			t.Errorf("bucket le=%s decreases: %g < %g", le, v, prev)
+		}
+		prev = v
+	}
+}
+
+func TestMetrics_SweeperRuns(t *testing.T) {
+	svc := newService(NewConStore(), testAuth())
+	_ = svc.store.PutIdem("old", idemRecord{Hash: "h", StatusCode: 201, CreatedAt: time.Now().Add(-time.Hour)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go startCacheSweeperWith(ctx, svc.store, time.Minute, 5*time.Millisecond, svc.metrics.observeSweep)
+
+	var out string
+	waitFor(t, "a sweep", func() bool {
+		var buf bytes.Buffer
+		for _, f := range svc.metrics.families {
+			if err := f.write(&buf); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		out = buf.String()
+		return strings.Contains(out, "fintech_idem_swept_total 1\n")
+	})
+	for _, line := range []string{
+		`fintech_idem_sweep_duration_seconds_bucket{le="+Inf"} `,
+		`fintech_idem_sweep_duration_seconds_count `,
+		`fintech_idem_cache_evictions_total{reason="expired"} 1`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+}
+
+func TestFormatLabels_Escapes(t *testing.T) {
+	got := formatLabels([]string{"a", "b"}, []string{`x"y`, "1\\2\n"})
+	if want := `{a="x\"y",b="1\\2\n"}`; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money
+// Amounts are carried as integer minor units (cents for EUR) together with an
+// ISO 4217 currency code. Floats are never used for money: 0.1+0.2 is not 0.3.
+
+// currencyExponent holds the number of minor-unit digits per supported ISO 4217 code.
+var currencyExponent = map[string]int{
+	"EUR": 2,
+	"USD": 2,
+	"GBP": 2,
+	"CHF": 2,
+	"SEK": 2,
+	"NOK": 2,
+	"DKK": 2,
+	"PLN": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"BHD": 3,
+}
+
+var (
+	errUnknownCurrency = errors.New("unknown currency")
+	errInvalidAmount   = errors.New("invalid amount")
+	errAmountPrecision = errors.New("amount has more decimals than the currency allows")
+)
+
+// Money is an amount in integer minor units of an ISO 4217 currency.
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// String renders the amount in major units, e.g. "10.50 EUR".
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// Decimal renders the amount in major units with exactly the currency exponent
+// of fraction digits, e.g. 1050 EUR -> "10.50". Unknown currencies render as minor units.
+func (m Money) Decimal() string {
+	return formatMinor(m.Minor, currencyExponent[m.Currency])
+}
+
+func formatMinor(minor int64, exp int) string {
+	neg := minor < 0
+	u := uint64(minor)
+	if neg {
+		u = -u
+	}
+	digits := strconv.FormatUint(u, 10)
+	if exp > 0 {
+		if len(digits) <= exp {
+			digits = strings.Repeat("0", exp-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+	}
+	if neg {
+		return "-" + digits
+	}
+	return digits
+}
+
+// normalizeCurrency upper-cases and checks a currency code against the exponent table.
+func normalizeCurrency(code string) (string, int, error) {
+	c := strings.ToUpper(strings.TrimSpace(code))
+	exp, ok := currencyExponent[c]
+	if !ok {
+		return "", 0, errUnknownCurrency
+	}
+	return c, exp, nil
+}
+
+// ParseMoney converts a decimal string in major units to Money. It rejects signs,
+// exponents and more significant fraction digits than the currency allows
+// ("10.001" EUR), but tolerates trailing zeros ("10.500" EUR is 1050).
+func ParseMoney(amount, currency string) (Money, error) {
+	cur, exp, err := normalizeCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	minor, err := parseMinor(strings.TrimSpace(amount), exp)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Minor: minor, Currency: cur}, nil
+}
+
+func parseMinor(s string, exp int) (int64, error) {
+	intPart, fracPart, hasDot := strings.Cut(s, ".")
+	if intPart == "" || (hasDot && fracPart == "") || !isDigits(intPart) || !isDigits(fracPart) {
+		return 0, errInvalidAmount
+	}
+	if len(fracPart) > exp {
+		if strings.Trim(fracPart[exp:], "0") != "" {
+			return 0, errAmountPrecision
+		}
+		fracPart = fracPart[:exp]
+	}
+	fracPart += strings.Repeat("0", exp-len(fracPart))
+
+	v, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil || v > math.MaxInt64/2 { // keep headroom for sums
+		return 0, errInvalidAmount
+	}
+	return v, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// decimalAmount is a JSON amount in major units. It accepts both a string ("10.50")
+// and a number literal (10.50); the literal text is kept so no float rounding happens.
+type decimalAmount string
+
+func (d *decimalAmount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*d = decimalAmount(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("amount must be a decimal string or number: %w", err)
+	}
+	*d = decimalAmount(n)
+	return nil
+}
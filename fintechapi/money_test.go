@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		Amount    string
+		Currency  string
+		WantMinor int64
+		WantCur   string
+		WantError bool
+	}{
+		{Amount: "10.50", Currency: "EUR", WantMinor: 1050, WantCur: "EUR"},
+		{Amount: "10.5", Currency: "eur", WantMinor: 1050, WantCur: "EUR"},
+		{Amount: "10", Currency: "EUR", WantMinor: 1000, WantCur: "EUR"},
+		{Amount: "10.500", Currency: "EUR", WantMinor: 1050, WantCur: "EUR"},
+		{Amount: "0.30000000000000004", Currency: "EUR", WantError: true},
+		{Amount: "10.001", Currency: "EUR", WantError: true},
+		{Amount: "1500", Currency: "JPY", WantMinor: 1500, WantCur: "JPY"},
+		{Amount: "15.5", Currency: "JPY", WantError: true},
+		{Amount: "1.234", Currency: "KWD", WantMinor: 1234, WantCur: "KWD"},
+		{Amount: "1e3", Currency: "EUR", WantError: true},
+		{Amount: "-1", Currency: "EUR", WantError: true},
+		{Amount: ".5", Currency: "EUR", WantError: true},
+		{Amount: "5.", Currency: "EUR", WantError: true},
+		{Amount: "", Currency: "EUR", WantError: true},
+		{Amount: "99999999999999999999", Currency: "EUR", WantError: true},
+		{Amount: "1", Currency: "ZZZ", WantError: true},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMoney(test.Amount, test.Currency)
+		if test.WantError {
+			if err == nil {
+				t.Errorf("%q %s: want error, got %v", test.Amount, test.Currency, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %s: want no error, got %s", test.Amount, test.Currency, err)
+			continue
+		}
+		if m.Minor != test.WantMinor || m.Currency != test.WantCur {
+			t.Errorf("%q %s: want %d %s, got %d %s", test.Amount, test.Currency, test.WantMinor, test.WantCur, m.Minor, m.Currency)
+		}
+	}
+}
+
+func TestMoneyDecimal(t *testing.T) {
+	tests := []struct {
+		M    Money
+		Want string
+	}{
+		{M: Money{Minor: 1050, Currency: "EUR"}, Want: "10.50"},
+		{M: Money{Minor: 5, Currency: "EUR"}, Want: "0.05"},
+		{M: Money{Minor: -5, Currency: "EUR"}, Want: "-0.05"},
+		{M: Money{Minor: 1500, Currency: "JPY"}, Want: "1500"},
+		{M: Money{Minor: 1, Currency: "KWD"}, Want: "0.001"},
+	}
+	for _, test := range tests {
+		if got := test.M.Decimal(); got != test.Want {
+			t.Errorf("%d %s: want %q, got %q", test.M.Minor, test.M.Currency, test.Want, got)
+		}
+	}
+}
+
+func TestDecimalAmount_KeepsLiteralText(t *testing.T) {
+	var in transactionRequest
+	if err := json.Unmarshal([]byte(`{"amount":0.30000000000000004,"currency":"EUR"}`), &in); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if in.Amount != "0.30000000000000004" {
+		t.Fatalf("number literal should be kept verbatim, got %q", in.Amount)
+	}
+	if err := json.Unmarshal([]byte(`{"amount":"10.10","currency":"EUR"}`), &in); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if in.Amount != "10.10" {
+		t.Fatalf("string amount should be kept verbatim, got %q", in.Amount)
+	}
+	if err := json.Unmarshal([]byte(`{"amount":true}`), &in); err == nil {
+		t.Fatalf("boolean amount should not decode")
+	}
+}
+
+func TestCanonicalTransaction(t *testing.T) {
+	a := transactionRequest{FromAccountID: "A1", ToAccountID: "A2", Amount: "10.5", Currency: "eur"}
+	b := transactionRequest{FromAccountID: " A1", ToAccountID: "A2 ", Amount: "10.50", Currency: "EUR"}
+	c := transactionRequest{FromAccountID: "A1", ToAccountID: "A2", Amount: "10.51", Currency: "EUR"}
+
+	fa, _ := canonicalTransaction(a)
+	fb, _ := canonicalTransaction(b)
+	fc, _ := canonicalTransaction(c)
+	if string(fa) != string(fb) {
+		t.Errorf("equivalent requests should share a fingerprint")
+	}
+	if string(fa) == string(fc) {
+		t.Errorf("different amounts should not share a fingerprint")
+	}
+}
+
+func TestAPI_Money(t *testing.T) {
+	t.Run("StoresMinorUnitsAndCurrency", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+
+		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "10.10", "currency": "eur"}
+		res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d body=%s", res.StatusCode, string(body))
+		}
+		var tr Transaction
+		if err := json.Unmarshal(body, &tr); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if tr.Amount != 1010 || tr.Currency != "EUR" {
+			t.Errorf("expected 1010 EUR, got %d %s", tr.Amount, tr.Currency)
+		}
+	})
+
+	t.Run("RejectsExcessPrecision", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+
+		in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "10.001", "currency": "EUR"}
+		res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+		if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "amount") {
+			t.Fatalf("expected 400 mentioning amount, got %d body=%s", res.StatusCode, string(body))
+		}
+	})
+
+	t.Run("Idempotency_EquivalentDecimalsReplay", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+
+		headers := map[string]string{"Idempotency-Key": "money-key"}
+		in1 := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "10.5", "currency": "EUR"}
+		in2 := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": 10.50, "currency": "eur"}
+
+		res1, _ := postJSON(t, ts.URL+"/transactions", in1, headers)
+		res2, _ := postJSON(t, ts.URL+"/transactions", in2, headers)
+		if res1.StatusCode != http.StatusAccepted || res2.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected 202 twice, got %d and %d", res1.StatusCode, res2.StatusCode)
+		}
+		if res1.Header.Get("Location") != res2.Header.Get("Location") {
+			t.Errorf("equivalent payloads should replay the same transaction")
+		}
+	})
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbox
+// Every write of transactions stores the events it raises in the same critical
+// section (in the same log line for the file store), numbered in write order:
+// an event is in the outbox if and only if its change is in the store. The
+// dispatcher delivers the outbox in order to each sink: webhooks (webhooks.go),
+// event streams (stream.go) and the configured ones:
+//
+//	-outbox-sinks log,file:/var/lib/fintech/events.jsonl,https://events.example.com/ingest
+//
+// A configured sink keeps its offset, the seq of the last entry it took, in the
+// store. The offset is saved once per batch the sink took, so a crash in between
+// delivers that batch again after the restart: delivery is at least once, and
+// sinks tell repeats apart by the event id. A failing sink, or one whose offset
+// cannot be read, is retried with backoff and holds up only itself. Webhooks and streams serve only the running
+// process: they start after the newest entry and keep their offsets in memory.
+//
+// Entries every sink has taken are pruned; the file store drops them from its
+// log at the next compaction, which pruning and saving offsets look out for. A slow sink holds pruning back, a sink no longer
+// configured does not (configured again later, it misses what was pruned).
+
+const (
+	outboxBatch        = 100
+	outboxPollInterval = time.Second // in case a wake-up is missed
+	outboxBackoff      = 100 * time.Millisecond
+	outboxHTTPTimeout  = 10 * time.Second
+)
+
+// outboxEntry is an event in the outbox.
+type outboxEntry struct {
+	Seq int64 `json:"seq"` // 1, 2, ... in write order
+	Event
+}
+
+// numberEvents makes outbox entries of events, following the entry last.
+func numberEvents(last int64, events []Event) []outboxEntry {
+	if len(events) == 0 {
+		return nil
+	}
+	entries := make([]outboxEntry, len(events))
+	for i, ev := range events {
+		entries[i] = outboxEntry{Seq: last + int64(i) + 1, Event: ev}
+	}
+	return entries
+}
+
+// outboxSink is where the dispatcher delivers the outbox. deliver returns nil
+// once the sink has taken e for good.
+type outboxSink interface {
+	name() string // the key of its offset: keep it stable across restarts
+	deliver(ctx context.Context, e outboxEntry) error
+}
+
+// parseOutboxSinks parses a comma-separated list of sinks: log, file:PATH or an
+// http(s) URL.
+func parseOutboxSinks(spec string) ([]outboxSink, error) {
+	var sinks []outboxSink
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if seen[s] {
+			return nil, fmt.Errorf("outbox sink %q is listed twice", s)
+		}
+		seen[s] = true
+
+		switch path, isFile := strings.CutPrefix(s, "file:"); {
+		case s == "log":
+			sinks = append(sinks, logSink{})
+		case isFile:
+			if path == "" {
+				return nil, fmt.Errorf("outbox sink %q: file: needs a path", s)
+			}
+			sinks = append(sinks, fileSink{path: path})
+		case strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://"):
+			if u, err := url.Parse(s); err != nil || u.Host == "" {
+				return nil, fmt.Errorf("outbox sink %q: not a valid URL", s)
+			}
+			sinks = append(sinks, httpSink{url: s, client: &http.Client{Timeout: outboxHTTPTimeout}})
+		default:
+			return nil, fmt.Errorf("outbox sink %q: want log, file:PATH or an http(s) URL", s)
+		}
+	}
+	return sinks, nil
+}
+
+// logSink writes a line per event to the standard logger.
+type logSink struct{}
+
+func (logSink) name() string { return "log" }
+
+func (logSink) deliver(_ context.Context, e outboxEntry) error {
+	log.Printf("event %d %s %s transaction=%s", e.Seq, e.ID, e.Type, e.Transaction.ID)
+	return nil
+}
+
+// fileSink appends each entry as a JSON line to a file and fsyncs it.
+type fileSink struct {
+	path string
+}
+
+func (s fileSink) name() string { return "file:" + s.path }
+
+func (s fileSink) deliver(_ context.Context, e outboxEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// httpSink POSTs each entry as JSON; any 2xx takes it.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s httpSink) name() string { return s.url }
+
+func (s httpSink) deliver(ctx context.Context, e outboxEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Event-Id", e.ID)
+	req.Header.Set("Event-Type", e.Type)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("sink answered %d", res.StatusCode)
+	}
+	return nil
+}
+
+// outboxDispatcher delivers the outbox of store to its sinks, one goroutine
+// each, and prunes the entries all of them have taken.
+type outboxDispatcher struct {
+	store   Store
+	sinks   []*sinkState
+	poll    time.Duration
+	backoff time.Duration
+
+	mu     sync.Mutex // guards the sinks' offsets and pruned
+	pruned int64
+}
+
+// sinkState is a sink and how far it has got.
+type sinkState struct {
+	outboxSink
+	live   bool // see addLive
+	wake   chan struct{}
+	offset int64 // taken, and saved unless live; guarded by the dispatcher's mu
+}
+
+func newOutboxDispatcher(store Store, sinks []outboxSink) *outboxDispatcher {
+	d := &outboxDispatcher{store: store, poll: outboxPollInterval, backoff: outboxBackoff}
+	d.add(sinks...)
+	return d
+}
+
+// add adds sinks that go on from their saved offsets. Call it before run.
+func (d *outboxDispatcher) add(sinks ...outboxSink) {
+	for _, sink := range sinks {
+		d.sinks = append(d.sinks, &sinkState{outboxSink: sink, wake: make(chan struct{}, 1)})
+	}
+}
+
+// addLive adds sinks that serve only this process, like webhooks and event
+// streams: they start after the entry after and their offsets are not saved.
+// Call it before run.
+func (d *outboxDispatcher) addLive(after int64, sinks ...outboxSink) {
+	for _, sink := range sinks {
+		d.sinks = append(d.sinks, &sinkState{outboxSink: sink, live: true, wake: make(chan struct{}, 1), offset: after})
+	}
+}
+
+// notify tells the sinks there are new entries.
+func (d *outboxDispatcher) notify() {
+	for _, s := range d.sinks {
+		select {
+		case s.wake <- struct{}{}:
+		default: // a wake-up is already pending
+		}
+	}
+}
+
+// run delivers until ctx is done.
+func (d *outboxDispatcher) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range d.sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.drain(ctx, s)
+		}()
+	}
+	wg.Wait()
+}
+
+// drain delivers the entries after s's offset, then waits for more.
+func (d *outboxDispatcher) drain(ctx context.Context, s *sinkState) {
+	if !s.live && !d.loadOffset(ctx, s) {
+		return
+	}
+	d.mu.Lock()
+	offset := s.offset
+	d.mu.Unlock()
+	poll := time.NewTicker(d.poll)
+	defer poll.Stop()
+	for {
+		entries, err := d.store.ListOutbox(offset, outboxBatch)
+		if err != nil {
+			log.Printf("outbox %s: listing entries: %v", s.name(), err)
+		}
+		taken := offset
+		for _, e := range entries {
+			if !d.deliver(ctx, s, e) {
+				break
+			}
+			taken = e.Seq
+		}
+		if taken > offset {
+			offset = taken
+			d.took(s, offset)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if len(entries) == outboxBatch {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-poll.C:
+		}
+	}
+}
+
+// loadOffset reads s's saved offset, retrying until it succeeds, and reports
+// false if ctx ended first. Until then s is at 0, which holds back pruning.
+func (d *outboxDispatcher) loadOffset(ctx context.Context, s *sinkState) bool {
+	for attempt := 1; ; attempt++ {
+		offset, err := d.store.OutboxOffset(s.name())
+		if err == nil {
+			d.mu.Lock()
+			s.offset = offset
+			d.mu.Unlock()
+			return true
+		}
+		log.Printf("outbox %s: reading offset, attempt %d: %v", s.name(), attempt, err)
+		if !d.wait(ctx, attempt) {
+			return false
+		}
+	}
+}
+
+// took records that s has taken the outbox up to offset.
+func (d *outboxDispatcher) took(s *sinkState, offset int64) {
+	if !s.live {
+		if err := d.store.PutOutboxOffset(s.name(), offset); err != nil {
+			// only means the batch is delivered again after a restart
+			log.Printf("outbox %s: saving offset %d: %v", s.name(), offset, err)
+			return
+		}
+	}
+	d.advance(s, offset)
+}
+
+// advance moves s's offset on and prunes what every sink has taken. A saved
+// offset only counts once it is saved: a pruned entry is never needed again.
+func (d *outboxDispatcher) advance(s *sinkState, offset int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s.offset = offset
+	low := d.deliveredLocked()
+	if low <= d.pruned {
+		return
+	}
+	if err := d.store.PruneOutbox(low); err != nil {
+		log.Printf("outbox: pruning up to %d: %v", low, err)
+		return
+	}
+	d.pruned = low
+}
+
+// delivered is the Seq up to which every sink has taken the outbox.
+func (d *outboxDispatcher) delivered() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deliveredLocked()
+}
+
+func (d *outboxDispatcher) deliveredLocked() int64 {
+	if len(d.sinks) == 0 {
+		return 0
+	}
+	low := d.sinks[0].offset
+	for _, s := range d.sinks[1:] {
+		low = min(low, s.offset)
+	}
+	return low
+}
+
+// deliver hands e to sink until it takes it, and reports false if ctx ended first.
+func (d *outboxDispatcher) deliver(ctx context.Context, sink outboxSink, e outboxEntry) bool {
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return false
+		}
+		err := sink.deliver(ctx, e)
+		if err == nil {
+			return true
+		}
+		log.Printf("outbox %s: event %d, attempt %d: %v", sink.name(), e.Seq, attempt, err)
+		if !d.wait(ctx, attempt) {
+			return false
+		}
+	}
+}
+
+// wait backs off before the next attempt, and reports false if ctx ended first.
+func (d *outboxDispatcher) wait(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(backoff(d.backoff, attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
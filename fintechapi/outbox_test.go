@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseOutboxSinks(t *testing.T) {
+	sinks, err := parseOutboxSinks(" log, file:/tmp/events.jsonl ,https://events.example.com/in,")
+	if err != nil || len(sinks) != 3 {
+		t.Fatalf("parse: %v %v", sinks, err)
+	}
+	for i, want := range []string{"log", "file:/tmp/events.jsonl", "https://events.example.com/in"} {
+		if sinks[i].name() != want {
+			t.Errorf("sink %d: want %s, got %s", i, want, sinks[i].name())
+		}
+	}
+	if sinks, err := parseOutboxSinks(""); err != nil || len(sinks) != 0 {
+		t.Errorf("empty: %v %v", sinks, err)
+	}
+	for _, in := range []string{"kafka://events", "file:", "https://", "log,log"} {
+		if _, err := parseOutboxSinks(in); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
+
+func TestOutbox_EventsStoredWithTheirChanges(t *testing.T) {
+	ts, svc := newFeeServer(t)
+	_, ch, _ := svc.stream.subscribe(0)
+
+	tr := createTx(t, ts, "A1", "A2")
+	if res, _ := putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("complete: %d", res.StatusCode)
+	}
+	if res, _ := reverseTx(t, ts, tr.ID, nil, nil); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("reverse: %d", res.StatusCode)
+	}
+	// an invalid transition raises nothing
+	if res, _ := putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "failed"}); res.StatusCode != http.StatusConflict {
+		t.Fatalf("second transition: %d", res.StatusCode)
+	}
+
+	want := []string{
+		EventTransactionCreated,
+		EventTransactionStatusChanged, EventTransactionCreated, EventTransactionCreated, // two fee postings
+		EventTransactionCreated, EventTransactionCreated, EventTransactionCreated, // the reversal and two refunds
+	}
+	// the stream is an outbox sink: it gets the entries in write order
+	var entries []sequencedEvent
+	var got []string
+	for range want {
+		select {
+		case se := <-ch:
+			entries = append(entries, se)
+			got = append(got, se.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("want %v, got only %v", want, got)
+		}
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i, e := range entries {
+		if e.Seq != uint64(i+1) {
+			t.Errorf("entry %d has seq %d", i, e.Seq)
+		}
+	}
+	if e := entries[1]; e.Transaction.Status != StatusCompleted || e.PreviousStatus == nil || *e.PreviousStatus != StatusPending {
+		t.Errorf("unexpected status change %+v", e)
+	}
+	for _, e := range entries[2:] {
+		if _, ok, _ := svc.store.GetTransaction(e.Transaction.ID); !ok {
+			t.Errorf("event %d for a transaction that is not stored: %s", e.Seq, e.Transaction.ID)
+		}
+	}
+
+	// taken by every sink, the entries are pruned; the numbering goes on
+	waitDelivered(t, svc)
+	if left, _ := svc.store.ListOutbox(0, 0); len(left) != 0 {
+		t.Errorf("want the delivered entries pruned, %d are left", len(left))
+	}
+	if last, _ := svc.store.LastOutboxSeq(); last != int64(len(want)) {
+		t.Errorf("want the last seq %d after pruning, got %d", len(want), last)
+	}
+}
+
+// recordingSink takes entries after failing the first failures attempts.
+type recordingSink struct {
+	mu       sync.Mutex
+	id       string // name suffix, to tell several apart
+	failures int
+	seqs     []int64
+}
+
+func (s *recordingSink) name() string { return "recording" + s.id }
+
+func (s *recordingSink) deliver(_ context.Context, e outboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	s.seqs = append(s.seqs, e.Seq)
+	return nil
+}
+
+func (s *recordingSink) taken() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.seqs...)
+}
+
+func TestOutbox_DispatcherDeliversInOrderAndRetries(t *testing.T) {
+	store := NewConStore()
+	for i := range 3 {
+		tr := Transaction{ID: "t" + strconv.Itoa(i), Currency: "EUR"}
+		_ = store.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	}
+	sink := &recordingSink{failures: 2}
+	d := newOutboxDispatcher(store, []outboxSink{sink})
+	d.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { d.run(ctx); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	waitFor(t, "the backlog", func() bool { return len(sink.taken()) == 3 })
+	// a later write is picked up on notify, well before the next poll
+	tr := Transaction{ID: "t3", Currency: "EUR"}
+	_ = store.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	d.notify()
+	waitFor(t, "the new entry", func() bool { return len(sink.taken()) == 4 })
+
+	if got := sink.taken(); got[0] != 1 || got[1] != 2 || got[2] != 3 || got[3] != 4 {
+		t.Errorf("want entries 1 to 4 in order, got %v", got)
+	}
+	waitFor(t, "the offset", func() bool { off, _ := store.OutboxOffset("recording"); return off == 4 })
+}
+
+// offsetStore fails the first failures reads of an offset and counts the saves.
+type offsetStore struct {
+	Store
+	mu       sync.Mutex
+	failures int
+	saves    int
+}
+
+func (s *offsetStore) OutboxOffset(sink string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return 0, errors.New("unavailable")
+	}
+	return s.Store.OutboxOffset(sink)
+}
+
+func (s *offsetStore) PutOutboxOffset(sink string, seq int64) error {
+	s.mu.Lock()
+	s.saves++
+	s.mu.Unlock()
+	return s.Store.PutOutboxOffset(sink, seq)
+}
+
+func TestOutbox_OffsetReadRetriedAndSavedPerBatch(t *testing.T) {
+	store := &offsetStore{Store: NewConStore(), failures: 2}
+	for i := range 5 {
+		tr := Transaction{ID: "t" + strconv.Itoa(i), Currency: "EUR"}
+		_ = store.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	}
+	_ = store.Store.PutOutboxOffset("recording", 2)
+	sink := &recordingSink{}
+	d := newOutboxDispatcher(store, []outboxSink{sink})
+	d.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { d.run(ctx); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	// the sink waits for its offset rather than being dropped or starting over
+	waitFor(t, "the backlog", func() bool { return len(sink.taken()) == 3 })
+	if got := sink.taken(); got[0] != 3 {
+		t.Errorf("want the entries after the saved offset, got %v", got)
+	}
+	waitFor(t, "the offset", func() bool { return d.delivered() == 5 })
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.saves != 1 {
+		t.Errorf("want one save for the batch, got %d", store.saves)
+	}
+}
+
+func TestOutbox_PrunedOnceEverySinkTookIt(t *testing.T) {
+	store := NewConStore()
+	for i := range 3 {
+		tr := Transaction{ID: "t" + strconv.Itoa(i), Currency: "EUR"}
+		_ = store.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	}
+	fast, slow := &recordingSink{}, &recordingSink{id: "-live", failures: 1 << 30}
+	d := newOutboxDispatcher(store, []outboxSink{fast})
+	d.addLive(0, slow)
+	d.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { d.run(ctx); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	waitFor(t, "the fast sink", func() bool { return len(fast.taken()) == 3 })
+	if entries, _ := store.ListOutbox(0, 0); len(entries) != 3 {
+		t.Fatalf("a sink that took nothing yet must hold back pruning, %d entries left", len(entries))
+	}
+	slow.mu.Lock()
+	slow.failures = 0
+	slow.mu.Unlock()
+	waitFor(t, "the pruning", func() bool { entries, _ := store.ListOutbox(0, 0); return len(entries) == 0 })
+	if got := slow.taken(); len(got) != 3 {
+		t.Errorf("the slow sink should have got all three, got %v", got)
+	}
+	if off, _ := store.OutboxOffset(slow.name()); off != 0 {
+		t.Errorf("a live sink's offset is not saved, got %d", off)
+	}
+}
+
+func TestOutbox_HTTPSink(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e outboxEntry
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &e); err != nil || r.Header.Get("Event-Id") != e.ID || r.Header.Get("Event-Type") != e.Type {
+			t.Errorf("unexpected delivery %s %v", string(b), r.Header)
+		}
+		ids = append(ids, e.Transaction.ID)
+	}))
+	defer ts.Close()
+
+	store := NewConStore()
+	for _, id := range []string{"a", "b"} {
+		tr := Transaction{ID: id, Currency: "EUR"}
+		_ = store.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	}
+	sinks, _ := parseOutboxSinks(ts.URL)
+	d := newOutboxDispatcher(store, sinks)
+	d.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { d.run(ctx); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	waitFor(t, "both deliveries", func() bool { mu.Lock(); defer mu.Unlock(); return len(ids) == 2 })
+	if ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("want a then b after the retry, got %v", ids)
+	}
+}
+
+// crashingSink is a fileSink whose process dies right after the sink took its
+// nth entry, before the dispatcher saves the offset.
+type crashingSink struct {
+	fileSink
+	n     int
+	crash context.CancelFunc
+}
+
+func (s *crashingSink) deliver(ctx context.Context, e outboxEntry) error {
+	if err := s.fileSink.deliver(ctx, e); err != nil {
+		return err
+	}
+	if s.n--; s.n == 0 {
+		s.crash()
+		return errors.New("crashed")
+	}
+	return nil
+}
+
+func TestOutbox_NoEventLostAcrossCrashes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fintech.log")
+	sink := fileSink{path: filepath.Join(dir, "events.jsonl")}
+
+	// each run writes, delivers a few entries and crashes
+	for run := range 4 {
+		store, err := openFileStore(path)
+		if err != nil {
+			t.Fatalf("run %d: open: %v", run, err)
+		}
+		svc := newService(store, testAuth())
+		for range 3 {
+			tr, _, err := svc.book(Transaction{ID: newID(), FromAccountID: "A1", ToAccountID: "A2", Amount: 100, Currency: "EUR", At: time.Now().UTC(), Status: StatusPending}, false)
+			if err != nil {
+				t.Fatalf("run %d: book: %v", run, err)
+			}
+			if _, err := svc.setStatus(tr.ID, StatusCompleted); err != nil {
+				t.Fatalf("run %d: complete: %v", run, err)
+			}
+		}
+
+		ctx, crash := context.WithCancel(context.Background())
+		d := newOutboxDispatcher(store, []outboxSink{&crashingSink{fileSink: sink, n: 4, crash: crash}})
+		d.run(ctx) // until the crash
+		svc.webhooks.close()
+		svc.stream.close()
+		store.f.Close() // no Close: nothing is flushed or synced on the way out
+
+		if run == 1 {
+			// and a crash halfway through the next write, a transaction with its event
+			f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+			_, _ = f.WriteString(`{"op":"put_tx","tx":{"id":"torn"},"events":[{"seq":`)
+			f.Close()
+		}
+	}
+
+	// the last run drains the outbox
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	entries, _ := store.ListOutbox(0, 0)
+	if len(entries) != 4*3*2 {
+		t.Fatalf("want 24 entries, got %d", len(entries))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newOutboxDispatcher(store, []outboxSink{sink})
+	done := make(chan struct{})
+	go func() { d.run(ctx); close(done) }()
+	waitFor(t, "the drain", func() bool { off, _ := store.OutboxOffset(sink.name()); return off == int64(len(entries)) })
+	cancel()
+	<-done
+
+	// every entry arrived, in order once repeats are dropped
+	f, err := os.Open(sink.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var last int64
+	seen := make(map[string]bool)
+	repeats := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e outboxEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("bad line %s: %v", sc.Text(), err)
+		}
+		if seen[e.ID] {
+			repeats++
+			continue
+		}
+		if e.Seq != last+1 || e.ID != entries[e.Seq-1].ID {
+			t.Fatalf("entry %d after %d", e.Seq, last)
+		}
+		seen[e.ID] = true
+		last = e.Seq
+	}
+	if last != int64(len(entries)) || repeats != 4 {
+		t.Errorf("want all %d entries and one repeat per crash, got up to %d and %d repeats", len(entries), last, repeats)
+	}
+	// and every stored transaction has its events
+	created := make(map[string]bool)
+	for _, e := range entries {
+		if e.Type == EventTransactionCreated {
+			created[e.Transaction.ID] = true
+		}
+	}
+	txs, _ := store.ListTransactions(listQuery{})
+	if _, ok, _ := store.GetTransaction("torn"); ok || len(txs) != len(created) {
+		t.Errorf("want one created event per transaction: %d transactions, %d events", len(txs), len(created))
+	}
+	for _, tr := range txs {
+		if !created[tr.ID] {
+			t.Errorf("no event for %s", tr.ID)
+		}
+	}
+}
+
+func TestFileStore_OutboxSurvivesCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fintech.log")
+	s, _ := openFileStore(path)
+	for _, id := range []string{"a", "b", "c"} {
+		tr := Transaction{ID: id, Currency: "EUR"}
+		_ = s.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	}
+	_ = s.PutOutboxOffset("log", 2)
+	if err := s.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	tr := Transaction{ID: "d", Currency: "EUR"}
+	_ = s.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	s.Close()
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	entries, _ := s.ListOutbox(0, 0)
+	if len(entries) != 4 || entries[0].Transaction.ID != "a" || entries[3].Seq != 4 || entries[3].Transaction.ID != "d" {
+		t.Errorf("unexpected outbox %+v", entries)
+	}
+	if off, _ := s.OutboxOffset("log"); off != 2 {
+		t.Errorf("offset: want 2, got %d", off)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Problems
+// Every error is answered as application/problem+json (RFC 7807):
+//
+//	{"type": "/problems/validation_failed", "title": "Invalid request", "status": 400,
+//	 "code": "validation_failed", "detail": "invalid or missing: amount",
+//	 "invalid-params": [{"name": "amount", "reason": "must be a positive amount in the currency's minor unit"}]}
+//
+// code is stable and what clients should switch on; detail is for humans and may
+// change. type resolves to GET /problems/{code}, which describes the code.
+
+const problemContentType = "application/problem+json"
+
+// error codes, see problemCatalogue
+const (
+	codeMalformedRequest     = "malformed_request"
+	codeValidationFailed     = "validation_failed"
+	codeInvalidDocument      = "invalid_document"
+	codeUnauthenticated      = "unauthenticated"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeInvalidTransition    = "invalid_status_transition"
+	codeNotReversible        = "not_reversible"
+	codeReversalExceeded     = "reversal_amount_exceeded"
+	codeTransactionFailed    = "transaction_failed"
+	codeOrderFinished        = "standing_order_finished"
+	codeIdempotencyMismatch  = "idempotency_key_reused"
+	codeIdempotencyInFlight  = "idempotency_key_in_flight"
+	codePreconditionFailed   = "precondition_failed"
+	codePreconditionRequired = "precondition_required"
+	codeBodyTooLarge         = "body_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeRuleViolation        = "rule_violation"
+	codeBatchItemNotStored   = "batch_item_not_stored"
+	codeAccountCurrencyFixed = "account_currency_fixed"
+	codeFXRateUnavailable    = "fx_rate_unavailable"
+	codeFXQuoteExpired       = "fx_quote_expired"
+	codeFXQuoteUsed          = "fx_quote_used"
+	codeInternal             = "internal_error"
+)
+
+type problemKind struct {
+	Status      int    `json:"status"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// problemCatalogue lists every code the API answers with. Codes are part of the
+// API: add new ones, never rename or reuse them.
+var problemCatalogue = map[string]problemKind{
+	codeMalformedRequest:     {http.StatusBadRequest, "Malformed request", "The body could not be read or parsed."},
+	codeValidationFailed:     {http.StatusBadRequest, "Invalid request", "Fields or query parameters are invalid or missing; invalid-params lists them."},
+	codeInvalidDocument:      {http.StatusBadRequest, "Invalid document", "An uploaded file (pain.001, camt.053, CSV) is not acceptable; detail says where."},
+	codeUnauthenticated:      {http.StatusUnauthorized, "Unauthenticated", "The API key or bearer token is missing or invalid."},
+	codeForbidden:            {http.StatusForbidden, "Forbidden", "The caller may not do this, e.g. transfer from an account it does not own."},
+	codeNotFound:             {http.StatusNotFound, "Not found", "The resource does not exist or is not visible to the caller."},
+	codeInvalidTransition:    {http.StatusConflict, "Invalid status transition", "The transaction cannot move from its current status to the requested one."},
+	codeNotReversible:        {http.StatusConflict, "Not reversible", "Failed transactions, reversals and fee postings cannot be reversed."},
+	codeReversalExceeded:     {http.StatusConflict, "Reversal amount exceeded", "The amount is more than what is left to reverse."},
+	codeTransactionFailed:    {http.StatusConflict, "Transaction failed", "The operation needs a transaction that has not failed."},
+	codeOrderFinished:        {http.StatusConflict, "Standing order finished", "The standing order has already run to its end or was cancelled."},
+	codeIdempotencyMismatch:  {http.StatusConflict, "Idempotency key reused", "The Idempotency-Key was first used with a different request."},
+	codeIdempotencyInFlight:  {http.StatusConflict, "Idempotency key in flight", "The first request with this Idempotency-Key is still running; retry after Retry-After seconds."},
+	codePreconditionFailed:   {http.StatusPreconditionFailed, "Precondition failed", "The resource changed since the ETag sent in If-Match; read it again and retry."},
+	codePreconditionRequired: {http.StatusPreconditionRequired, "Precondition required", "This request needs an If-Match header with the ETag of the resource."},
+	codeBodyTooLarge:         {http.StatusRequestEntityTooLarge, "Body too large", "The request body exceeds the size limit."},
+	codeUnsupportedMediaType: {http.StatusUnsupportedMediaType, "Unsupported media type", "The Content-Type is not accepted here."},
+	codeRuleViolation:        {http.StatusUnprocessableEntity, "Rejected by risk rules", "A risk or velocity rule refused the transaction; reason says which."},
+	codeBatchItemNotStored:   {http.StatusFailedDependency, "Not stored", "The item was fine, but another item of its atomic batch failed."},
+	codeAccountCurrencyFixed: {http.StatusConflict, "Account currency fixed", "The account is already held in another currency, which cannot change."},
+	codeFXRateUnavailable:    {http.StatusUnprocessableEntity, "Exchange rate unavailable", "The transfer needs a conversion, but there is no rate for the currency pair at this time."},
+	codeFXQuoteExpired:       {http.StatusConflict, "Quote expired", "The FX quote is past its expires_at; request a new one."},
+	codeFXQuoteUsed:          {http.StatusConflict, "Quote used", "The FX quote has already been used for another transfer."},
+	codeInternal:             {http.StatusInternalServerError, "Internal error", "Something went wrong on our side; the request can be retried."},
+}
+
+// problem is an RFC 7807 problem details object.
+type problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Code          string         `json:"code"`
+	Detail        string         `json:"detail,omitempty"`
+	InvalidParams []invalidParam `json:"invalid-params,omitempty"`
+	Reason        string         `json:"reason,omitempty"` // rule_violation only, see rules.go
+}
+
+// invalidParam names a field or query parameter and what is wrong with it.
+type invalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// validationError is what the validate functions return; it becomes the
+// invalid-params of a validation_failed problem.
+type validationError []invalidParam
+
+func (e validationError) Error() string {
+	names := make([]string, len(e))
+	for i, p := range e {
+		names[i] = p.Name
+	}
+	return "invalid or missing: " + strings.Join(names, ", ")
+}
+
+func newProblem(code, detail string) *problem {
+	kind, ok := problemCatalogue[code]
+	if !ok {
+		panic("unknown problem code " + code)
+	}
+	return &problem{Type: "/problems/" + code, Title: kind.Title, Status: kind.Status, Code: code, Detail: detail}
+}
+
+// invalidProblem is the validation_failed problem for err; a validationError
+// fills invalid-params.
+func invalidProblem(err error) *problem {
+	p := newProblem(codeValidationFailed, err.Error())
+	var ve validationError
+	if errors.As(err, &ve) {
+		p.InvalidParams = ve
+	}
+	return p
+}
+
+func writeProblem(w http.ResponseWriter, p *problem) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// writeError answers with the problem for code; detail is free text.
+func writeError(w http.ResponseWriter, code, detail string) {
+	writeProblem(w, newProblem(code, detail))
+}
+
+// writeInvalid answers a failed validation, see invalidProblem.
+func writeInvalid(w http.ResponseWriter, err error) {
+	writeProblem(w, invalidProblem(err))
+}
+
+// getProblemType describes a code; it is what the type URI of a problem points at.
+func getProblemType(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	kind, ok := problemCatalogue[code]
+	if !ok {
+		writeError(w, codeNotFound, "no such problem type")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Type string `json:"type"`
+		Code string `json:"code"`
+		problemKind
+	}{"/problems/" + code, code, kind})
+}
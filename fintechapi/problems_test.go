@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestProblemCatalogue pins the error codes: they are API, so changing one must
+// fail here first.
+func TestProblemCatalogue(t *testing.T) {
+	want := map[string]int{
+		"malformed_request":         400,
+		"validation_failed":         400,
+		"invalid_document":          400,
+		"unauthenticated":           401,
+		"forbidden":                 403,
+		"not_found":                 404,
+		"invalid_status_transition": 409,
+		"not_reversible":            409,
+		"reversal_amount_exceeded":  409,
+		"transaction_failed":        409,
+		"standing_order_finished":   409,
+		"idempotency_key_reused":    409,
+		"idempotency_key_in_flight": 409,
+		"precondition_failed":       412,
+		"precondition_required":     428,
+		"body_too_large":            413,
+		"unsupported_media_type":    415,
+		"rule_violation":            422,
+		"batch_item_not_stored":     424,
+		"account_currency_fixed":    409,
+		"fx_rate_unavailable":       422,
+		"fx_quote_expired":          409,
+		"fx_quote_used":             409,
+		"internal_error":            500,
+	}
+	got := make(map[string]int, len(problemCatalogue))
+	for code, kind := range problemCatalogue {
+		got[code] = kind.Status
+		if kind.Title == "" || kind.Description == "" {
+			t.Errorf("%s: title and description are required", code)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("catalogue changed:\nwant %v\n got %v", want, got)
+	}
+}
+
+func decodeProblem(t *testing.T, res *http.Response, body []byte) problem {
+	t.Helper()
+	if ct := res.Header.Get("Content-Type"); ct != problemContentType {
+		t.Fatalf("want %s, got %q body=%s", problemContentType, ct, string(body))
+	}
+	var p problem
+	if err := json.Unmarshal(body, &p); err != nil {
+		t.Fatalf("decode problem: %v", err)
+	}
+	if p.Status != res.StatusCode || p.Type != "/problems/"+p.Code || p.Title == "" {
+		t.Errorf("inconsistent problem for %d: %+v", res.StatusCode, p)
+	}
+	return p
+}
+
+func TestAPI_Problems(t *testing.T) {
+	ts, svc := newTestServer(t)
+
+	t.Run("InvalidParams", func(t *testing.T) {
+		in := map[string]any{"from_account_id": "A1", "to_account_id": "A1", "amount": "-1", "currency": "EUR"}
+		res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+		p := decodeProblem(t, res, body)
+		var names []string
+		for _, ip := range p.InvalidParams {
+			names = append(names, ip.Name)
+			if ip.Reason == "" {
+				t.Errorf("%s: missing reason", ip.Name)
+			}
+		}
+		if p.Code != codeValidationFailed || !reflect.DeepEqual(names, []string{"to_account_id", "amount"}) {
+			t.Errorf("want validation_failed on to_account_id and amount, got %+v", p)
+		}
+	})
+
+	for _, test := range []struct {
+		Name string
+		Do   func() (*http.Response, []byte)
+		Code string
+	}{
+		{Name: "Malformed", Do: func() (*http.Response, []byte) { return postJSON(t, ts.URL+"/transactions", "not an object", nil) }, Code: codeMalformedRequest},
+		{Name: "Unauthenticated", Do: func() (*http.Response, []byte) {
+			return postJSON(t, ts.URL+"/transactions", map[string]any{}, map[string]string{"Authorization": ""})
+		}, Code: codeUnauthenticated},
+		{Name: "NotFound", Do: func() (*http.Response, []byte) { return get(t, ts.URL+"/transactions/nope") }, Code: codeNotFound},
+		{Name: "BadQuery", Do: func() (*http.Response, []byte) { return get(t, ts.URL+"/transactions?limit=x") }, Code: codeValidationFailed},
+		{Name: "NotOwner", Do: func() (*http.Response, []byte) {
+			in := map[string]any{"from_account_id": "Z1", "to_account_id": "A1", "amount": "1", "currency": "EUR"}
+			return postJSON(t, ts.URL+"/transactions", in, map[string]string{"Authorization": bearer("alice", "", "A1")})
+		}, Code: codeForbidden},
+	} {
+		res, body := test.Do()
+		if p := decodeProblem(t, res, body); p.Code != test.Code {
+			t.Errorf("%s: want %s, got %+v", test.Name, test.Code, p)
+		}
+	}
+
+	t.Run("Conflicts", func(t *testing.T) {
+		tr := createTx(t, ts, "A1", "A2")
+		_, _ = putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "failed"})
+		res, body := putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"})
+		if p := decodeProblem(t, res, body); p.Code != codeInvalidTransition {
+			t.Errorf("want invalid_status_transition, got %+v", p)
+		}
+		res, body = postJSON(t, ts.URL+"/transactions/"+tr.ID+"/reverse", nil, nil)
+		if p := decodeProblem(t, res, body); p.Code != codeNotReversible {
+			t.Errorf("want not_reversible, got %+v", p)
+		}
+
+		key := map[string]string{"Idempotency-Key": "problem-key"}
+		_, _ = postJSON(t, ts.URL+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1", "currency": "EUR"}, key)
+		res, body = postJSON(t, ts.URL+"/transactions", map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "2", "currency": "EUR"}, key)
+		if p := decodeProblem(t, res, body); p.Code != codeIdempotencyMismatch {
+			t.Errorf("want idempotency_key_reused, got %+v", p)
+		}
+	})
+
+	t.Run("RuleViolation", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		writeRules(t, path, `{"blocked_accounts":["B9"]}`)
+		if err := svc.rules.loadFile(path); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		res, body := postJSON(t, ts.URL+"/transactions", map[string]any{"from_account_id": "B9", "to_account_id": "A2", "amount": "1", "currency": "EUR"}, nil)
+		if p := decodeProblem(t, res, body); p.Code != codeRuleViolation || p.Reason != reasonAccountBlocked {
+			t.Errorf("want rule_violation %s, got %+v", reasonAccountBlocked, p)
+		}
+	})
+
+	t.Run("TypeResolves", func(t *testing.T) {
+		res, body := getWith(t, ts.URL+"/problems/"+codeValidationFailed, "")
+		var kind problemKind
+		_ = json.Unmarshal(body, &kind)
+		if res.StatusCode != http.StatusOK || kind.Status != http.StatusBadRequest {
+			t.Errorf("expected the description, got %d body=%s", res.StatusCode, string(body))
+		}
+		res, body = getWith(t, ts.URL+"/problems/nope", "")
+		if p := decodeProblem(t, res, body); p.Code != codeNotFound {
+			t.Errorf("unknown code: want not_found, got %+v", p)
+		}
+	})
+}
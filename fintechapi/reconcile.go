@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reconciliation
+// POST /reconciliations?account_id=..&window=72h takes a bank statement of one
+// account, a camt.053 file (application/xml) or a CSV file (text/csv) with the
+// header
+//
+//	date,amount,currency,reference
+//
+// where amount is signed (negative: money out), and matches its booked entries
+// to the transactions of the account:
+//  1. an entry whose reference is a transaction ID matches it; when amount,
+//     currency or direction differ the item is an amount_mismatch;
+//  2. any other entry matches the closest unmatched transaction with the same
+//     signed amount and currency no more than window away.
+//
+// Entries left over are unmatched_external, transactions of the statement period
+// left over are unmatched_internal; failed transactions are ignored. For camt.053
+// the account defaults to the statement's. The report is kept in memory and read
+// with GET /reconciliations/{id}, or as CSV with ?format=csv.
+
+const (
+	defaultReconWindow = 72 * time.Hour
+	maxStatementBytes  = 10 << 20
+	maxReconciliations = 100 // reports kept; the oldest go first
+)
+
+const (
+	reconMatched           = "matched"
+	reconAmountMismatch    = "amount_mismatch"
+	reconUnmatchedInternal = "unmatched_internal"
+	reconUnmatchedExternal = "unmatched_external"
+)
+
+// statementEntry is a booked line of a bank statement.
+type statementEntry struct {
+	Date      time.Time
+	Amount    int64 // signed minor units, negative for debits
+	Currency  string
+	Reference string
+}
+
+type reconItem struct {
+	Result         string `json:"result"`
+	MatchedBy      string `json:"matched_by,omitempty"` // reference or amount_date
+	TransactionID  string `json:"transaction_id,omitempty"`
+	Reference      string `json:"reference,omitempty"`
+	BookingDate    string `json:"booking_date,omitempty"` // of the statement entry
+	Currency       string `json:"currency"`
+	InternalAmount *int64 `json:"internal_amount_minor,omitempty"` // signed, as seen from the account
+	ExternalAmount *int64 `json:"external_amount_minor,omitempty"`
+}
+
+type reconciliation struct {
+	ID          string         `json:"id"`
+	ClientID    string         `json:"client_id,omitempty"`
+	AccountID   string         `json:"account_id"`
+	Source      string         `json:"source"` // camt.053 or csv
+	StatementID string         `json:"statement_id,omitempty"`
+	From        string         `json:"from"` // statement period, dates
+	To          string         `json:"to"`
+	Window      string         `json:"window"`
+	CreatedAt   time.Time      `json:"created_at"`
+	Summary     map[string]int `json:"summary"`
+	Items       []reconItem    `json:"items"`
+}
+
+// reconciliations keeps the latest reports in memory.
+type reconciliations struct {
+	mu      sync.Mutex
+	reports map[string]*reconciliation
+	order   []string // IDs, oldest first
+}
+
+func newReconciliations() *reconciliations {
+	return &reconciliations{reports: make(map[string]*reconciliation)}
+}
+
+func (rs *reconciliations) add(rec *reconciliation) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.reports[rec.ID] = rec
+	rs.order = append(rs.order, rec.ID)
+	if len(rs.order) > maxReconciliations {
+		delete(rs.reports, rs.order[0])
+		rs.order = rs.order[1:]
+	}
+}
+
+// get returns report id if p may read it: its own client's, for an account p owns.
+func (rs *reconciliations) get(id string, p principal) (*reconciliation, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rec, ok := rs.reports[id]
+	if !ok || (!p.Admin && (rec.ClientID != p.ClientID || !p.owns(rec.AccountID))) {
+		return nil, false
+	}
+	return rec, true
+}
+
+// reconcile matches entries to txs, the transactions of account around the
+// statement period [from, to] (days).
+func reconcile(account string, entries []statementEntry, txs []Transaction, from, to time.Time, window time.Duration) []reconItem {
+	// the receiving side of a converted transfer sees the converted amount
+	signed := func(t Transaction) (int64, string) { return t.leg(account) }
+	byID := make(map[string]int, len(txs))
+	for i, t := range txs {
+		byID[t.ID] = i
+	}
+	used := make([]bool, len(txs))
+	items := make([]reconItem, 0, len(entries)+len(txs))
+	matched := make([]bool, len(entries))
+
+	item := func(e statementEntry) reconItem {
+		ext := e.Amount
+		return reconItem{Reference: e.Reference, BookingDate: e.Date.Format(time.DateOnly), Currency: e.Currency, ExternalAmount: &ext}
+	}
+
+	// 1. references
+	for i, e := range entries {
+		j, ok := byID[e.Reference]
+		if !ok || used[j] {
+			continue
+		}
+		t := txs[j]
+		it := item(e)
+		internal, currency := signed(t)
+		it.TransactionID, it.InternalAmount, it.MatchedBy = t.ID, &internal, "reference"
+		it.Result = reconMatched
+		if internal != e.Amount || currency != e.Currency {
+			it.Result = reconAmountMismatch
+		}
+		items = append(items, it)
+		used[j], matched[i] = true, true
+	}
+
+	// 2. amount and date
+	for i, e := range entries {
+		if matched[i] {
+			continue
+		}
+		best := -1
+		var bestDist time.Duration
+		for j, t := range txs {
+			if used[j] {
+				continue
+			}
+			if amount, currency := signed(t); currency != e.Currency || amount != e.Amount {
+				continue
+			}
+			// the entry has a day only; measure from noon of that day
+			dist := t.At.Sub(e.Date.Add(12 * time.Hour)).Abs()
+			if dist > window+12*time.Hour {
+				continue
+			}
+			if best < 0 || dist < bestDist {
+				best, bestDist = j, dist
+			}
+		}
+		it := item(e)
+		if best < 0 {
+			it.Result = reconUnmatchedExternal
+			items = append(items, it)
+			continue
+		}
+		internal, _ := signed(txs[best])
+		it.Result, it.MatchedBy, it.TransactionID, it.InternalAmount = reconMatched, "amount_date", txs[best].ID, &internal
+		items = append(items, it)
+		used[best] = true
+	}
+
+	end := to.AddDate(0, 0, 1)
+	for j, t := range txs {
+		if used[j] || t.At.Before(from) || !t.At.Before(end) {
+			continue
+		}
+		internal, currency := signed(t)
+		items = append(items, reconItem{Result: reconUnmatchedInternal, TransactionID: t.ID, Currency: currency, InternalAmount: &internal})
+	}
+	return items
+}
+
+// camt.053 bank to customer statement, versions .02 to .08
+
+type camt053Document struct {
+	XMLName xml.Name      `xml:"Document"`
+	Stmts   []camt053Stmt `xml:"BkToCstmrStmt>Stmt"`
+}
+
+type camt053Stmt struct {
+	ID     string     `xml:"Id"`
+	Acct   isoAccount `xml:"Acct"`
+	FrToDt struct {
+		FrDtTm string `xml:"FrDtTm"`
+		ToDtTm string `xml:"ToDtTm"`
+	} `xml:"FrToDt"`
+	Ntry []camt053Entry `xml:"Ntry"`
+}
+
+type camt053Entry struct {
+	NtryRef string `xml:"NtryRef"`
+	Amt     struct {
+		Ccy   string `xml:"Ccy,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"Amt"`
+	CdtDbtInd string `xml:"CdtDbtInd"`
+	Sts       struct {
+		Text string `xml:",chardata"` // up to version .05
+		Cd   string `xml:"Cd"`
+	} `xml:"Sts"`
+	BookgDt     isoDate `xml:"BookgDt"`
+	AcctSvcrRef string  `xml:"AcctSvcrRef"`
+	Refs        []struct {
+		EndToEndID string `xml:"EndToEndId"`
+	} `xml:"NtryDtls>TxDtls>Refs"`
+}
+
+// reference is the end-to-end ID the entry carries, else the entry reference,
+// else the bank's own reference.
+func (e camt053Entry) reference() string {
+	for _, r := range e.Refs {
+		if id := strings.TrimSpace(r.EndToEndID); id != "" && id != "NOTPROVIDED" {
+			return id
+		}
+	}
+	if ref := strings.TrimSpace(e.NtryRef); ref != "" {
+		return ref
+	}
+	return strings.TrimSpace(e.AcctSvcrRef)
+}
+
+type statement struct {
+	Source    string
+	ID        string
+	AccountID string
+	From, To  time.Time // zero when the file does not say
+	Entries   []statementEntry
+}
+
+func parseCamt053(body []byte) (statement, error) {
+	var doc camt053Document
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return statement{}, fmt.Errorf("malformed camt.053: %w", err)
+	}
+	if !strings.HasPrefix(doc.XMLName.Space, "urn:iso:std:iso:20022:tech:xsd:camt.053.") {
+		return statement{}, fmt.Errorf("not a camt.053 document: namespace %q", doc.XMLName.Space)
+	}
+	if len(doc.Stmts) != 1 {
+		return statement{}, fmt.Errorf("want one Stmt, got %d", len(doc.Stmts))
+	}
+	s := doc.Stmts[0]
+	st := statement{Source: "camt.053", ID: strings.TrimSpace(s.ID), AccountID: s.Acct.account()}
+	if v := strings.TrimSpace(s.FrToDt.FrDtTm); v != "" {
+		st.From, _ = time.Parse(time.RFC3339, v)
+	}
+	if v := strings.TrimSpace(s.FrToDt.ToDtTm); v != "" {
+		st.To, _ = time.Parse(time.RFC3339, v)
+	}
+	for i, n := range s.Ntry {
+		status := strings.TrimSpace(n.Sts.Cd + n.Sts.Text)
+		if status != "BOOK" {
+			continue // pending and informational entries are not settled
+		}
+		m, err := ParseMoney(strings.TrimSpace(n.Amt.Value), n.Amt.Ccy)
+		if err != nil {
+			return statement{}, fmt.Errorf("Ntry %d: Amt: %w", i+1, err)
+		}
+		switch strings.TrimSpace(n.CdtDbtInd) {
+		case "CRDT":
+		case "DBIT":
+			m.Minor = -m.Minor
+		default:
+			return statement{}, fmt.Errorf("Ntry %d: CdtDbtInd must be CRDT or DBIT", i+1)
+		}
+		date, err := n.BookgDt.date()
+		if err != nil || date.IsZero() {
+			return statement{}, fmt.Errorf("Ntry %d: BookgDt: missing or invalid date", i+1)
+		}
+		st.Entries = append(st.Entries, statementEntry{Date: date, Amount: m.Minor, Currency: m.Currency, Reference: n.reference()})
+	}
+	return st, nil
+}
+
+func parseStatementCSV(body []byte) (statement, error) {
+	rd := csv.NewReader(bytes.NewReader(body))
+	rd.TrimLeadingSpace = true
+	header, err := rd.Read()
+	if err != nil {
+		return statement{}, fmt.Errorf("malformed CSV: %w", err)
+	}
+	want := []string{"date", "amount", "currency", "reference"}
+	if len(header) != len(want) {
+		return statement{}, fmt.Errorf("CSV header must be %s", strings.Join(want, ","))
+	}
+	for i := range want {
+		if strings.ToLower(strings.TrimSpace(header[i])) != want[i] {
+			return statement{}, fmt.Errorf("CSV header must be %s", strings.Join(want, ","))
+		}
+	}
+
+	st := statement{Source: "csv"}
+	for line := 2; ; line++ {
+		rec, err := rd.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return statement{}, fmt.Errorf("malformed CSV: %w", err)
+		}
+		date, err := time.Parse(time.DateOnly, strings.TrimSpace(rec[0]))
+		if err != nil {
+			return statement{}, fmt.Errorf("line %d: date must be YYYY-MM-DD", line)
+		}
+		amount := strings.TrimSpace(rec[1])
+		negative := strings.HasPrefix(amount, "-")
+		m, err := ParseMoney(strings.TrimPrefix(amount, "-"), rec[2])
+		if err != nil {
+			return statement{}, fmt.Errorf("line %d: %w", line, err)
+		}
+		if negative {
+			m.Minor = -m.Minor
+		}
+		st.Entries = append(st.Entries, statementEntry{Date: date, Amount: m.Minor, Currency: m.Currency, Reference: strings.TrimSpace(rec[3])})
+	}
+	return st, nil
+}
+
+// period is the statement period in whole days: the file's, or the span of its entries.
+func (st statement) period() (from, to time.Time) {
+	day := func(t time.Time) time.Time { return t.UTC().Truncate(24 * time.Hour) }
+	for i, e := range st.Entries {
+		if i == 0 || e.Date.Before(from) {
+			from = e.Date
+		}
+		if i == 0 || e.Date.After(to) {
+			to = e.Date
+		}
+	}
+	if !st.From.IsZero() {
+		from = st.From
+	}
+	if !st.To.IsZero() {
+		to = st.To
+	}
+	return day(from), day(to)
+}
+
+// handlers
+
+func createReconciliation(w http.ResponseWriter, r *http.Request, svc *service) {
+	window := defaultReconWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeInvalid(w, validationError{{Name: "window", Reason: "must be a non-negative duration like 72h"}})
+			return
+		}
+		window = d
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxStatementBytes+1))
+	if err != nil {
+		writeError(w, codeMalformedRequest, "could not read request body")
+		return
+	}
+	if len(body) > maxStatementBytes {
+		writeError(w, codeBodyTooLarge, "request body too large")
+		return
+	}
+
+	var st statement
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.HasPrefix(ct, "application/xml"), strings.HasPrefix(ct, "text/xml"):
+		st, err = parseCamt053(body)
+	case strings.HasPrefix(ct, "text/csv"):
+		st, err = parseStatementCSV(body)
+	default:
+		writeError(w, codeUnsupportedMediaType, "send a camt.053 file as application/xml or a CSV file as text/csv")
+		return
+	}
+	if err != nil {
+		writeError(w, codeInvalidDocument, err.Error())
+		return
+	}
+	if a := strings.TrimSpace(r.URL.Query().Get("account_id")); a != "" {
+		st.AccountID = a
+	}
+	if st.AccountID == "" {
+		writeInvalid(w, validationError{{Name: "account_id", Reason: "required for CSV statements"}})
+		return
+	}
+	if len(st.Entries) == 0 {
+		writeError(w, codeInvalidDocument, "statement has no booked entries")
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	if !p.owns(st.AccountID) {
+		writeError(w, codeForbidden, "not allowed to reconcile this account")
+		return
+	}
+
+	from, to := st.period()
+	candidates, err := svc.store.ListTransactions(listQuery{
+		Accounts: map[string]bool{st.AccountID: true},
+		Since:    from.Add(-window),
+	})
+	if err != nil {
+		writeError(w, codeInternal, "could not list transactions")
+		return
+	}
+	txs := candidates[:0]
+	until := to.AddDate(0, 0, 1).Add(window)
+	for _, t := range candidates {
+		if t.Status != StatusFailed && t.At.Before(until) {
+			txs = append(txs, t)
+		}
+	}
+
+	rec := &reconciliation{
+		ID:          newID(),
+		ClientID:    p.ClientID,
+		AccountID:   st.AccountID,
+		Source:      st.Source,
+		StatementID: st.ID,
+		From:        from.Format(time.DateOnly),
+		To:          to.Format(time.DateOnly),
+		Window:      window.String(),
+		CreatedAt:   time.Now().UTC(),
+		Items:       reconcile(st.AccountID, st.Entries, txs, from, to, window),
+		Summary:     map[string]int{reconMatched: 0, reconAmountMismatch: 0, reconUnmatchedInternal: 0, reconUnmatchedExternal: 0},
+	}
+	for _, it := range rec.Items {
+		rec.Summary[it.Result]++
+	}
+	svc.recons.add(rec)
+
+	w.Header().Set("Location", "/reconciliations/"+rec.ID)
+	writeJSON(w, http.StatusCreated, rec)
+}
+
+func getReconciliation(w http.ResponseWriter, r *http.Request, svc *service) {
+	p, _ := principalFrom(r.Context())
+	rec, ok := svc.recons.get(r.PathValue("id"), p)
+	if !ok {
+		writeError(w, codeNotFound, "this reconciliation does not exist")
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, rec)
+	case "csv":
+		writeReconciliationCSV(w, rec)
+	default:
+		writeInvalid(w, validationError{{Name: "format", Reason: "must be json or csv"}})
+	}
+}
+
+func writeReconciliationCSV(w http.ResponseWriter, rec *reconciliation) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="reconciliation-`+rec.ID+`.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	amount := func(minor *int64, currency string) string {
+		if minor == nil {
+			return ""
+		}
+		return formatMinor(*minor, currencyExponent[currency])
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"result", "matched_by", "transaction_id", "reference", "booking_date", "currency", "internal_amount", "external_amount"})
+	for _, it := range rec.Items {
+		_ = cw.Write([]string{it.Result, it.MatchedBy, it.TransactionID, it.Reference, it.BookingDate, it.Currency,
+			amount(it.InternalAmount, it.Currency), amount(it.ExternalAmount, it.Currency)})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// seedStatementAccount stores the transactions the sample statements in testdata
+// are reconciled against.
+func seedStatementAccount(t *testing.T, s Store) {
+	t.Helper()
+	at := func(day, hour int) time.Time { return time.Date(2025, 3, day, hour, 0, 0, 0, time.UTC) }
+	failed := Transaction{ID: "tx-declined", FromAccountID: "A1", ToAccountID: "X", Amount: 250, Currency: "EUR", At: at(7, 8), Status: StatusFailed}
+	for _, tr := range []Transaction{
+		{ID: "tx-rent", FromAccountID: "A1", ToAccountID: "L", Amount: 10000, Currency: "EUR", At: at(3, 9)},
+		{ID: "tx-salary", FromAccountID: "E", ToAccountID: "A1", Amount: 25000, Currency: "EUR", At: at(4, 15)},
+		{ID: "tx-power", FromAccountID: "A1", ToAccountID: "P", Amount: 4000, Currency: "EUR", At: at(4, 10)},
+		{ID: "tx-coffee", FromAccountID: "A1", ToAccountID: "C", Amount: 1000, Currency: "EUR", At: at(6, 8)},
+		{ID: "tx-february", FromAccountID: "A1", ToAccountID: "L", Amount: 10000, Currency: "EUR", At: time.Date(2025, 2, 1, 9, 0, 0, 0, time.UTC)},
+		{ID: "tx-unrelated", FromAccountID: "B", ToAccountID: "C", Amount: 250, Currency: "EUR", At: at(7, 8)},
+		failed, // would match the fee otherwise
+	} {
+		if err := s.PutTransaction(tr); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+}
+
+func postStatement(t *testing.T, ts *httptest.Server, query, contentType string, body []byte, authorization string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/reconciliations"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", authorization)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /reconciliations failed: %v", err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+
+	return res, data
+}
+
+func TestAPI_Reconciliation(t *testing.T) {
+	want := map[string]string{ // transaction or reference -> result
+		"tx-rent":   reconMatched,
+		"tx-salary": reconMatched,
+		"tx-power":  reconAmountMismatch,
+		"tx-coffee": reconUnmatchedInternal,
+		"FEE-MARCH": reconUnmatchedExternal,
+	}
+	for _, test := range []struct {
+		Name, Query, ContentType, File string
+	}{
+		{Name: "Camt053", ContentType: "application/xml", File: "camt053_sample.xml"},
+		{Name: "CSV", Query: "?account_id=A1", ContentType: "text/csv", File: "statement.csv"},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+			ts, svc := newTestServer(t)
+			seedStatementAccount(t, svc.store)
+
+			res, body := postStatement(t, ts, test.Query, test.ContentType, readSample(t, test.File), bearer("alice", "", "A1"))
+			var rec reconciliation
+			_ = json.Unmarshal(body, &rec)
+			if res.StatusCode != http.StatusCreated || res.Header.Get("Location") != "/reconciliations/"+rec.ID {
+				t.Fatalf("expected 201, got %d body=%s", res.StatusCode, string(body))
+			}
+			if rec.From != "2025-03-03" || rec.To != "2025-03-07" || rec.AccountID != "A1" {
+				t.Errorf("unexpected period or account: %s..%s %s", rec.From, rec.To, rec.AccountID)
+			}
+			wantSummary := map[string]int{reconMatched: 2, reconAmountMismatch: 1, reconUnmatchedInternal: 1, reconUnmatchedExternal: 1}
+			if !reflect.DeepEqual(rec.Summary, wantSummary) {
+				t.Errorf("summary: want %v, got %v", wantSummary, rec.Summary)
+			}
+			got := map[string]string{}
+			for _, it := range rec.Items {
+				key := it.TransactionID
+				if key == "" {
+					key = it.Reference
+				}
+				got[key] = it.Result
+				if it.TransactionID == "tx-salary" && it.MatchedBy != "amount_date" {
+					t.Errorf("tx-salary should match by amount and date, got %q", it.MatchedBy)
+				}
+				if it.TransactionID == "tx-power" && (*it.InternalAmount != -4000 || *it.ExternalAmount != -4500) {
+					t.Errorf("tx-power: want -4000 vs -4500, got %d vs %d", *it.InternalAmount, *it.ExternalAmount)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("results: want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestAPI_ReconciliationReport(t *testing.T) {
+	ts, svc := newTestServer(t)
+	seedStatementAccount(t, svc.store)
+	alice := bearer("alice", "", "A1")
+
+	_, body := postStatement(t, ts, "", "application/xml", readSample(t, "camt053_sample.xml"), alice)
+	var created reconciliation
+	_ = json.Unmarshal(body, &created)
+
+	res, body := getWith(t, ts.URL+"/reconciliations/"+created.ID, alice)
+	var rec reconciliation
+	_ = json.Unmarshal(body, &rec)
+	if res.StatusCode != http.StatusOK || len(rec.Items) != len(created.Items) {
+		t.Fatalf("expected the report, got %d body=%s", res.StatusCode, string(body))
+	}
+
+	res, body = getWith(t, ts.URL+"/reconciliations/"+created.ID+"?format=csv", alice)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("expected a CSV download, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil || len(rows) != len(rec.Items)+1 || rows[0][0] != "result" {
+		t.Fatalf("unexpected CSV (%v):\n%s", err, string(body))
+	}
+	for _, row := range rows[1:] {
+		if row[2] == "tx-power" && (row[6] != "-40.00" || row[7] != "-45.00") {
+			t.Errorf("tx-power amounts: got %v", row)
+		}
+	}
+
+	if res, _ := getWith(t, ts.URL+"/reconciliations/"+created.ID, bearer("mallory", "", "Z1")); res.StatusCode != http.StatusNotFound {
+		t.Errorf("someone else's report: expected 404, got %d", res.StatusCode)
+	}
+}
+
+func TestAPI_ReconciliationRejects(t *testing.T) {
+	ts, _ := newTestServer(t)
+	csvFile := readSample(t, "statement.csv")
+
+	for _, test := range []struct {
+		Name, Query, ContentType string
+		Body                     []byte
+		Auth                     string
+		Status                   int
+	}{
+		{Name: "NoAccountForCSV", ContentType: "text/csv", Body: csvFile, Auth: adminBearer, Status: http.StatusBadRequest},
+		{Name: "OtherAccount", Query: "?account_id=A1", ContentType: "text/csv", Body: csvFile, Auth: bearer("mallory", "", "Z1"), Status: http.StatusForbidden},
+		{Name: "BadHeader", Query: "?account_id=A1", ContentType: "text/csv", Body: []byte("when,how much\n"), Auth: adminBearer, Status: http.StatusBadRequest},
+		{Name: "BadAmount", Query: "?account_id=A1", ContentType: "text/csv", Body: []byte("date,amount,currency,reference\n2025-03-03,1.001,EUR,x\n"), Auth: adminBearer, Status: http.StatusBadRequest},
+		{Name: "BadWindow", Query: "?account_id=A1&window=soon", ContentType: "text/csv", Body: csvFile, Auth: adminBearer, Status: http.StatusBadRequest},
+		{Name: "NotCamt", ContentType: "application/xml", Body: readSample(t, "pain001_v09.xml"), Auth: adminBearer, Status: http.StatusBadRequest},
+		{Name: "UnknownType", Query: "?account_id=A1", ContentType: "application/pdf", Body: csvFile, Auth: adminBearer, Status: http.StatusUnsupportedMediaType},
+	} {
+		if res, body := postStatement(t, ts, test.Query, test.ContentType, test.Body, test.Auth); res.StatusCode != test.Status {
+			t.Errorf("%s: expected %d, got %d body=%s", test.Name, test.Status, res.StatusCode, string(body))
+		}
+	}
+}
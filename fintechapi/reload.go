@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Reloadable files
+// Rules, FX rates and fees each come from a JSON file that is parsed into an
+// immutable table. Readers take the active table with current(); a reload
+// parses the file anew and swaps the table in, so a request sees one version
+// throughout. The file is read every interval and reloaded when its contents
+// hash differently, so a rewrite keeping size and modification time is not
+// missed; a file that does not parse is logged and keeps the previous table.
+
+const fileReloadInterval = 5 * time.Second
+
+// reloadable holds the table parsed from a file and reloads it.
+type reloadable[T any] struct {
+	what   string // for logs and errors, e.g. "fx rates"
+	parse  func([]byte) (*T, error)
+	active atomic.Pointer[T]
+
+	path string
+	sum  [sha256.Size]byte // of the contents last loaded or found broken
+}
+
+// newReloadable returns a reloadable serving initial until a file is loaded.
+func newReloadable[T any](what string, parse func([]byte) (*T, error), initial *T) *reloadable[T] {
+	r := &reloadable[T]{what: what, parse: parse}
+	r.active.Store(initial)
+	return r
+}
+
+func (r *reloadable[T]) current() *T { return r.active.Load() }
+
+// loadFile reads the table from path and makes it active.
+func (r *reloadable[T]) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	r.path = path
+	return r.load(b)
+}
+
+// load parses b, the contents of r.path, and makes it active.
+func (r *reloadable[T]) load(b []byte) error {
+	r.sum = sha256.Sum256(b)
+	v, err := r.parse(b)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", r.what, r.path, err)
+	}
+	r.active.Store(v)
+	return nil
+}
+
+// watch reloads the file whenever its contents change, until ctx is done.
+// Only one watch may run per reloadable.
+func (r *reloadable[T]) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b, err := os.ReadFile(r.path)
+			if err != nil || sha256.Sum256(b) == r.sum {
+				continue
+			}
+			// a broken file is not retried until it changes again
+			if err := r.load(b); err != nil {
+				log.Printf("keeping previous %s: %v", r.what, err)
+				continue
+			}
+			log.Printf("%s reloaded from %s", r.what, r.path)
+		}
+	}
+}
+
+// fileWatcher is a reloadable of any table, so that run can start them alike.
+type fileWatcher interface {
+	loadFile(path string) error
+	watch(ctx context.Context, interval time.Duration)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type reloadTable struct {
+	N int `json:"n"`
+}
+
+func parseReloadTable(b []byte) (*reloadTable, error) {
+	var tb reloadTable
+	return &tb, json.Unmarshal(b, &tb)
+}
+
+func writeTable(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestReloadable_HotReload(t *testing.T) {
+	r := newReloadable("numbers", parseReloadTable, &reloadTable{})
+	path := filepath.Join(t.TempDir(), "numbers.json")
+	writeTable(t, path, `{"n":"one"}`)
+	if err := r.loadFile(path); err == nil || !strings.HasPrefix(err.Error(), "numbers "+path+": ") {
+		t.Fatalf("want a parse error naming the file, got %v", err)
+	}
+	if r.current().N != 0 {
+		t.Fatalf("a failed load should keep the initial table")
+	}
+	writeTable(t, path, `{"n":1}`)
+	if err := r.loadFile(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.watch(ctx, 5*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	writeTable(t, path, `{"n":7}`)
+	waitFor(t, "reload", func() bool { return r.current().N == 7 })
+
+	// same size and, within one mtime tick, the same modification time
+	writeTable(t, path, `{"n":8}`)
+	waitFor(t, "same-size reload", func() bool { return r.current().N == 8 })
+
+	// a broken file keeps the table that was active
+	writeTable(t, path, `{"n":"many"}`)
+	time.Sleep(50 * time.Millisecond)
+	if got := r.current().N; got != 8 {
+		t.Errorf("broken file should keep the previous table, got n=%d", got)
+	}
+
+	writeTable(t, path, `{"n":9}`)
+	waitFor(t, "reload after fix", func() bool { return r.current().N == 9 })
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Reversals
+// POST /transactions/{id}/reverse creates a compensating transaction from the
+// original's to_account_id back to its from_account_id, for the full remaining
+// amount or a part of it. The original keeps the running total and the list of
+// its reversals; that check-and-add is one UpdateTransaction, so concurrent
+// reversals can never add up to more than the original amount. A reversal of a
+// converted transfer is in the currency received, see fx.go. Reversals refund
+// fees pro rata, see fees.go; the refunds complete or fail with the reversal.
+// A reversal that fails gives its amount and fee refunds back to the original,
+// which can then be reversed again; it stays in the history, marked failed.
+
+var (
+	errNotReversible   = errors.New("only pending or completed transactions can be reversed")
+	errReverseReversal = errors.New("a reversal cannot be reversed")
+	errReverseFee      = errors.New("fees are refunded by reversing the transaction they were charged for")
+	errReverseExceeds  = errors.New("amount exceeds what is left to reverse")
+)
+
+// reversalRef is an entry of the reversal history of an original transaction.
+type reversalRef struct {
+	ID           string            `json:"id"`
+	Amount       int64             `json:"amount_minor"`
+	At           time.Time         `json:"at"`
+	Status       TransactionStatus `json:"status"`                        // the reversal's; a failed one is not in Reversed
+	FeesRefunded []int64           `json:"fees_refunded_minor,omitempty"` // by fee of the original
+}
+
+type reverseRequest struct {
+	Amount decimalAmount `json:"amount,omitempty"` // major units; empty reverses what is left
+}
+
+// reverse books a reversal of amount minor units (0: everything left) of the
+// transaction id and returns it.
+func (svc *service) reverse(id string, amount int64) (Transaction, error) {
+	rev := Transaction{
+		ID:         newID(),
+		At:         time.Now().UTC(),
+		Status:     StatusPending,
+		ReversalOf: id,
+	}
+
+	var w txWrite
+	_, err := svc.store.ApplyTransaction(id, func(orig *Transaction) (txWrite, error) {
+		switch {
+		case orig.ReversalOf != "":
+			return txWrite{}, errReverseReversal
+		case orig.FeeFor != "":
+			return txWrite{}, errReverseFee
+		case orig.Status == StatusFailed:
+			return txWrite{}, errNotReversible
+		}
+		received, currency := orig.received()
+		left := received - orig.Reversed
+		if amount == 0 {
+			amount = left
+		}
+		if amount <= 0 || amount > left {
+			return txWrite{}, errReverseExceeds
+		}
+
+		rev.FromAccountID, rev.ToAccountID = orig.ToAccountID, orig.FromAccountID
+		rev.Amount, rev.Currency = amount, currency
+		if orig.ToCurrency != "" {
+			rev.ToAmount, rev.ToCurrency = svc.convertBack(*orig, amount), orig.Currency
+			if rate, ok := new(big.Rat).SetString(orig.FXRate); ok && rate.Sign() > 0 {
+				rev.FXRate = formatRate(rate.Inv(rate))
+			}
+		}
+		orig.Reversed += amount
+		refunded, refunds := feeRefunds(orig, rev)
+		// clipped, so the append never writes into an array a reader still holds
+		orig.Reversals = append(slices.Clip(orig.Reversals), reversalRef{ID: rev.ID, Amount: amount, At: rev.At, Status: rev.Status, FeesRefunded: refunded})
+		// the reversal and its fee refunds are stored with the original
+		w.Put = append([]Transaction{rev}, refunds...)
+		for _, t := range w.Put {
+			w.Events = append(w.Events, newEvent(EventTransactionCreated, t))
+		}
+		return w, nil
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	svc.outbox.notify()
+
+	return rev, nil
+}
+
+// reversalIDs are the transactions a status change of the reversal rev
+// writes: rev, its original and its fee refunds.
+func (svc *service) reversalIDs(rev Transaction) ([]string, error) {
+	orig, ok, err := svc.store.GetTransaction(rev.ReversalOf)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errTransactionNotFound
+	}
+	// the refunds are stored with rev and never added later, so this is all of them
+	ids := []string{rev.ID, orig.ID}
+	for i, f := range orig.Fees {
+		if id := feeRefundID(rev.ID, i); slices.Contains(f.RefundIDs, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// settleReversal moves the fee refunds of rev, which just completed or failed,
+// and its entry in orig's history along with it. A failed rev gives back to
+// orig what it took, and returns the fees posted to make up for refunds that
+// no longer apply.
+func settleReversal(rev Transaction, orig *Transaction, refunds []Transaction, now time.Time) []Transaction {
+	for i := range refunds {
+		refunds[i].Status = rev.Status
+		if rev.Status == StatusCompleted {
+			refunds[i].SettledAt = &now
+		}
+	}
+	i := slices.IndexFunc(orig.Reversals, func(r reversalRef) bool { return r.ID == rev.ID })
+	if i < 0 {
+		return nil
+	}
+	orig.Reversals = slices.Clone(orig.Reversals)
+	ref := &orig.Reversals[i]
+	ref.Status = rev.Status
+	if rev.Status != StatusFailed {
+		return nil
+	}
+	orig.Reversed -= ref.Amount
+	return unrefundFees(orig, *ref, now)
+}
+
+func reverseTransaction(w http.ResponseWriter, r *http.Request, svc *service) {
+	var in reverseRequest
+	// the body is optional: an empty one, chunked or not, reverses what is left
+	if err := bindJSON(r, &in); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, codeMalformedRequest, "bad request")
+		return
+	}
+
+	id := r.PathValue("id")
+	orig, ok, err := svc.store.GetTransaction(id)
+	if err != nil {
+		writeError(w, codeInternal, "could not read transaction")
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	if !ok || !p.canSee(orig) {
+		writeError(w, codeNotFound, "this payment does not exist")
+		return
+	}
+	// the money goes back out of the receiving account
+	if !p.owns(orig.ToAccountID) {
+		writeError(w, codeForbidden, "not allowed to reverse from this account")
+		return
+	}
+
+	var amount int64
+	if in.Amount != "" {
+		_, currency := orig.received()
+		m, err := ParseMoney(string(in.Amount), currency)
+		if err != nil || m.Minor <= 0 {
+			writeInvalid(w, validationError{{Name: "amount", Reason: "must be a positive amount in the currency's minor unit"}})
+			return
+		}
+		amount = m.Minor
+	}
+
+	rev, err := svc.reverse(id, amount)
+	switch {
+	case errors.Is(err, errTransactionNotFound):
+		writeError(w, codeNotFound, "this payment does not exist")
+		return
+	case errors.Is(err, errNotReversible), errors.Is(err, errReverseReversal), errors.Is(err, errReverseFee):
+		writeError(w, codeNotReversible, err.Error())
+		return
+	case errors.Is(err, errReverseExceeds):
+		writeError(w, codeReversalExceeded, err.Error())
+		return
+	case err != nil:
+		writeError(w, codeInternal, "could not store reversal")
+		return
+	}
+
+	w.Header().Set("Location", "/transactions/"+rev.ID)
+	writeJSON(w, http.StatusAccepted, rev)
+}
+
+// canonicalReverseBody is the canonicalizer of POST /transactions/{id}/reverse:
+// "5.5" and "5.50" are the same request. The currency is the original's, which
+// the fingerprinted path already pins down.
+func canonicalReverseBody(body []byte) ([]byte, error) {
+	var in reverseRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &in); err != nil {
+			return nil, err
+		}
+	}
+	amount := strings.TrimSpace(string(in.Amount))
+	if whole, frac, ok := strings.Cut(amount, "."); ok {
+		if frac = strings.TrimRight(frac, "0"); frac != "" {
+			amount = whole + "." + frac
+		} else {
+			amount = whole
+		}
+	}
+	return json.Marshal(reverseRequest{Amount: decimalAmount(amount)})
+}
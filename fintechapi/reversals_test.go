@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func reverseTx(t *testing.T, ts *httptest.Server, id string, body any, headers map[string]string) (*http.Response, Transaction) {
+	t.Helper()
+
+	res, b := postJSON(t, ts.URL+"/transactions/"+id+"/reverse", body, headers)
+	var rev Transaction
+	if res.StatusCode == http.StatusAccepted {
+		if err := json.Unmarshal(b, &rev); err != nil {
+			t.Fatalf("decode reversal: %v", err)
+		}
+	}
+	return res, rev
+}
+
+func newOriginal(t *testing.T, ts *httptest.Server, amount string) Transaction {
+	t.Helper()
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": amount, "currency": "EUR"}
+	res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d body=%s", res.StatusCode, string(body))
+	}
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	return tr
+}
+
+func TestReverse(t *testing.T) {
+	t.Run("FullSwapsAccountsAndLinksOriginal", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		orig := newOriginal(t, ts, "10.00")
+
+		res, rev := reverseTx(t, ts, orig.ID, map[string]any{}, nil)
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", res.StatusCode)
+		}
+		if rev.FromAccountID != "A2" || rev.ToAccountID != "A1" || rev.Amount != 1000 || rev.Currency != "EUR" || rev.ReversalOf != orig.ID {
+			t.Errorf("unexpected reversal %+v", rev)
+		}
+
+		res, body := get(t, ts.URL+"/transactions/"+orig.ID)
+		var got Transaction
+		_ = json.Unmarshal(body, &got)
+		if res.StatusCode != http.StatusOK || got.Reversed != 1000 || len(got.Reversals) != 1 || got.Reversals[0].ID != rev.ID {
+			t.Errorf("original should show the reversal history, got %d %s", res.StatusCode, string(body))
+		}
+
+		if res, _ := reverseTx(t, ts, orig.ID, map[string]any{"amount": "0.01"}, nil); res.StatusCode != http.StatusConflict {
+			t.Errorf("fully reversed: expected 409, got %d", res.StatusCode)
+		}
+		if res, _ := reverseTx(t, ts, rev.ID, nil, nil); res.StatusCode != http.StatusConflict {
+			t.Errorf("reversing a reversal: expected 409, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("PartialUpToTheOriginalAmount", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		orig := newOriginal(t, ts, "10.00")
+
+		if res, rev := reverseTx(t, ts, orig.ID, map[string]any{"amount": "4"}, nil); res.StatusCode != http.StatusAccepted || rev.Amount != 400 {
+			t.Fatalf("partial reversal: got %d %+v", res.StatusCode, rev)
+		}
+		if res, _ := reverseTx(t, ts, orig.ID, map[string]any{"amount": "6.01"}, nil); res.StatusCode != http.StatusConflict {
+			t.Errorf("exceeding the rest: expected 409, got %d", res.StatusCode)
+		}
+		if res, rev := reverseTx(t, ts, orig.ID, nil, nil); res.StatusCode != http.StatusAccepted || rev.Amount != 600 {
+			t.Errorf("no amount should reverse the rest (600), got %d %d", res.StatusCode, rev.Amount)
+		}
+		for _, amount := range []string{"0", "-1", "1.001"} {
+			if res, _ := reverseTx(t, ts, orig.ID, map[string]any{"amount": amount}, nil); res.StatusCode != http.StatusBadRequest {
+				t.Errorf("amount %q: expected 400, got %d", amount, res.StatusCode)
+			}
+		}
+	})
+
+	t.Run("FailedReversalGivesItsAmountBack", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		orig := newOriginal(t, ts, "10.00")
+
+		_, rev := reverseTx(t, ts, orig.ID, nil, nil)
+		if res, _ := putJSON(t, ts.URL+"/transactions/"+rev.ID+"/status", map[string]any{"status": "failed"}); res.StatusCode != http.StatusOK {
+			t.Fatalf("fail the reversal: %d", res.StatusCode)
+		}
+		// the original changed with it, and says so
+		entries, _ := svc.store.ListAudit(0, 0)
+		if last := entries[len(entries)-1]; last.Action != auditUpdate || last.TransactionID != orig.ID {
+			t.Errorf("want the original's update last in the audit log, got %s of %s", last.Action, last.TransactionID)
+		}
+		_, body := get(t, ts.URL+"/transactions/"+orig.ID)
+		var got Transaction
+		_ = json.Unmarshal(body, &got)
+		if got.Reversed != 0 || len(got.Reversals) != 1 || got.Reversals[0].ID != rev.ID || got.Reversals[0].Status != StatusFailed {
+			t.Errorf("want nothing reversed and the reversal in the history as failed, got %d in %+v", got.Reversed, got.Reversals)
+		}
+		if res, again := reverseTx(t, ts, orig.ID, nil, nil); res.StatusCode != http.StatusAccepted || again.Amount != 1000 {
+			t.Errorf("reversing again: want 202 for 1000, got %d %+v", res.StatusCode, again)
+		}
+	})
+
+	t.Run("EmptyChunkedBodyReversesTheRest", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		orig := newOriginal(t, ts, "10.00")
+
+		// a reader of unknown length makes the client send the body chunked
+		req, _ := http.NewRequest("POST", ts.URL+"/transactions/"+orig.ID+"/reverse", struct{ io.Reader }{strings.NewReader("")})
+		req.Header.Set(apiKeyHeader, testAPIKey)
+		req.Header.Set("Authorization", adminBearer)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var rev Transaction
+		_ = json.NewDecoder(res.Body).Decode(&rev)
+		if res.StatusCode != http.StatusAccepted || rev.Amount != 1000 {
+			t.Errorf("want 202 reversing 1000, got %d %+v", res.StatusCode, rev)
+		}
+	})
+
+	t.Run("ConcurrentNeverExceedOriginal", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		orig := newOriginal(t, ts, "10.00")
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		codes := map[int]int{}
+		for range 25 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, _ := reverseTx(t, ts, orig.ID, map[string]any{"amount": "1.00"}, nil)
+				mu.Lock()
+				codes[res.StatusCode]++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		if codes[http.StatusAccepted] != 10 || codes[http.StatusConflict] != 15 {
+			t.Errorf("expected 10 accepted and 15 conflicts, got %v", codes)
+		}
+		_, body := get(t, ts.URL+"/transactions/"+orig.ID)
+		var got Transaction
+		_ = json.Unmarshal(body, &got)
+		if got.Reversed != 1000 || len(got.Reversals) != 10 {
+			t.Errorf("expected 1000 reversed in 10 reversals, got %d in %d", got.Reversed, len(got.Reversals))
+		}
+	})
+
+	t.Run("IdempotencyKeyReplays", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		orig := newOriginal(t, ts, "10.00")
+
+		headers := map[string]string{"Idempotency-Key": "refund-1"}
+		res1, rev1 := reverseTx(t, ts, orig.ID, map[string]any{"amount": "2.5"}, headers)
+		res2, rev2 := reverseTx(t, ts, orig.ID, map[string]any{"amount": "2.50"}, headers)
+		if res1.StatusCode != http.StatusAccepted || res2.StatusCode != http.StatusAccepted || rev1.ID != rev2.ID {
+			t.Fatalf("retry should replay the first reversal, got %d %s and %d %s", res1.StatusCode, rev1.ID, res2.StatusCode, rev2.ID)
+		}
+		if res2.Header.Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected Idempotent-Replayed on the retry")
+		}
+		if res, _ := reverseTx(t, ts, orig.ID, map[string]any{"amount": "3"}, headers); res.StatusCode != http.StatusConflict {
+			t.Errorf("same key, other amount: expected 409, got %d", res.StatusCode)
+		}
+
+		_, body := get(t, ts.URL+"/transactions/"+orig.ID)
+		var got Transaction
+		_ = json.Unmarshal(body, &got)
+		if got.Reversed != 250 {
+			t.Errorf("only one reversal should be booked, reversed=%d", got.Reversed)
+		}
+	})
+
+	t.Run("OnlyTheReceivingAccountMayReverse", func(t *testing.T) {
+		t.Parallel()
+		ts, _ := newTestServer(t)
+		orig := newOriginal(t, ts, "10.00")
+
+		payer := map[string]string{"Authorization": bearer("alice", "", "A1")}
+		if res, _ := reverseTx(t, ts, orig.ID, nil, payer); res.StatusCode != http.StatusForbidden {
+			t.Errorf("payer: expected 403, got %d", res.StatusCode)
+		}
+		stranger := map[string]string{"Authorization": bearer("mallory", "", "Z1")}
+		if res, _ := reverseTx(t, ts, orig.ID, nil, stranger); res.StatusCode != http.StatusNotFound {
+			t.Errorf("stranger: expected 404, got %d", res.StatusCode)
+		}
+		payee := map[string]string{"Authorization": bearer("bob", "", "A2")}
+		if res, _ := reverseTx(t, ts, orig.ID, nil, payee); res.StatusCode != http.StatusAccepted {
+			t.Errorf("payee: expected 202, got %d", res.StatusCode)
+		}
+	})
+}
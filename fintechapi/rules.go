@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Risk rules
+// Every new transaction is checked against the active rule set before it is
+// stored. A rule set is a JSON file, e.g.
+//
+//	{
+//	  "action": "reject",
+//	  "max_amount": {"EUR": "10000.00"},
+//	  "max_daily_total": {"EUR": "25000.00"},
+//	  "max_per_minute": 10,
+//	  "blocked_accounts": ["ACC-666"],
+//	  "new_account_cooling": "72h"
+//	}
+//
+// Every rule is optional. Limits on amounts are per currency; daily totals and
+// counts are per sending account over a rolling window and take what it sent,
+// see sent (fee tiers take the same). An account is new until cooling has
+// passed since it was registered (see accounts.go) or since the first
+// transaction touching it that did not fail, whichever came first; new
+// accounts cannot send.
+// With action "reject" (default) a request that trips a rule gets a 422
+// rule_violation problem with the reason and nothing is stored; with "fail" the
+// transaction is stored as failed with the reason.
+// The file is re-read when it changes; a broken file keeps the previous rules.
+
+const (
+	ruleActionReject = "reject"
+	ruleActionFail   = "fail"
+)
+
+// Reasons are machine readable and stable: clients switch on them.
+const (
+	reasonAccountBlocked = "account_blocked"
+	reasonAccountCooling = "account_cooling"
+	reasonAmountLimit    = "amount_over_limit"
+	reasonDailyLimit     = "daily_total_over_limit"
+	reasonVelocityLimit  = "velocity_over_limit"
+)
+
+type ruleFile struct {
+	Action            string                   `json:"action,omitempty"`
+	MaxAmount         map[string]decimalAmount `json:"max_amount,omitempty"`
+	MaxDailyTotal     map[string]decimalAmount `json:"max_daily_total,omitempty"`
+	MaxPerMinute      int                      `json:"max_per_minute,omitempty"`
+	BlockedAccounts   []string                 `json:"blocked_accounts,omitempty"`
+	NewAccountCooling string                   `json:"new_account_cooling,omitempty"`
+}
+
+// ruleSet is a parsed rule file; zero values disable a rule.
+type ruleSet struct {
+	action        string
+	maxAmount     map[string]int64 // currency -> minor units
+	maxDailyTotal map[string]int64
+	maxPerMinute  int
+	blocked       map[string]bool
+	cooling       time.Duration
+}
+
+func parseRules(b []byte) (*ruleSet, error) {
+	var f ruleFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	rs := &ruleSet{action: f.Action, maxPerMinute: f.MaxPerMinute, blocked: make(map[string]bool)}
+	switch rs.action {
+	case "":
+		rs.action = ruleActionReject
+	case ruleActionReject, ruleActionFail:
+	default:
+		return nil, fmt.Errorf("action must be %q or %q, got %q", ruleActionReject, ruleActionFail, f.Action)
+	}
+	var err error
+	if rs.maxAmount, err = parseLimits("max_amount", f.MaxAmount); err != nil {
+		return nil, err
+	}
+	if rs.maxDailyTotal, err = parseLimits("max_daily_total", f.MaxDailyTotal); err != nil {
+		return nil, err
+	}
+	if rs.maxPerMinute < 0 {
+		return nil, fmt.Errorf("max_per_minute must not be negative")
+	}
+	for _, a := range f.BlockedAccounts {
+		rs.blocked[strings.TrimSpace(a)] = true
+	}
+	if f.NewAccountCooling != "" {
+		if rs.cooling, err = time.ParseDuration(f.NewAccountCooling); err != nil || rs.cooling < 0 {
+			return nil, fmt.Errorf("new_account_cooling: invalid duration %q", f.NewAccountCooling)
+		}
+	}
+	return rs, nil
+}
+
+func parseLimits(name string, in map[string]decimalAmount) (map[string]int64, error) {
+	out := make(map[string]int64, len(in))
+	for cur, amount := range in {
+		m, err := ParseMoney(string(amount), cur)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", name, cur, err)
+		}
+		out[m.Currency] = m.Minor
+	}
+	return out, nil
+}
+
+// ruleViolation is why a transaction was refused.
+type ruleViolation struct {
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+// readsHistory reports whether checking t sums or counts what its sender sent
+// before, so that two concurrent checks could both pass where only one may.
+// Blocks, amount limits and cooling depend on t and the clock alone.
+func (rs *ruleSet) readsHistory(t Transaction) bool {
+	_, daily := rs.maxDailyTotal[t.Currency]
+	return rs.maxPerMinute > 0 || daily
+}
+
+// check evaluates t against rs. History comes from store; when readsHistory
+// the caller holds the sending account's lock, so no other transaction from it
+// lands in between.
+func (rs *ruleSet) check(store Store, t Transaction, now time.Time) (*ruleViolation, error) {
+	for _, a := range []string{t.FromAccountID, t.ToAccountID} {
+		if rs.blocked[a] {
+			return &ruleViolation{Reason: reasonAccountBlocked, Detail: "account " + a + " is blocked"}, nil
+		}
+	}
+	if limit, ok := rs.maxAmount[t.Currency]; ok && t.Amount > limit {
+		return &ruleViolation{Reason: reasonAmountLimit, Detail: "amount is over the limit of " + Money{Minor: limit, Currency: t.Currency}.String()}, nil
+	}
+
+	if rs.cooling > 0 {
+		since, ok, err := accountSince(store, t.FromAccountID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || now.Sub(since) < rs.cooling {
+			return &ruleViolation{Reason: reasonAccountCooling, Detail: "account " + t.FromAccountID + " is too new to send"}, nil
+		}
+	}
+
+	if rs.maxPerMinute > 0 {
+		recent, err := store.ListTransactions(listQuery{FromAccountID: t.FromAccountID, Since: now.Add(-time.Minute)})
+		if err != nil {
+			return nil, err
+		}
+		if countSent(recent)+1 > rs.maxPerMinute {
+			return &ruleViolation{Reason: reasonVelocityLimit, Detail: fmt.Sprintf("more than %d transactions per minute", rs.maxPerMinute)}, nil
+		}
+	}
+
+	if limit, ok := rs.maxDailyTotal[t.Currency]; ok {
+		day, err := store.ListTransactions(listQuery{FromAccountID: t.FromAccountID, Since: now.Add(-24 * time.Hour)})
+		if err != nil {
+			return nil, err
+		}
+		total := t.Amount
+		for _, d := range day {
+			if sent(d) && d.Currency == t.Currency {
+				total += d.Amount
+			}
+		}
+		if total > limit {
+			return &ruleViolation{Reason: reasonDailyLimit, Detail: "24h total is over the limit of " + Money{Minor: limit, Currency: t.Currency}.String()}, nil
+		}
+	}
+	return nil, nil
+}
+
+// sent reports whether t counts as sent by its sender for limits and fee
+// tiers: it did not fail and is neither a fee posting nor a reversal, which
+// gives money back rather than sending it.
+func sent(t Transaction) bool {
+	return t.Status != StatusFailed && t.FeeFor == "" && t.ReversalOf == ""
+}
+
+func countSent(ts []Transaction) int {
+	n := 0
+	for _, t := range ts {
+		if sent(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// accountSince is when account came into being: its registration or the first
+// transaction touching it that did not fail, whichever is earlier. ok is false
+// for an account never seen.
+func accountSince(store Store, account string) (since time.Time, ok bool, err error) {
+	a, registered, err := store.GetAccount(account)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if registered {
+		since, ok = a.CreatedAt, true
+	}
+	q := listQuery{Accounts: map[string]bool{account: true}, Limit: 100}
+	for {
+		page, err := store.ListTransactions(q)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		for _, t := range page {
+			if ok && !t.At.Before(since) {
+				return since, true, nil
+			}
+			if t.Status != StatusFailed {
+				return t.At, true, nil
+			}
+		}
+		if len(page) < q.Limit {
+			return since, ok, nil
+		}
+		last := page[len(page)-1]
+		q.After = trCursor{At: last.At, ID: last.ID}
+	}
+}
+
+// rulesEngine holds the active rule set and reloads it from its file.
+type rulesEngine = reloadable[ruleSet]
+
+func newRulesEngine() *rulesEngine {
+	return newReloadable("rules", parseRules, &ruleSet{action: ruleActionReject})
+}
+
+// accountLockKey is the lockRegistry key serializing the transactions sent from
+// an account while its history is checked. Idempotency keys always contain the
+// client ID before the NUL, so the two never collide.
+func accountLockKey(account string) string {
+	return "\x00account\x00" + account
+}
+
+// problem is the rule_violation problem for v.
+func (v *ruleViolation) problem() *problem {
+	p := newProblem(codeRuleViolation, v.Detail)
+	p.Reason = v.Reason
+	return p
+}
+
+// writeViolation answers a rejected transaction.
+func writeViolation(w http.ResponseWriter, v *ruleViolation) {
+	writeProblem(w, v.problem())
+}
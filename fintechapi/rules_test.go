@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	rs, err := parseRules([]byte(`{"max_amount":{"eur":"100.5"},"max_per_minute":3,"blocked_accounts":[" X "],"new_account_cooling":"1h"}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if rs.action != ruleActionReject || rs.maxAmount["EUR"] != 10050 || rs.maxPerMinute != 3 || !rs.blocked["X"] || rs.cooling != time.Hour {
+		t.Errorf("unexpected rule set %+v", rs)
+	}
+
+	for _, bad := range []string{
+		`{"action":"warn"}`,
+		`{"max_amount":{"EUR":"1.001"}}`,
+		`{"max_daily_total":{"ZZZ":"1"}}`,
+		`{"max_per_minute":-1}`,
+		`{"new_account_cooling":"soon"}`,
+		`{"max_amount_eur":"1"}`,
+		`not json`,
+	} {
+		if _, err := parseRules([]byte(bad)); err == nil {
+			t.Errorf("%s: want error", bad)
+		}
+	}
+}
+
+func TestRulesCheck(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	tx := func(id, from string, minor int64, at time.Time) Transaction {
+		return Transaction{ID: id, FromAccountID: from, ToAccountID: "B", Amount: minor, Currency: "EUR", At: at}
+	}
+	failed := tx("f", "A", 90_000, now.Add(-time.Hour))
+	failed.Status = StatusFailed
+	tried := tx("f2", "TRIED", 1, now.Add(-48*time.Hour))
+	tried.Status = StatusFailed
+	refund := tx("r", "R", 9_000, now.Add(-30*time.Second))
+	refund.ReversalOf = "x"
+	feePosting := tx("p", "X", 1, now.Add(-48*time.Hour))
+	feePosting.ToAccountID, feePosting.FeeFor = "REVENUE", "x"
+
+	history := []Transaction{
+		tx("h1", "A", 4_000, now.Add(-23*time.Hour)),
+		tx("h2", "A", 4_000, now.Add(-30*time.Second)),
+		tx("h3", "A", 4_000, now.Add(-25*time.Hour)), // outside the day
+		failed, // failed ones don't count
+		tx("n1", "NEW", 1, now.Add(-time.Minute)),
+		tried,      // nor do they start the cooling clock
+		refund,     // reversals give money back, they don't send it
+		feePosting, // receiving fees is history too
+		tx("rn", "REGNEW", 1, now.Add(-48*time.Hour)),
+	}
+	store := NewConStore()
+	for _, h := range history {
+		_ = store.PutTransaction(h)
+	}
+	_ = store.PutAccount(account{ID: "REG", Currency: "EUR", CreatedAt: now.Add(-48 * time.Hour)})
+	_ = store.PutAccount(account{ID: "REGNEW", Currency: "EUR", CreatedAt: now.Add(-time.Minute)})
+
+	tests := []struct {
+		Name   string
+		Rules  string
+		Tx     Transaction
+		Reason string // empty: allowed
+	}{
+		{Name: "NoRules", Rules: `{}`, Tx: tx("t", "A", 1_000_000, now)},
+		{Name: "BlockedSender", Rules: `{"blocked_accounts":["A"]}`, Tx: tx("t", "A", 1, now), Reason: reasonAccountBlocked},
+		{Name: "BlockedReceiver", Rules: `{"blocked_accounts":["B"]}`, Tx: tx("t", "A", 1, now), Reason: reasonAccountBlocked},
+		{Name: "AmountAtLimit", Rules: `{"max_amount":{"EUR":"10.00"}}`, Tx: tx("t", "A", 1_000, now)},
+		{Name: "AmountOverLimit", Rules: `{"max_amount":{"EUR":"10.00"}}`, Tx: tx("t", "A", 1_001, now), Reason: reasonAmountLimit},
+		{Name: "OtherCurrencyUnlimited", Rules: `{"max_amount":{"USD":"10.00"}}`, Tx: tx("t", "A", 1_001, now)},
+		{Name: "DailyAtLimit", Rules: `{"max_daily_total":{"EUR":"100.00"}}`, Tx: tx("t", "A", 2_000, now)},
+		{Name: "DailyOverLimit", Rules: `{"max_daily_total":{"EUR":"100.00"}}`, Tx: tx("t", "A", 2_001, now), Reason: reasonDailyLimit},
+		{Name: "VelocityUnder", Rules: `{"max_per_minute":2}`, Tx: tx("t", "A", 1, now)},
+		{Name: "VelocityOver", Rules: `{"max_per_minute":1}`, Tx: tx("t", "A", 1, now), Reason: reasonVelocityLimit},
+		{Name: "CoolingOld", Rules: `{"new_account_cooling":"24h"}`, Tx: tx("t", "A", 1, now)},
+		{Name: "CoolingRecent", Rules: `{"new_account_cooling":"24h"}`, Tx: tx("t", "NEW", 1, now), Reason: reasonAccountCooling},
+		{Name: "CoolingUnseen", Rules: `{"new_account_cooling":"24h"}`, Tx: tx("t", "NOBODY", 1, now), Reason: reasonAccountCooling},
+		{Name: "CoolingOnlyFailed", Rules: `{"new_account_cooling":"24h"}`, Tx: tx("t", "TRIED", 1, now), Reason: reasonAccountCooling},
+		{Name: "CoolingFeeRevenue", Rules: `{"new_account_cooling":"24h"}`, Tx: tx("t", "REVENUE", 1, now)},
+		{Name: "CoolingRegisteredLongAgo", Rules: `{"new_account_cooling":"24h"}`, Tx: tx("t", "REG", 1, now)},
+		{Name: "CoolingSeenBeforeRegistered", Rules: `{"new_account_cooling":"24h"}`, Tx: tx("t", "REGNEW", 1, now)},
+		{Name: "DailyIgnoresReversals", Rules: `{"max_daily_total":{"EUR":"10.00"}}`, Tx: tx("t", "R", 1_000, now)},
+		{Name: "VelocityIgnoresReversals", Rules: `{"max_per_minute":1}`, Tx: tx("t", "R", 1, now)},
+	}
+	for _, test := range tests {
+		rs, err := parseRules([]byte(test.Rules))
+		if err != nil {
+			t.Fatalf("%s: parse: %v", test.Name, err)
+		}
+		v, err := rs.check(store, test.Tx, now)
+		if err != nil {
+			t.Fatalf("%s: check: %v", test.Name, err)
+		}
+		switch {
+		case test.Reason == "" && v != nil:
+			t.Errorf("%s: want allowed, got %s (%s)", test.Name, v.Reason, v.Detail)
+		case test.Reason != "" && (v == nil || v.Reason != test.Reason):
+			t.Errorf("%s: want %s, got %+v", test.Name, test.Reason, v)
+		}
+	}
+}
+
+func writeRules(t *testing.T, path, rules string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+}
+
+func TestAPI_Rules(t *testing.T) {
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "50.00", "currency": "EUR"}
+
+	t.Run("RejectWithReason", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		path := filepath.Join(t.TempDir(), "rules.json")
+		writeRules(t, path, `{"max_amount":{"EUR":"10.00"}}`)
+		if err := svc.rules.loadFile(path); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+
+		res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+		var v ruleViolation
+		_ = json.Unmarshal(body, &v)
+		if res.StatusCode != http.StatusUnprocessableEntity || v.Reason != reasonAmountLimit {
+			t.Fatalf("expected 422 %s, got %d body=%s", reasonAmountLimit, res.StatusCode, string(body))
+		}
+		if counts, _ := svc.store.CountTransactions(); len(counts) != 0 {
+			t.Errorf("a rejected transaction should not be stored, got %v", counts)
+		}
+	})
+
+	t.Run("FailWithReason", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		path := filepath.Join(t.TempDir(), "rules.json")
+		writeRules(t, path, `{"action":"fail","blocked_accounts":["A2"]}`)
+		if err := svc.rules.loadFile(path); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+
+		res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+		var tr Transaction
+		_ = json.Unmarshal(body, &tr)
+		if res.StatusCode != http.StatusAccepted || tr.Status != StatusFailed || tr.FailureReason != reasonAccountBlocked {
+			t.Fatalf("expected 202 failed/%s, got %d body=%s", reasonAccountBlocked, res.StatusCode, string(body))
+		}
+	})
+
+	t.Run("ConcurrentDailyLimit", func(t *testing.T) {
+		t.Parallel()
+		ts, svc := newTestServer(t)
+		path := filepath.Join(t.TempDir(), "rules.json")
+		writeRules(t, path, `{"max_daily_total":{"EUR":"200.00"}}`)
+		if err := svc.rules.loadFile(path); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for range 12 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = postJSON(t, ts.URL+"/transactions", in, nil)
+			}()
+		}
+		wg.Wait()
+
+		if counts, _ := svc.store.CountTransactions(); counts[StatusPending] != 4 {
+			t.Errorf("exactly 4 x 50.00 fit in 200.00, got %d", counts[StatusPending])
+		}
+	})
+}
+
+func TestAPI_AccountLockOnlyForHistoryRules(t *testing.T) {
+	ts, svc := newTestServer(t)
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "50.00", "currency": "EUR"}
+	unlock := svc.keyLocks.acquire(accountLockKey("A1"))
+
+	// amount limits don't read history, so a held account lock doesn't matter
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(t, path, `{"max_amount":{"EUR":"100.00"}}`)
+	if err := svc.rules.loadFile(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if res, body := postJSON(t, ts.URL+"/transactions", in, nil); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202 without waiting on the account, got %d body=%s", res.StatusCode, string(body))
+	}
+
+	writeRules(t, path, `{"max_per_minute":5}`)
+	if err := svc.rules.loadFile(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	done := make(chan int, 1)
+	go func() {
+		res, _ := postJSON(t, ts.URL+"/transactions", in, nil)
+		done <- res.StatusCode
+	}()
+	select {
+	case code := <-done:
+		t.Fatalf("a velocity-checked booking should wait for the account, got %d", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	if code := <-done; code != http.StatusAccepted {
+		t.Errorf("expected 202 after release, got %d", code)
+	}
+}
+
+func TestRulesEngine_HotReload(t *testing.T) {
+	e := newRulesEngine()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(t, path, `{"max_per_minute":1}`)
+	if err := e.loadFile(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.watch(ctx, 5*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	writeRules(t, path, `{"max_per_minute":7}`)
+	waitFor(t, "reload", func() bool { return e.current().maxPerMinute == 7 })
+
+	// a broken file keeps the rules that were active
+	writeRules(t, path, `{"max_per_minute":"many"}`)
+	time.Sleep(50 * time.Millisecond)
+	if got := e.current().maxPerMinute; got != 7 {
+		t.Errorf("broken file should keep the previous rules, got max_per_minute=%d", got)
+	}
+
+	writeRules(t, path, `{"max_per_minute":9}`)
+	waitFor(t, "reload after fix", func() bool { return e.current().maxPerMinute == 9 })
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduled transfers
+// A standing order books the same transfer on a schedule: daily, weekly (on a
+// weekday, 0 = Sunday) or monthly (on a day of the month, moved to the last day
+// in shorter months), at the clock time of start_at, until end_at. A transaction
+// with an execute_at in the future is a standing order that runs once.
+// The scheduler books every occurrence that is due, including the ones missed
+// while the service was down; start_at cannot be in the past, so that is all
+// it ever catches up on. Occurrence n of order o becomes transaction
+// "<o>-<n>"; an occurrence whose transaction already exists is not booked again,
+// so a crash between booking and saving the order's progress creates no duplicate.
+// Scheduled transactions go through the rules; a violation fails them. So does
+// a conversion without a rate, see fx.go.
+
+const defaultSchedulerInterval = time.Second
+
+const (
+	FrequencyOnce    = "once"
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+)
+
+const (
+	orderActive    = "active"
+	orderFinished  = "finished"
+	orderCancelled = "cancelled"
+)
+
+type standingOrder struct {
+	ID            string            `json:"id"`
+	ClientID      string            `json:"client_id,omitempty"`
+	FromAccountID string            `json:"from_account_id"`
+	ToAccountID   string            `json:"to_account_id"`
+	Amount        int64             `json:"amount_minor"`
+	Currency      string            `json:"currency"`
+	Description   string            `json:"description,omitempty"` // copied to every transaction
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Frequency     string            `json:"frequency"`
+	Day           int               `json:"day,omitempty"` // weekday (weekly) or day of month (monthly)
+	StartAt       time.Time         `json:"start_at"`
+	EndAt         *time.Time        `json:"end_at,omitempty"`
+	Status        string            `json:"status"`
+	Runs          int               `json:"runs"`              // occurrences booked so far
+	NextAt        *time.Time        `json:"next_at,omitempty"` // nil once finished or cancelled
+	CreatedAt     time.Time         `json:"created_at"`
+	CancelledAt   *time.Time        `json:"cancelled_at,omitempty"`
+}
+
+// occurrence returns the due time of occurrence n (0-based).
+func (o standingOrder) occurrence(n int) time.Time {
+	start := o.StartAt.UTC()
+	switch o.Frequency {
+	case FrequencyDaily:
+		return start.AddDate(0, 0, n)
+	case FrequencyWeekly:
+		first := start.AddDate(0, 0, (o.Day-int(start.Weekday())+7)%7)
+		return first.AddDate(0, 0, 7*n)
+	case FrequencyMonthly:
+		if o.monthly(0).Before(start) {
+			n++
+		}
+		return o.monthly(n)
+	default: // once
+		return start
+	}
+}
+
+// monthly is o.Day in the k-th month after the start month, clamped to the month's end.
+func (o standingOrder) monthly(k int) time.Time {
+	start := o.StartAt.UTC()
+	first := time.Date(start.Year(), start.Month()+time.Month(k), 1, start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), time.UTC)
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(o.Day, last)-1)
+}
+
+// advance updates NextAt and Status after Runs changed.
+func (o *standingOrder) advance() {
+	if o.Status == orderCancelled {
+		o.NextAt = nil
+		return
+	}
+	next := o.occurrence(o.Runs)
+	if (o.Frequency == FrequencyOnce && o.Runs > 0) || (o.EndAt != nil && next.After(*o.EndAt)) {
+		o.Status, o.NextAt = orderFinished, nil
+		return
+	}
+	o.Status, o.NextAt = orderActive, &next
+}
+
+func (o standingOrder) visibleTo(p principal) bool {
+	return p.owns(o.FromAccountID) || p.owns(o.ToAccountID)
+}
+
+func orderLockKey(id string) string {
+	return "\x00order\x00" + id
+}
+
+// scheduler books the due occurrences of standing orders.
+type scheduler struct {
+	svc *service
+	now func() time.Time // injectable clock
+}
+
+// run calls runDue every interval until ctx is done.
+func (s *scheduler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.runDue(); err != nil {
+			log.Printf("scheduler: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDue books every occurrence due by now and reports the first error.
+func (s *scheduler) runDue() error {
+	now := s.now().UTC()
+	orders, err := s.svc.store.ListStandingOrders()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, o := range orders {
+		if o.Status != orderActive || o.NextAt == nil || o.NextAt.After(now) {
+			continue
+		}
+		if err := s.catchUp(o.ID, now); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("standing order %s: %w", o.ID, err)
+		}
+	}
+	return firstErr
+}
+
+// catchUp books the due occurrences of one order, saving its progress after each.
+func (s *scheduler) catchUp(id string, now time.Time) error {
+	unlock := s.svc.keyLocks.acquire(orderLockKey(id))
+	defer unlock()
+
+	// re-read under the lock: it may have been cancelled meanwhile
+	o, ok, err := s.svc.store.GetStandingOrder(id)
+	if err != nil || !ok {
+		return err
+	}
+	for o.Status == orderActive && o.NextAt != nil && !o.NextAt.After(now) {
+		if err := s.book(o, *o.NextAt, now); err != nil {
+			return err
+		}
+		o.Runs++
+		o.advance()
+		if err := s.svc.store.PutStandingOrder(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scheduler) book(o standingOrder, due, now time.Time) error {
+	id := o.ID + "-" + strconv.Itoa(o.Runs)
+	if _, exists, err := s.svc.store.GetTransaction(id); err != nil || exists {
+		return err
+	}
+	t := Transaction{
+		ID:              id,
+		FromAccountID:   o.FromAccountID,
+		ToAccountID:     o.ToAccountID,
+		Amount:          o.Amount,
+		Currency:        o.Currency,
+		At:              now,
+		Status:          StatusPending,
+		ClientID:        o.ClientID,
+		Description:     o.Description,
+		Metadata:        o.Metadata,
+		StandingOrderID: o.ID,
+		ScheduledFor:    &due,
+	}
+	if err := s.svc.convert(&t, nil); err != nil {
+		reason, ok := fxFailureReason(err)
+		if !ok {
+			return err
+		}
+		t.Status, t.FailureReason = StatusFailed, reason
+	}
+	_, _, err := s.svc.book(t, false)
+	return err
+}
+
+// handlers
+
+type standingOrderRequest struct {
+	transactionRequest
+	Frequency string     `json:"frequency"`
+	Day       int        `json:"day,omitempty"`
+	StartAt   *time.Time `json:"start_at,omitempty"` // default: now
+	EndAt     *time.Time `json:"end_at,omitempty"`
+}
+
+// validateStandingOrderRequest checks in against now, the scheduler's clock.
+func validateStandingOrderRequest(in standingOrderRequest, now time.Time) error {
+	if in.ExecuteAt != nil {
+		return validationError{{"execute_at", "not supported, use start_at"}}
+	}
+	if in.FXQuoteID != "" {
+		return validationError{{"fx_quote_id", "not supported, occurrences convert at the rate of their booking"}}
+	}
+	if err := validateTransactionRequest(in.transactionRequest); err != nil {
+		return err
+	}
+	var invalids validationError
+	switch in.Frequency {
+	case FrequencyDaily:
+		if in.Day != 0 {
+			invalids = append(invalids, invalidParam{"day", "must be empty for daily orders"})
+		}
+	case FrequencyWeekly:
+		if in.Day < 0 || in.Day > 6 {
+			invalids = append(invalids, invalidParam{"day", "must be 0 (Sunday) to 6"})
+		}
+	case FrequencyMonthly:
+		if in.Day < 1 || in.Day > 31 {
+			invalids = append(invalids, invalidParam{"day", "must be 1 to 31"})
+		}
+	default:
+		invalids = append(invalids, invalidParam{"frequency", "must be daily, weekly or monthly"})
+	}
+	if in.StartAt != nil && in.StartAt.Before(now) {
+		invalids = append(invalids, invalidParam{"start_at", "must not be in the past"})
+	}
+	if in.EndAt != nil && in.StartAt != nil && in.EndAt.Before(*in.StartAt) {
+		invalids = append(invalids, invalidParam{"end_at", "must not be before start_at"})
+	}
+	if len(invalids) > 0 {
+		return invalids
+	}
+	return nil
+}
+
+func createStandingOrder(w http.ResponseWriter, r *http.Request, svc *service) {
+	var in standingOrderRequest
+	if err := bindJSON(r, &in); err != nil {
+		writeError(w, codeMalformedRequest, "bad request")
+		return
+	}
+	now := svc.schedule.now().UTC() // the clock the order is run by
+	if err := validateStandingOrderRequest(in, now); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	if !p.owns(strings.TrimSpace(in.FromAccountID)) {
+		writeError(w, codeForbidden, "not allowed to transfer from this account")
+		return
+	}
+
+	amount, _ := ParseMoney(string(in.Amount), in.Currency) // already validated
+	t := newTransaction(in.transactionRequest, amount)
+	start := now
+	if in.StartAt != nil {
+		start = in.StartAt.UTC()
+	}
+	o := standingOrder{
+		ID:            newID(),
+		ClientID:      p.ClientID,
+		FromAccountID: t.FromAccountID,
+		ToAccountID:   t.ToAccountID,
+		Amount:        t.Amount,
+		Currency:      t.Currency,
+		Description:   t.Description,
+		Metadata:      t.Metadata,
+		Frequency:     in.Frequency,
+		Day:           in.Day,
+		StartAt:       start,
+		EndAt:         in.EndAt,
+		CreatedAt:     now,
+	}
+	saveStandingOrder(w, svc, o)
+}
+
+// canonicalStandingOrderBody is the canonicalizer of POST /standing-orders.
+func canonicalStandingOrderBody(body []byte) ([]byte, error) {
+	var in standingOrderRequest
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	tx, err := canonicalTransaction(in.transactionRequest)
+	if err != nil {
+		return nil, err
+	}
+	in.transactionRequest = transactionRequest{}
+	for _, t := range []**time.Time{&in.StartAt, &in.EndAt} {
+		if *t != nil {
+			utc := (*t).UTC()
+			*t = &utc
+		}
+	}
+	schedule, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(tx, '\n'), schedule...), nil
+}
+
+// scheduleTransaction answers a future-dated POST /transactions.
+func scheduleTransaction(w http.ResponseWriter, svc *service, t Transaction, at time.Time) {
+	saveStandingOrder(w, svc, standingOrder{
+		ID:            newID(),
+		ClientID:      t.ClientID,
+		FromAccountID: t.FromAccountID,
+		ToAccountID:   t.ToAccountID,
+		Amount:        t.Amount,
+		Currency:      t.Currency,
+		Description:   t.Description,
+		Metadata:      t.Metadata,
+		Frequency:     FrequencyOnce,
+		StartAt:       at.UTC(),
+		CreatedAt:     svc.schedule.now().UTC(),
+	})
+}
+
+func saveStandingOrder(w http.ResponseWriter, svc *service, o standingOrder) {
+	o.advance()
+	if o.Status == orderFinished {
+		writeInvalid(w, validationError{{Name: "end_at", Reason: "no occurrence before it"}})
+		return
+	}
+	if err := svc.store.PutStandingOrder(o); err != nil {
+		writeError(w, codeInternal, "could not store standing order")
+		return
+	}
+	w.Header().Set("Location", "/standing-orders/"+o.ID)
+	writeJSON(w, http.StatusAccepted, o)
+}
+
+func listStandingOrders(w http.ResponseWriter, r *http.Request, svc *service) {
+	orders, err := svc.store.ListStandingOrders()
+	if err != nil {
+		writeError(w, codeInternal, "could not read standing orders")
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	items := make([]standingOrder, 0, len(orders))
+	for _, o := range orders {
+		if o.visibleTo(p) {
+			items = append(items, o)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"items": items})
+}
+
+func getStandingOrder(w http.ResponseWriter, r *http.Request, svc *service) {
+	o, ok, err := svc.store.GetStandingOrder(r.PathValue("id"))
+	if err != nil {
+		writeError(w, codeInternal, "could not read standing order")
+		return
+	}
+	if p, _ := principalFrom(r.Context()); !ok || !o.visibleTo(p) {
+		writeError(w, codeNotFound, "this standing order does not exist")
+		return
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+// cancelStandingOrder stops future occurrences; booked ones stay. Cancelling
+// twice is fine, cancelling a finished order is a conflict.
+func cancelStandingOrder(w http.ResponseWriter, r *http.Request, svc *service) {
+	id := r.PathValue("id")
+	unlock := svc.keyLocks.acquire(orderLockKey(id))
+	defer unlock()
+
+	o, ok, err := svc.store.GetStandingOrder(id)
+	if err != nil {
+		writeError(w, codeInternal, "could not read standing order")
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	if !ok || !o.visibleTo(p) {
+		writeError(w, codeNotFound, "this standing order does not exist")
+		return
+	}
+	if !p.owns(o.FromAccountID) {
+		writeError(w, codeForbidden, "not allowed to cancel transfers from this account")
+		return
+	}
+	switch o.Status {
+	case orderFinished:
+		writeError(w, codeOrderFinished, "standing order has already finished")
+		return
+	case orderActive:
+		now := svc.schedule.now().UTC()
+		o.Status, o.CancelledAt = orderCancelled, &now
+		o.advance()
+		if err := svc.store.PutStandingOrder(o); err != nil {
+			writeError(w, codeInternal, "could not store standing order")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, o)
+}
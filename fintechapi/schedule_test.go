@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStandingOrder_Occurrences(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		Name  string
+		Order standingOrder
+		Want  []string
+	}{
+		{
+			Name:  "Daily",
+			Order: standingOrder{Frequency: FrequencyDaily, StartAt: at("2025-01-30T09:00:00Z")},
+			Want:  []string{"2025-01-30T09:00:00Z", "2025-01-31T09:00:00Z", "2025-02-01T09:00:00Z"},
+		},
+		{
+			Name:  "WeeklyOnMonday",
+			Order: standingOrder{Frequency: FrequencyWeekly, Day: 1, StartAt: at("2025-01-01T09:00:00Z")}, // a Wednesday
+			Want:  []string{"2025-01-06T09:00:00Z", "2025-01-13T09:00:00Z"},
+		},
+		{
+			Name:  "MonthlyOnDayOneStartsNextMonth",
+			Order: standingOrder{Frequency: FrequencyMonthly, Day: 1, StartAt: at("2025-01-15T09:00:00Z")},
+			Want:  []string{"2025-02-01T09:00:00Z", "2025-03-01T09:00:00Z"},
+		},
+		{
+			Name:  "MonthlyOnDay31Clamps",
+			Order: standingOrder{Frequency: FrequencyMonthly, Day: 31, StartAt: at("2024-01-15T00:00:00Z")},
+			Want:  []string{"2024-01-31T00:00:00Z", "2024-02-29T00:00:00Z", "2024-03-31T00:00:00Z", "2024-04-30T00:00:00Z"},
+		},
+		{
+			Name:  "MonthlyAcrossTheYear",
+			Order: standingOrder{Frequency: FrequencyMonthly, Day: 28, StartAt: at("2025-11-28T10:00:00Z")},
+			Want:  []string{"2025-11-28T10:00:00Z", "2025-12-28T10:00:00Z", "2026-01-28T10:00:00Z"},
+		},
+	}
+	for _, test := range tests {
+		for n, want := range test.Want {
+			if got := test.Order.occurrence(n).Format(time.RFC3339); got != want {
+				t.Errorf("%s: occurrence %d: want %s, got %s", test.Name, n, want, got)
+			}
+		}
+	}
+}
+
+func TestStandingOrder_AdvanceStopsAtEnd(t *testing.T) {
+	end := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	o := standingOrder{Frequency: FrequencyMonthly, Day: 1, StartAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), EndAt: &end}
+	for range 3 {
+		o.advance()
+		if o.Status != orderActive {
+			t.Fatalf("finished after %d runs, want 3", o.Runs)
+		}
+		o.Runs++
+	}
+	o.advance()
+	if o.Status != orderFinished || o.NextAt != nil {
+		t.Errorf("want finished without next_at, got %s %v", o.Status, o.NextAt)
+	}
+}
+
+// fakeClock is the scheduler's clock in tests.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestScheduler_CatchUpWithoutDuplicates(t *testing.T) {
+	svc := newService(NewConStore(), testAuth())
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	svc.schedule.now = clock.Now
+
+	o := standingOrder{ID: "o1", FromAccountID: "A1", ToAccountID: "A2", Amount: 500, Currency: "EUR",
+		Frequency: FrequencyMonthly, Day: 1, StartAt: clock.now.Add(9 * time.Hour), CreatedAt: clock.now}
+	o.advance()
+	if err := svc.store.PutStandingOrder(o); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	// no dispatcher runs here, so the outbox keeps every event
+	created := func() []Transaction {
+		entries, _ := svc.store.ListOutbox(0, 0)
+		var ts []Transaction
+		for _, e := range entries {
+			ts = append(ts, e.Transaction)
+		}
+		return ts
+	}
+
+	if err := svc.schedule.runDue(); err != nil || len(created()) != 0 {
+		t.Fatalf("nothing is due yet: err=%v created=%d", err, len(created()))
+	}
+
+	// down from January to mid-April: January to April are booked on restart
+	clock.now = time.Date(2025, 4, 15, 0, 0, 0, 0, time.UTC)
+	if err := svc.schedule.runDue(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(created()) != 4 {
+		t.Fatalf("want 4 catch-up transactions, got %d", len(created()))
+	}
+	for i, tr := range created() {
+		wantDue := time.Date(2025, time.Month(i+1), 1, 9, 0, 0, 0, time.UTC)
+		if tr.StandingOrderID != "o1" || tr.ScheduledFor == nil || !tr.ScheduledFor.Equal(wantDue) || !tr.At.Equal(clock.now) {
+			t.Errorf("occurrence %d: unexpected %+v", i, tr)
+		}
+	}
+
+	if err := svc.schedule.runDue(); err != nil || len(created()) != 4 {
+		t.Fatalf("a second run must not book again: err=%v created=%d", err, len(created()))
+	}
+
+	// progress lost after booking (crash before the order was saved)
+	o, _, _ = svc.store.GetStandingOrder("o1")
+	o.Runs = 2
+	o.advance()
+	_ = svc.store.PutStandingOrder(o)
+	if err := svc.schedule.runDue(); err != nil || len(created()) != 4 {
+		t.Fatalf("already booked occurrences must be skipped: err=%v created=%d", err, len(created()))
+	}
+	if o, _, _ = svc.store.GetStandingOrder("o1"); o.Runs != 4 || !o.NextAt.Equal(time.Date(2025, 5, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("want 4 runs and next_at on May 1st, got %d %v", o.Runs, o.NextAt)
+	}
+}
+
+func deleteWith(t *testing.T, url, authorization string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", authorization)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE %s failed: %v", url, err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+
+	return res, data
+}
+
+func TestAPI_ExecuteAt(t *testing.T) {
+	ts, svc := newTestServer(t)
+	at := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "12.50", "currency": "EUR", "execute_at": at}
+	res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+	var o standingOrder
+	_ = json.Unmarshal(body, &o)
+	if res.StatusCode != http.StatusAccepted || o.Frequency != FrequencyOnce || o.NextAt == nil || !o.NextAt.Equal(at) {
+		t.Fatalf("expected 202 with a scheduled order, got %d body=%s", res.StatusCode, string(body))
+	}
+	if res.Header.Get("Location") != "/standing-orders/"+o.ID {
+		t.Errorf("unexpected Location %q", res.Header.Get("Location"))
+	}
+	if counts, _ := svc.store.CountTransactions(); len(counts) != 0 {
+		t.Fatalf("nothing may be booked before execute_at, got %v", counts)
+	}
+
+	svc.schedule.now = func() time.Time { return at.Add(time.Minute) }
+	if err := svc.schedule.runDue(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	res, body = get(t, ts.URL+"/transactions/"+o.ID+"-0")
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusOK || tr.Amount != 1250 || tr.StandingOrderID != o.ID || !tr.ScheduledFor.Equal(at) {
+		t.Fatalf("expected the booked transaction, got %d body=%s", res.StatusCode, string(body))
+	}
+	res, body = get(t, ts.URL+"/standing-orders/"+o.ID)
+	_ = json.Unmarshal(body, &o)
+	if res.StatusCode != http.StatusOK || o.Status != orderFinished || o.Runs != 1 {
+		t.Errorf("expected a finished order, got %d body=%s", res.StatusCode, string(body))
+	}
+
+	// execute_at in the past books right away
+	in["execute_at"] = time.Now().Add(-time.Hour)
+	res, body = postJSON(t, ts.URL+"/transactions", in, nil)
+	var now Transaction
+	_ = json.Unmarshal(body, &now)
+	if res.StatusCode != http.StatusAccepted || now.ID == "" || now.StandingOrderID != "" || now.ScheduledFor != nil {
+		t.Errorf("expected an immediate transaction, got %d body=%s", res.StatusCode, string(body))
+	}
+}
+
+func TestAPI_SchedulingUsesTheSchedulersClock(t *testing.T) {
+	ts, svc := newTestServer(t)
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	svc.schedule.now = clock.Now
+
+	// in the past by the wall clock, but not yet by the scheduler's
+	at := clock.now.Add(24 * time.Hour)
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1", "currency": "EUR", "execute_at": at}
+	res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+	var o standingOrder
+	_ = json.Unmarshal(body, &o)
+	if res.StatusCode != http.StatusAccepted || o.Frequency != FrequencyOnce || !o.CreatedAt.Equal(clock.now) {
+		t.Fatalf("expected an order scheduled at the scheduler's now, got %d body=%s", res.StatusCode, string(body))
+	}
+
+	delete(in, "execute_at")
+	in["frequency"] = FrequencyDaily
+	// a start a year back by the scheduler's clock would book a year of transfers
+	in["start_at"] = clock.now.AddDate(-1, 0, 0)
+	res, body = postJSON(t, ts.URL+"/standing-orders", in, nil)
+	var p problem
+	_ = json.Unmarshal(body, &p)
+	if res.StatusCode != http.StatusBadRequest || len(p.InvalidParams) != 1 || p.InvalidParams[0].Name != "start_at" {
+		t.Fatalf("expected start_at in the past rejected, got %d body=%s", res.StatusCode, string(body))
+	}
+	if counts, _ := svc.store.CountTransactions(); len(counts) != 0 {
+		t.Fatalf("nothing should be booked, got %v", counts)
+	}
+	// after the scheduler's now, though long past by the wall clock
+	in["start_at"] = clock.now.Add(time.Hour)
+	res, _ = postJSON(t, ts.URL+"/standing-orders", in, nil)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected a start after the scheduler's now accepted, got %d", res.StatusCode)
+	}
+
+	delete(in, "start_at")
+	res, body = postJSON(t, ts.URL+"/standing-orders", in, nil)
+	_ = json.Unmarshal(body, &o)
+	if res.StatusCode != http.StatusAccepted || !o.StartAt.Equal(clock.now) || !o.CreatedAt.Equal(clock.now) {
+		t.Fatalf("expected an order starting at the scheduler's now, got %d body=%s", res.StatusCode, string(body))
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	res, body = deleteWith(t, ts.URL+"/standing-orders/"+o.ID, adminBearer)
+	_ = json.Unmarshal(body, &o)
+	if res.StatusCode != http.StatusOK || o.CancelledAt == nil || !o.CancelledAt.Equal(clock.now) {
+		t.Errorf("expected it cancelled at the scheduler's now, got %d body=%s", res.StatusCode, string(body))
+	}
+}
+
+func TestAPI_StandingOrders(t *testing.T) {
+	ts, svc := newTestServer(t)
+	payer := bearer("alice", "", "A1")
+	payee := bearer("bob", "", "A2")
+	stranger := bearer("mallory", "", "Z1")
+	start := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "5", "currency": "EUR",
+		"frequency": "daily", "start_at": start, "end_at": start.Add(48 * time.Hour)}
+
+	for _, bad := range []map[string]any{
+		{"frequency": "hourly"},
+		{"frequency": "monthly", "day": 0},
+		{"frequency": "weekly", "day": 7},
+		{"end_at": start.Add(-time.Hour)},
+		{"execute_at": start},
+	} {
+		req := map[string]any{}
+		for k, v := range in {
+			req[k] = v
+		}
+		for k, v := range bad {
+			req[k] = v
+		}
+		if res, body := postJSON(t, ts.URL+"/standing-orders", req, nil); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d body=%s", bad, res.StatusCode, string(body))
+		}
+	}
+	if res, _ := postJSON(t, ts.URL+"/standing-orders", in, map[string]string{"Authorization": stranger}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("ordering from someone else's account: expected 403, got %d", res.StatusCode)
+	}
+
+	res, body := postJSON(t, ts.URL+"/standing-orders", in, map[string]string{"Authorization": payer, "Idempotency-Key": "so-1"})
+	var o standingOrder
+	_ = json.Unmarshal(body, &o)
+	if res.StatusCode != http.StatusAccepted || o.Status != orderActive || !o.NextAt.Equal(start) {
+		t.Fatalf("expected 202 active order, got %d body=%s", res.StatusCode, string(body))
+	}
+	if res, again := postJSON(t, ts.URL+"/standing-orders", in, map[string]string{"Authorization": payer, "Idempotency-Key": "so-1"}); res.StatusCode != http.StatusAccepted || string(again) != string(body) {
+		t.Errorf("a retry should replay the order, got %d body=%s", res.StatusCode, string(again))
+	}
+
+	// visible to both sides, not to others
+	for _, auth := range []string{payer, payee} {
+		if res, _ := getWith(t, ts.URL+"/standing-orders/"+o.ID, auth); res.StatusCode != http.StatusOK {
+			t.Errorf("expected 200 for a party, got %d", res.StatusCode)
+		}
+	}
+	if res, _ := getWith(t, ts.URL+"/standing-orders/"+o.ID, stranger); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a stranger, got %d", res.StatusCode)
+	}
+	var list struct{ Items []standingOrder }
+	_, body = getWith(t, ts.URL+"/standing-orders", stranger)
+	_ = json.Unmarshal(body, &list)
+	if len(list.Items) != 0 {
+		t.Errorf("a stranger should see no orders, got %d", len(list.Items))
+	}
+
+	// one run, then cancel: nothing more is booked
+	svc.schedule.now = func() time.Time { return start.Add(time.Minute) }
+	_ = svc.schedule.runDue()
+
+	if res, _ := deleteWith(t, ts.URL+"/standing-orders/"+o.ID, payee); res.StatusCode != http.StatusForbidden {
+		t.Errorf("the payee may not cancel: expected 403, got %d", res.StatusCode)
+	}
+	for range 2 { // cancelling twice is fine
+		res, body = deleteWith(t, ts.URL+"/standing-orders/"+o.ID, payer)
+		var cancelled standingOrder
+		_ = json.Unmarshal(body, &cancelled)
+		if res.StatusCode != http.StatusOK || cancelled.Status != orderCancelled || cancelled.NextAt != nil || cancelled.CancelledAt == nil {
+			t.Fatalf("expected 200 cancelled, got %d body=%s", res.StatusCode, string(body))
+		}
+	}
+
+	svc.schedule.now = func() time.Time { return start.Add(72 * time.Hour) }
+	_ = svc.schedule.runDue()
+	if counts, _ := svc.store.CountTransactions(); counts[StatusPending] != 1 {
+		t.Errorf("want only the run before cancelling, got %v", counts)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Balances and statements
+// A transaction moves the balances of its accounts when it settles, i.e. is
+// completed; settled_at records when. Pending and failed transactions move
+// nothing. The sending account is debited the amount, the receiving one
+// credited what arrives (see fx.go); fees are their own postings (see fees.go).
+//
+//	GET /accounts/{id}/balance?as_of=2025-03-31T23:59:59Z      (default: now)
+//	GET /accounts/{id}/statements?month=2025-03&format=csv     (json by default)
+//
+// A statement has the opening balance, every movement settled in the month with
+// the running balance, and the closing balance, in one currency: the account's
+// (see accounts.go), else the only one in its history, else ?currency= says
+// which. Both are computed from one snapshot of the account's history as of
+// as_of, so the opening balance plus the movements is always the closing
+// balance, however many transactions arrive meanwhile. Settlement times are
+// taken under the store's lock, so nothing settled before as_of can show up
+// after the snapshot; fee postings are stored in the write settling their
+// transfer.
+// A statement of the running month is not final: it stops at as_of.
+
+// balance is the balance of an account in one currency.
+type balance struct {
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount_minor"`
+}
+
+type movement struct {
+	TransactionID  string    `json:"transaction_id"`
+	SettledAt      time.Time `json:"settled_at"`
+	Counterparty   string    `json:"counterparty_account_id"`
+	Description    string    `json:"description,omitempty"`
+	FeeFor         string    `json:"fee_for,omitempty"`
+	Amount         int64     `json:"amount_minor"`  // signed, negative for debits
+	RunningBalance int64     `json:"balance_minor"` // after this movement
+}
+
+type accountStatement struct {
+	AccountID string     `json:"account_id"`
+	Currency  string     `json:"currency"`
+	Month     string     `json:"month"`
+	From      time.Time  `json:"from"`
+	To        time.Time  `json:"to"` // exclusive
+	AsOf      time.Time  `json:"as_of"`
+	Final     bool       `json:"final"` // false while the month is running
+	Opening   int64      `json:"opening_balance_minor"`
+	Closing   int64      `json:"closing_balance_minor"`
+	Movements []movement `json:"movements"`
+}
+
+// leg is the signed amount and currency of t as seen from account.
+func (t Transaction) leg(account string) (int64, string) {
+	if t.FromAccountID == account {
+		return -t.Amount, t.Currency
+	}
+	return t.received()
+}
+
+// settledAt is when t settled. Transactions completed before settlement times
+// were recorded count from their creation.
+func (t Transaction) settledAt() time.Time {
+	if t.SettledAt != nil {
+		return *t.SettledAt
+	}
+	return t.At
+}
+
+// settledHistory is what of account has settled by asOf, ordered by
+// (settled_at, ID), from one snapshot of the store.
+func (svc *service) settledHistory(account string, asOf time.Time) ([]Transaction, error) {
+	txs, err := svc.store.ListTransactions(listQuery{Accounts: map[string]bool{account: true}})
+	if err != nil {
+		return nil, err
+	}
+	settled := txs[:0]
+	for _, t := range txs {
+		if t.Status == StatusCompleted && !t.settledAt().After(asOf) {
+			settled = append(settled, t)
+		}
+	}
+	slices.SortFunc(settled, func(a, b Transaction) int {
+		if c := a.settledAt().Compare(b.settledAt()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return settled, nil
+}
+
+// accountFor checks that the caller may read account id and returns its
+// registered currency, if any.
+func accountFor(w http.ResponseWriter, r *http.Request, svc *service) (string, string, bool) {
+	id := r.PathValue("id")
+	if p, _ := principalFrom(r.Context()); !p.owns(id) {
+		writeError(w, codeNotFound, "this account does not exist")
+		return "", "", false
+	}
+	currency, err := svc.accountCurrency(id)
+	if err != nil {
+		writeError(w, codeInternal, "could not read account")
+		return "", "", false
+	}
+	return id, currency, true
+}
+
+func getBalance(w http.ResponseWriter, r *http.Request, svc *service) {
+	now := time.Now().UTC()
+	asOf := now
+	if s := r.URL.Query().Get("as_of"); s != "" {
+		at, err := time.Parse(time.RFC3339, s)
+		if err != nil || at.After(now) {
+			writeInvalid(w, validationError{{"as_of", "must be an RFC 3339 time, not in the future"}})
+			return
+		}
+		asOf = at.UTC()
+	}
+	id, currency, ok := accountFor(w, r, svc)
+	if !ok {
+		return
+	}
+
+	history, err := svc.settledHistory(id, asOf)
+	if err != nil {
+		writeError(w, codeInternal, "could not list transactions")
+		return
+	}
+	totals := make(map[string]int64)
+	if currency != "" {
+		totals[currency] = 0
+	}
+	for _, t := range history {
+		amount, c := t.leg(id)
+		totals[c] += amount
+	}
+	balances := make([]balance, 0, len(totals))
+	for _, c := range slices.Sorted(maps.Keys(totals)) {
+		balances = append(balances, balance{Currency: c, Amount: totals[c]})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"account_id": id, "as_of": asOf, "balances": balances})
+}
+
+func getStatement(w http.ResponseWriter, r *http.Request, svc *service) {
+	now := time.Now().UTC()
+	q := r.URL.Query()
+	from, err := time.Parse("2006-01", q.Get("month"))
+	if err != nil || from.After(now) {
+		writeInvalid(w, validationError{{"month", "must be a month (YYYY-MM), not in the future"}})
+		return
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeInvalid(w, validationError{{"format", "must be json or csv"}})
+		return
+	}
+	id, currency, ok := accountFor(w, r, svc)
+	if !ok {
+		return
+	}
+
+	history, err := svc.settledHistory(id, now)
+	if err != nil {
+		writeError(w, codeInternal, "could not list transactions")
+		return
+	}
+	if c := q.Get("currency"); c != "" {
+		if currency, _, err = normalizeCurrency(c); err != nil {
+			writeInvalid(w, validationError{{"currency", "must be a supported ISO 4217 code"}})
+			return
+		}
+	}
+	if currency == "" {
+		seen := make(map[string]bool)
+		for _, t := range history {
+			_, c := t.leg(id)
+			seen[c] = true
+		}
+		switch len(seen) {
+		case 0:
+			writeInvalid(w, validationError{{"currency", "required: the account has no registered currency and no history"}})
+			return
+		case 1:
+			for c := range seen {
+				currency = c
+			}
+		default:
+			writeInvalid(w, validationError{{"currency", "required: the account has history in " + strings.Join(slices.Sorted(maps.Keys(seen)), ", ")}})
+			return
+		}
+	}
+
+	to := from.AddDate(0, 1, 0)
+	st := accountStatement{AccountID: id, Currency: currency, Month: from.Format("2006-01"), From: from, To: to, AsOf: now, Final: !to.After(now), Movements: []movement{}}
+	var running int64
+	for _, t := range history { // oldest first
+		amount, c := t.leg(id)
+		at := t.settledAt()
+		if c != currency || !at.Before(to) {
+			continue
+		}
+		running += amount
+		if at.Before(from) {
+			st.Opening = running
+			continue
+		}
+		counterparty := t.FromAccountID
+		if counterparty == id {
+			counterparty = t.ToAccountID
+		}
+		st.Movements = append(st.Movements, movement{TransactionID: t.ID, SettledAt: at, Counterparty: counterparty,
+			Description: t.Description, FeeFor: t.FeeFor, Amount: amount, RunningBalance: running})
+	}
+	st.Closing = running
+
+	if format == "csv" {
+		writeStatementCSV(w, st)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// writeStatementCSV writes st with one row per movement between an opening and
+// a closing row.
+func writeStatementCSV(w http.ResponseWriter, st accountStatement) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="statement-`+st.AccountID+`-`+st.Month+`.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	exp := currencyExponent[st.Currency]
+	closedAt := st.To
+	if !st.Final {
+		closedAt = st.AsOf
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"type", "settled_at", "transaction_id", "counterparty_account_id", "description", "currency", "amount", "balance"})
+	_ = cw.Write([]string{"opening", st.From.Format(time.RFC3339), "", "", "", st.Currency, "", formatMinor(st.Opening, exp)})
+	for _, m := range st.Movements {
+		_ = cw.Write([]string{"movement", m.SettledAt.Format(time.RFC3339Nano), m.TransactionID, m.Counterparty, m.Description, st.Currency,
+			formatMinor(m.Amount, exp), formatMinor(m.RunningBalance, exp)})
+	}
+	_ = cw.Write([]string{"closing", closedAt.Format(time.RFC3339Nano), "", "", "", st.Currency, "", formatMinor(st.Closing, exp)})
+	cw.Flush()
+}
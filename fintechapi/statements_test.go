@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// settled puts a completed transaction that settled at the given time.
+func settled(t *testing.T, svc *service, id, from, to string, amount int64, at time.Time) {
+	t.Helper()
+
+	tr := Transaction{ID: id, FromAccountID: from, ToAccountID: to, Amount: amount, Currency: "EUR", At: at.Add(-time.Hour), Status: StatusCompleted, SettledAt: &at}
+	if err := svc.store.PutTransactions([]Transaction{tr}); err != nil {
+		t.Fatalf("put %s: %v", id, err)
+	}
+}
+
+func TestAPI_Balance(t *testing.T) {
+	ts, svc := newTestServer(t)
+	feb := time.Date(2025, 2, 10, 12, 0, 0, 0, time.UTC)
+	settled(t, svc, "t1", "B", "A1", 10000, feb)
+	settled(t, svc, "t2", "A1", "B", 2500, feb.AddDate(0, 1, 0))
+	_ = svc.store.PutTransactions([]Transaction{
+		{ID: "pending", FromAccountID: "A1", ToAccountID: "B", Amount: 100, Currency: "EUR", At: feb, Status: StatusPending},
+		{ID: "failed", FromAccountID: "A1", ToAccountID: "B", Amount: 100, Currency: "EUR", At: feb, Status: StatusFailed},
+		{ID: "usd", FromAccountID: "B", ToAccountID: "A1", Amount: 700, Currency: "USD", At: feb, Status: StatusCompleted},
+	})
+
+	for _, test := range []struct {
+		Name string
+		AsOf string
+		Want []balance
+	}{
+		{Name: "Now", Want: []balance{{"EUR", 7500}, {"USD", 700}}},
+		{Name: "BetweenSettlements", AsOf: "2025-03-01T00:00:00Z", Want: []balance{{"EUR", 10000}, {"USD", 700}}},
+		{Name: "AtSettlement", AsOf: "2025-02-10T12:00:00Z", Want: []balance{{"EUR", 10000}, {"USD", 700}}},
+		{Name: "Before", AsOf: "2025-01-01T00:00:00Z", Want: []balance{}},
+	} {
+		url := ts.URL + "/accounts/A1/balance"
+		if test.AsOf != "" {
+			url += "?as_of=" + test.AsOf
+		}
+		res, body := getWith(t, url, bearer("alice", "", "A1"))
+		var got struct {
+			Balances []balance `json:"balances"`
+		}
+		_ = json.Unmarshal(body, &got)
+		if res.StatusCode != http.StatusOK || !reflect.DeepEqual(got.Balances, test.Want) {
+			t.Errorf("%s: want %v, got %d body=%s", test.Name, test.Want, res.StatusCode, string(body))
+		}
+	}
+
+	// a registered currency shows even without history
+	_, _ = putJSON(t, ts.URL+"/accounts/A7", map[string]any{"currency": "GBP"})
+	if _, body := get(t, ts.URL+"/accounts/A7/balance"); !strings.Contains(string(body), `"balances":[{"currency":"GBP","amount_minor":0}]`) {
+		t.Errorf("registered account: got %s", string(body))
+	}
+
+	if res, _ := get(t, ts.URL+"/accounts/A1/balance?as_of=2999-01-01T00:00:00Z"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("future as_of: expected 400, got %d", res.StatusCode)
+	}
+	if res, _ := getWith(t, ts.URL+"/accounts/A1/balance", bearer("mallory", "", "Z1")); res.StatusCode != http.StatusNotFound {
+		t.Errorf("stranger: expected 404, got %d", res.StatusCode)
+	}
+}
+
+func TestAPI_BalanceSettlesOnCompletion(t *testing.T) {
+	ts, _ := newFeeServer(t)
+	tr := createTx(t, ts, "A1", "A2")
+	balanceOf := func(account string) string {
+		_, body := get(t, ts.URL+"/accounts/"+account+"/balance")
+		return string(body)
+	}
+	if got := balanceOf("A1"); !strings.Contains(got, `"balances":[]`) {
+		t.Errorf("pending: want no balance, got %s", got)
+	}
+
+	res, body := putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"})
+	_ = json.Unmarshal(body, &tr)
+	if res.StatusCode != http.StatusOK || tr.SettledAt == nil {
+		t.Fatalf("complete: expected settled_at, got %d body=%s", res.StatusCode, string(body))
+	}
+	// 1.00 EUR plus the fees of 0.25 and 0.50
+	for account, want := range map[string]string{"A1": "-175", "A2": "100", "FEES": "75"} {
+		if got := balanceOf(account); !strings.Contains(got, `"amount_minor":`+want+`}`) {
+			t.Errorf("%s: want %s, got %s", account, want, got)
+		}
+	}
+}
+
+func TestAPI_Statement(t *testing.T) {
+	ts, svc := newTestServer(t)
+	jan := time.Date(2025, 1, 20, 9, 0, 0, 0, time.UTC)
+	settled(t, svc, "t1", "B", "A1", 10000, jan)
+	settled(t, svc, "t2", "A1", "C", 2500, jan.AddDate(0, 1, 0))
+	settled(t, svc, "t3", "D", "A1", 400, jan.AddDate(0, 1, 5))
+	settled(t, svc, "t4", "A1", "B", 1000, jan.AddDate(0, 2, 0))
+
+	res, body := get(t, ts.URL+"/accounts/A1/statements?month=2025-02")
+	var st accountStatement
+	_ = json.Unmarshal(body, &st)
+	if res.StatusCode != http.StatusOK || st.Currency != "EUR" || !st.Final || st.Opening != 10000 || st.Closing != 7900 || len(st.Movements) != 2 {
+		t.Fatalf("unexpected statement %d body=%s", res.StatusCode, string(body))
+	}
+	if m := st.Movements[0]; m.TransactionID != "t2" || m.Counterparty != "C" || m.Amount != -2500 || m.RunningBalance != 7500 {
+		t.Errorf("unexpected movement %+v", m)
+	}
+	if m := st.Movements[1]; m.TransactionID != "t3" || m.Counterparty != "D" || m.Amount != 400 || m.RunningBalance != 7900 {
+		t.Errorf("unexpected movement %+v", m)
+	}
+
+	res, body = get(t, ts.URL+"/accounts/A1/statements?month=2025-02&format=csv")
+	rows, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+	if err != nil || res.Header.Get("Content-Type") != "text/csv; charset=utf-8" || len(rows) != 5 {
+		t.Fatalf("csv: %v %d rows, body=%s", err, len(rows), string(body))
+	}
+	if got, want := rows[1], []string{"opening", "2025-02-01T00:00:00Z", "", "", "", "EUR", "", "100.00"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("opening: want %v, got %v", want, got)
+	}
+	if got := rows[2]; got[2] != "t2" || got[6] != "-25.00" || got[7] != "75.00" {
+		t.Errorf("movement: got %v", got)
+	}
+	if got := rows[4]; got[0] != "closing" || got[1] != "2025-03-01T00:00:00Z" || got[7] != "79.00" {
+		t.Errorf("closing: got %v", got)
+	}
+
+	// a month without movements carries the balance over
+	_, body = get(t, ts.URL+"/accounts/A1/statements?month=2024-12")
+	if !strings.Contains(string(body), `"opening_balance_minor":0,"closing_balance_minor":0,"movements":[]`) {
+		t.Errorf("empty month: got %s", string(body))
+	}
+}
+
+func TestAPI_StatementValidation(t *testing.T) {
+	ts, svc := newTestServer(t)
+	settled(t, svc, "t1", "B", "A1", 100, time.Date(2025, 1, 20, 9, 0, 0, 0, time.UTC))
+	_ = svc.store.PutTransactions([]Transaction{{ID: "usd", FromAccountID: "B", ToAccountID: "A1", Amount: 700, Currency: "USD", At: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), Status: StatusCompleted}})
+
+	for _, test := range []struct {
+		Name   string
+		Query  string
+		Status int
+		Param  string
+	}{
+		{Name: "NoMonth", Query: "", Status: http.StatusBadRequest, Param: "month"},
+		{Name: "FutureMonth", Query: "?month=2999-01", Status: http.StatusBadRequest, Param: "month"},
+		{Name: "BadFormat", Query: "?month=2025-01&format=pdf", Status: http.StatusBadRequest, Param: "format"},
+		{Name: "AmbiguousCurrency", Query: "?month=2025-01", Status: http.StatusBadRequest, Param: "currency"},
+		{Name: "Currency", Query: "?month=2025-01&currency=usd", Status: http.StatusOK},
+	} {
+		res, body := get(t, ts.URL+"/accounts/A1/statements"+test.Query)
+		if res.StatusCode != test.Status {
+			t.Errorf("%s: expected %d, got %d body=%s", test.Name, test.Status, res.StatusCode, string(body))
+			continue
+		}
+		if test.Param != "" {
+			if p := decodeProblem(t, res, body); len(p.InvalidParams) != 1 || p.InvalidParams[0].Name != test.Param {
+				t.Errorf("%s: expected invalid %s, got %+v", test.Name, test.Param, p)
+			}
+		}
+	}
+	if res, _ := getWith(t, ts.URL+"/accounts/A1/statements?month=2025-01", bearer("mallory", "", "Z1")); res.StatusCode != http.StatusNotFound {
+		t.Errorf("stranger: expected 404, got %d", res.StatusCode)
+	}
+}
+
+func TestAPI_StatementConsistentUnderWrites(t *testing.T) {
+	ts, _ := newTestServer(t)
+	month := time.Now().UTC().Format("2006-01")
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				tr := createTx(t, ts, "A1", "A2")
+				_, _ = putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"})
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+
+	for stop := false; !stop; {
+		select {
+		case <-done:
+			stop = true
+		default:
+		}
+		_, body := get(t, ts.URL+"/accounts/A1/statements?month="+month+"&currency=EUR")
+		var st accountStatement
+		if err := json.Unmarshal(body, &st); err != nil {
+			t.Fatalf("decode: %v body=%s", err, string(body))
+		}
+		sum := st.Opening
+		for _, m := range st.Movements {
+			sum += m.Amount
+			if m.RunningBalance != sum {
+				t.Fatalf("running balance %d, want %d", m.RunningBalance, sum)
+			}
+		}
+		if sum != st.Closing || st.Final {
+			t.Fatalf("opening plus movements is %d, closing %d", sum, st.Closing)
+		}
+	}
+
+	_, body := get(t, ts.URL+"/accounts/A1/statements?month="+month+"&currency=EUR")
+	var st accountStatement
+	_ = json.Unmarshal(body, &st)
+	if len(st.Movements) != 40 || st.Closing != -4000 {
+		t.Errorf("want 40 movements to -40.00, got %d to %d", len(st.Movements), st.Closing)
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage
+// Handlers only talk to the Store interface. conStore keeps everything in maps;
+// fileStore (filestore.go) adds a durable append-only log in front of a conStore.
+// Writes of transactions carry the events they raise into the outbox (outbox.go)
+// and the audit log (audit.go).
+
+var errTransactionNotFound = errors.New("transaction not found")
+
+// Store persists transactions and idempotency records.
+type Store interface {
+	// PutTransaction inserts t or replaces the transaction with the same ID, and
+	// appends events to the outbox and the audit log in the same write.
+	PutTransaction(t Transaction, events ...Event) error
+	// PutTransactions stores all of ts and events or, on error, none of them.
+	PutTransactions(ts []Transaction, events ...Event) error
+	GetTransaction(id string) (Transaction, bool, error)
+	// UpdateTransaction applies fn to the stored transaction id and saves the result.
+	// No other write to id happens in between; an error from fn aborts the update.
+	UpdateTransaction(id string, fn func(*Transaction) error) (Transaction, error)
+	// ApplyTransaction is UpdateTransaction that also stores what fn returns, all
+	// in one write.
+	ApplyTransaction(id string, fn func(*Transaction) (txWrite, error)) (Transaction, error)
+	// ApplyTransactions is ApplyTransaction of several transactions: fn gets them
+	// in the order of ids and all it changes is saved in the same write.
+	ApplyTransactions(ids []string, fn func([]Transaction) (txWrite, error)) ([]Transaction, error)
+	// CountTransactions reports how many transactions there are per status.
+	CountTransactions() (map[TransactionStatus]int, error)
+	// ListTransactions returns up to q.Limit transactions ordered by (At, ID),
+	// strictly after q.After when it is set.
+	ListTransactions(q listQuery) ([]Transaction, error)
+
+	PutStandingOrder(o standingOrder) error
+	GetStandingOrder(id string) (standingOrder, bool, error)
+	// ListStandingOrders returns every standing order ordered by (CreatedAt, ID).
+	ListStandingOrders() ([]standingOrder, error)
+
+	PutAccount(a account) error
+	GetAccount(id string) (account, bool, error)
+
+	// AppendAudit adds e to the end of the audit log; e.Seq must be one past the last entry.
+	AppendAudit(e auditEntry) error
+	// ListAudit returns up to limit audit entries (0: all) with Seq > after, in order.
+	ListAudit(after int64, limit int) ([]auditEntry, error)
+	// LastAudit returns the newest audit entry, if there is one.
+	LastAudit() (auditEntry, bool, error)
+
+	// ListOutbox returns up to limit outbox entries (0: all) with Seq > after, in
+	// order. Pruned entries are gone.
+	ListOutbox(after int64, limit int) ([]outboxEntry, error)
+	// LastOutboxSeq is the Seq of the newest outbox entry, 0 if none, pruned or not.
+	LastOutboxSeq() (int64, error)
+	// PruneOutbox drops the entries up to Seq through: every sink has taken them.
+	PruneOutbox(through int64) error
+	// OutboxOffset is the Seq of the last entry sink has taken, 0 if none.
+	OutboxOffset(sink string) (int64, error)
+	PutOutboxOffset(sink string, seq int64) error
+
+	// LookupIdem finds the record for key and compares its fingerprint with hash.
+	LookupIdem(key, hash string) (idemRecord, idemResult, error)
+	PutIdem(key string, rec idemRecord) error
+	DeleteIdem(key string) error
+	// SweepIdem deletes idempotency records created before cutoff and reports how many went.
+	SweepIdem(cutoff time.Time) (int, error)
+	IdemStats() idemStats
+
+	Close() error
+}
+
+// listQuery selects a page of transactions.
+type listQuery struct {
+	FromAccountID string            // optional filter
+	Accounts      map[string]bool   // when not nil, only transactions touching one of them
+	Metadata      map[string]string // only transactions with all of these metadata pairs
+	After         trCursor          // keyset position; zero value starts at the beginning
+	Since         time.Time         // when set, only transactions at or after it
+	Limit         int
+}
+
+// txWrite is what ApplyTransaction stores along with the updated transaction.
+type txWrite struct {
+	Put    []Transaction // other transactions, e.g. fee postings
+	Events []Event       // for the outbox, see outbox.go
+}
+
+// idemRecord is the recorded response to the first request with an idempotency key.
+type idemRecord struct {
+	Hash       string // fingerprint of method, path and canonical body
+	StatusCode int
+	Header     http.Header // only idemReplayHeaders
+	Body       []byte
+	CreatedAt  time.Time
+}
+
+// conStore is an in-memory concurrency-safe store guarded by an RWmutex.
+// Idempotency records live in a bounded cache with its own lock; when both are
+// needed MuTransactions is taken first.
+type conStore struct {
+	MuTransactions sync.RWMutex
+	Transactions   map[string]Transaction
+	StandingOrders map[string]standingOrder // guarded by MuTransactions too
+	Accounts       map[string]account       // guarded by MuTransactions too
+	Audit          []auditEntry             // guarded by MuTransactions too; Audit[i].Seq == i+1
+	Outbox         []outboxEntry            // guarded by MuTransactions too; Outbox[i].Seq == OutboxPruned+i+1
+	OutboxPruned   int64                    // guarded by MuTransactions too; Seq of the last pruned entry
+	OutboxOffsets  map[string]int64         // guarded by MuTransactions too; by sink
+	idemCache      *idemCache
+}
+
+func NewConStore() *conStore {
+	return newConStoreWithLimits(idemMaxEntries, idemMaxBytes)
+}
+
+// newConStoreWithLimits caps the idempotency cache at maxEntries records and maxBytes.
+func newConStoreWithLimits(maxEntries int, maxBytes int64) *conStore {
+	store := &conStore{
+		MuTransactions: sync.RWMutex{},
+		Transactions:   make(map[string]Transaction),
+		StandingOrders: make(map[string]standingOrder),
+		Accounts:       make(map[string]account),
+		OutboxOffsets:  make(map[string]int64),
+		idemCache:      newIdemCache(maxEntries, maxBytes),
+	}
+
+	return store
+}
+
+func (s *conStore) PutTransaction(t Transaction, events ...Event) error {
+	return s.PutTransactions([]Transaction{t}, events...)
+}
+
+func (s *conStore) PutTransactions(ts []Transaction, events ...Event) error {
+	s.MuTransactions.Lock()
+	defer s.MuTransactions.Unlock()
+	entries, audit, err := s.entriesLocked(events)
+	if err != nil {
+		return err
+	}
+	return s.putLocked(ts, entries, audit)
+}
+
+// commit stores ts with outbox and audit entries made by the caller, see fileStore.
+func (s *conStore) commit(ts []Transaction, entries []outboxEntry, audit []auditEntry) error {
+	s.MuTransactions.Lock()
+	defer s.MuTransactions.Unlock()
+	return s.putLocked(ts, entries, audit)
+}
+
+// entriesLocked makes the outbox and audit entries for events, following the
+// newest ones; MuTransactions must be held, for reading at least.
+func (s *conStore) entriesLocked(events []Event) ([]outboxEntry, []auditEntry, error) {
+	head := auditHead{Hash: auditGenesis}
+	if n := len(s.Audit); n > 0 {
+		head = auditHead{Seq: s.Audit[n-1].Seq, Hash: s.Audit[n-1].Hash}
+	}
+	audit, err := chainAudit(head, events)
+	if err != nil {
+		return nil, nil, err
+	}
+	return numberEvents(s.OutboxPruned+int64(len(s.Outbox)), events), audit, nil
+}
+
+// putLocked stores ts and entries, which must continue the outbox and the audit
+// log; MuTransactions must be held.
+func (s *conStore) putLocked(ts []Transaction, entries []outboxEntry, audit []auditEntry) error {
+	for i, e := range entries {
+		if want := s.OutboxPruned + int64(len(s.Outbox)+i+1); e.Seq != want {
+			return fmt.Errorf("outbox entry %d out of sequence, want %d", e.Seq, want)
+		}
+	}
+	for i, e := range audit {
+		if want := int64(len(s.Audit) + i + 1); e.Seq != want {
+			return fmt.Errorf("audit entry %d out of sequence, want %d", e.Seq, want)
+		}
+	}
+	for _, t := range ts {
+		s.Transactions[t.ID] = t
+	}
+	s.Outbox = append(s.Outbox, entries...)
+	s.Audit = append(s.Audit, audit...)
+	return nil
+}
+
+// outboxLen is the Seq of the last outbox entry.
+func (s *conStore) outboxLen() int64 {
+	s.MuTransactions.RLock()
+	defer s.MuTransactions.RUnlock()
+	return s.OutboxPruned + int64(len(s.Outbox))
+}
+
+func (s *conStore) GetTransaction(id string) (Transaction, bool, error) {
+	s.MuTransactions.RLock()
+	t, ok := s.Transactions[id]
+	s.MuTransactions.RUnlock()
+	return t, ok, nil
+}
+
+func (s *conStore) UpdateTransaction(id string, fn func(*Transaction) error) (Transaction, error) {
+	return s.ApplyTransaction(id, func(t *Transaction) (txWrite, error) { return txWrite{}, fn(t) })
+}
+
+func (s *conStore) ApplyTransaction(id string, fn func(*Transaction) (txWrite, error)) (Transaction, error) {
+	ts, err := s.ApplyTransactions([]string{id}, func(ts []Transaction) (txWrite, error) { return fn(&ts[0]) })
+	if err != nil {
+		return Transaction{}, err
+	}
+	return ts[0], nil
+}
+
+func (s *conStore) ApplyTransactions(ids []string, fn func([]Transaction) (txWrite, error)) ([]Transaction, error) {
+	s.MuTransactions.Lock()
+	defer s.MuTransactions.Unlock()
+	ts, err := s.getLocked(ids)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fn(ts)
+	if err != nil {
+		return nil, err
+	}
+	entries, audit, err := s.entriesLocked(w.Events)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.putLocked(append(slices.Clone(ts), w.Put...), entries, audit); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// getLocked returns the transactions ids; MuTransactions must be held.
+func (s *conStore) getLocked(ids []string) ([]Transaction, error) {
+	ts := make([]Transaction, len(ids))
+	for i, id := range ids {
+		t, ok := s.Transactions[id]
+		if !ok {
+			return nil, errTransactionNotFound
+		}
+		ts[i] = t
+	}
+	return ts, nil
+}
+
+func (s *conStore) CountTransactions() (map[TransactionStatus]int, error) {
+	s.MuTransactions.RLock()
+	defer s.MuTransactions.RUnlock()
+	counts := make(map[TransactionStatus]int)
+	for _, t := range s.Transactions {
+		counts[t.Status]++
+	}
+	return counts, nil
+}
+
+func (s *conStore) ListTransactions(q listQuery) ([]Transaction, error) {
+	// Snapshot under read lock
+	s.MuTransactions.RLock()
+	items := make([]Transaction, 0, len(s.Transactions))
+	for _, t := range s.Transactions {
+		if q.matches(t) {
+			items = append(items, t)
+		}
+	}
+	s.MuTransactions.RUnlock()
+
+	return q.page(items), nil
+}
+
+// matches reports whether t passes the filters of q.
+func (q listQuery) matches(t Transaction) bool {
+	if q.FromAccountID != "" && t.FromAccountID != q.FromAccountID {
+		return false
+	}
+	if q.Accounts != nil && !q.Accounts[t.FromAccountID] && !q.Accounts[t.ToAccountID] {
+		return false
+	}
+	for k, v := range q.Metadata {
+		if got, ok := t.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	if !q.After.At.IsZero() && !afterCursor(t, q.After) {
+		return false
+	}
+	if !q.Since.IsZero() && t.At.Before(q.Since) {
+		return false
+	}
+	return true
+}
+
+// page sorts matching items by (At, ID) and cuts them to q.Limit.
+func (q listQuery) page(items []Transaction) []Transaction {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].At.Before(items[j].At) {
+			return true
+		}
+		if items[i].At.After(items[j].At) {
+			return false
+		}
+		return items[i].ID < items[j].ID
+	})
+
+	if q.Limit > 0 && len(items) > q.Limit {
+		items = items[:q.Limit]
+	}
+	return items
+}
+
+func (s *conStore) PutStandingOrder(o standingOrder) error {
+	s.MuTransactions.Lock()
+	s.StandingOrders[o.ID] = o
+	s.MuTransactions.Unlock()
+	return nil
+}
+
+func (s *conStore) GetStandingOrder(id string) (standingOrder, bool, error) {
+	s.MuTransactions.RLock()
+	o, ok := s.StandingOrders[id]
+	s.MuTransactions.RUnlock()
+	return o, ok, nil
+}
+
+func (s *conStore) ListStandingOrders() ([]standingOrder, error) {
+	s.MuTransactions.RLock()
+	items := make([]standingOrder, 0, len(s.StandingOrders))
+	for _, o := range s.StandingOrders {
+		items = append(items, o)
+	}
+	s.MuTransactions.RUnlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items, nil
+}
+
+func (s *conStore) PutAccount(a account) error {
+	s.MuTransactions.Lock()
+	s.Accounts[a.ID] = a
+	s.MuTransactions.Unlock()
+	return nil
+}
+
+func (s *conStore) GetAccount(id string) (account, bool, error) {
+	s.MuTransactions.RLock()
+	a, ok := s.Accounts[id]
+	s.MuTransactions.RUnlock()
+	return a, ok, nil
+}
+
+func (s *conStore) AppendAudit(e auditEntry) error {
+	s.MuTransactions.Lock()
+	defer s.MuTransactions.Unlock()
+	if e.Seq != int64(len(s.Audit))+1 {
+		return fmt.Errorf("audit entry %d out of sequence, log is at %d", e.Seq, len(s.Audit))
+	}
+	s.Audit = append(s.Audit, e)
+	return nil
+}
+
+func (s *conStore) ListAudit(after int64, limit int) ([]auditEntry, error) {
+	s.MuTransactions.RLock()
+	defer s.MuTransactions.RUnlock()
+	if after < 0 {
+		after = 0
+	}
+	if after >= int64(len(s.Audit)) {
+		return nil, nil
+	}
+	items := s.Audit[after:]
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return slices.Clone(items), nil
+}
+
+func (s *conStore) LastAudit() (auditEntry, bool, error) {
+	s.MuTransactions.RLock()
+	defer s.MuTransactions.RUnlock()
+	if len(s.Audit) == 0 {
+		return auditEntry{}, false, nil
+	}
+	return s.Audit[len(s.Audit)-1], true, nil
+}
+
+func (s *conStore) ListOutbox(after int64, limit int) ([]outboxEntry, error) {
+	s.MuTransactions.RLock()
+	defer s.MuTransactions.RUnlock()
+	after = max(after-s.OutboxPruned, 0) // index of the first entry after it
+	if after >= int64(len(s.Outbox)) {
+		return nil, nil
+	}
+	items := s.Outbox[after:]
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return slices.Clone(items), nil
+}
+
+func (s *conStore) LastOutboxSeq() (int64, error) {
+	return s.outboxLen(), nil
+}
+
+func (s *conStore) PruneOutbox(through int64) error {
+	s.MuTransactions.Lock()
+	defer s.MuTransactions.Unlock()
+	s.pruneLocked(through)
+	return nil
+}
+
+// pruneLocked drops the outbox entries up to Seq through; MuTransactions must be held.
+// Pruning past the newest entry moves the numbering on, see fileStore.Compact.
+func (s *conStore) pruneLocked(through int64) {
+	if through <= s.OutboxPruned {
+		return
+	}
+	n := min(through-s.OutboxPruned, int64(len(s.Outbox)))
+	// a copy, so the pruned entries don't stay reachable through the array
+	s.Outbox = slices.Clone(s.Outbox[n:])
+	s.OutboxPruned = through
+}
+
+func (s *conStore) OutboxOffset(sink string) (int64, error) {
+	s.MuTransactions.RLock()
+	defer s.MuTransactions.RUnlock()
+	return s.OutboxOffsets[sink], nil
+}
+
+func (s *conStore) PutOutboxOffset(sink string, seq int64) error {
+	s.MuTransactions.Lock()
+	s.OutboxOffsets[sink] = seq
+	s.MuTransactions.Unlock()
+	return nil
+}
+
+func (s *conStore) LookupIdem(key, hash string) (idemRecord, idemResult, error) {
+	rec, res := s.idemCache.lookup(key, hash)
+	return rec, res, nil
+}
+
+func (s *conStore) PutIdem(key string, rec idemRecord) error {
+	s.idemCache.put(key, rec)
+	return nil
+}
+
+func (s *conStore) DeleteIdem(key string) error {
+	s.idemCache.delete(key)
+	return nil
+}
+
+// SweepIdem takes no store lock: the cache pops expired records off its
+// expiry index under its own lock.
+func (s *conStore) SweepIdem(cutoff time.Time) (int, error) {
+	return s.idemCache.sweep(cutoff), nil
+}
+
+func (s *conStore) IdemStats() idemStats {
+	return s.idemCache.stats()
+}
+
+func (s *conStore) Close() error { return nil }
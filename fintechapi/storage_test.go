@@ -0,0 +1,684 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeFactory opens a fresh, empty store for one subtest.
+type storeFactory func(t *testing.T) Store
+
+func TestStore_Memory(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T) Store { return NewConStore() })
+}
+
+func TestStore_File(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T) Store {
+		s, err := openFileStore(filepath.Join(t.TempDir(), "fintech.log"))
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+// runStoreSuite is the behaviour every Store implementation must share.
+func runStoreSuite(t *testing.T, open storeFactory) {
+	t0 := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tx := func(id, from string, at time.Time) Transaction {
+		return Transaction{ID: id, FromAccountID: from, ToAccountID: "B", Amount: 100, Currency: "EUR", At: at}
+	}
+
+	t.Run("PutGetTransaction", func(t *testing.T) {
+		s := open(t)
+		if _, ok, _ := s.GetTransaction("nope"); ok {
+			t.Fatalf("empty store returned a transaction")
+		}
+		want := tx("t1", "A", t0)
+		if err := s.PutTransaction(want); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		got, ok, err := s.GetTransaction("t1")
+		if err != nil || !ok {
+			t.Fatalf("get: ok=%v err=%v", ok, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %+v, got %+v", want, got)
+		}
+
+		want.Status = StatusCompleted
+		_ = s.PutTransaction(want)
+		got, _, _ = s.GetTransaction("t1")
+		if got.Status != StatusCompleted {
+			t.Errorf("put should replace, got status %s", got.Status)
+		}
+	})
+
+	t.Run("PutTransactions", func(t *testing.T) {
+		s := open(t)
+		batch := []Transaction{tx("b1", "A", t0), tx("b2", "A", t0.Add(time.Second))}
+		if err := s.PutTransactions(batch); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		got, err := s.ListTransactions(listQuery{})
+		if err != nil || ids(got) != "b1,b2" {
+			t.Errorf("want b1,b2, got %s (err=%v)", ids(got), err)
+		}
+	})
+
+	t.Run("UpdateTransaction", func(t *testing.T) {
+		s := open(t)
+		if _, err := s.UpdateTransaction("nope", func(*Transaction) error { return nil }); !errors.Is(err, errTransactionNotFound) {
+			t.Fatalf("want errTransactionNotFound, got %v", err)
+		}
+		_ = s.PutTransaction(tx("t1", "A", t0))
+
+		got, err := s.UpdateTransaction("t1", func(t *Transaction) error {
+			t.Status = StatusCompleted
+			return nil
+		})
+		if err != nil || got.Status != StatusCompleted {
+			t.Fatalf("update: status=%s err=%v", got.Status, err)
+		}
+		boom := errors.New("boom")
+		if _, err := s.UpdateTransaction("t1", func(t *Transaction) error {
+			t.Status = StatusFailed
+			return boom
+		}); !errors.Is(err, boom) {
+			t.Fatalf("want fn error, got %v", err)
+		}
+		if stored, _, _ := s.GetTransaction("t1"); stored.Status != StatusCompleted {
+			t.Errorf("aborted update should not be saved, got %s", stored.Status)
+		}
+	})
+
+	t.Run("ApplyTransactions", func(t *testing.T) {
+		s := open(t)
+		_ = s.PutTransaction(tx("t1", "A", t0))
+		_ = s.PutTransaction(tx("t2", "B", t0))
+		if _, err := s.ApplyTransactions([]string{"t1", "nope"}, func([]Transaction) (txWrite, error) { return txWrite{}, nil }); !errors.Is(err, errTransactionNotFound) {
+			t.Fatalf("want errTransactionNotFound, got %v", err)
+		}
+
+		got, err := s.ApplyTransactions([]string{"t2", "t1"}, func(ts []Transaction) (txWrite, error) {
+			ts[0].Status, ts[1].Status = StatusFailed, StatusCompleted
+			return txWrite{Put: []Transaction{tx("t3", "A", t0)}}, nil
+		})
+		if err != nil || got[0].ID != "t2" || got[1].Status != StatusCompleted {
+			t.Fatalf("apply: %+v %v", got, err)
+		}
+		t1, _, _ := s.GetTransaction("t1")
+		t2, _, _ := s.GetTransaction("t2")
+		_, ok, _ := s.GetTransaction("t3")
+		if t1.Status != StatusCompleted || t2.Status != StatusFailed || !ok {
+			t.Errorf("want every change saved, got %s %s %v", t1.Status, t2.Status, ok)
+		}
+	})
+
+	t.Run("CountTransactions", func(t *testing.T) {
+		s := open(t)
+		_ = s.PutTransaction(tx("t1", "A", t0))
+		_ = s.PutTransaction(tx("t2", "A", t0))
+		done := tx("t3", "A", t0)
+		done.Status = StatusCompleted
+		_ = s.PutTransaction(done)
+
+		counts, err := s.CountTransactions()
+		if err != nil {
+			t.Fatalf("count: %v", err)
+		}
+		if counts[StatusPending] != 2 || counts[StatusCompleted] != 1 || counts[StatusFailed] != 0 {
+			t.Errorf("unexpected counts %v", counts)
+		}
+	})
+
+	t.Run("ListSince", func(t *testing.T) {
+		s := open(t)
+		_ = s.PutTransaction(tx("t1", "A", t0))
+		_ = s.PutTransaction(tx("t2", "A", t0.Add(time.Minute)))
+		_ = s.PutTransaction(tx("t3", "A", t0.Add(2*time.Minute)))
+
+		got, err := s.ListTransactions(listQuery{Since: t0.Add(time.Minute)})
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if len(got) != 2 || got[0].ID != "t2" || got[1].ID != "t3" {
+			t.Errorf("expected t2, t3 (Since is inclusive), got %v", got)
+		}
+	})
+
+	t.Run("ListOrderFilterAndCursor", func(t *testing.T) {
+		s := open(t)
+		// same timestamp for t2/t3 so the ID tie-break matters
+		_ = s.PutTransaction(tx("t3", "A", t0.Add(time.Second)))
+		_ = s.PutTransaction(tx("t1", "A", t0))
+		_ = s.PutTransaction(tx("t2", "A", t0.Add(time.Second)))
+		_ = s.PutTransaction(tx("x1", "Z", t0))
+
+		all, err := s.ListTransactions(listQuery{})
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if got := ids(all); got != "t1,x1,t2,t3" {
+			t.Errorf("order: got %s", got)
+		}
+
+		fromA, _ := s.ListTransactions(listQuery{FromAccountID: "A", Limit: 2})
+		if got := ids(fromA); got != "t1,t2" {
+			t.Errorf("filter+limit: got %s", got)
+		}
+
+		last := fromA[len(fromA)-1]
+		rest, _ := s.ListTransactions(listQuery{FromAccountID: "A", After: trCursor{At: last.At, ID: last.ID}})
+		if got := ids(rest); got != "t3" {
+			t.Errorf("after cursor: got %s", got)
+		}
+	})
+
+	t.Run("IdempotencyRecords", func(t *testing.T) {
+		s := open(t)
+		rec := idemRecord{
+			Hash:       "h",
+			StatusCode: 202,
+			Header:     http.Header{"Location": {"/transactions/t1"}},
+			Body:       []byte(`{"id":"t1"}`),
+			CreatedAt:  t0,
+		}
+		if err := s.PutIdem("k1", rec); err != nil {
+			t.Fatalf("put idem: %v", err)
+		}
+		got, res, err := s.LookupIdem("k1", "h")
+		if err != nil || res != idemHit {
+			t.Fatalf("lookup idem: res=%v err=%v", res, err)
+		}
+		if _, res, _ := s.LookupIdem("k1", "other"); res != idemConflict {
+			t.Errorf("different fingerprint: want conflict, got %v", res)
+		}
+		if _, res, _ := s.LookupIdem("k-unknown", "h"); res != idemMiss {
+			t.Errorf("unknown key: want miss, got %v", res)
+		}
+		if st := s.IdemStats(); st.Hits != 1 || st.Conflicts != 1 || st.Misses != 1 || st.Entries != 1 {
+			t.Errorf("unexpected stats %+v", st)
+		}
+		if got.Hash != rec.Hash || string(got.Body) != string(rec.Body) || got.Header.Get("Location") != "/transactions/t1" || !got.CreatedAt.Equal(rec.CreatedAt) {
+			t.Errorf("want %+v, got %+v", rec, got)
+		}
+
+		if err := s.DeleteIdem("k1"); err != nil {
+			t.Fatalf("delete idem: %v", err)
+		}
+		if _, ok, _ := findIdem(s, "k1"); ok {
+			t.Errorf("deleted record still present")
+		}
+	})
+
+	t.Run("SweepIdem", func(t *testing.T) {
+		s := open(t)
+		_ = s.PutIdem("old", idemRecord{Hash: "a", CreatedAt: t0})
+		_ = s.PutIdem("new", idemRecord{Hash: "b", CreatedAt: t0.Add(time.Hour)})
+
+		n, err := s.SweepIdem(t0.Add(time.Minute))
+		if err != nil || n != 1 {
+			t.Fatalf("sweep: n=%d err=%v", n, err)
+		}
+		if _, ok, _ := findIdem(s, "old"); ok {
+			t.Errorf("expired record survived the sweep")
+		}
+		if _, ok, _ := findIdem(s, "new"); !ok {
+			t.Errorf("fresh record was swept")
+		}
+	})
+
+	t.Run("StandingOrders", func(t *testing.T) {
+		s := open(t)
+		next := t0.Add(time.Hour)
+		a := standingOrder{ID: "o1", FromAccountID: "A", Frequency: FrequencyDaily, StartAt: next, Status: orderActive, NextAt: &next, CreatedAt: t0.Add(time.Minute)}
+		b := standingOrder{ID: "o2", FromAccountID: "B", Frequency: FrequencyOnce, StartAt: next, Status: orderActive, NextAt: &next, CreatedAt: t0}
+		for _, o := range []standingOrder{a, b} {
+			if err := s.PutStandingOrder(o); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+		}
+		a.Runs, a.Status, a.NextAt = 1, orderFinished, nil
+		if err := s.PutStandingOrder(a); err != nil {
+			t.Fatalf("replace: %v", err)
+		}
+
+		if got, ok, err := s.GetStandingOrder("o1"); err != nil || !ok || !reflect.DeepEqual(got, a) {
+			t.Errorf("get: ok=%v err=%v got %+v", ok, err, got)
+		}
+		if _, ok, _ := s.GetStandingOrder("nope"); ok {
+			t.Errorf("unknown order found")
+		}
+		all, err := s.ListStandingOrders()
+		if err != nil || len(all) != 2 || all[0].ID != "o2" || all[1].ID != "o1" {
+			t.Errorf("list should be oldest first: err=%v %+v", err, all)
+		}
+	})
+
+	t.Run("Accounts", func(t *testing.T) {
+		s := open(t)
+		want := account{ID: "A", Currency: "USD", CreatedAt: t0}
+		if err := s.PutAccount(want); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		if got, ok, err := s.GetAccount("A"); err != nil || !ok || got != want {
+			t.Errorf("get: ok=%v err=%v got %+v", ok, err, got)
+		}
+		if _, ok, _ := s.GetAccount("nope"); ok {
+			t.Errorf("unknown account found")
+		}
+	})
+
+	t.Run("AuditLog", func(t *testing.T) {
+		s := open(t)
+		if _, ok, err := s.LastAudit(); ok || err != nil {
+			t.Fatalf("empty log has a last entry: ok=%v err=%v", ok, err)
+		}
+		for seq := int64(1); seq <= 3; seq++ {
+			if err := s.AppendAudit(auditEntry{Seq: seq, TransactionID: fmt.Sprintf("t%d", seq), Data: json.RawMessage(`{}`)}); err != nil {
+				t.Fatalf("append %d: %v", seq, err)
+			}
+		}
+		for _, seq := range []int64{3, 5} {
+			if err := s.AppendAudit(auditEntry{Seq: seq, Data: json.RawMessage(`{}`)}); err == nil {
+				t.Errorf("entry %d after 3 was accepted", seq)
+			}
+		}
+
+		if last, ok, _ := s.LastAudit(); !ok || last.Seq != 3 {
+			t.Errorf("last: want 3, got %+v", last)
+		}
+		if got, err := s.ListAudit(1, 1); err != nil || len(got) != 1 || got[0].Seq != 2 {
+			t.Errorf("list after 1, limit 1: err=%v %+v", err, got)
+		}
+		if got, _ := s.ListAudit(0, 0); len(got) != 3 || got[0].TransactionID != "t1" {
+			t.Errorf("list all: %+v", got)
+		}
+		if got, _ := s.ListAudit(3, 0); len(got) != 0 {
+			t.Errorf("list after the end: %+v", got)
+		}
+	})
+
+	t.Run("AuditWithTheWrite", func(t *testing.T) {
+		s := open(t)
+		t1 := tx("t1", "A", t0)
+		_ = s.PutTransaction(t1, newEvent(EventTransactionCreated, t1))
+		_ = s.PutTransaction(tx("t0", "A", t0)) // no events, no entry
+		_, _ = s.ApplyTransaction("t1", func(t *Transaction) (txWrite, error) {
+			t.Status = StatusCompleted
+			return txWrite{Events: []Event{newEvent(EventTransactionStatusChanged, *t)}}, nil
+		})
+		if _, err := s.ApplyTransaction("t1", func(t *Transaction) (txWrite, error) {
+			return txWrite{Events: []Event{newEvent(EventTransactionUpdated, *t)}}, errors.New("boom")
+		}); err == nil {
+			t.Fatalf("want fn error")
+		}
+
+		entries, _ := s.ListAudit(0, 0)
+		var lines, actions []string
+		for _, e := range entries {
+			b, _ := json.Marshal(e)
+			lines = append(lines, string(b))
+			actions = append(actions, e.Action+":"+e.TransactionID)
+		}
+		if strings.Join(actions, " ") != "create:t1 status_change:t1" {
+			t.Errorf("want an entry per stored event and none for the failed write, got %v", actions)
+		}
+		if head, err := verifyAudit(strings.NewReader(strings.Join(lines, "\n"))); err != nil || head.Seq != 2 {
+			t.Errorf("verify: head %+v err=%v", head, err)
+		}
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		s := open(t)
+		t1 := tx("t1", "A", t0)
+		_ = s.PutTransaction(t1, newEvent(EventTransactionCreated, t1))
+		_ = s.PutTransaction(tx("t0", "A", t0)) // no events
+		batch := []Transaction{tx("b1", "A", t0), tx("b2", "A", t0)}
+		_ = s.PutTransactions(batch, newEvent(EventTransactionCreated, batch[0]), newEvent(EventTransactionCreated, batch[1]))
+
+		got, err := s.ApplyTransaction("t1", func(t *Transaction) (txWrite, error) {
+			t.Status = StatusCompleted
+			fee := tx("t1-fee-0", "A", t0)
+			return txWrite{Put: []Transaction{fee}, Events: []Event{newEvent(EventTransactionStatusChanged, *t), newEvent(EventTransactionCreated, fee)}}, nil
+		})
+		if err != nil || got.Status != StatusCompleted {
+			t.Fatalf("apply: %+v %v", got, err)
+		}
+		if _, ok, _ := s.GetTransaction("t1-fee-0"); !ok {
+			t.Errorf("the transaction put with the update is missing")
+		}
+		boom := errors.New("boom")
+		if _, err := s.ApplyTransaction("t1", func(t *Transaction) (txWrite, error) {
+			return txWrite{Events: []Event{newEvent(EventTransactionUpdated, *t)}}, boom
+		}); !errors.Is(err, boom) {
+			t.Fatalf("want fn error, got %v", err)
+		}
+
+		entries, err := s.ListOutbox(0, 0)
+		var types []string
+		for i, e := range entries {
+			if e.Seq != int64(i+1) {
+				t.Errorf("entry %d has seq %d", i, e.Seq)
+			}
+			types = append(types, e.Type+":"+e.Transaction.ID)
+		}
+		want := "transaction.created:t1 transaction.created:b1 transaction.created:b2 transaction.status_changed:t1 transaction.created:t1-fee-0"
+		if err != nil || strings.Join(types, " ") != want {
+			t.Errorf("want %s, got %v %v", want, types, err)
+		}
+		if page, _ := s.ListOutbox(2, 2); len(page) != 2 || page[0].Seq != 3 {
+			t.Errorf("list after 2, limit 2: %+v", page)
+		}
+
+		// pruning keeps the numbering
+		_ = s.PruneOutbox(3)
+		if page, _ := s.ListOutbox(0, 0); len(page) != 2 || page[0].Seq != 4 {
+			t.Errorf("after pruning up to 3: %+v", page)
+		}
+		b3 := tx("b3", "A", t0)
+		_ = s.PutTransaction(b3, newEvent(EventTransactionCreated, b3))
+		if last, _ := s.LastOutboxSeq(); last != 6 {
+			t.Errorf("want the next entry numbered 6, last is %d", last)
+		}
+		_ = s.PruneOutbox(6)
+		if page, _ := s.ListOutbox(2, 0); len(page) != 0 {
+			t.Errorf("after pruning everything: %+v", page)
+		}
+		if last, _ := s.LastOutboxSeq(); last != 6 {
+			t.Errorf("want the last seq kept after pruning everything, got %d", last)
+		}
+
+		if off, err := s.OutboxOffset("log"); err != nil || off != 0 {
+			t.Errorf("offset of a new sink: %d %v", off, err)
+		}
+		_ = s.PutOutboxOffset("log", 4)
+		if off, _ := s.OutboxOffset("log"); off != 4 {
+			t.Errorf("offset: want 4, got %d", off)
+		}
+	})
+}
+
+// findIdem looks key up regardless of fingerprint.
+func findIdem(s Store, key string) (idemRecord, bool, error) {
+	rec, res, err := s.LookupIdem(key, "")
+	return rec, res != idemMiss, err
+}
+
+func ids(ts []Transaction) string {
+	s := make([]string, len(ts))
+	for i, t := range ts {
+		s[i] = t.ID
+	}
+	return strings.Join(s, ",")
+}
+
+func TestFileStore_RecoversAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fintech.log")
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	at := time.Now().UTC()
+	_ = s.PutTransaction(Transaction{ID: "t1", FromAccountID: "A", ToAccountID: "B", Amount: 1, Currency: "EUR", At: at})
+	_ = s.PutIdem("k1", idemRecord{Hash: "h", CreatedAt: at, Header: http.Header{"Location": {"/transactions/t1"}}})
+	_ = s.PutIdem("k2", idemRecord{Hash: "h2", CreatedAt: at})
+	_ = s.DeleteIdem("k2")
+	_ = s.PutTransactions([]Transaction{{ID: "b1", Currency: "EUR", At: at}, {ID: "b2", Currency: "EUR", At: at}})
+	_ = s.PutStandingOrder(standingOrder{ID: "o1", Frequency: FrequencyDaily, StartAt: at, Status: orderActive, Runs: 1})
+	_ = s.PutStandingOrder(standingOrder{ID: "o1", Frequency: FrequencyDaily, StartAt: at, Status: orderActive, Runs: 2})
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s, err = openFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if tr, ok, _ := s.GetTransaction("t1"); !ok || !tr.At.Equal(at) {
+		t.Errorf("transaction not recovered: %+v", tr)
+	}
+	if rec, ok, _ := findIdem(s, "k1"); !ok || rec.Header.Get("Location") != "/transactions/t1" {
+		t.Errorf("idempotency record not recovered: %+v", rec)
+	}
+	if _, ok, _ := findIdem(s, "k2"); ok {
+		t.Errorf("deleted idempotency record came back")
+	}
+	if _, ok, _ := s.GetTransaction("b2"); !ok {
+		t.Errorf("batch not recovered")
+	}
+	if o, ok, _ := s.GetStandingOrder("o1"); !ok || o.Runs != 2 {
+		t.Errorf("standing order not recovered: %+v", o)
+	}
+}
+
+func TestFileStore_TornTailIsDropped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fintech.log")
+	s, _ := openFileStore(path)
+	_ = s.PutTransaction(Transaction{ID: "t1", Currency: "EUR"})
+	s.Close()
+
+	// simulate a crash halfway through the next append
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	_, _ = f.WriteString(`{"op":"put_tx","tx":{"id":"t2"`)
+	f.Close()
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen with torn tail: %v", err)
+	}
+	if _, ok, _ := s.GetTransaction("t2"); ok {
+		t.Errorf("torn record should not be applied")
+	}
+	// the store keeps working and the new record is readable after another restart
+	_ = s.PutTransaction(Transaction{ID: "t3", Currency: "EUR"})
+	s.Close()
+
+	s, err = openFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen after append: %v", err)
+	}
+	defer s.Close()
+	for _, id := range []string{"t1", "t3"} {
+		if _, ok, _ := s.GetTransaction(id); !ok {
+			t.Errorf("%s missing after recovery", id)
+		}
+	}
+}
+
+// faultyLog writes only half of the next record and fails, or fails the next
+// sync after writing all of it.
+type faultyLog struct {
+	logFile
+	shortWrite, failSync bool
+}
+
+func (f *faultyLog) Write(b []byte) (int, error) {
+	if f.shortWrite {
+		f.shortWrite = false
+		n, _ := f.logFile.Write(b[:len(b)/2])
+		return n, errors.New("disk full")
+	}
+	return f.logFile.Write(b)
+}
+
+func (f *faultyLog) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return errors.New("I/O error")
+	}
+	return f.logFile.Sync()
+}
+
+func TestFileStore_FailedAppendIsCutOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fintech.log")
+	s, _ := openFileStore(path)
+	put := func(id string) error {
+		tr := Transaction{ID: id, Currency: "EUR"}
+		return s.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	}
+	_ = put("t1")
+	if err := s.Compact(); err != nil { // the log is reopened for appending
+		t.Fatalf("compact: %v", err)
+	}
+	f := &faultyLog{logFile: s.f, shortWrite: true}
+	s.f = f
+
+	if err := put("lost1"); err == nil {
+		t.Fatalf("want the short write to fail")
+	}
+	_ = put("t2")
+	f.failSync = true
+	if err := put("lost2"); err == nil {
+		t.Fatalf("want the failed sync to fail")
+	}
+	_ = put("t3")
+	s.Close()
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	all, _ := s.ListTransactions(listQuery{})
+	if ids(all) != "t1,t2,t3" {
+		t.Errorf("want t1,t2,t3 and no trace of the failed appends, got %s", ids(all))
+	}
+	audit, _ := s.ListAudit(0, 0)
+	var audited []string
+	for _, e := range audit {
+		audited = append(audited, e.TransactionID)
+	}
+	if strings.Join(audited, ",") != "t1,t2,t3" || audit[2].PrevHash != audit[1].Hash {
+		t.Errorf("want the chain t1,t2,t3 without the failed appends, got %v", audited)
+	}
+}
+
+func TestFileStore_CompactDropsPrunedOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fintech.log")
+	s, _ := openFileStore(path)
+	for i := range 4 {
+		tr := Transaction{ID: fmt.Sprintf("t%d", i), Currency: "EUR"}
+		_ = s.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	}
+	_ = s.PruneOutbox(3)
+	if err := s.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	b, _ := os.ReadFile(path)
+	if n := strings.Count(string(b), `"op":"outbox"`); n != 1 {
+		t.Errorf("want only the entry not pruned in the log, got %d", n)
+	}
+	s.Close()
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if page, _ := s.ListOutbox(0, 0); len(page) != 1 || page[0].Seq != 4 {
+		t.Errorf("want entry 4 alone, got %+v", page)
+	}
+	tr := Transaction{ID: "t4", Currency: "EUR"}
+	if err := s.PutTransaction(tr, newEvent(EventTransactionCreated, tr)); err != nil {
+		t.Fatalf("put after reopen: %v", err)
+	}
+	if last, _ := s.LastOutboxSeq(); last != 5 {
+		t.Errorf("want the numbering to go on at 5, last is %d", last)
+	}
+}
+
+func TestFileStore_OutboxCompactsTheLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fintech.log")
+	s, _ := openFileStore(path)
+	defer s.Close()
+	for i := range 10 {
+		tr := Transaction{ID: fmt.Sprintf("t%d", i), Currency: "EUR"}
+		_ = s.PutTransaction(tr, newEvent(EventTransactionCreated, tr))
+	}
+	_ = s.PruneOutbox(8)
+	// no idempotency records to sweep: saving offsets sees to compaction
+	for range 2 * compactMinRecords {
+		_ = s.PutOutboxOffset("log", 8)
+	}
+	s.mu.Lock()
+	records := s.records
+	s.mu.Unlock()
+	if records >= compactMinRecords {
+		t.Errorf("want the log compacted, it has %d records", records)
+	}
+	b, _ := os.ReadFile(path)
+	if n := strings.Count(string(b), `"op":"outbox"`); n != 2 {
+		t.Errorf("want the pruned entries gone from the log, %d entries left", n)
+	}
+	if off, _ := s.OutboxOffset("log"); off != 8 {
+		t.Errorf("compaction lost the offset, got %d", off)
+	}
+}
+
+func TestFileStore_CorruptRecordFailsOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fintech.log")
+	content := "{\"op\":\"put_tx\",\"tx\":{\"id\":\"t1\"}}\nnot json\n{\"op\":\"put_tx\",\"tx\":{\"id\":\"t2\"}}\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openFileStore(path); err == nil {
+		t.Fatalf("expected corruption error")
+	}
+}
+
+func TestFileStore_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fintech.log")
+	s, _ := openFileStore(path)
+	// many overwrites of a few transactions: the log grows, the live set doesn't
+	for i := 0; i < 50; i++ {
+		_ = s.PutTransaction(Transaction{ID: fmt.Sprintf("t%d", i%5), Amount: int64(i), Currency: "EUR"})
+	}
+	for seq := int64(1); seq <= 3; seq++ {
+		_ = s.AppendAudit(auditEntry{Seq: seq, Data: json.RawMessage(`{}`)})
+	}
+	_ = s.PutAccount(account{ID: "A", Currency: "USD"})
+	before, _ := os.Stat(path)
+
+	if err := s.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("compaction did not shrink the log: %d -> %d", before.Size(), after.Size())
+	}
+
+	// appends after compaction land in the new file
+	_ = s.PutTransaction(Transaction{ID: "t9", Currency: "EUR"})
+	s.Close()
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	all, _ := s.ListTransactions(listQuery{})
+	if len(all) != 6 {
+		t.Fatalf("want 6 transactions after compaction, got %d", len(all))
+	}
+	if tr, _, _ := s.GetTransaction("t4"); tr.Amount != 49 {
+		t.Errorf("compaction kept a stale version: %+v", tr)
+	}
+	if audit, _ := s.ListAudit(0, 0); len(audit) != 3 || audit[2].Seq != 3 {
+		t.Errorf("compaction lost the audit log: %+v", audit)
+	}
+	if a, ok, _ := s.GetAccount("A"); !ok || a.Currency != "USD" {
+		t.Errorf("compaction lost the account: %+v", a)
+	}
+}
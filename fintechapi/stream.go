@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event stream
+// GET /transactions/events streams events as text/event-stream. The stream is an
+// outbox sink (outbox.go) and an event's SSE id is its outbox seq; the last
+// sseReplaySize events are kept, so a client reconnecting with Last-Event-ID
+// gets what it missed. If what it missed has already left the buffer, the stream
+// starts with a stream.reset event and the client should reload with GET
+// /transactions. The outbox numbering continues across restarts, so an id from
+// before one is older than the (empty) buffer and gets the reset, never other
+// events under a reused id.
+// Publishing never blocks: a client whose buffer is full is disconnected and
+// catches up on reconnect.
+
+const (
+	sseReplaySize     = 1024
+	sseClientBuffer   = 64
+	sseHeartbeatEvery = 15 * time.Second
+	eventStreamReset  = "stream.reset"
+)
+
+type sequencedEvent struct {
+	Seq uint64
+	Event
+}
+
+type eventStream struct {
+	mu     sync.Mutex
+	seq    uint64           // last assigned sequence number
+	buf    []sequencedEvent // ring of the last len(buf) events
+	next   int              // position of the next write in buf
+	size   int              // events in buf
+	subs   map[chan sequencedEvent]struct{}
+	closed bool
+}
+
+// newEventStream takes the events after seq.
+func newEventStream(replay int, seq uint64) *eventStream {
+	return &eventStream{
+		seq:  seq,
+		buf:  make([]sequencedEvent, replay),
+		subs: make(map[chan sequencedEvent]struct{}),
+	}
+}
+
+func (s *eventStream) name() string { return "stream" }
+
+// deliver is the outbox sink: it publishes e to the subscribers.
+func (s *eventStream) deliver(_ context.Context, e outboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.seq = uint64(e.Seq)
+	se := sequencedEvent{Seq: s.seq, Event: e.Event}
+	s.buf[s.next] = se
+	s.next = (s.next + 1) % len(s.buf)
+	s.size = min(s.size+1, len(s.buf))
+
+	for ch := range s.subs {
+		select {
+		case ch <- se:
+		default:
+			// slow consumer: drop it rather than block the dispatcher
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// subscribe returns the buffered events after lastSeq and a channel for later
+// ones; both are taken under one lock, so nothing falls in between. gap reports
+// that events after lastSeq were already evicted from the buffer.
+func (s *eventStream) subscribe(lastSeq uint64) (missed []sequencedEvent, ch chan sequencedEvent, gap bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch = make(chan sequencedEvent, sseClientBuffer)
+	if s.closed {
+		close(ch)
+		return nil, ch, false
+	}
+	s.subs[ch] = struct{}{}
+
+	oldest := s.seq - uint64(s.size) + 1 // seq of the oldest buffered event
+	gap = lastSeq+1 < oldest
+	if lastSeq > s.seq {
+		// an id this stream never handed out: what happened since is unknown
+		lastSeq, gap = 0, true
+	}
+	for i := 0; i < s.size; i++ {
+		se := s.buf[(s.next-s.size+i+len(s.buf))%len(s.buf)]
+		if se.Seq > lastSeq {
+			missed = append(missed, se)
+		}
+	}
+	return missed, ch, gap
+}
+
+func (s *eventStream) unsubscribe(ch chan sequencedEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[ch]; ok {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// close ends every stream, so shutdown does not wait for clients to hang up.
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// handler
+
+func streamEvents(w http.ResponseWriter, r *http.Request, svc *service) {
+	p, _ := principalFrom(r.Context())
+	account := strings.TrimSpace(r.URL.Query().Get("account_id"))
+	if account != "" && !p.owns(account) {
+		writeError(w, codeForbidden, "not allowed to watch this account")
+		return
+	}
+
+	var lastSeq uint64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeInvalid(w, validationError{{Name: "Last-Event-ID", Reason: "must be an event sequence number"}})
+			return
+		}
+		lastSeq = n
+	}
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{}) // streams outlive the server write timeout
+
+	missed, ch, gap := svc.stream.subscribe(lastSeq)
+	defer svc.stream.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	wanted := func(t Transaction) bool {
+		if account != "" {
+			return t.FromAccountID == account || t.ToAccountID == account
+		}
+		return p.canSee(t)
+	}
+	send := func(se sequencedEvent) error {
+		if !wanted(se.Transaction) {
+			return nil
+		}
+		return writeSSE(w, strconv.FormatUint(se.Seq, 10), se.Type, se.Event)
+	}
+
+	if gap {
+		if err := writeSSE(w, "", eventStreamReset, map[string]string{"reason": "events were missed; reload with GET /transactions"}); err != nil {
+			return
+		}
+	}
+	for _, se := range missed {
+		if err := send(se); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatEvery)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case se, ok := <-ch:
+			if !ok {
+				return // too slow, or shutting down
+			}
+			if err := send(se); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeSSE writes one event; an empty id leaves the client's last id unchanged.
+func writeSSE(w http.ResponseWriter, id, typ string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ, b)
+	return err
+}
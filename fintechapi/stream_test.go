@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseMessage struct {
+	ID    string
+	Type  string
+	Event Event
+}
+
+// openStream connects to the event stream and returns the parsed messages as
+// they arrive; the connection is closed at the end of the test.
+func openStream(t *testing.T, ts *httptest.Server, query, authorization, lastEventID string) <-chan sseMessage {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/transactions/events"+query, nil)
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", authorization)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET events: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected 200 text/event-stream, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	out := make(chan sseMessage, 16)
+	go func() {
+		defer close(out)
+		defer res.Body.Close()
+		var m sseMessage
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case line == "":
+				if m.Type != "" {
+					out <- m
+				}
+				m = sseMessage{}
+			case strings.HasPrefix(line, "id: "):
+				m.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				m.Type = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m.Event)
+			}
+		}
+	}()
+	return out
+}
+
+func next(t *testing.T, msgs <-chan sseMessage) sseMessage {
+	t.Helper()
+
+	select {
+	case m, ok := <-msgs:
+		if !ok {
+			t.Fatalf("stream ended")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for an event")
+	}
+	return sseMessage{}
+}
+
+func createTx(t *testing.T, ts *httptest.Server, from, to string) Transaction {
+	t.Helper()
+
+	in := map[string]any{"from_account_id": from, "to_account_id": to, "amount": "1", "currency": "EUR"}
+	res, body := postJSON(t, ts.URL+"/transactions", in, nil)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d body=%s", res.StatusCode, string(body))
+	}
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	return tr
+}
+
+func TestStream_LiveEventsWithAccountFilter(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	msgs := openStream(t, ts, "?account_id=A1", adminBearer, "")
+	createTx(t, ts, "Z1", "Z2")
+	tr := createTx(t, ts, "A1", "A2")
+	_, _ = putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"})
+
+	m := next(t, msgs)
+	if m.Type != EventTransactionCreated || m.Event.Transaction.ID != tr.ID {
+		t.Fatalf("expected created event for %s, got %s for %s", tr.ID, m.Type, m.Event.Transaction.ID)
+	}
+	if m.ID != "2" {
+		t.Errorf("filtered events should keep the global sequence id, got %q", m.ID)
+	}
+	m = next(t, msgs)
+	if m.Type != EventTransactionStatusChanged || m.Event.Transaction.Status != StatusCompleted {
+		t.Errorf("expected status change to completed, got %s %s", m.Type, m.Event.Transaction.Status)
+	}
+}
+
+func TestStream_OnlyOwnAccounts(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	owner := bearer("alice", "", "A1")
+	if res, _ := getWith(t, ts.URL+"/transactions/events?account_id=Z1", owner); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("watching another account: expected 403, got %d", res.StatusCode)
+	}
+
+	msgs := openStream(t, ts, "", owner, "")
+	createTx(t, ts, "Z1", "Z2")
+	tr := createTx(t, ts, "Z1", "A1")
+
+	if m := next(t, msgs); m.Event.Transaction.ID != tr.ID {
+		t.Errorf("expected only the transfer into A1, got %s", m.Event.Transaction.ID)
+	}
+}
+
+func TestStream_ResumeWithLastEventID(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	var ids []string
+	for range 3 {
+		ids = append(ids, createTx(t, ts, "A1", "A2").ID)
+	}
+
+	msgs := openStream(t, ts, "", adminBearer, "1")
+	for _, want := range ids[1:] {
+		if m := next(t, msgs); m.Event.Transaction.ID != want {
+			t.Fatalf("replay out of order: want %s, got %s", want, m.Event.Transaction.ID)
+		}
+	}
+	live := createTx(t, ts, "A1", "A2")
+	if m := next(t, msgs); m.Event.Transaction.ID != live.ID || m.ID != "4" {
+		t.Errorf("expected live event 4 after the replay, got %s (id %s)", m.Event.Transaction.ID, m.ID)
+	}
+}
+
+func TestStream_ResetWhenReplayBufferOverrun(t *testing.T) {
+	ts, svc := newTestServer(t)
+	svc.stream.mu.Lock()
+	svc.stream.buf = make([]sequencedEvent, 2) // replay the last two events only
+	svc.stream.mu.Unlock()
+
+	for range 4 {
+		createTx(t, ts, "A1", "A2")
+	}
+
+	msgs := openStream(t, ts, "", adminBearer, "1")
+	if m := next(t, msgs); m.Type != eventStreamReset || m.ID != "" {
+		t.Fatalf("expected %s without id, got %s (id %q)", eventStreamReset, m.Type, m.ID)
+	}
+	if m := next(t, msgs); m.ID != "3" {
+		t.Errorf("expected the oldest buffered event 3 after the reset, got %q", m.ID)
+	}
+}
+
+func TestStream_ResumeAcrossRestart(t *testing.T) {
+	store := NewConStore()
+	ts, _ := newTestServerWithStore(t, store)
+	for range 3 {
+		createTx(t, ts, "A1", "A2")
+	}
+	ts.Close()
+
+	// the client saw event 2 before the restart
+	ts, _ = newTestServerWithStore(t, store)
+	live := createTx(t, ts, "A1", "A2")
+	msgs := openStream(t, ts, "", adminBearer, "2")
+	if m := next(t, msgs); m.Type != eventStreamReset {
+		t.Fatalf("want %s for an id from before the restart, got %s %s", eventStreamReset, m.Type, m.ID)
+	}
+	if m := next(t, msgs); m.ID != "4" || m.Event.Transaction.ID != live.ID {
+		t.Errorf("want the first event after the restart as 4, got %s (id %s)", m.Event.Transaction.ID, m.ID)
+	}
+}
+
+func TestEventStream_SlowConsumerIsDropped(t *testing.T) {
+	s := newEventStream(sseReplaySize, 0)
+	_, slow, _ := s.subscribe(0)
+	_, fast, _ := s.subscribe(0)
+
+	done := make(chan struct{})
+	go func() {
+		for range fast {
+		}
+		close(done)
+	}()
+
+	for i := range sseClientBuffer + 1 {
+		_ = s.deliver(context.Background(), outboxEntry{Seq: int64(i + 1), Event: newEvent(EventTransactionCreated, Transaction{ID: "t"})})
+	}
+
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != sseClientBuffer {
+		t.Errorf("slow consumer should get its buffer and then be closed, got %d events", n)
+	}
+
+	s.close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("close should end every subscriber")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhooks
+// Clients register endpoints with POST /webhooks. Every event about a transaction
+// the registering caller could see is POSTed to the endpoint, signed with the
+// endpoint secret:
+//
+//	Webhook-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256(secret, "<t>.<body>")>
+//
+// Failed deliveries (network errors, non-2xx) are retried with exponential backoff;
+// after maxAttempts the delivery is dead-lettered. GET /webhooks/{id}/deliveries
+// returns the delivery log of an endpoint, its latest maxWebhookDeliveries
+// deliveries. Endpoints and logs live in memory.
+//
+// Endpoints must be public: a URL whose host is or resolves to a loopback,
+// private, link-local or otherwise internal address is rejected, and every
+// connection is checked again against the address actually dialled, so a name
+// that resolves differently later can't reach internal services either.
+// Events come from the outbox (outbox.go); deliveries are made by a fixed pool of
+// workers.
+
+const (
+	webhookSignatureHeader = "Webhook-Signature"
+	defaultWebhookAttempts = 8
+	defaultWebhookBackoff  = time.Second
+	maxWebhookBackoff      = 10 * time.Minute
+	webhookTimeout         = 10 * time.Second
+	webhookResolveTimeout  = 5 * time.Second
+	webhookWorkers         = 8
+	webhookQueueSize       = 256
+	maxWebhookDeliveries   = 1000 // per endpoint; the oldest are dropped
+)
+
+// nonPublicPrefixes are the ranges publicAddr rejects beyond what netip
+// classifies as loopback, private, link-local, multicast or unspecified.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // this network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, may embed any IPv4 address
+}
+
+// publicAddr reports whether a webhook may be delivered to a.
+func publicAddr(a netip.Addr) bool {
+	a = a.Unmap()
+	if !a.IsGlobalUnicast() || a.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(a) {
+			return false
+		}
+	}
+	return true
+}
+
+type deliveryStatus string
+
+const (
+	deliveryPending   deliveryStatus = "pending"   // not attempted yet, or waiting for a retry
+	deliverySucceeded deliveryStatus = "succeeded" // receiver answered 2xx
+	deliveryDead      deliveryStatus = "dead"      // gave up after maxAttempts
+)
+
+type webhookEndpoint struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // only returned on creation
+	ClientID  string    `json:"client_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	owner principal // what the registering caller could see
+}
+
+type webhookDelivery struct {
+	ID             string         `json:"id"`
+	EndpointID     string         `json:"endpoint_id"`
+	EventID        string         `json:"event_id"`
+	EventType      string         `json:"event_type"`
+	Status         deliveryStatus `json:"status"`
+	Attempts       int            `json:"attempts"`
+	LastStatusCode int            `json:"last_status_code,omitempty"`
+	LastError      string         `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time     `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+}
+
+// deliveryJob is the next attempt of a delivery, due at due.
+type deliveryJob struct {
+	ep   webhookEndpoint
+	d    *webhookDelivery
+	body []byte
+	due  time.Time
+}
+
+type webhooks struct {
+	client      *http.Client
+	maxAttempts int
+	baseBackoff time.Duration
+	allowed     func(netip.Addr) bool // publicAddr outside of tests
+
+	mu         sync.Mutex
+	endpoints  map[string]*webhookEndpoint
+	deliveries map[string][]*webhookDelivery // by endpoint ID, oldest first
+
+	jobs    chan deliveryJob // to the workers
+	retries chan deliveryJob // to the scheduler, from the workers
+
+	ctx    context.Context // cancelled by close; pending retries stop
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWebhooks() *webhooks {
+	ctx, cancel := context.WithCancel(context.Background())
+	wh := &webhooks{
+		maxAttempts: defaultWebhookAttempts,
+		baseBackoff: defaultWebhookBackoff,
+		allowed:     publicAddr,
+		endpoints:   make(map[string]*webhookEndpoint),
+		deliveries:  make(map[string][]*webhookDelivery),
+		jobs:        make(chan deliveryJob, webhookQueueSize),
+		retries:     make(chan deliveryJob),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // a proxy would dial the receiver instead of us
+	transport.DialContext = (&net.Dialer{Timeout: webhookTimeout, Control: wh.checkDial}).DialContext
+	wh.client = &http.Client{Timeout: webhookTimeout, Transport: transport}
+
+	wh.wg.Add(webhookWorkers + 1)
+	for range webhookWorkers {
+		go wh.work()
+	}
+	go wh.schedule()
+	return wh
+}
+
+// close stops retrying and waits for attempts in progress.
+func (wh *webhooks) close() {
+	wh.cancel()
+	wh.wg.Wait()
+}
+
+// checkDial refuses connections to addresses webhooks may not reach.
+func (wh *webhooks) checkDial(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !wh.allowed(ap.Addr()) {
+		return fmt.Errorf("webhook address %s is not public", ap.Addr())
+	}
+	return nil
+}
+
+// checkHost resolves host and reports whether every address it has is allowed.
+func (wh *webhooks) checkHost(host string) bool {
+	if a, err := netip.ParseAddr(host); err == nil {
+		return wh.allowed(a)
+	}
+	ctx, cancel := context.WithTimeout(wh.ctx, webhookResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, a := range addrs {
+		if !wh.allowed(a) {
+			return false
+		}
+	}
+	return true
+}
+
+func (wh *webhooks) register(rawURL string, owner principal) (webhookEndpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webhookEndpoint{}, validationError{{Name: "url", Reason: "must be an absolute http(s) URL"}}
+	}
+	if !wh.checkHost(u.Hostname()) {
+		return webhookEndpoint{}, validationError{{Name: "url", Reason: "must resolve to public addresses only"}}
+	}
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return webhookEndpoint{}, err
+	}
+
+	ep := &webhookEndpoint{
+		ID:        newID(),
+		URL:       u.String(),
+		Secret:    "whsec_" + hex.EncodeToString(secret[:]),
+		ClientID:  owner.ClientID,
+		CreatedAt: time.Now().UTC(),
+		owner:     owner,
+	}
+	wh.mu.Lock()
+	wh.endpoints[ep.ID] = ep
+	wh.mu.Unlock()
+
+	return *ep, nil
+}
+
+// endpoint returns the endpoint with id if p registered it (or p is admin).
+func (wh *webhooks) endpoint(id string, p principal) (*webhookEndpoint, bool) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	ep, ok := wh.endpoints[id]
+	if !ok || (!p.Admin && ep.ClientID != p.ClientID) {
+		return nil, false
+	}
+	return ep, true
+}
+
+// log returns a copy of the deliveries of an endpoint, oldest first.
+func (wh *webhooks) log(endpointID string) []webhookDelivery {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	out := make([]webhookDelivery, 0, len(wh.deliveries[endpointID]))
+	for _, d := range wh.deliveries[endpointID] {
+		out = append(out, *d)
+	}
+	return out
+}
+
+func (wh *webhooks) name() string { return "webhooks" }
+
+// deliver is the outbox sink: it logs a delivery of e to every endpoint that may
+// see it and queues them for the workers, waiting while the queue is full.
+func (wh *webhooks) deliver(ctx context.Context, e outboxEntry) error {
+	ev := e.Event
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	var jobs []deliveryJob
+	wh.mu.Lock()
+	for _, ep := range wh.endpoints {
+		if !ep.owner.canSee(ev.Transaction) {
+			continue
+		}
+		now := time.Now().UTC()
+		d := &webhookDelivery{
+			ID:         newID(),
+			EndpointID: ep.ID,
+			EventID:    ev.ID,
+			EventType:  ev.Type,
+			Status:     deliveryPending,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		log := append(wh.deliveries[ep.ID], d)
+		if len(log) > maxWebhookDeliveries {
+			log = slices.Delete(log, 0, len(log)-maxWebhookDeliveries)
+		}
+		wh.deliveries[ep.ID] = log
+		jobs = append(jobs, deliveryJob{ep: *ep, d: d, body: body})
+	}
+	wh.mu.Unlock()
+
+	for _, j := range jobs {
+		select {
+		case wh.jobs <- j:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wh.ctx.Done():
+			return wh.ctx.Err()
+		}
+	}
+	return nil
+}
+
+// work makes the attempts that are due, until the webhooks close.
+func (wh *webhooks) work() {
+	defer wh.wg.Done()
+	for {
+		select {
+		case <-wh.ctx.Done():
+			return
+		case j := <-wh.jobs:
+			if !wh.attempt(&j) {
+				continue
+			}
+			select {
+			case wh.retries <- j:
+			case <-wh.ctx.Done():
+				return // stays pending; the log shows when it was due
+			}
+		}
+	}
+}
+
+// attempt sends j once and reports whether it is to be retried at j.due.
+func (wh *webhooks) attempt(j *deliveryJob) bool {
+	code, err := wh.send(j.ep, j.d.EventType, j.d.ID, j.body)
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	d := j.d
+	d.Attempts++
+	d.LastStatusCode = code
+	d.UpdatedAt = time.Now().UTC()
+	d.NextAttemptAt = nil
+	if err == nil {
+		d.Status, d.LastError = deliverySucceeded, ""
+		return false
+	}
+	d.LastError = err.Error()
+	if d.Attempts >= wh.maxAttempts {
+		d.Status = deliveryDead
+		return false
+	}
+	next := d.UpdatedAt.Add(backoff(wh.baseBackoff, d.Attempts))
+	d.NextAttemptAt, j.due = &next, next
+	return true
+}
+
+// schedule holds the retries until they are due and then queues them.
+func (wh *webhooks) schedule() {
+	defer wh.wg.Done()
+	var waiting []deliveryJob // by due time
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		var out chan deliveryJob // nil, and so never ready, unless one is due
+		var next deliveryJob
+		if len(waiting) > 0 {
+			next = waiting[0]
+			if wait := time.Until(next.due); wait > 0 {
+				timer.Reset(wait)
+			} else {
+				out = wh.jobs
+			}
+		}
+
+		select {
+		case <-wh.ctx.Done():
+			return
+		case j := <-wh.retries:
+			i, _ := slices.BinarySearchFunc(waiting, j.due, func(w deliveryJob, due time.Time) int { return w.due.Compare(due) })
+			waiting = slices.Insert(waiting, i, j)
+		case out <- next:
+			waiting = waiting[1:]
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff doubles base for every failed attempt, up to maxWebhookBackoff.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < maxWebhookBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxWebhookBackoff)
+}
+
+func (wh *webhooks) send(ep webhookEndpoint, eventType, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(wh.ctx, "POST", ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-Id", deliveryID)
+	req.Header.Set("Webhook-Event", eventType)
+	req.Header.Set(webhookSignatureHeader, signWebhook(ep.Secret, time.Now(), body))
+
+	res, err := wh.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver answered %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// signWebhook builds the Webhook-Signature header value for body sent at t.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts))
+	m.Write([]byte{'.'})
+	m.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// verifyWebhook is what a receiver does: recompute the signature and compare.
+// Signatures older than tolerance are rejected to limit replays.
+func verifyWebhook(secret, header string, body []byte, now time.Time, tolerance time.Duration) bool {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || now.Sub(time.Unix(sec, 0)).Abs() > tolerance {
+		return false
+	}
+	want := signWebhook(secret, time.Unix(sec, 0), body)
+	return hmac.Equal([]byte(want), []byte("t="+ts+",v1="+sig))
+}
+
+// handlers
+
+type webhookRequest struct {
+	URL string `json:"url"`
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request, svc *service) {
+	var in webhookRequest
+	if err := bindJSON(r, &in); err != nil {
+		writeError(w, codeMalformedRequest, "bad request")
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	ep, err := svc.webhooks.register(strings.TrimSpace(in.URL), p)
+	var invalid validationError
+	switch {
+	case errors.As(err, &invalid):
+		writeInvalid(w, err)
+		return
+	case err != nil:
+		writeError(w, codeInternal, "could not register webhook")
+		return
+	}
+
+	w.Header().Set("Location", "/webhooks/"+ep.ID)
+	writeJSON(w, http.StatusCreated, ep)
+}
+
+func listWebhookDeliveries(w http.ResponseWriter, r *http.Request, svc *service) {
+	p, _ := principalFrom(r.Context())
+	ep, ok := svc.webhooks.endpoint(r.PathValue("id"), p)
+	if !ok {
+		writeError(w, codeNotFound, "this webhook does not exist")
+		return
+	}
+
+	items := svc.webhooks.log(ep.ID)
+	if st := r.URL.Query().Get("status"); st != "" {
+		kept := items[:0]
+		for _, d := range items {
+			if string(d.Status) == st {
+				kept = append(kept, d)
+			}
+		}
+		items = kept
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"items": items})
+}
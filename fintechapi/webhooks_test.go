@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is an httptest webhook endpoint that fails every request whose
+// number (1-based) is in failOn, and records the events it accepted.
+type receiver struct {
+	t      *testing.T
+	secret string
+	failOn map[int]bool
+	always bool // fail everything
+
+	mu       sync.Mutex
+	requests int
+	events   []Event
+	badSigs  int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests++
+	if !verifyWebhook(rc.secret, r.Header.Get(webhookSignatureHeader), body, time.Now(), time.Minute) {
+		rc.badSigs++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if rc.always || rc.failOn[rc.requests] {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var ev Event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		rc.t.Errorf("decode event: %v", err)
+	}
+	rc.events = append(rc.events, ev)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rc *receiver) accepted() []Event {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]Event(nil), rc.events...)
+}
+
+// registerReceiver registers a webhook pointing at rc for the caller in authorization.
+func registerReceiver(t *testing.T, ts *httptest.Server, rc *receiver, authorization string) webhookEndpoint {
+	t.Helper()
+
+	recvSrv := httptest.NewServer(rc)
+	t.Cleanup(recvSrv.Close)
+
+	res, body := postJSON(t, ts.URL+"/webhooks", map[string]any{"url": recvSrv.URL}, map[string]string{"Authorization": authorization})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("register webhook: expected 201, got %d body=%s", res.StatusCode, string(body))
+	}
+	var ep webhookEndpoint
+	if err := json.Unmarshal(body, &ep); err != nil || ep.Secret == "" {
+		t.Fatalf("webhook should be returned with its secret: %v body=%s", err, string(body))
+	}
+	rc.secret = ep.Secret
+	return ep
+}
+
+func putJSON(t *testing.T, url string, body any) (*http.Response, []byte) {
+	t.Helper()
+
+	b, _ := json.Marshal(body)
+	req, _ := http.NewRequest("PUT", url, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(apiKeyHeader, testAPIKey)
+	req.Header.Set("Authorization", adminBearer)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT %s failed: %v", url, err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+
+	return res, data
+}
+
+func deliveries(t *testing.T, ts *httptest.Server, endpointID, query, authorization string) []webhookDelivery {
+	t.Helper()
+
+	res, body := getWith(t, ts.URL+"/webhooks/"+endpointID+"/deliveries"+query, authorization)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("deliveries: expected 200, got %d body=%s", res.StatusCode, string(body))
+	}
+	var out struct {
+		Items []webhookDelivery `json:"items"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatalf("decode deliveries: %v", err)
+	}
+	return out.Items
+}
+
+// waitFor polls cond until it holds or the deadline passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhooks_RetriesIntermittentFailures(t *testing.T) {
+	ts, svc := newTestServer(t)
+	svc.webhooks.baseBackoff = time.Millisecond
+
+	owner := bearer("alice", "", "A1")
+	rc := &receiver{t: t, failOn: map[int]bool{1: true, 2: true, 4: true}}
+	ep := registerReceiver(t, ts, rc, owner)
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "10.00", "currency": "EUR"}
+	res, body := postJSON(t, ts.URL+"/transactions", in, map[string]string{"Authorization": owner})
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d body=%s", res.StatusCode, string(body))
+	}
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+	waitFor(t, "created event", func() bool { return len(rc.accepted()) == 1 })
+
+	res, body = putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status change: expected 200, got %d body=%s", res.StatusCode, string(body))
+	}
+	waitFor(t, "status event", func() bool { return len(rc.accepted()) == 2 })
+
+	events := rc.accepted()
+	if events[0].Type != EventTransactionCreated || events[1].Type != EventTransactionStatusChanged {
+		t.Fatalf("unexpected event types %s, %s", events[0].Type, events[1].Type)
+	}
+	if events[1].Transaction.Status != StatusCompleted || events[1].PreviousStatus == nil || *events[1].PreviousStatus != StatusPending {
+		t.Errorf("status event should carry pending -> completed, got %+v", events[1])
+	}
+	if rc.badSigs != 0 {
+		t.Errorf("every delivery should be signed with the endpoint secret, %d were not", rc.badSigs)
+	}
+
+	// the receiver counts a delivery before the worker has recorded its answer
+	waitFor(t, "settled deliveries", func() bool {
+		log := svc.webhooks.log(ep.ID)
+		return len(log) == 2 && log[0].Status != deliveryPending && log[1].Status != deliveryPending
+	})
+	log := deliveries(t, ts, ep.ID, "", owner)
+	if len(log) != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", len(log))
+	}
+	if log[0].Status != deliverySucceeded || log[0].Attempts != 3 {
+		t.Errorf("first delivery: want succeeded after 3 attempts, got %s after %d", log[0].Status, log[0].Attempts)
+	}
+	if log[1].Status != deliverySucceeded || log[1].Attempts != 2 {
+		t.Errorf("second delivery: want succeeded after 2 attempts, got %s after %d", log[1].Status, log[1].Attempts)
+	}
+}
+
+func TestWebhooks_DeadLetter(t *testing.T) {
+	ts, svc := newTestServer(t)
+	svc.webhooks.baseBackoff = time.Millisecond
+	svc.webhooks.maxAttempts = 3
+
+	rc := &receiver{t: t, always: true}
+	ep := registerReceiver(t, ts, rc, adminBearer)
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1", "currency": "EUR"}
+	if res, _ := postJSON(t, ts.URL+"/transactions", in, nil); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", res.StatusCode)
+	}
+
+	var d webhookDelivery
+	waitFor(t, "dead delivery", func() bool {
+		log := deliveries(t, ts, ep.ID, "", adminBearer)
+		if len(log) == 1 {
+			d = log[0]
+		}
+		return d.Status == deliveryDead
+	})
+	if d.Attempts != 3 || d.LastStatusCode != http.StatusServiceUnavailable || d.LastError == "" || d.NextAttemptAt != nil {
+		t.Errorf("unexpected dead delivery %+v", d)
+	}
+
+	dead := deliveries(t, ts, ep.ID, "?status=dead", adminBearer)
+	if len(dead) != 1 {
+		t.Errorf("status filter should return the dead delivery, got %d", len(dead))
+	}
+}
+
+func TestWebhooks_OnlyVisibleEventsAndOwnLog(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	owner := bearer("alice", "", "A1")
+	rc := &receiver{t: t}
+	ep := registerReceiver(t, ts, rc, owner)
+
+	other := map[string]any{"from_account_id": "Z1", "to_account_id": "Z2", "amount": "1", "currency": "EUR"}
+	mine := map[string]any{"from_account_id": "Z1", "to_account_id": "A1", "amount": "2", "currency": "EUR"}
+	_, _ = postJSON(t, ts.URL+"/transactions", other, nil)
+	_, _ = postJSON(t, ts.URL+"/transactions", mine, nil)
+
+	waitFor(t, "incoming transfer event", func() bool { return len(rc.accepted()) == 1 })
+	if got := rc.accepted()[0].Transaction.ToAccountID; got != "A1" {
+		t.Errorf("endpoint should only receive its accounts' events, got one for %s", got)
+	}
+	if n := len(deliveries(t, ts, ep.ID, "", owner)); n != 1 {
+		t.Errorf("expected 1 delivery, got %d", n)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/webhooks/"+ep.ID+"/deliveries", nil)
+	req.Header.Set(apiKeyHeader, otherAPIKey)
+	req.Header.Set("Authorization", bearer("bob", "", "A1"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET deliveries: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("another client's delivery log should be 404, got %d", res.StatusCode)
+	}
+}
+
+func TestWebhooks_RegisterValidation(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	for _, u := range []string{"", "ftp://example.com/hook", "/relative", "http://"} {
+		res, body := postJSON(t, ts.URL+"/webhooks", map[string]any{"url": u}, nil)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("url %q: expected 400, got %d body=%s", u, res.StatusCode, string(body))
+		}
+	}
+}
+
+func TestWebhooks_RejectsNonPublicHosts(t *testing.T) {
+	wh := newWebhooks()
+	defer wh.close()
+
+	for _, u := range []string{
+		"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook",
+		"http://10.0.0.7/hook", "http://192.168.1.1/hook", "http://169.254.169.254/latest/meta-data",
+		"http://100.64.0.1/hook", "http://[fd00::1]/hook", "http://[::ffff:127.0.0.1]/hook", "http://0.0.0.0/hook",
+	} {
+		if _, err := wh.register(u, principal{ClientID: "c"}); err == nil {
+			t.Errorf("%s: want rejected", u)
+		}
+	}
+	for _, a := range []string{"93.184.215.14", "2606:2800:21f:cb07:6820:80da:af6b:8b2c"} {
+		if !publicAddr(netip.MustParseAddr(a)) {
+			t.Errorf("%s: want public", a)
+		}
+	}
+}
+
+func TestWebhooks_ChecksTheDialledAddress(t *testing.T) {
+	rc := &receiver{t: t}
+	recvSrv := httptest.NewServer(rc)
+	defer recvSrv.Close()
+
+	// registered while the name was public, resolving to loopback now
+	wh := newWebhooks()
+	defer wh.close()
+	wh.baseBackoff = time.Millisecond
+	wh.maxAttempts = 1
+	wh.endpoints["e1"] = &webhookEndpoint{ID: "e1", URL: recvSrv.URL, owner: principal{Admin: true}}
+	_ = wh.deliver(context.Background(), outboxEntry{Seq: 1, Event: newEvent(EventTransactionCreated, Transaction{ID: "t1"})})
+
+	waitFor(t, "the dead delivery", func() bool {
+		log := wh.log("e1")
+		return len(log) == 1 && log[0].Status == deliveryDead
+	})
+	if d := wh.log("e1")[0]; !strings.Contains(d.LastError, "not public") {
+		t.Errorf("want the dial refused, got %+v", d)
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.requests != 0 {
+		t.Errorf("the receiver got %d requests", rc.requests)
+	}
+}
+
+func TestWebhooks_DeliveryLogIsCapped(t *testing.T) {
+	ts, svc := newTestServer(t)
+	rc := &receiver{t: t}
+	ep := registerReceiver(t, ts, rc, adminBearer)
+
+	var sent []string
+	for i := range maxWebhookDeliveries + 5 {
+		ev := newEvent(EventTransactionCreated, Transaction{ID: strconv.Itoa(i)})
+		_ = svc.webhooks.deliver(context.Background(), outboxEntry{Seq: int64(i + 1), Event: ev})
+		sent = append(sent, ev.ID)
+	}
+	waitFor(t, "every delivery", func() bool { return len(rc.accepted()) == len(sent) })
+	log := svc.webhooks.log(ep.ID)
+	if len(log) != maxWebhookDeliveries {
+		t.Fatalf("want the latest %d deliveries, got %d", maxWebhookDeliveries, len(log))
+	}
+	if log[0].EventID != sent[5] || log[len(log)-1].EventID != sent[len(sent)-1] {
+		t.Errorf("want the oldest five dropped, log runs from %s to %s", log[0].EventID, log[len(log)-1].EventID)
+	}
+}
+
+func TestStatusChange(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	in := map[string]any{"from_account_id": "A1", "to_account_id": "A2", "amount": "1", "currency": "EUR"}
+	_, body := postJSON(t, ts.URL+"/transactions", in, nil)
+	var tr Transaction
+	_ = json.Unmarshal(body, &tr)
+
+	if res, _ := putJSON(t, ts.URL+"/transactions/nope/status", map[string]any{"status": "failed"}); res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown transaction: expected 404, got %d", res.StatusCode)
+	}
+	if res, _ := putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "failed"}); res.StatusCode != http.StatusOK {
+		t.Errorf("pending -> failed: expected 200, got %d", res.StatusCode)
+	}
+	if res, _ := putJSON(t, ts.URL+"/transactions/"+tr.ID+"/status", map[string]any{"status": "completed"}); res.StatusCode != http.StatusConflict {
+		t.Errorf("failed -> completed: expected 409, got %d", res.StatusCode)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"id":"e1"}`)
+	sig := signWebhook("whsec_test", now, body)
+
+	if !verifyWebhook("whsec_test", sig, body, now, time.Minute) {
+		t.Errorf("signature should verify")
+	}
+	if verifyWebhook("whsec_other", sig, body, now, time.Minute) {
+		t.Errorf("wrong secret should not verify")
+	}
+	if verifyWebhook("whsec_test", sig, []byte(`{"id":"e2"}`), now, time.Minute) {
+		t.Errorf("tampered body should not verify")
+	}
+	if verifyWebhook("whsec_test", sig, body, now.Add(time.Hour), time.Minute) {
+		t.Errorf("stale signature should not verify")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		Attempt int
+		Want    time.Duration
+	}{
+		{Attempt: 1, Want: time.Second},
+		{Attempt: 2, Want: 2 * time.Second},
+		{Attempt: 4, Want: 8 * time.Second},
+		{Attempt: 30, Want: maxWebhookBackoff},
+	}
+	for _, test := range tests {
+		if got := backoff(time.Second, test.Attempt); got != test.Want {
+			t.Errorf("attempt %d: want %s, got %s", test.Attempt, test.Want, got)
+		}
+	}
+}